@@ -0,0 +1,203 @@
+// Package bot runs automated players against the rest_reversi REST API.
+//
+// A bot implements Player and Runner takes care of the rest: registration,
+// matchmaking, waiting for the turn, passes, reconnection and game over.
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ykore52/rest_reversi/client"
+	"github.com/ykore52/rest_reversi/server"
+)
+
+// Player chooses a move of a bot
+type Player interface {
+	// ChooseMove returns one of candidates as [y, x]. board is indexed by [y][x]
+	ChooseMove(board [][]int, color int, candidates [][]int) []int
+}
+
+// PlayerFunc is an adapter to use a function as a Player
+type PlayerFunc func(board [][]int, color int, candidates [][]int) []int
+
+// ChooseMove calls f
+func (f PlayerFunc) ChooseMove(board [][]int, color int, candidates [][]int) []int {
+	return f(board, color, candidates)
+}
+
+// Result is the outcome of a game played by a Runner
+type Result struct {
+	SessionID string
+	UserID    string
+	Color     int
+	State     server.SessionState
+	White     int
+	Black     int
+	Moves     int
+}
+
+// Won returns whether the bot won the game
+func (r *Result) Won() bool {
+	return (r.State == server.StateWonWhite && r.Color == server.WHITE) ||
+		(r.State == server.StateWonBlack && r.Color == server.BLACK)
+}
+
+// Runner plays a game with a Player
+type Runner struct {
+	Client *client.Client
+	Name   string
+	Player Player
+
+	// MaxReconnects is the number of consecutive failures tolerated while waiting for the turn
+	MaxReconnects int
+
+	// ReconnectWait is the wait before reconnecting, and before looking again at
+	// a turn without candidates
+	ReconnectWait time.Duration
+
+	// Logf receives progress messages when it is set
+	Logf func(format string, args ...interface{})
+}
+
+// NewRunner returns a runner of player named name
+func NewRunner(c *client.Client, name string, player Player) *Runner {
+	return &Runner{
+		Client:        c,
+		Name:          name,
+		Player:        player,
+		MaxReconnects: 5,
+		ReconnectWait: time.Second,
+	}
+}
+
+// Play registers the bot, waits for an opponent and plays until the game is over
+func (r *Runner) Play(ctx context.Context) (*Result, error) {
+
+	info, err := r.Client.CreateUser(ctx, r.Name)
+	if err != nil {
+		return nil, err
+	}
+	r.logf("%s: registered as %s in session %s", r.Name, info.UserID, info.SessionID)
+
+	session, err := r.Client.JoinSession(ctx, info.SessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Result{SessionID: info.SessionID, UserID: info.UserID, Color: server.WHITE}
+	if session.Players[0].UserID != info.UserID {
+		result.Color = server.BLACK
+	}
+	r.logf("%s: paired as color %d", r.Name, result.Color)
+
+	failures := 0
+	for {
+		session, err := r.Client.WaitForTurn(ctx, info.SessionID, result.Color)
+		if err != nil {
+			if failures, err = r.reconnect(ctx, failures, err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if server.IsSessionFinished(session) {
+			result.State = session.State
+			result.White, result.Black = server.CountDiscs(session.Board)
+			r.logf("%s: game over (state %d, white %d, black %d)", r.Name, result.State, result.White, result.Black)
+			return result, nil
+		}
+
+		candidates, err := r.Client.GetCandidates(ctx, info.SessionID)
+		if err != nil {
+			if failures, err = r.reconnect(ctx, failures, err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if len(candidates) == 0 {
+			// the server passes the turn by itself, so give it time before looking again
+			if err := sleep(ctx, r.ReconnectWait); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		move := r.Player.ChooseMove(session.Board, result.Color, candidates)
+		if !isCandidate(move, candidates) {
+			r.logf("%s: %v is not a candidate, play %v instead", r.Name, move, candidates[0])
+			move = candidates[0]
+		}
+
+		if _, err := r.Client.PlayMove(ctx, info.SessionID, info.Token, move[1], move[0]); err != nil {
+			if errors.Is(err, client.ErrNotYourTurn) || errors.Is(err, client.ErrIllegalMove) || errors.Is(err, client.ErrGameFinished) {
+				// the session moved on while we were thinking, so look at it again
+				continue
+			}
+			if errors.Is(err, client.ErrUnauthorized) && info.RefreshToken != "" {
+				// the access token expired while waiting, so get a new one and try again
+				tokens, refreshErr := r.Client.Refresh(ctx, info.RefreshToken)
+				if refreshErr == nil {
+					info.Token, info.RefreshToken = tokens.Token, tokens.RefreshToken
+					continue
+				}
+				err = refreshErr
+			}
+			if failures, err = r.reconnect(ctx, failures, err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		failures = 0
+		result.Moves++
+	}
+}
+
+// reconnect waits before the next attempt, or gives up when err is permanent or happens too often
+func (r *Runner) reconnect(ctx context.Context, failures int, err error) (int, error) {
+
+	if !client.IsTemporary(err) || failures >= r.MaxReconnects {
+		return failures, fmt.Errorf("bot %s: %w", r.Name, err)
+	}
+	r.logf("%s: %s, reconnecting", r.Name, err.Error())
+
+	if err := sleep(ctx, r.ReconnectWait); err != nil {
+		return failures, err
+	}
+	return failures + 1, nil
+}
+
+// sleep waits for d, or returns the error of ctx when it is done first
+func sleep(ctx context.Context, d time.Duration) error {
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (r *Runner) logf(format string, args ...interface{}) {
+	if r.Logf != nil {
+		r.Logf(format, args...)
+	}
+}
+
+func isCandidate(move []int, candidates [][]int) bool {
+
+	if len(move) != 2 {
+		return false
+	}
+	for _, c := range candidates {
+		if c[0] == move[0] && c[1] == move[1] {
+			return true
+		}
+	}
+	return false
+}
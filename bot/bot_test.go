@@ -0,0 +1,114 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ykore52/rest_reversi/client"
+	"github.com/ykore52/rest_reversi/server"
+)
+
+func TestRunner_Play(t *testing.T) {
+
+	server.InitSessionStore(true)
+	server.InitUserStore(true)
+
+	ts := httptest.NewServer(http.HandlerFunc(server.APIRoute))
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	results := make(chan *Result, 2)
+	for _, p := range []struct {
+		name   string
+		player Player
+	}{
+		{"greedy", GreedyPlayer{}},
+		{"positional", PositionalPlayer{}},
+	} {
+		go func(name string, player Player) {
+			result, err := NewRunner(client.New(ts.URL), name, player).Play(ctx)
+			assert.Nil(t, err)
+			results <- result
+		}(p.name, p.player)
+		// make the pairing order stable
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	r1, r2 := <-results, <-results
+	if !assert.NotNil(t, r1) || !assert.NotNil(t, r2) {
+		return
+	}
+	assert.Equal(t, r1.SessionID, r2.SessionID)
+	assert.NotEqual(t, r1.Color, r2.Color)
+	assert.True(t, server.IsSessionFinished(&server.Session{State: r1.State}))
+	assert.Equal(t, r1.White+r1.Black, r2.White+r2.Black)
+	assert.False(t, r1.Won() && r2.Won())
+}
+
+func TestRunner_NoCandidates(t *testing.T) {
+
+	// the server keeps the turn of the bot without candidates, as before it passes the turn
+	session := &server.Session{
+		SessionID: "s1",
+		State:     server.StatePutBlack,
+		Turn:      server.WHITE,
+		Players:   []server.User{{UserID: "u1"}, {UserID: "u2"}},
+	}
+	var cands int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case server.APIUser:
+			json.NewEncoder(w).Encode(&server.GetSessionInfoResponse{Status: "success", UserID: "u1", SessionID: "s1"})
+		case server.APISession + "/s1" + server.APISessionEvents:
+			data, _ := json.Marshal(session)
+			fmt.Fprintf(w, "event: session\ndata: %s\n\n", data)
+		case server.APISession + "/s1" + server.APISessionCand:
+			atomic.AddInt32(&cands, 1)
+			json.NewEncoder(w).Encode(&server.GetCandidatesResponse{Status: "success", Candidates: [][]int{}})
+		default:
+			json.NewEncoder(w).Encode(session)
+		}
+	}))
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+	defer cancel()
+
+	r := NewRunner(client.New(ts.URL), "greedy", GreedyPlayer{})
+	r.ReconnectWait = 100 * time.Millisecond
+	_, err := r.Play(ctx)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.LessOrEqual(t, atomic.LoadInt32(&cands), int32(3))
+}
+
+func TestFlips(t *testing.T) {
+
+	board := [][]int{
+		{0, 0, 0, 0, 0, 0, 0, 0},
+		{0, 0, 0, 0, 0, 0, 0, 0},
+		{0, 0, 0, 0, 0, 0, 0, 0},
+		{0, 0, 0, 1, 2, 0, 0, 0},
+		{0, 0, 0, 2, 1, 0, 0, 0},
+		{0, 0, 0, 0, 0, 0, 0, 0},
+		{0, 0, 0, 0, 0, 0, 0, 0},
+		{0, 0, 0, 0, 0, 0, 0, 0},
+	}
+	assert.Equal(t, 1, Flips(board, server.WHITE, 4, 2))
+	assert.Equal(t, 0, Flips(board, server.WHITE, 0, 0))
+	assert.Equal(t, 0, Flips(board, server.BLACK, 4, 2))
+
+	assert.Equal(t, []int{2, 4}, GreedyPlayer{}.ChooseMove(board, server.WHITE, [][]int{{2, 4}, {3, 5}}))
+
+	board[0][1], board[0][2] = server.BLACK, server.WHITE
+	assert.Equal(t, []int{0, 0}, PositionalPlayer{}.ChooseMove(board, server.WHITE, [][]int{{2, 4}, {0, 0}}))
+}
@@ -0,0 +1,93 @@
+package bot
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/ykore52/rest_reversi/server"
+)
+
+// RandomPlayer puts a disc on a random candidate
+type RandomPlayer struct {
+	Rand *rand.Rand
+}
+
+// NewRandomPlayer returns a RandomPlayer seeded by the current time
+func NewRandomPlayer() *RandomPlayer {
+	return &RandomPlayer{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+// ChooseMove ...
+func (p *RandomPlayer) ChooseMove(board [][]int, color int, candidates [][]int) []int {
+	return candidates[p.Rand.Intn(len(candidates))]
+}
+
+// GreedyPlayer puts a disc on the candidate which flips the most discs
+type GreedyPlayer struct{}
+
+// ChooseMove ...
+func (p GreedyPlayer) ChooseMove(board [][]int, color int, candidates [][]int) []int {
+
+	best, bestFlips := candidates[0], -1
+	for _, c := range candidates {
+		if flips := Flips(board, color, c[1], c[0]); flips > bestFlips {
+			best, bestFlips = c, flips
+		}
+	}
+	return best
+}
+
+// positionWeights rates each grid of an 8x8 board: corners are precious and
+// the grids next to them give the corners away
+var positionWeights = [][]int{
+	{100, -20, 10, 5, 5, 10, -20, 100},
+	{-20, -50, -2, -2, -2, -2, -50, -20},
+	{10, -2, 1, 1, 1, 1, -2, 10},
+	{5, -2, 1, 0, 0, 1, -2, 5},
+	{5, -2, 1, 0, 0, 1, -2, 5},
+	{10, -2, 1, 1, 1, 1, -2, 10},
+	{-20, -50, -2, -2, -2, -2, -50, -20},
+	{100, -20, 10, 5, 5, 10, -20, 100},
+}
+
+// PositionalPlayer prefers corners and edges, breaking ties by the number of flips
+type PositionalPlayer struct{}
+
+// ChooseMove ...
+func (p PositionalPlayer) ChooseMove(board [][]int, color int, candidates [][]int) []int {
+
+	best, bestScore := candidates[0], 0
+	for i, c := range candidates {
+		score := Flips(board, color, c[1], c[0])
+		if c[0] < len(positionWeights) && c[1] < len(positionWeights[c[0]]) {
+			score += positionWeights[c[0]][c[1]] * 10
+		}
+		if i == 0 || score > bestScore {
+			best, bestScore = c, score
+		}
+	}
+	return best
+}
+
+// directions are the eight directions to look for discs to flip as (dx, dy)
+var directions = [][2]int{{0, -1}, {1, -1}, {1, 0}, {1, 1}, {0, 1}, {-1, 1}, {-1, 0}, {-1, -1}}
+
+// Flips returns the number of discs flipped by putting a disc of color on (x, y)
+func Flips(board [][]int, color int, x, y int) int {
+
+	flips := 0
+	for _, d := range directions {
+		n := 0
+		for cx, cy := x+d[0], y+d[1]; cy >= 0 && cy < len(board) && cx >= 0 && cx < len(board[cy]); cx, cy = cx+d[0], cy+d[1] {
+			if board[cy][cx] == server.EMPTY {
+				break
+			}
+			if board[cy][cx] == color {
+				flips += n
+				break
+			}
+			n++
+		}
+	}
+	return flips
+}
@@ -0,0 +1,524 @@
+// Package client is a Go client of the rest_reversi REST API.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ykore52/rest_reversi/server"
+)
+
+var (
+	// ErrSessionNotFound is returned when the session does not exist
+	ErrSessionNotFound = errors.New("session not found")
+
+	// ErrSessionNotStarted is returned when a move is posted before the session is paired
+	ErrSessionNotStarted = errors.New("session does not start yet")
+
+	// ErrNotYourTurn is returned when a move is posted by the player who does not have the turn
+	ErrNotYourTurn = errors.New("not your turn")
+
+	// ErrGameFinished is returned when a move is posted to a finished session
+	ErrGameFinished = errors.New("game is finished")
+
+	// ErrIllegalMove is returned when the disc cannot be put on the given grid
+	ErrIllegalMove = errors.New("cannot put a disc")
+
+	// ErrInvalidCall is returned when the server does not know the endpoint
+	ErrInvalidCall = errors.New("invalid call")
+
+	// ErrUnauthorized is returned when the access token is missing or not known
+	ErrUnauthorized = errors.New("unauthorized")
+
+	// ErrLoginFailed is returned when the username or the password is wrong
+	ErrLoginFailed = errors.New("login failed")
+
+	// ErrUsernameTaken is returned when an account of the username exists
+	ErrUsernameTaken = errors.New("username is taken")
+
+	// ErrTooManyRequests is returned when the server limits the requests of the client or the user
+	ErrTooManyRequests = errors.New("too many requests")
+)
+
+// descriptionErrors maps descriptions of GeneralMessageResponse to the errors above
+var descriptionErrors = map[string]error{
+	"Invalid session":              ErrSessionNotFound,
+	"Session does not start yet":   ErrSessionNotStarted,
+	"Not your turn":                ErrNotYourTurn,
+	"Game is finished":             ErrGameFinished,
+	"Cannot put a disc":            ErrIllegalMove,
+	"Invalid call":                 ErrInvalidCall,
+	"Unauthorized":                 ErrUnauthorized,
+	"Invalid username or password": ErrLoginFailed,
+	"Username is taken":            ErrUsernameTaken,
+}
+
+// APIError is an error replied by the server
+type APIError struct {
+	StatusCode  int
+	Status      string
+	Description string
+
+	// RetryAfter is the wait the server asked for with Retry-After, or 0
+	RetryAfter time.Duration
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("api error: %d %s: %s", e.StatusCode, e.Status, e.Description)
+}
+
+// Unwrap lets errors.Is match the known failures such as ErrNotYourTurn
+func (e *APIError) Unwrap() error {
+	if e.StatusCode == http.StatusTooManyRequests {
+		return ErrTooManyRequests
+	}
+	return descriptionErrors[e.Description]
+}
+
+// Client calls the REST API of a server
+type Client struct {
+	// BaseURL is the URL of the server, e.g. http://localhost:8080
+	BaseURL string
+
+	// HTTPClient is used to send requests. http.DefaultClient is used when nil
+	HTTPClient *http.Client
+
+	// MaxRetries is the number of retries of idempotent requests on transient errors
+	MaxRetries int
+
+	// RetryWait is the wait before the first retry, doubled on every retry. A Retry-After
+	// of the server replaces it
+	RetryWait time.Duration
+
+	// PollTimeout is the timeout of a long polling request in WaitForTurn
+	PollTimeout time.Duration
+}
+
+// New returns a client of the server at baseURL
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:     strings.TrimRight(baseURL, "/"),
+		MaxRetries:  3,
+		RetryWait:   200 * time.Millisecond,
+		PollTimeout: 30 * time.Second,
+	}
+}
+
+// CreateUser registers a user and pairs it to a session. The response has
+// the access token to play the session with
+func (c *Client) CreateUser(ctx context.Context, name string) (*server.GetSessionInfoResponse, error) {
+
+	res := new(server.GetSessionInfoResponse)
+	if err := c.do(ctx, "POST", server.APIUser, &server.GetUserRequest{Name: name}, res, false); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Register creates an account and returns its access token
+func (c *Client) Register(ctx context.Context, username, password string) (*server.LoginResponse, error) {
+
+	res := new(server.LoginResponse)
+	req := &server.PostAccountRequest{Username: username, Password: password}
+	if err := c.do(ctx, "POST", server.APIAccount, req, res, false); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Login returns a new access token of the account
+func (c *Client) Login(ctx context.Context, username, password string) (*server.LoginResponse, error) {
+
+	res := new(server.LoginResponse)
+	req := &server.PostAccountRequest{Username: username, Password: password}
+	if err := c.do(ctx, "POST", server.APILogin, req, res, false); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Refresh exchanges the refresh token for a new access token and refresh token
+func (c *Client) Refresh(ctx context.Context, refreshToken string) (*server.LoginResponse, error) {
+
+	res := new(server.LoginResponse)
+	req := &server.PostRefreshRequest{RefreshToken: refreshToken}
+	if err := c.do(ctx, "POST", server.APIRefresh, req, res, false); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Logout revokes the refresh token. The access tokens stay valid until they expire
+func (c *Client) Logout(ctx context.Context, refreshToken string) error {
+
+	req := &server.PostRefreshRequest{RefreshToken: refreshToken}
+	return c.do(ctx, "POST", server.APILogout, req, new(server.GeneralMessageResponse), false)
+}
+
+// LogoutAll revokes every refresh token of the user of the access token
+func (c *Client) LogoutAll(ctx context.Context, token string) error {
+	return c.doAs(ctx, token, "POST", server.APILogout+"?all=true", nil, new(server.GeneralMessageResponse), false)
+}
+
+// StartSession pairs the user of the access token to a session of a rated or a casual game
+func (c *Client) StartSession(ctx context.Context, token string, rated bool) (*server.GetSessionInfoResponse, error) {
+
+	res := new(server.GetSessionInfoResponse)
+	if err := c.doAs(ctx, token, "POST", server.APISession, &server.PostSessionRequest{Rated: rated}, res, false); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// GetUser returns the profile of the user
+func (c *Client) GetUser(ctx context.Context, userID string) (*server.GetUserResponse, error) {
+
+	user := new(server.GetUserResponse)
+	if err := c.do(ctx, "GET", server.APIUser+"/"+userID, nil, user, true); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// JoinSession waits until an opponent joins the session and returns it
+func (c *Client) JoinSession(ctx context.Context, sessionID string) (*server.Session, error) {
+
+	var joined *server.Session
+	err := c.WatchSession(ctx, sessionID, func(s *server.Session) bool {
+		joined = s
+		return s.State >= server.StateEstablished
+	})
+	if err != nil {
+		return nil, err
+	}
+	return joined, nil
+}
+
+// GetSession returns the session
+func (c *Client) GetSession(ctx context.Context, sessionID string) (*server.Session, error) {
+	return c.getSession(ctx, server.APISession+"/"+sessionID)
+}
+
+func (c *Client) getSession(ctx context.Context, path string) (*server.Session, error) {
+
+	var session *server.Session
+	if err := c.do(ctx, "GET", path, nil, &session, true); err != nil {
+		return nil, err
+	}
+	if session == nil {
+		return nil, ErrSessionNotFound
+	}
+	return session, nil
+}
+
+// GetBoard returns the board of the session indexed by [y][x]
+func (c *Client) GetBoard(ctx context.Context, sessionID string) ([][]int, error) {
+
+	res := new(server.GetBoardResponse)
+	if err := c.do(ctx, "GET", server.APISession+"/"+sessionID+server.APISessionBoard, nil, res, true); err != nil {
+		return nil, err
+	}
+	return res.Board, nil
+}
+
+// GetCandidates returns the grids as [y, x] where the player of the turn can put a disc
+func (c *Client) GetCandidates(ctx context.Context, sessionID string) ([][]int, error) {
+
+	res := new(server.GetCandidatesResponse)
+	if err := c.do(ctx, "GET", server.APISession+"/"+sessionID+server.APISessionCand, nil, res, true); err != nil {
+		return nil, err
+	}
+	return res.Candidates, nil
+}
+
+// PlayMove puts a disc of the user of the access token on (x, y) and returns the board after the move
+func (c *Client) PlayMove(ctx context.Context, sessionID, token string, x, y int) ([][]int, error) {
+
+	var board [][]int
+	req := &server.PostBoardRequest{PosX: x, PosY: y}
+	if err := c.doAs(ctx, token, "POST", server.APISession+"/"+sessionID, req, &board, false); err != nil {
+		return nil, err
+	}
+	return board, nil
+}
+
+// WaitForTurn blocks until the player of color has the turn or the session is finished
+func (c *Client) WaitForTurn(ctx context.Context, sessionID string, color int) (*server.Session, error) {
+
+	session, err := c.GetSession(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		if server.IsSessionFinished(session) {
+			return session, nil
+		}
+		if session.State >= server.StateEstablished && session.Turn == color {
+			return session, nil
+		}
+
+		path := fmt.Sprintf("%s/%s?since=%d&timeout=%d", server.APISession, sessionID, session.ElapsedTurn, int(c.PollTimeout/time.Second))
+		if session.State < server.StateEstablished {
+			// pairing does not advance the turn, so watch the stream instead
+			if _, err := c.JoinSession(ctx, sessionID); err != nil {
+				return nil, err
+			}
+			path = server.APISession + "/" + sessionID
+		}
+
+		session, err = c.getSession(ctx, path)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// WatchSession calls fn with the session every time it changes until fn returns true.
+// The event stream is reconnected when it is cut.
+func (c *Client) WatchSession(ctx context.Context, sessionID string, fn func(*server.Session) bool) error {
+
+	retries := 0
+	for {
+		done, err := c.watchSession(ctx, sessionID, fn)
+		if done {
+			return err
+		}
+		if err == nil {
+			// the stream is closed by the server, so reconnect immediately
+			retries = 0
+			continue
+		}
+
+		if retries >= c.MaxRetries || !IsTemporary(err) {
+			return err
+		}
+		if err := c.sleep(ctx, retries, err); err != nil {
+			return err
+		}
+		retries++
+	}
+}
+
+func (c *Client) watchSession(ctx context.Context, sessionID string, fn func(*server.Session) bool) (bool, error) {
+
+	req, err := http.NewRequestWithContext(ctx, "GET", c.BaseURL+server.APISession+"/"+sessionID+server.APISessionEvents, nil)
+	if err != nil {
+		return true, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	res, err := c.httpClient().Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		err := readError(res)
+		return !IsTemporary(err), err
+	}
+
+	event := ""
+	scanner := bufio.NewScanner(res.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: ") && event == "close":
+			return true, ErrSessionNotFound
+		case strings.HasPrefix(line, "data: ") && event == "session":
+			session := new(server.Session)
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), session); err != nil {
+				return true, err
+			}
+			if fn(session) {
+				return true, nil
+			}
+			if server.IsSessionFinished(session) {
+				return true, nil
+			}
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return true, err
+	}
+	return false, scanner.Err()
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// do sends a request and decodes the response into out. Idempotent requests are retried on transient errors
+func (c *Client) do(ctx context.Context, method, path string, in, out interface{}, idempotent bool) error {
+	return c.doAs(ctx, "", method, path, in, out, idempotent)
+}
+
+// doAs is do on behalf of the user of the access token
+func (c *Client) doAs(ctx context.Context, token, method, path string, in, out interface{}, idempotent bool) error {
+
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+
+	retries := 0
+	for {
+		err := c.doOnce(ctx, token, method, path, body, out)
+		if err == nil || !idempotent || retries >= c.MaxRetries || !IsTemporary(err) {
+			return err
+		}
+		if err := c.sleep(ctx, retries, err); err != nil {
+			return err
+		}
+		retries++
+	}
+}
+
+func (c *Client) doOnce(ctx context.Context, token, method, path string, body []byte, out interface{}) error {
+
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	res, err := c.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return readError(res)
+	}
+
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	// failures are replied with 200 as well, so look for a message first
+	msg := new(server.GeneralMessageResponse)
+	if err := json.Unmarshal(data, msg); err == nil && msg.Description != "" {
+		return &APIError{StatusCode: res.StatusCode, Status: msg.Status, Description: msg.Description}
+	}
+
+	return json.Unmarshal(data, out)
+}
+
+func readError(res *http.Response) error {
+
+	apiErr := &APIError{
+		StatusCode:  res.StatusCode,
+		Status:      "fail",
+		Description: http.StatusText(res.StatusCode),
+		RetryAfter:  retryAfter(res.Header.Get("Retry-After"), time.Now()),
+	}
+
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return apiErr
+	}
+	msg := new(server.GeneralMessageResponse)
+	if err := json.Unmarshal(data, msg); err == nil && msg.Description != "" {
+		apiErr.Status = msg.Status
+		apiErr.Description = msg.Description
+	}
+	return apiErr
+}
+
+// IsTemporary returns whether the request may succeed when it is sent again: the server
+// replied 429 or 5xx, or the network failed
+func IsTemporary(err error) bool {
+
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode == http.StatusTooManyRequests || apiErr.StatusCode/100 == 5
+	}
+
+	// *url.Error is a net.Error whatever failed, so look at what it wraps. A connection
+	// closed before the response is read fails with EOF
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		if errors.Is(urlErr.Err, io.EOF) || errors.Is(urlErr.Err, io.ErrUnexpectedEOF) {
+			return true
+		}
+		err = urlErr.Err
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// retryAfter parses a Retry-After header of seconds or of an HTTP date. It returns 0 when there is none
+func retryAfter(header string, now time.Time) time.Duration {
+
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(header); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
+
+// sleep waits before the next retry after err. The wait is the one the server asked for
+// with Retry-After, or RetryWait doubled on every retry
+func (c *Client) sleep(ctx context.Context, retries int, err error) error {
+
+	wait := c.RetryWait << uint(retries)
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.RetryAfter > 0 {
+		wait = apiErr.RetryAfter
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
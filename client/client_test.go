@@ -0,0 +1,255 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ykore52/rest_reversi/server"
+)
+
+func newTestClient() (*Client, func()) {
+
+	server.InitSessionStore(true)
+	server.InitUserStore(true)
+
+	ts := httptest.NewServer(http.HandlerFunc(server.APIRoute))
+	c := New(ts.URL)
+	c.RetryWait = time.Millisecond
+	return c, ts.Close
+}
+
+func TestClient_Game(t *testing.T) {
+
+	c, closeServer := newTestClient()
+	defer closeServer()
+	ctx := context.Background()
+
+	white, err := c.CreateUser(ctx, "white")
+	if !assert.Nil(t, err) {
+		return
+	}
+	black, err := c.CreateUser(ctx, "black")
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, white.SessionID, black.SessionID)
+
+	user, err := c.GetUser(ctx, white.UserID)
+	assert.Nil(t, err)
+	assert.Equal(t, "white", user.Name)
+
+	session, err := c.JoinSession(ctx, white.SessionID)
+	assert.Nil(t, err)
+	assert.Equal(t, server.StateEstablished, session.State)
+
+	cand, err := c.GetCandidates(ctx, white.SessionID)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]int{{2, 4}, {3, 5}, {4, 2}, {5, 3}}, cand)
+
+	_, err = c.PlayMove(ctx, black.SessionID, black.Token, 4, 2)
+	assert.True(t, errors.Is(err, ErrNotYourTurn))
+
+	_, err = c.PlayMove(ctx, white.SessionID, "", 4, 2)
+	assert.True(t, errors.Is(err, ErrUnauthorized))
+
+	_, err = c.PlayMove(ctx, white.SessionID, white.Token, 0, 0)
+	assert.True(t, errors.Is(err, ErrIllegalMove))
+
+	board, err := c.PlayMove(ctx, white.SessionID, white.Token, 4, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, server.WHITE, board[2][4])
+
+	board, err = c.GetBoard(ctx, white.SessionID)
+	assert.Nil(t, err)
+	assert.Equal(t, server.WHITE, board[3][4])
+
+	session, err = c.WaitForTurn(ctx, black.SessionID, server.BLACK)
+	assert.Nil(t, err)
+	assert.Equal(t, server.BLACK, session.Turn)
+}
+
+func TestClient_Account(t *testing.T) {
+
+	c, closeServer := newTestClient()
+	defer closeServer()
+	ctx := context.Background()
+
+	registered, err := c.Register(ctx, "alice", "correct horse")
+	if !assert.Nil(t, err) {
+		return
+	}
+	_, err = c.Register(ctx, "alice", "correct horse")
+	assert.True(t, errors.Is(err, ErrUsernameTaken))
+
+	_, err = c.Login(ctx, "alice", "wrong password")
+	assert.True(t, errors.Is(err, ErrLoginFailed))
+
+	login, err := c.Login(ctx, "alice", "correct horse")
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, registered.UserID, login.UserID)
+
+	info, err := c.StartSession(ctx, login.Token, false)
+	assert.Nil(t, err)
+	assert.Equal(t, login.UserID, info.UserID)
+
+	refreshed, err := c.Refresh(ctx, login.RefreshToken)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, login.UserID, refreshed.UserID)
+	_, err = c.Refresh(ctx, login.RefreshToken)
+	assert.True(t, errors.Is(err, ErrUnauthorized))
+
+	assert.Nil(t, c.Logout(ctx, refreshed.RefreshToken))
+	_, err = c.Refresh(ctx, refreshed.RefreshToken)
+	assert.True(t, errors.Is(err, ErrUnauthorized))
+
+	assert.Nil(t, c.LogoutAll(ctx, refreshed.Token))
+	_, err = c.Refresh(ctx, registered.RefreshToken)
+	assert.True(t, errors.Is(err, ErrUnauthorized))
+
+	_, err = c.StartSession(ctx, "nothing", false)
+	assert.True(t, errors.Is(err, ErrUnauthorized))
+}
+
+func TestClient_WaitForTurn(t *testing.T) {
+
+	c, closeServer := newTestClient()
+	defer closeServer()
+	ctx := context.Background()
+
+	white, _ := c.CreateUser(ctx, "white")
+
+	done := make(chan *server.Session, 1)
+	go func() {
+		session, err := c.WaitForTurn(ctx, white.SessionID, server.BLACK)
+		assert.Nil(t, err)
+		done <- session
+	}()
+
+	c.CreateUser(ctx, "black")
+	time.Sleep(50 * time.Millisecond)
+	c.PlayMove(ctx, white.SessionID, white.Token, 4, 2)
+
+	select {
+	case session := <-done:
+		assert.Equal(t, server.BLACK, session.Turn)
+		assert.Equal(t, 2, session.ElapsedTurn)
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "WaitForTurn did not return")
+	}
+}
+
+func TestClient_Context(t *testing.T) {
+
+	c, closeServer := newTestClient()
+	defer closeServer()
+
+	white, _ := c.CreateUser(context.Background(), "white")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	_, err := c.JoinSession(ctx, white.SessionID)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+}
+
+func TestClient_Retry(t *testing.T) {
+
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"status":"success","board":[[0]]}`))
+	}))
+	defer ts.Close()
+
+	c := New(ts.URL)
+	c.RetryWait = time.Millisecond
+
+	board, err := c.GetBoard(context.Background(), "abc")
+	assert.Nil(t, err)
+	assert.Equal(t, [][]int{{0}}, board)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+
+	atomic.StoreInt32(&calls, 0)
+	c.MaxRetries = 1
+	_, err = c.GetBoard(context.Background(), "abc")
+	var apiErr *APIError
+	assert.True(t, errors.As(err, &apiErr))
+	assert.Equal(t, http.StatusServiceUnavailable, apiErr.StatusCode)
+}
+
+func TestIsTemporary(t *testing.T) {
+
+	assert.True(t, IsTemporary(&APIError{StatusCode: http.StatusTooManyRequests}))
+	assert.True(t, IsTemporary(&APIError{StatusCode: http.StatusInternalServerError}))
+	assert.True(t, IsTemporary(&APIError{StatusCode: http.StatusServiceUnavailable}))
+	assert.False(t, IsTemporary(&APIError{StatusCode: http.StatusBadRequest}))
+	assert.False(t, IsTemporary(&APIError{StatusCode: http.StatusNotFound}))
+
+	// the network failing is temporary, anything else the client gets wrong is not
+	ts := httptest.NewServer(http.NotFoundHandler())
+	ts.Close()
+	_, err := New(ts.URL).GetBoard(context.Background(), "abc")
+	assert.True(t, IsTemporary(err))
+	assert.True(t, IsTemporary(&url.Error{Op: "Get", URL: ts.URL, Err: io.EOF}))
+
+	_, err = New("nothing://host").GetBoard(context.Background(), "abc")
+	assert.NotNil(t, err)
+	assert.False(t, IsTemporary(err))
+	assert.False(t, IsTemporary(ErrSessionNotFound))
+	assert.False(t, IsTemporary(errors.New("invalid character")))
+	assert.False(t, IsTemporary(context.DeadlineExceeded))
+}
+
+func TestClient_RetryAfter(t *testing.T) {
+
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 || r.Method == "POST" {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"status":"fail","description":"Too many requests"}`))
+			return
+		}
+		w.Write([]byte(`{"status":"success","board":[[0]]}`))
+	}))
+	defer ts.Close()
+
+	c := New(ts.URL)
+	c.RetryWait = time.Millisecond
+
+	// the retry waits as long as the server asked, not RetryWait
+	start := time.Now()
+	board, err := c.GetBoard(context.Background(), "abc")
+	assert.Nil(t, err)
+	assert.Equal(t, [][]int{{0}}, board)
+	assert.True(t, time.Since(start) >= time.Second)
+
+	_, err = c.PlayMove(context.Background(), "abc", "token", 2, 3)
+	assert.True(t, errors.Is(err, ErrTooManyRequests))
+	var apiErr *APIError
+	if assert.True(t, errors.As(err, &apiErr)) {
+		assert.Equal(t, time.Second, apiErr.RetryAfter)
+	}
+
+	now := time.Now()
+	assert.Equal(t, time.Duration(0), retryAfter("", now))
+	assert.Equal(t, time.Duration(0), retryAfter("soon", now))
+	assert.Equal(t, 30*time.Second, retryAfter("30", now))
+	date := now.Add(time.Minute).UTC().Truncate(time.Second)
+	assert.InDelta(t, float64(date.Sub(now)), float64(retryAfter(date.Format(http.TimeFormat), now)), float64(time.Second))
+}
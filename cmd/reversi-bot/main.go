@@ -0,0 +1,63 @@
+// Command reversi-bot plays games against the rest_reversi server with one of the example bots.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+
+	"github.com/ykore52/rest_reversi/bot"
+	"github.com/ykore52/rest_reversi/client"
+)
+
+func main() {
+
+	serverURL := flag.String("server", "http://localhost:8080", "URL of the reversi server")
+	name := flag.String("name", "", "name of the bot (defaults to the kind of the bot)")
+	kind := flag.String("bot", "greedy", "kind of the bot: random, greedy or positional")
+	games := flag.Int("games", 1, "number of games to play")
+	verbose := flag.Bool("v", false, "print progress of the games")
+	flag.Parse()
+
+	var player bot.Player
+	switch *kind {
+	case "random":
+		player = bot.NewRandomPlayer()
+	case "greedy":
+		player = bot.GreedyPlayer{}
+	case "positional":
+		player = bot.PositionalPlayer{}
+	default:
+		fmt.Printf("reversi-bot: unknown bot %q\n", *kind)
+		os.Exit(2)
+	}
+	if *name == "" {
+		*name = *kind
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	runner := bot.NewRunner(client.New(*serverURL), *name, player)
+	if *verbose {
+		runner.Logf = func(format string, args ...interface{}) {
+			fmt.Printf(format+"\n", args...)
+		}
+	}
+
+	wins := 0
+	for i := 0; i < *games; i++ {
+		result, err := runner.Play(ctx)
+		if err != nil {
+			fmt.Printf("reversi-bot: %s\n", err.Error())
+			os.Exit(1)
+		}
+		if result.Won() {
+			wins++
+		}
+		fmt.Printf("game %d: session %s, white %d, black %d, won %t\n", i+1, result.SessionID, result.White, result.Black, result.Won())
+	}
+	fmt.Printf("%s won %d of %d games\n", *name, wins, *games)
+}
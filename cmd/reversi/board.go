@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ykore52/rest_reversi/server"
+)
+
+// discMarks are the characters drawn for EMPTY, WHITE and BLACK
+var discMarks = map[int]string{
+	server.EMPTY: ".",
+	server.WHITE: "O",
+	server.BLACK: "X",
+}
+
+// candidateMark is drawn on the grids where the player can put a disc
+const candidateMark = "*"
+
+// renderBoard draws the board with the coordinates of standard notation, row 1 at the top.
+// cand holds grids as [y, x]
+func renderBoard(board [][]int, cand [][]int) string {
+
+	marked := make(map[[2]int]bool)
+	for _, c := range cand {
+		marked[[2]int{c[0], c[1]}] = true
+	}
+
+	var b strings.Builder
+	b.WriteString("  ")
+	for x := range board[0] {
+		b.WriteString(" " + string(rune('a'+x)))
+	}
+	b.WriteString("\n")
+
+	for y := len(board) - 1; y >= 0; y-- {
+		b.WriteString(fmt.Sprintf("%2d", len(board)-y))
+		for x, disc := range board[y] {
+			mark := discMarks[disc]
+			if disc == server.EMPTY && marked[[2]int{y, x}] {
+				mark = candidateMark
+			}
+			b.WriteString(" " + mark)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
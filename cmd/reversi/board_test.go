@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ykore52/rest_reversi/server"
+)
+
+func TestRenderBoard(t *testing.T) {
+
+	board := make([][]int, server.MaxBoardSize)
+	for y := range board {
+		board[y] = make([]int, server.MaxBoardSize)
+	}
+	board[3][3], board[3][4] = server.WHITE, server.BLACK
+	board[4][3], board[4][4] = server.BLACK, server.WHITE
+
+	expected := "" +
+		"   a b c d e f g h\n" +
+		" 1 . . . . . . . .\n" +
+		" 2 . . . . . . . .\n" +
+		" 3 . . . * . . . .\n" +
+		" 4 . . * X O . . .\n" +
+		" 5 . . . O X * . .\n" +
+		" 6 . . . . * . . .\n" +
+		" 7 . . . . . . . .\n" +
+		" 8 . . . . . . . .\n"
+	// the rows are of standard notation, so session row y is drawn as row 8-y
+	assert.Equal(t, expected, renderBoard(board, [][]int{{2, 4}, {3, 5}, {4, 2}, {5, 3}}))
+}
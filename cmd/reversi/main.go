@@ -0,0 +1,191 @@
+// Command reversi plays a game against the rest_reversi server from the terminal.
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/ykore52/rest_reversi/client"
+	"github.com/ykore52/rest_reversi/server"
+)
+
+func main() {
+
+	serverURL := flag.String("server", "http://localhost:8080", "URL of the reversi server")
+	name := flag.String("name", "player", "name of the player")
+	account := flag.String("account", "", "username of the account to log in with, taking the password from $REVERSI_PASSWORD. A guest plays when empty")
+	rated := flag.Bool("rated", false, "play a rated game, which needs -account")
+	flag.Parse()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	c := client.New(*serverURL)
+	info, err := join(ctx, c, *name, *account, os.Getenv("REVERSI_PASSWORD"), *rated)
+	if err == nil {
+		err = play(ctx, c, info)
+	}
+	if err != nil && !errors.Is(err, context.Canceled) {
+		fmt.Printf("reversi: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
+
+// join pairs a guest named name, or the account when it is given, to a session.
+// Only an account plays rated games
+func join(ctx context.Context, c *client.Client, name, account, password string, rated bool) (*server.GetSessionInfoResponse, error) {
+
+	if account == "" {
+		if rated {
+			return nil, server.ErrRatedGuest
+		}
+		info, err := c.CreateUser(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Printf("Registered as %s (user %s)\n", info.Username, info.UserID)
+		return info, nil
+	}
+
+	login, err := c.Login(ctx, account, password)
+	if err != nil {
+		return nil, err
+	}
+	info, err := c.StartSession(ctx, login.Token, rated)
+	if err != nil {
+		return nil, err
+	}
+	info.Token, info.RefreshToken = login.Token, login.RefreshToken
+	fmt.Printf("Logged in as %s (user %s)\n", info.Username, info.UserID)
+	return info, nil
+}
+
+// refresh replaces the tokens of info with new ones
+func refresh(ctx context.Context, c *client.Client, info *server.GetSessionInfoResponse) error {
+
+	tokens, err := c.Refresh(ctx, info.RefreshToken)
+	if err != nil {
+		return err
+	}
+	info.Token, info.RefreshToken = tokens.Token, tokens.RefreshToken
+	return nil
+}
+
+func play(ctx context.Context, c *client.Client, info *server.GetSessionInfoResponse) error {
+
+	fmt.Printf("Session %s: waiting for an opponent...\n", info.SessionID)
+
+	session, err := c.JoinSession(ctx, info.SessionID)
+	if err != nil {
+		return err
+	}
+
+	color := server.WHITE
+	if session.Players[0].UserID != info.UserID {
+		color = server.BLACK
+	}
+	fmt.Printf("Matched: you are %s (%s) against %s\n", discMarks[color], colorName(color), opponentName(session, info.UserID))
+
+	input := bufio.NewScanner(os.Stdin)
+	for {
+		session, err = c.WaitForTurn(ctx, info.SessionID, color)
+		if err != nil {
+			return err
+		}
+
+		if len(session.LastMove) == 3 && session.LastMove[0] != color {
+			fmt.Printf("\n%s played %s\n", colorName(session.LastMove[0]), server.FormatMove(session.LastMove[1], session.LastMove[2]))
+		}
+
+		if server.IsSessionFinished(session) {
+			fmt.Println()
+			fmt.Print(renderBoard(session.Board, nil))
+			printResult(session, color)
+			return nil
+		}
+
+		cand, err := c.GetCandidates(ctx, info.SessionID)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println()
+		fmt.Print(renderBoard(session.Board, cand))
+		white, black := server.CountDiscs(session.Board)
+		fmt.Printf("O: %d  X: %d  turn %d\n", white, black, session.ElapsedTurn)
+
+		for {
+			fmt.Printf("Your move (%s), e.g. d3, or q to quit: ", discMarks[color])
+			if !input.Scan() {
+				return input.Err()
+			}
+
+			line := strings.TrimSpace(input.Text())
+			if line == "q" || line == "quit" {
+				return nil
+			}
+
+			x, y, err := server.ParseMove(line)
+			if err != nil {
+				fmt.Printf("Invalid move %q: use a column letter and a row number like d3\n", line)
+				continue
+			}
+
+			_, err = c.PlayMove(ctx, info.SessionID, info.Token, x, y)
+			if errors.Is(err, client.ErrUnauthorized) {
+				// the access token expired while the player was thinking
+				if err = refresh(ctx, c, info); err == nil {
+					_, err = c.PlayMove(ctx, info.SessionID, info.Token, x, y)
+				}
+			}
+			if err != nil {
+				if errors.Is(err, client.ErrIllegalMove) {
+					fmt.Printf("Cannot put a disc on %s\n", server.FormatMove(x, y))
+					continue
+				}
+				return err
+			}
+			break
+		}
+	}
+}
+
+func printResult(session *server.Session, color int) {
+
+	white, black := server.CountDiscs(session.Board)
+	fmt.Printf("Game over. O: %d  X: %d\n", white, black)
+
+	switch {
+	case session.State == server.StateWonWhite && color == server.WHITE,
+		session.State == server.StateWonBlack && color == server.BLACK:
+		fmt.Println("You win!")
+	case session.State == server.StateWonWhite, session.State == server.StateWonBlack:
+		fmt.Println("You lose.")
+	case session.State == server.StateDraw:
+		fmt.Println("Draw.")
+	default:
+		fmt.Println("The session is closed.")
+	}
+}
+
+func colorName(color int) string {
+	if color == server.WHITE {
+		return "white"
+	}
+	return "black"
+}
+
+func opponentName(session *server.Session, userID string) string {
+	for _, p := range session.Players {
+		if p.UserID != userID {
+			return p.Name
+		}
+	}
+	return "unknown"
+}
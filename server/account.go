@@ -0,0 +1,533 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// APIAccount is an API endpoint that registers an account
+	APIAccount string = "/account"
+
+	// APILogin is an API endpoint that issues an access token of an account
+	APILogin string = "/login"
+
+	// APILogout is an API endpoint that revokes a refresh token, or every
+	// refresh token of the user of the access token with ?all=true
+	APILogout string = "/logout"
+
+	// APIRefresh is an API endpoint that exchanges a refresh token for new tokens
+	APIRefresh string = "/refresh"
+)
+
+const (
+	// MinPasswordLength and MaxPasswordLength bound the length of a password in bytes.
+	// bcrypt reads no more than 72 bytes
+	MinPasswordLength int = 8
+	MaxPasswordLength int = 72
+
+	// passwordCost is the bcrypt cost of the password hashes
+	passwordCost = bcrypt.DefaultCost
+)
+
+var (
+	// ErrAccountNotFound is returned when no account has the username
+	ErrAccountNotFound = errors.New("Invalid account")
+
+	// ErrUsernameTaken is returned when an account of the username exists
+	ErrUsernameTaken = errors.New("Username is taken")
+
+	// ErrInvalidUsername is returned when a username is not 3 to 32 letters, digits, - or _
+	ErrInvalidUsername = errors.New("Invalid username")
+
+	// ErrInvalidPassword is returned when a password is too short or too long
+	ErrInvalidPassword = errors.New("Invalid password")
+
+	// ErrLoginFailed is returned when the username or the password is wrong
+	ErrLoginFailed = errors.New("Invalid username or password")
+)
+
+var usernamePattern = regexp.MustCompile("^[a-zA-Z0-9_-]{3,32}$")
+
+// Account is a user who logs in with a username and a password.
+// Usernames are unique regardless of case
+type Account struct {
+	Username     string    `json:"username"`
+	UserID       string    `json:"userID"`
+	PasswordHash string    `json:"passwordHash"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+// AccountStore keeps accounts by their usernames. Implementations must be safe for concurrent use
+type AccountStore interface {
+	// Get returns the account of the username, or ErrAccountNotFound
+	Get(username string) (Account, error)
+
+	// Create adds the account, or returns ErrUsernameTaken
+	Create(account Account) error
+
+	// Delete removes the account of the username
+	Delete(username string) error
+}
+
+// accountKey is the key of the username in the stores
+func accountKey(username string) string {
+	return strings.ToLower(username)
+}
+
+// dummyPasswordHash is compared with when the username is unknown, so that the
+// response time does not tell whether an account exists. It is made on the first use
+var (
+	dummyPasswordHash     []byte
+	dummyPasswordHashOnce sync.Once
+)
+
+// Register creates an account and its user
+func (sv *Server) Register(username, password string) (User, error) {
+
+	if !usernamePattern.MatchString(username) {
+		return User{}, ErrInvalidUsername
+	}
+	if len(password) < MinPasswordLength || len(password) > MaxPasswordLength {
+		return User{}, ErrInvalidPassword
+	}
+	if _, err := sv.Accounts.Get(username); err == nil {
+		return User{}, ErrUsernameTaken
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), passwordCost)
+	if err != nil {
+		return User{}, err
+	}
+
+	user := newUser(username)
+	user.Registered = true
+	err = sv.Accounts.Create(Account{
+		Username:     username,
+		UserID:       user.UserID,
+		PasswordHash: string(hash),
+		CreatedAt:    time.Now(),
+	})
+	if err != nil {
+		return User{}, err
+	}
+	if err := sv.Users.Put(user); err != nil {
+		sv.Accounts.Delete(username)
+		return User{}, err
+	}
+	return user, sv.createProfile(user)
+}
+
+// Login returns the user of the account when the password is right
+func (sv *Server) Login(username, password string) (User, error) {
+
+	account, err := sv.Accounts.Get(username)
+	if err == ErrAccountNotFound {
+		dummyPasswordHashOnce.Do(func() {
+			dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), passwordCost)
+		})
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return User{}, ErrLoginFailed
+	}
+	if err != nil {
+		return User{}, err
+	}
+	if bcrypt.CompareHashAndPassword([]byte(account.PasswordHash), []byte(password)) != nil {
+		return User{}, ErrLoginFailed
+	}
+
+	user, err := sv.Users.Get(account.UserID)
+	if err == ErrUserNotFound {
+		return User{}, ErrLoginFailed
+	}
+	if err == nil && user.Banned {
+		return User{}, ErrBanned
+	}
+	return user, err
+}
+
+// Logout revokes the refresh token. Access tokens issued with it stay valid until they
+// expire, which is within AccessTTL
+func (sv *Server) Logout(refreshToken string) error {
+	return sv.Tokens.Delete(hashToken(refreshToken))
+}
+
+// MemoryAccountStore keeps accounts in memory
+type MemoryAccountStore struct {
+	mu       sync.RWMutex
+	accounts map[string]Account
+
+	// save and remove let a durable store write a change through before it is committed
+	save   func(Account) error
+	remove func(username string) error
+}
+
+// NewMemoryAccountStore returns an empty MemoryAccountStore
+func NewMemoryAccountStore() *MemoryAccountStore {
+	return &MemoryAccountStore{accounts: make(map[string]Account)}
+}
+
+// Get ...
+func (st *MemoryAccountStore) Get(username string) (Account, error) {
+
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	account, ok := st.accounts[accountKey(username)]
+	if !ok {
+		return account, ErrAccountNotFound
+	}
+	return account, nil
+}
+
+// Create ...
+func (st *MemoryAccountStore) Create(account Account) error {
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	key := accountKey(account.Username)
+	if _, ok := st.accounts[key]; ok {
+		return ErrUsernameTaken
+	}
+	if st.save != nil {
+		if err := st.save(account); err != nil {
+			return err
+		}
+	}
+	st.accounts[key] = account
+	return nil
+}
+
+// Delete ...
+func (st *MemoryAccountStore) Delete(username string) error {
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.remove != nil {
+		if err := st.remove(username); err != nil {
+			return err
+		}
+	}
+	delete(st.accounts, accountKey(username))
+	return nil
+}
+
+// NewFileAccountStore returns an account store which keeps every account as a JSON file under dir/accounts
+func NewFileAccountStore(dir string) (*MemoryAccountStore, error) {
+
+	dir = filepath.Join(dir, "accounts")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	st := NewMemoryAccountStore()
+	err := readJSONFiles(dir, func(data []byte) error {
+		var account Account
+		if err := json.Unmarshal(data, &account); err != nil {
+			return err
+		}
+		st.accounts[accountKey(account.Username)] = account
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	st.save = func(account Account) error {
+		return writeJSONFile(filepath.Join(dir, accountKey(account.Username)+".json"), account)
+	}
+	st.remove = func(username string) error {
+		return removeFile(filepath.Join(dir, accountKey(username)+".json"))
+	}
+	return st, nil
+}
+
+// PostAccountRequest ...
+type PostAccountRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// PostRefreshRequest ...
+type PostRefreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+// LoginResponse has the tokens of the user. Token is the access token, which
+// expires in ExpiresIn seconds, and RefreshToken gets new tokens
+type LoginResponse struct {
+	Status       string `json:"status"`
+	Username     string `json:"username"`
+	UserID       string `json:"userID"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refreshToken"`
+	ExpiresIn    int    `json:"expiresIn"`
+}
+
+// APIPostAccount registers an account and logs it in
+func (sv *Server) APIPostAccount(w http.ResponseWriter, r *http.Request) {
+
+	reqBody := new(PostAccountRequest)
+	if !readRequest(w, r, reqBody) {
+		return
+	}
+
+	user, err := sv.Register(reqBody.Username, reqBody.Password)
+	switch err {
+	case nil:
+	case ErrInvalidUsername, ErrInvalidPassword:
+		returnJSONMessage(w, http.StatusBadRequest, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: err.Error(),
+		})
+		return
+	case ErrUsernameTaken:
+		returnJSONMessage(w, http.StatusConflict, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: err.Error(),
+		})
+		return
+	default:
+		fmt.Println("APIPostAccount: " + err.Error())
+		returnJSONMessage(w, http.StatusInternalServerError, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: "Cannot create an account",
+		})
+		return
+	}
+
+	sv.returnLogin(w, user)
+}
+
+// APIPostLogin issues an access token of the account
+func (sv *Server) APIPostLogin(w http.ResponseWriter, r *http.Request) {
+
+	reqBody := new(PostAccountRequest)
+	if !readRequest(w, r, reqBody) {
+		return
+	}
+
+	user, err := sv.Login(reqBody.Username, reqBody.Password)
+	if err == ErrBanned {
+		returnAuthError(w, err)
+		return
+	}
+	if err == ErrLoginFailed {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="rest_reversi"`)
+		returnJSONMessage(w, http.StatusUnauthorized, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		fmt.Println("APIPostLogin: " + err.Error())
+		returnJSONMessage(w, http.StatusInternalServerError, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: "Cannot log in",
+		})
+		return
+	}
+
+	sv.returnLogin(w, user)
+}
+
+// APIPostRefresh exchanges a refresh token for a new access token and refresh token
+func (sv *Server) APIPostRefresh(w http.ResponseWriter, r *http.Request) {
+
+	reqBody := new(PostRefreshRequest)
+	if !readRequest(w, r, reqBody) {
+		return
+	}
+
+	user, tokens, err := sv.Refresh(reqBody.RefreshToken)
+	if err == ErrUnauthorized || err == ErrBanned {
+		returnAuthError(w, err)
+		return
+	}
+	if err != nil {
+		fmt.Println("APIPostRefresh: " + err.Error())
+		returnJSONMessage(w, http.StatusInternalServerError, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: "Cannot issue a token",
+		})
+		return
+	}
+
+	returnJSONMessage(w, http.StatusOK, newLoginResponse(user, tokens))
+}
+
+// APIPostLogout revokes the refresh token in the body. ?all=true revokes every refresh
+// token of the user of the access token instead, logging out all of its clients
+func (sv *Server) APIPostLogout(w http.ResponseWriter, r *http.Request) {
+
+	var err error
+	if r.URL.Query().Get("all") == "true" {
+		user, authErr := sv.authenticate(r)
+		if authErr != nil {
+			returnAuthError(w, authErr)
+			return
+		}
+		err = sv.Tokens.DeleteUser(user.UserID)
+	} else {
+		reqBody := new(PostRefreshRequest)
+		if !readRequest(w, r, reqBody) {
+			return
+		}
+		err = sv.Logout(reqBody.RefreshToken)
+	}
+	if err != nil {
+		fmt.Println("APIPostLogout: " + err.Error())
+		returnJSONMessage(w, http.StatusInternalServerError, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: "Cannot log out",
+		})
+		return
+	}
+
+	returnJSONMessage(w, http.StatusOK, &GeneralMessageResponse{
+		Status: "success",
+	})
+}
+
+// PostSessionRequest asks for a rated or a casual game. The body may be left out for a casual one
+type PostSessionRequest struct {
+	Rated bool `json:"rated"`
+}
+
+// APIPostSession pairs the user of the access token with a waiting session, or creates a new session
+func (sv *Server) APIPostSession(w http.ResponseWriter, r *http.Request) {
+
+	user, err := sv.authenticate(r)
+	if err != nil {
+		returnAuthError(w, err)
+		return
+	}
+
+	var reqBody PostSessionRequest
+	if r.ContentLength != 0 && !readRequest(w, r, &reqBody) {
+		return
+	}
+
+	session, err := sv.JoinSession(user, reqBody.Rated)
+	if err == ErrBanned {
+		returnAuthError(w, err)
+		return
+	}
+	if err == ErrTooManySessions {
+		returnTooManyRequests(w, time.Minute, err.Error())
+		return
+	}
+	if err == ErrRatedGuest {
+		returnJSONMessage(w, http.StatusForbidden, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		fmt.Println("APIPostSession: " + err.Error())
+		returnJSONMessage(w, http.StatusInternalServerError, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: "Cannot create a session",
+		})
+		return
+	}
+
+	returnJSONMessage(w, http.StatusOK, &GetSessionInfoResponse{
+		Status:    "success",
+		Username:  user.Name,
+		UserID:    user.UserID,
+		SessionID: session.SessionID,
+	})
+}
+
+// readRequest reads the JSON body of the request into v. The body is not
+// logged since it may have a password or a token
+func readRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+
+	body, ok := readBody(w, r)
+	if !ok {
+		return false
+	}
+
+	if err := json.Unmarshal(body, v); err != nil {
+		returnJSONMessage(w, http.StatusInternalServerError, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: "Cannot parse to json",
+		})
+		return false
+	}
+	return true
+}
+
+// readBody reads the body of the request, which must not be empty nor larger than
+// the limit of the server
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+
+	if r.ContentLength == 0 {
+		returnJSONMessage(w, http.StatusBadRequest, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: "Empty body",
+		})
+		return nil, false
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		returnJSONMessage(w, http.StatusRequestEntityTooLarge, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: "Body too large",
+		})
+		return nil, false
+	}
+	if err != nil {
+		returnJSONMessage(w, http.StatusInternalServerError, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: "Cannot read body",
+		})
+		return nil, false
+	}
+	return body, true
+}
+
+// returnLogin issues tokens of the user and replies them
+func (sv *Server) returnLogin(w http.ResponseWriter, user User) {
+
+	tokens, err := sv.IssueTokens(user)
+	if err != nil {
+		fmt.Println("returnLogin: " + err.Error())
+		returnJSONMessage(w, http.StatusInternalServerError, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: "Cannot issue a token",
+		})
+		return
+	}
+
+	returnJSONMessage(w, http.StatusOK, newLoginResponse(user, tokens))
+}
+
+func newLoginResponse(user User, tokens *TokenPair) *LoginResponse {
+	return &LoginResponse{
+		Status:       "success",
+		Username:     user.Name,
+		UserID:       user.UserID,
+		Token:        tokens.AccessToken,
+		RefreshToken: tokens.RefreshToken,
+		ExpiresIn:    tokens.ExpiresIn,
+	}
+}
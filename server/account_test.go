@@ -0,0 +1,200 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegisterLogin(t *testing.T) {
+
+	sv := NewServer(NewMemorySessionStore(), NewMemoryUserStore())
+
+	user, err := sv.Register("Alice", "correct horse")
+	assert.Nil(t, err)
+	assert.True(t, user.Registered)
+	assert.Equal(t, "Alice", user.Name)
+
+	account, _ := sv.Accounts.Get("alice")
+	assert.NotContains(t, account.PasswordHash, "correct horse")
+
+	_, err = sv.Register("ALICE", "another password")
+	assert.Equal(t, ErrUsernameTaken, err)
+	_, err = sv.Register("a", "correct horse")
+	assert.Equal(t, ErrInvalidUsername, err)
+	_, err = sv.Register("bob", "short")
+	assert.Equal(t, ErrInvalidPassword, err)
+
+	got, err := sv.Login("alice", "correct horse")
+	assert.Nil(t, err)
+	assert.Equal(t, user, got)
+
+	_, err = sv.Login("alice", "wrong password")
+	assert.Equal(t, ErrLoginFailed, err)
+	_, err = sv.Login("nobody", "correct horse")
+	assert.Equal(t, ErrLoginFailed, err)
+
+	// the janitor keeps accounts without games
+	j := NewJanitor(sv, JanitorConfig{})
+	j.Sweep()
+	j.Sweep()
+	_, err = sv.Users.Get(user.UserID)
+	assert.Nil(t, err)
+}
+
+func TestAPIAccount(t *testing.T) {
+
+	sv := NewServer(NewMemorySessionStore(), NewMemoryUserStore())
+	ts := httptest.NewServer(sv)
+	defer ts.Close()
+
+	post := func(path string, v interface{}) (*http.Response, error) {
+		body, _ := json.Marshal(v)
+		return http.Post(ts.URL+path, "application/json", bytes.NewReader(body))
+	}
+
+	res, err := post(APIAccount, &PostAccountRequest{Username: "alice", Password: "correct horse"})
+	if !assert.Nil(t, err) {
+		return
+	}
+	var registered LoginResponse
+	assert.Nil(t, json.NewDecoder(res.Body).Decode(&registered))
+	res.Body.Close()
+	assert.NotEmpty(t, registered.Token)
+
+	res, err = post(APIAccount, &PostAccountRequest{Username: "Alice", Password: "correct horse"})
+	if !assert.Nil(t, err) {
+		return
+	}
+	res.Body.Close()
+	assert.Equal(t, http.StatusConflict, res.StatusCode)
+
+	res, err = post(APILogin, &PostAccountRequest{Username: "alice", Password: "wrong password"})
+	if !assert.Nil(t, err) {
+		return
+	}
+	res.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+	res, err = post(APILogin, &PostAccountRequest{Username: "alice", Password: "correct horse"})
+	if !assert.Nil(t, err) {
+		return
+	}
+	var login LoginResponse
+	assert.Nil(t, json.NewDecoder(res.Body).Decode(&login))
+	res.Body.Close()
+	assert.Equal(t, registered.UserID, login.UserID)
+	assert.NotEqual(t, registered.Token, login.Token)
+
+	// the account plays under the same user in every session, against a guest
+	res, err = postWithToken(ts.URL+APISession, login.Token, nil)
+	if !assert.Nil(t, err) {
+		return
+	}
+	var info GetSessionInfoResponse
+	assert.Nil(t, json.NewDecoder(res.Body).Decode(&info))
+	res.Body.Close()
+	assert.Equal(t, login.UserID, info.UserID)
+	assert.Empty(t, info.Token)
+
+	// joining again does not pair the account with itself
+	res, err = postWithToken(ts.URL+APISession, registered.Token, nil)
+	if !assert.Nil(t, err) {
+		return
+	}
+	var again GetSessionInfoResponse
+	assert.Nil(t, json.NewDecoder(res.Body).Decode(&again))
+	res.Body.Close()
+	assert.NotEqual(t, info.SessionID, again.SessionID)
+
+	_, guest, _ := sv.CreateSession("guest")
+	assert.Equal(t, StateEstablished, guest.State)
+
+	// logging out revokes the refresh token, and ?all=true every refresh token of the user
+	body, _ := json.Marshal(&PostRefreshRequest{RefreshToken: login.RefreshToken})
+	res, err = http.Post(ts.URL+APILogout, "application/json", bytes.NewReader(body))
+	if !assert.Nil(t, err) {
+		return
+	}
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	_, _, err = sv.Refresh(login.RefreshToken)
+	assert.Equal(t, ErrUnauthorized, err)
+
+	res, err = post(APIRefresh, &PostRefreshRequest{RefreshToken: registered.RefreshToken})
+	if !assert.Nil(t, err) {
+		return
+	}
+	var refreshed LoginResponse
+	assert.Nil(t, json.NewDecoder(res.Body).Decode(&refreshed))
+	res.Body.Close()
+	assert.Equal(t, registered.UserID, refreshed.UserID)
+	assert.Equal(t, "alice", refreshed.Username)
+
+	res, err = postWithToken(ts.URL+APILogout+"?all=true", refreshed.Token, nil)
+	if !assert.Nil(t, err) {
+		return
+	}
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	res, err = post(APIRefresh, &PostRefreshRequest{RefreshToken: refreshed.RefreshToken})
+	if !assert.Nil(t, err) {
+		return
+	}
+	res.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+	res, err = postWithToken(ts.URL+APILogout+"?all=true", "nothing", nil)
+	if !assert.Nil(t, err) {
+		return
+	}
+	res.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+}
+
+func TestAccountStores(t *testing.T) {
+
+	dir := t.TempDir()
+	sqlite, err := OpenSQLiteStore(filepath.Join(dir, "reversi.db"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer sqlite.Close()
+
+	files, err := NewFileAccountStore(dir)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	account := Account{Username: "Alice", UserID: "u1", PasswordHash: "hash", CreatedAt: time.Now().UTC().Truncate(time.Second)}
+	for _, st := range []AccountStore{NewMemoryAccountStore(), files, sqlite.Accounts()} {
+		assert.Nil(t, st.Create(account))
+		assert.Equal(t, ErrUsernameTaken, st.Create(Account{Username: "alice", UserID: "u2"}))
+
+		got, err := st.Get("ALICE")
+		assert.Nil(t, err)
+		assert.Equal(t, account, got)
+
+		_, err = st.Get("bob")
+		assert.Equal(t, ErrAccountNotFound, err)
+	}
+
+	files, err = NewFileAccountStore(dir)
+	if !assert.Nil(t, err) {
+		return
+	}
+	got, err := files.Get("alice")
+	assert.Nil(t, err)
+	assert.Equal(t, "u1", got.UserID)
+
+	assert.Nil(t, files.Delete("alice"))
+	_, err = files.Get("alice")
+	assert.Equal(t, ErrAccountNotFound, err)
+}
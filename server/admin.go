@@ -0,0 +1,399 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"runtime"
+	"sort"
+	"time"
+)
+
+const (
+	// APIAdmin is the prefix of the API endpoints of moderators and admins
+	APIAdmin string = "/admin"
+
+	// APIAdminSessions is an API endpoint of the live sessions
+	APIAdminSessions string = "/sessions"
+
+	// APIAdminSessionClose is an API endpoint that closes a session without a winner
+	APIAdminSessionClose string = "/close"
+
+	// APIAdminSessionAdjudicate is an API endpoint that decides the result of a session
+	APIAdminSessionAdjudicate string = "/adjudicate"
+
+	// APIAdminUserBan and APIAdminUserUnban are API endpoints that ban a user and lift the ban
+	APIAdminUserBan   string = "/ban"
+	APIAdminUserUnban string = "/unban"
+
+	// APIAdminUserRole is an API endpoint that changes the role of a user
+	APIAdminUserRole string = "/role"
+
+	// APIAdminStats is an API endpoint of the statistics of the server
+	APIAdminStats string = "/stats"
+)
+
+var (
+	// ErrForbidden is returned when the role of the user does not allow the request
+	ErrForbidden = errors.New("Forbidden")
+
+	// ErrBanned is returned when a banned user logs in, joins a session or moves
+	ErrBanned = errors.New("Banned")
+
+	// ErrInvalidRole is returned when a role is not known, or given to a guest
+	ErrInvalidRole = errors.New("Invalid role")
+
+	// ErrInvalidResult is returned when a session is adjudicated by an unknown result
+	ErrInvalidResult = errors.New("Invalid result")
+)
+
+// authorize returns the user of the bearer token when its role is role or above it.
+// Roles and bans change before access tokens expire, so the user is read from the store
+func (sv *Server) authorize(r *http.Request, role string) (User, error) {
+
+	user, err := sv.authenticate(r)
+	if err != nil {
+		return User{}, err
+	}
+	user, err = sv.Users.Get(user.UserID)
+	if err == ErrUserNotFound {
+		return User{}, ErrUnauthorized
+	}
+	if err != nil {
+		return User{}, err
+	}
+	if user.Banned || !hasRole(user, role) {
+		return User{}, ErrForbidden
+	}
+	return user, nil
+}
+
+// checkBanned returns ErrBanned when the user is banned. The user is read from the
+// store, since the ban may be newer than the user the caller has
+func (sv *Server) checkBanned(userID string) error {
+
+	if user, err := sv.Users.Get(userID); err == nil && user.Banned {
+		return ErrBanned
+	}
+	return nil
+}
+
+// Adjudicate ends the session by the result. ResultNone closes it without a winner,
+// which is the only result of a session still waiting for an opponent
+func (sv *Server) Adjudicate(sessionID string, result string) error {
+
+	state, ok := map[string]SessionState{
+		ResultNone:  StateClose,
+		ResultWhite: StateWonWhite,
+		ResultBlack: StateWonBlack,
+		ResultDraw:  StateDraw,
+	}[result]
+	if !ok {
+		return ErrInvalidResult
+	}
+
+	return sv.updateSession(sessionID, func(s *Session) error {
+
+		if IsSessionFinished(s) {
+			return ErrGameFinished
+		}
+		if state != StateClose && (s.State < StateEstablished || len(s.Players) < 2) {
+			return ErrSessionNotStarted
+		}
+
+		s.Apply(GameEvent{Type: EventAdjudicated, Time: time.Now(), State: state})
+		s.Apply(GameEvent{Type: EventFinished, Time: time.Now(), State: state})
+		return nil
+	})
+}
+
+// Ban bans the user, or lifts the ban. A banned user is logged out of every client
+func (sv *Server) Ban(userID string, banned bool) error {
+
+	err := sv.Users.Update(userID, func(user *User) error {
+		user.Banned = banned
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if banned {
+		return sv.Tokens.DeleteUser(userID)
+	}
+	return nil
+}
+
+// SetRole gives the role to the registered user
+func (sv *Server) SetRole(userID string, role string) error {
+
+	if role == RoleGuest {
+		return ErrInvalidRole
+	}
+	if _, ok := roleRanks[role]; !ok {
+		return ErrInvalidRole
+	}
+
+	return sv.Users.Update(userID, func(user *User) error {
+		if !user.Registered {
+			return ErrInvalidRole
+		}
+		user.Role = role
+		if role == RolePlayer {
+			user.Role = ""
+		}
+		return nil
+	})
+}
+
+// GrantAdmin makes the user of the account an admin
+func (sv *Server) GrantAdmin(username string) error {
+
+	account, err := sv.Accounts.Get(username)
+	if err != nil {
+		return err
+	}
+	return sv.SetRole(account.UserID, RoleAdmin)
+}
+
+// GetAdminSessionsResponse ...
+type GetAdminSessionsResponse struct {
+	Status   string     `json:"status"`
+	Sessions []*Session `json:"sessions"`
+}
+
+// APIGetAdminSessions returns the live sessions, the latest changed first. ?state=waiting or
+// ?state=playing returns the sessions waiting for an opponent or being played only
+func (sv *Server) APIGetAdminSessions(w http.ResponseWriter, r *http.Request) {
+
+	if _, err := sv.authorize(r, RoleModerator); err != nil {
+		returnAuthError(w, err)
+		return
+	}
+
+	state := r.URL.Query().Get("state")
+	if state != "" && state != "waiting" && state != "playing" {
+		returnJSONMessage(w, http.StatusBadRequest, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: "Invalid state",
+		})
+		return
+	}
+
+	all, err := sv.Sessions.All()
+	if err != nil {
+		fmt.Println("APIGetAdminSessions: " + err.Error())
+		returnJSONMessage(w, http.StatusInternalServerError, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: "Cannot read sessions",
+		})
+		return
+	}
+
+	sessions := make([]*Session, 0, len(all))
+	for _, s := range all {
+		waiting := s.State == StateWait
+		if IsSessionFinished(s) || (state == "waiting" && !waiting) || (state == "playing" && waiting) {
+			continue
+		}
+		sessions = append(sessions, s)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].UpdatedAt.After(sessions[j].UpdatedAt)
+	})
+
+	returnJSONMessage(w, http.StatusOK, &GetAdminSessionsResponse{
+		Status:   "success",
+		Sessions: sessions,
+	})
+}
+
+// PostAdjudicateRequest ...
+type PostAdjudicateRequest struct {
+	Result string `json:"result"`
+}
+
+// APIPostAdminSession closes or adjudicates a session
+func (sv *Server) APIPostAdminSession(w http.ResponseWriter, r *http.Request) {
+
+	if _, err := sv.authorize(r, RoleModerator); err != nil {
+		returnAuthError(w, err)
+		return
+	}
+
+	re := regexp.MustCompile(APIAdmin + APISession + "/([a-zA-Z0-9]+)(/[a-z]+)")
+	match := re.FindStringSubmatch(r.URL.Path)
+	if len(match) < 3 {
+		returnJSONMessage(w, http.StatusInternalServerError, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: "Invalid session",
+		})
+		return
+	}
+
+	result := ResultNone
+	if match[2] == APIAdminSessionAdjudicate {
+		reqBody := new(PostAdjudicateRequest)
+		if !readRequest(w, r, reqBody) {
+			return
+		}
+		result = reqBody.Result
+	}
+
+	switch err := sv.Adjudicate(match[1], result); err {
+	case nil:
+		returnJSONMessage(w, http.StatusOK, &GeneralMessageResponse{
+			Status: "success",
+		})
+	case ErrInvalidResult:
+		returnJSONMessage(w, http.StatusBadRequest, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: err.Error(),
+		})
+	case ErrGameFinished, ErrSessionNotStarted:
+		returnJSONMessage(w, http.StatusConflict, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: err.Error(),
+		})
+	default:
+		returnSessionError(w, err)
+	}
+}
+
+// PostRoleRequest ...
+type PostRoleRequest struct {
+	Role string `json:"role"`
+}
+
+// APIPostAdminUser bans a user, lifts the ban or changes the role of the user. Moderators
+// ban users below them, and only admins change roles
+func (sv *Server) APIPostAdminUser(w http.ResponseWriter, r *http.Request) {
+
+	re := regexp.MustCompile(APIAdmin + APIUser + "/([a-zA-Z0-9]+)(/[a-z]+)")
+	match := re.FindStringSubmatch(r.URL.Path)
+	if len(match) < 3 {
+		returnJSONMessage(w, http.StatusInternalServerError, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: "Invalid user",
+		})
+		return
+	}
+
+	role := RoleModerator
+	if match[2] == APIAdminUserRole {
+		role = RoleAdmin
+	}
+	actor, err := sv.authorize(r, role)
+	if err != nil {
+		returnAuthError(w, err)
+		return
+	}
+
+	target, err := sv.Users.Get(match[1])
+	if err == nil && match[2] != APIAdminUserRole && roleRanks[userRole(target)] >= roleRanks[userRole(actor)] {
+		err = ErrForbidden
+	}
+	if err == nil {
+		switch match[2] {
+		case APIAdminUserBan:
+			err = sv.Ban(target.UserID, true)
+		case APIAdminUserUnban:
+			err = sv.Ban(target.UserID, false)
+		default:
+			reqBody := new(PostRoleRequest)
+			if !readRequest(w, r, reqBody) {
+				return
+			}
+			err = sv.SetRole(target.UserID, reqBody.Role)
+		}
+	}
+
+	switch err {
+	case nil:
+		returnJSONMessage(w, http.StatusOK, &GeneralMessageResponse{
+			Status: "success",
+		})
+	case ErrForbidden:
+		returnAuthError(w, err)
+	case ErrInvalidRole:
+		returnJSONMessage(w, http.StatusBadRequest, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: err.Error(),
+		})
+	case ErrUserNotFound:
+		returnJSONMessage(w, http.StatusNotFound, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: err.Error(),
+		})
+	default:
+		fmt.Println("APIPostAdminUser: " + err.Error())
+		returnJSONMessage(w, http.StatusInternalServerError, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: "Cannot change the user",
+		})
+	}
+}
+
+// GetAdminStatsResponse is GetMetricsResponse with what only admins see
+type GetAdminStatsResponse struct {
+	GetMetricsResponse
+
+	// Users by their kind
+	Guests     int `json:"guests"`
+	Players    int `json:"players"`
+	Moderators int `json:"moderators"`
+	Admins     int `json:"admins"`
+	Banned     int `json:"banned"`
+
+	StartedAt  time.Time `json:"startedAt"`
+	Uptime     int       `json:"uptime"`
+	Goroutines int       `json:"goroutines"`
+	HeapBytes  uint64    `json:"heapBytes"`
+}
+
+// APIGetAdminStats returns the statistics of the server
+func (sv *Server) APIGetAdminStats(w http.ResponseWriter, r *http.Request) {
+
+	if _, err := sv.authorize(r, RoleAdmin); err != nil {
+		returnAuthError(w, err)
+		return
+	}
+
+	metrics, users, err := sv.metrics()
+	if err != nil {
+		fmt.Println("APIGetAdminStats: " + err.Error())
+		returnJSONMessage(w, http.StatusInternalServerError, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: "Cannot read metrics",
+		})
+		return
+	}
+
+	stats := &GetAdminStatsResponse{
+		GetMetricsResponse: *metrics,
+		StartedAt:          sv.startedAt,
+		Uptime:             int(time.Since(sv.startedAt) / time.Second),
+		Goroutines:         runtime.NumGoroutine(),
+	}
+	for _, user := range users {
+		switch userRole(user) {
+		case RoleGuest:
+			stats.Guests++
+		case RolePlayer:
+			stats.Players++
+		case RoleModerator:
+			stats.Moderators++
+		case RoleAdmin:
+			stats.Admins++
+		}
+		if user.Banned {
+			stats.Banned++
+		}
+	}
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	stats.HeapBytes = mem.HeapAlloc
+
+	returnJSONMessage(w, http.StatusOK, stats)
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoles(t *testing.T) {
+
+	assert.Equal(t, []string{RoleGuest}, userRoles(User{}))
+	assert.Equal(t, []string{RolePlayer}, userRoles(User{Registered: true}))
+	assert.Equal(t, []string{RolePlayer, RoleModerator}, userRoles(User{Registered: true, Role: RoleModerator}))
+	assert.Equal(t, []string{RolePlayer, RoleModerator, RoleAdmin}, userRoles(User{Registered: true, Role: RoleAdmin}))
+
+	// a guest never gets a role above its own
+	assert.False(t, hasRole(User{Role: RoleAdmin}, RolePlayer))
+
+	// sessions and their events keep neither the role nor the ban of their players
+	s := NewSession("s1", User{Name: "root", UserID: "u1", Registered: true, Role: RoleAdmin})
+	s.Pair(User{Name: "bob", UserID: "u2", Registered: true, Banned: true})
+	assert.Equal(t, []User{{Name: "root", UserID: "u1", Registered: true}, {Name: "bob", UserID: "u2", Registered: true}}, s.Players)
+	for _, e := range s.pending {
+		assert.Equal(t, e.User.player(), *e.User)
+	}
+}
+
+func TestAdmin(t *testing.T) {
+
+	sv := NewServer(NewMemorySessionStore(), NewMemoryUserStore())
+	ts := httptest.NewServer(sv)
+	defer ts.Close()
+
+	root, _ := sv.Register("root", "correct horse")
+	mod, _ := sv.Register("mod", "correct horse")
+	alice, _ := sv.Register("alice", "correct horse")
+	bob, _ := sv.Register("bob", "correct horse")
+	assert.Nil(t, sv.GrantAdmin("root"))
+	assert.Equal(t, ErrAccountNotFound, sv.GrantAdmin("nobody"))
+
+	token := func(user User) string {
+		stored, _ := sv.Users.Get(user.UserID)
+		tokens, err := sv.IssueTokens(stored)
+		assert.Nil(t, err)
+		return tokens.AccessToken
+	}
+	get := func(path, token string, v interface{}) int {
+		req, _ := http.NewRequest("GET", ts.URL+path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		res, err := http.DefaultClient.Do(req)
+		if !assert.Nil(t, err) {
+			return 0
+		}
+		defer res.Body.Close()
+		if v != nil && res.StatusCode == http.StatusOK {
+			assert.Nil(t, json.NewDecoder(res.Body).Decode(v))
+		}
+		return res.StatusCode
+	}
+	post := func(path, token string, body string) int {
+		res, err := postWithToken(ts.URL+path, token, []byte(body))
+		if !assert.Nil(t, err) {
+			return 0
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	claims, _ := sv.Authenticate(token(root))
+	assert.True(t, claims.HasRole(RoleAdmin))
+
+	// only admins change roles
+	assert.Equal(t, http.StatusOK, post(APIAdmin+APIUser+"/"+mod.UserID+APIAdminUserRole, token(root), `{"role": "moderator"}`))
+	assert.Equal(t, http.StatusForbidden, post(APIAdmin+APIUser+"/"+alice.UserID+APIAdminUserRole, token(mod), `{"role": "moderator"}`))
+	assert.Equal(t, http.StatusBadRequest, post(APIAdmin+APIUser+"/"+alice.UserID+APIAdminUserRole, token(root), `{"role": "guest"}`))
+	assert.Equal(t, http.StatusNotFound, post(APIAdmin+APIUser+"/nobody"+APIAdminUserRole, token(root), `{"role": "player"}`))
+
+	// moderators list the live sessions
+	playing, _ := sv.JoinSession(alice, false)
+	sv.JoinSession(bob, false)
+	_, waiting, _ := sv.CreateSession("guest")
+
+	assert.Equal(t, http.StatusUnauthorized, get(APIAdmin+APIAdminSessions, "", nil))
+	assert.Equal(t, http.StatusForbidden, get(APIAdmin+APIAdminSessions, token(alice), nil))
+	var sessions GetAdminSessionsResponse
+	assert.Equal(t, http.StatusOK, get(APIAdmin+APIAdminSessions, token(mod), &sessions))
+	assert.Len(t, sessions.Sessions, 2)
+	assert.Equal(t, http.StatusOK, get(APIAdmin+APIAdminSessions+"?state=waiting", token(mod), &sessions))
+	if assert.Len(t, sessions.Sessions, 1) {
+		assert.Equal(t, waiting.SessionID, sessions.Sessions[0].SessionID)
+	}
+	assert.Equal(t, http.StatusBadRequest, get(APIAdmin+APIAdminSessions+"?state=over", token(mod), nil))
+
+	// and adjudicate or close them
+	adjudicate := APIAdmin + APISession + "/" + playing.SessionID + APIAdminSessionAdjudicate
+	assert.Equal(t, http.StatusForbidden, post(adjudicate, token(alice), `{"result": "white"}`))
+	assert.Equal(t, http.StatusBadRequest, post(adjudicate, token(mod), `{"result": "nobody"}`))
+	assert.Equal(t, http.StatusConflict, post(APIAdmin+APISession+"/"+waiting.SessionID+APIAdminSessionAdjudicate, token(mod), `{"result": "white"}`))
+	assert.Equal(t, http.StatusOK, post(adjudicate, token(mod), `{"result": "black"}`))
+	assert.Equal(t, http.StatusConflict, post(adjudicate, token(mod), `{"result": "white"}`))
+	game, err := sv.Games.Get(playing.SessionID)
+	if assert.Nil(t, err) {
+		assert.Equal(t, ResultBlack, game.Result)
+	}
+
+	assert.Equal(t, http.StatusOK, post(APIAdmin+APISession+"/"+waiting.SessionID+APIAdminSessionClose, token(mod), ""))
+	_, err = sv.Sessions.Get(waiting.SessionID)
+	assert.Equal(t, ErrSessionNotFound, err)
+	assert.Equal(t, http.StatusNotFound, post(APIAdmin+APISession+"/nothing"+APIAdminSessionClose, token(mod), ""))
+
+	// moderators ban the users below them
+	aliceToken := token(alice)
+	login, _ := sv.IssueTokens(alice)
+	assert.Equal(t, http.StatusForbidden, post(APIAdmin+APIUser+"/"+root.UserID+APIAdminUserBan, token(mod), ""))
+	assert.Equal(t, http.StatusOK, post(APIAdmin+APIUser+"/"+alice.UserID+APIAdminUserBan, token(mod), ""))
+
+	_, err = sv.Login("alice", "correct horse")
+	assert.Equal(t, ErrBanned, err)
+	_, _, err = sv.Refresh(login.RefreshToken)
+	assert.Equal(t, ErrUnauthorized, err)
+	_, err = sv.JoinSession(alice, false)
+	assert.Equal(t, ErrBanned, err)
+	assert.Equal(t, ErrBanned, sv.PlayMove(playing.SessionID, alice.UserID, 4, 2))
+
+	assert.Equal(t, http.StatusForbidden, post(APISession, aliceToken, ""))
+
+	assert.Equal(t, http.StatusOK, post(APIAdmin+APIUser+"/"+alice.UserID+APIAdminUserUnban, token(mod), ""))
+	_, err = sv.Login("alice", "correct horse")
+	assert.Nil(t, err)
+
+	// only admins see the statistics
+	assert.Equal(t, http.StatusForbidden, get(APIAdmin+APIAdminStats, token(mod), nil))
+	var stats GetAdminStatsResponse
+	assert.Equal(t, http.StatusOK, get(APIAdmin+APIAdminStats, token(root), &stats))
+	assert.Equal(t, "success", stats.Status)
+	assert.Equal(t, 1, stats.Admins)
+	assert.Equal(t, 1, stats.Moderators)
+	assert.Equal(t, 2, stats.Players)
+	assert.Equal(t, 1, stats.Guests)
+	assert.Equal(t, 0, stats.Banned)
+	assert.Equal(t, 1, stats.Games)
+	assert.Equal(t, 0, stats.PlayingSessions)
+	assert.False(t, stats.StartedAt.IsZero())
+
+	// a demoted admin loses the role before the access token expires
+	rootToken := token(root)
+	assert.Nil(t, sv.SetRole(root.UserID, RolePlayer))
+	assert.Equal(t, http.StatusForbidden, get(APIAdmin+APIAdminStats, rootToken, nil))
+}
@@ -2,10 +2,11 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 	"regexp"
+	"strconv"
 )
 
 const (
@@ -20,6 +21,30 @@ const (
 
 	// APISessionCand is an API endpoint that you get candidates for putting discs on the board
 	APISessionCand string = "/cand"
+
+	// APISessionEvents is an API endpoint that streams changes of the session as Server-Sent Events
+	APISessionEvents string = "/events"
+
+	// APISessionResign is an API endpoint that a player resigns the session by
+	APISessionResign string = "/resign"
+
+	// APISessionJournal is an API endpoint of the events of the session
+	APISessionJournal string = "/journal"
+
+	// APIGames is an API endpoint of the archive of finished games
+	APIGames string = "/games"
+
+	// APIGamesImport is an API endpoint that adds a game in a notation to the archive
+	APIGamesImport string = "/import"
+
+	// APISessionExport is an API endpoint of the session in a notation
+	APISessionExport string = "/export"
+
+	// APISessionPosition is an API endpoint of the position of the session
+	APISessionPosition string = "/position"
+
+	// APIAnalysis is an API endpoint that creates a session played by a single user from a position
+	APIAnalysis string = "/analysis"
 )
 
 // GeneralMessageResponse ...
@@ -34,11 +59,10 @@ type GetUserRequest struct {
 	Name   string `json:"name"`
 }
 
-// PostBoardRequest ...
+// PostBoardRequest is a move of the user of the access token
 type PostBoardRequest struct {
-	UserID string `json:"userID"`
-	PosX   int    `json:"posX"`
-	PosY   int    `json:"posY"`
+	PosX int `json:"posX"`
+	PosY int `json:"posY"`
 }
 
 // GetSessionInfoResponse ...
@@ -47,6 +71,12 @@ type GetSessionInfoResponse struct {
 	Username  string `json:"username"`
 	UserID    string `json:"userID"`
 	SessionID string `json:"sessionID"`
+
+	// Token is the access token of the user, sent as "Authorization: Bearer <token>"
+	// to act as the user for ExpiresIn seconds. RefreshToken gets a new one. They are issued only once
+	Token        string `json:"token,omitempty"`
+	RefreshToken string `json:"refreshToken,omitempty"`
+	ExpiresIn    int    `json:"expiresIn,omitempty"`
 }
 
 // GetBoardResponse ...
@@ -61,21 +91,82 @@ type GetCandidatesResponse struct {
 	Candidates [][]int `json:"candidates"`
 }
 
-// APIRoute ...
+// APIRoute routes a request to the handler of the default server
 func APIRoute(w http.ResponseWriter, r *http.Request) {
+	defaultServer.APIRoute(w, r)
+}
 
-	if r.Method == "POST" && r.RequestURI == APIUser {
-		APIPostUser(w, r)
-	} else if match, _ := regexp.Match(APIUser+"/[a-zA-Z0-9]+", []byte(r.RequestURI)); r.Method == "GET" && match {
-		APIGetUser(w, r)
-	} else if match, _ := regexp.Match(APISession+"/[a-zA-Z0-9]+"+APISessionBoard, []byte(r.RequestURI)); r.Method == "GET" && match {
-		APIGetBoard(w, r)
-	} else if match, _ := regexp.Match(APISession+"/[a-zA-Z0-9]+"+APISessionCand, []byte(r.RequestURI)); r.Method == "GET" && match {
-		APIGetCandidates(w, r)
-	} else if match, _ := regexp.Match(APISession+"/[a-zA-Z0-9]+", []byte(r.RequestURI)); r.Method == "POST" && match {
-		APIPostBoard(w, r)
-	} else if match, _ := regexp.Match(APISession+"/[a-zA-Z0-9]+", []byte(r.RequestURI)); r.Method == "GET" && match {
-		APIGetSession(w, r)
+// APIRoute ...
+func (sv *Server) APIRoute(w http.ResponseWriter, r *http.Request) {
+
+	path := r.URL.Path
+
+	if r.Method == "POST" && path == APIUser {
+		sv.APIPostUser(w, r)
+	} else if r.Method == "POST" && path == APIAccount {
+		sv.APIPostAccount(w, r)
+	} else if r.Method == "POST" && path == APILogin {
+		sv.APIPostLogin(w, r)
+	} else if r.Method == "POST" && path == APILogout {
+		sv.APIPostLogout(w, r)
+	} else if r.Method == "POST" && path == APIRefresh {
+		sv.APIPostRefresh(w, r)
+	} else if r.Method == "POST" && path == APISession {
+		sv.APIPostSession(w, r)
+	} else if match, _ := regexp.MatchString("^"+APIUser+"/[a-zA-Z0-9]+$", path); r.Method == "GET" && match {
+		sv.APIGetUser(w, r)
+	} else if match, _ := regexp.MatchString("^"+APISession+"/[a-zA-Z0-9]+("+regexp.QuoteMeta(APISessionBoardSVG)+"|"+regexp.QuoteMeta(APISessionBoardPNG)+")$", path); r.Method == "GET" && match {
+		sv.APIGetBoardImage(w, r)
+	} else if match, _ := regexp.MatchString("^"+APISession+"/[a-zA-Z0-9]+"+regexp.QuoteMeta(APISessionReplay)+"$", path); r.Method == "GET" && match {
+		sv.APIGetReplay(w, r)
+	} else if match, _ := regexp.MatchString("^"+APISession+"/[a-zA-Z0-9]+"+APISessionBoard+"$", path); r.Method == "GET" && match {
+		sv.APIGetBoard(w, r)
+	} else if match, _ := regexp.MatchString("^"+APISession+"/[a-zA-Z0-9]+"+APISessionCand+"$", path); r.Method == "GET" && match {
+		sv.APIGetCandidates(w, r)
+	} else if match, _ := regexp.MatchString("^"+APISession+"/[a-zA-Z0-9]+"+APISessionEvents+"$", path); r.Method == "GET" && match {
+		sv.APIGetSessionEvents(w, r)
+	} else if r.Method == "GET" && path == APIAdmin+APIAdminSessions {
+		sv.APIGetAdminSessions(w, r)
+	} else if r.Method == "GET" && path == APIAdmin+APIAdminStats {
+		sv.APIGetAdminStats(w, r)
+	} else if match, _ := regexp.MatchString("^"+APIAdmin+APISession+"/[a-zA-Z0-9]+("+APIAdminSessionClose+"|"+APIAdminSessionAdjudicate+")$", path); r.Method == "POST" && match {
+		sv.APIPostAdminSession(w, r)
+	} else if match, _ := regexp.MatchString("^"+APIAdmin+APIUser+"/[a-zA-Z0-9]+("+APIAdminUserBan+"|"+APIAdminUserUnban+"|"+APIAdminUserRole+")$", path); r.Method == "POST" && match {
+		sv.APIPostAdminUser(w, r)
+	} else if r.Method == "GET" && path == APIFriends {
+		sv.APIGetFriends(w, r)
+	} else if match, _ := regexp.MatchString("^"+APIFriends+"/[a-zA-Z0-9]+("+APIFriendsRequest+"|"+APIFriendsAccept+"|"+APIFriendsRemove+"|"+APIFriendsBlock+"|"+APIFriendsUnblock+")$", path); r.Method == "POST" && match {
+		sv.APIPostFriend(w, r)
+	} else if r.Method == "GET" && path == APIOIDC+APIOIDCLogin {
+		sv.APIGetOIDCLogin(w, r)
+	} else if r.Method == "POST" && path == APIOIDC+APIOIDCLink {
+		sv.APIPostOIDCLink(w, r)
+	} else if r.Method == "GET" && path == APIOIDC+APIOIDCCallback {
+		sv.APIGetOIDCCallback(w, r)
+	} else if r.Method == "GET" && path == APIMetrics {
+		sv.APIGetMetrics(w, r)
+	} else if r.Method == "POST" && path == APIAnalysis {
+		sv.APIPostAnalysis(w, r)
+	} else if r.Method == "POST" && path == APIGames+APIGamesImport {
+		sv.APIPostImport(w, r)
+	} else if match, _ := regexp.MatchString("^"+APILeaderboard+"(/[a-z]+)?$", path); r.Method == "GET" && match {
+		sv.APIGetLeaderboard(w, r)
+	} else if r.Method == "GET" && path == APIGames {
+		sv.APIGetGames(w, r)
+	} else if match, _ := regexp.MatchString("^"+APIGames+"/[a-zA-Z0-9]+$", path); r.Method == "GET" && match {
+		sv.APIGetGame(w, r)
+	} else if match, _ := regexp.MatchString("^"+APISession+"/[a-zA-Z0-9]+"+APISessionPosition+"$", path); r.Method == "GET" && match {
+		sv.APIGetPosition(w, r)
+	} else if match, _ := regexp.MatchString("^"+APISession+"/[a-zA-Z0-9]+"+APISessionExport+"$", path); r.Method == "GET" && match {
+		sv.APIGetExport(w, r)
+	} else if match, _ := regexp.MatchString("^"+APISession+"/[a-zA-Z0-9]+"+APISessionJournal+"$", path); r.Method == "GET" && match {
+		sv.APIGetJournal(w, r)
+	} else if match, _ := regexp.MatchString("^"+APISession+"/[a-zA-Z0-9]+"+APISessionResign+"$", path); r.Method == "POST" && match {
+		sv.APIPostResign(w, r)
+	} else if match, _ := regexp.MatchString("^"+APISession+"/[a-zA-Z0-9]+$", path); r.Method == "POST" && match {
+		sv.APIPostBoard(w, r)
+	} else if match, _ := regexp.MatchString("^"+APISession+"/[a-zA-Z0-9]+$", path); r.Method == "GET" && match {
+		sv.APIGetSession(w, r)
 	} else {
 		returnJSONMessage(w, http.StatusInternalServerError, &GeneralMessageResponse{
 			Status:      "fail",
@@ -86,20 +177,16 @@ func APIRoute(w http.ResponseWriter, r *http.Request) {
 }
 
 // APIPostUser ...
-func APIPostUser(w http.ResponseWriter, r *http.Request) {
+func (sv *Server) APIPostUser(w http.ResponseWriter, r *http.Request) {
 
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		returnJSONMessage(w, http.StatusInternalServerError, &GeneralMessageResponse{
-			Status:      "fail",
-			Description: "Cannot read body",
-		})
+	body, ok := readBody(w, r)
+	if !ok {
 		return
 	}
 
 	var reqBody GetUserRequest
 	fmt.Println(string(body))
-	err = json.Unmarshal(body, &reqBody)
+	err := json.Unmarshal(body, &reqBody)
 	if err != nil {
 		returnJSONMessage(w, http.StatusInternalServerError, &GeneralMessageResponse{
 			Status:      "fail",
@@ -109,38 +196,40 @@ func APIPostUser(w http.ResponseWriter, r *http.Request) {
 	}
 
 	username := reqBody.Name
-	userID, sessionID := CreateSession(username)
-
-	returnJSONMessage(w, http.StatusOK, &GetSessionInfoResponse{
-		Status:    "success",
-		Username:  username,
-		UserID:    userID,
-		SessionID: sessionID,
-	})
-
-}
-
-// APIGetUser ...
-func APIGetUser(w http.ResponseWriter, r *http.Request) {
+	user, session, err := sv.CreateSession(username)
+	if err != nil {
+		fmt.Println("APIPostUser: " + err.Error())
+		returnJSONMessage(w, http.StatusInternalServerError, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: "Cannot create a session",
+		})
+		return
+	}
 
-	re := regexp.MustCompile(APIUser + "/([a-zA-Z0-9]+)")
-	userIDMatch := re.FindStringSubmatch(r.URL.Path)
-	if len(userIDMatch) < 2 {
+	tokens, err := sv.IssueTokens(user)
+	if err != nil {
+		fmt.Println("APIPostUser: " + err.Error())
 		returnJSONMessage(w, http.StatusInternalServerError, &GeneralMessageResponse{
 			Status:      "fail",
-			Description: "Invalid username",
+			Description: "Cannot issue a token",
 		})
 		return
 	}
 
-	userID := userIDMatch[1]
-	user := GetUser(userID)
-	returnJSONMessage(w, http.StatusOK, user)
+	returnJSONMessage(w, http.StatusOK, &GetSessionInfoResponse{
+		Status:       "success",
+		Username:     username,
+		UserID:       user.UserID,
+		SessionID:    session.SessionID,
+		Token:        tokens.AccessToken,
+		RefreshToken: tokens.RefreshToken,
+		ExpiresIn:    tokens.ExpiresIn,
+	})
 
 }
 
 // APIGetSession ...
-func APIGetSession(w http.ResponseWriter, r *http.Request) {
+func (sv *Server) APIGetSession(w http.ResponseWriter, r *http.Request) {
 
 	re := regexp.MustCompile(APISession + "/([a-zA-Z0-9]+)")
 	sessionIDMatch := re.FindStringSubmatch(r.URL.Path)
@@ -153,13 +242,35 @@ func APIGetSession(w http.ResponseWriter, r *http.Request) {
 	}
 
 	sessionID := sessionIDMatch[1]
-	session := GetSessionInfo(sessionID)
+
+	// long polling: wait until the session advances past the given turn
+	if since := r.URL.Query().Get("since"); since != "" {
+		elapsedTurn, err := strconv.Atoi(since)
+		if err != nil {
+			returnJSONMessage(w, http.StatusBadRequest, &GeneralMessageResponse{
+				Status:      "fail",
+				Description: "Invalid since",
+			})
+			return
+		}
+		sv.waitSessionAdvance(w, r, sessionID, elapsedTurn)
+		return
+	}
+
+	session, err := sv.GetSessionInfo(sessionID)
+	if err != nil {
+		returnSessionError(w, err)
+		return
+	}
+	if checkNotModified(w, r, session) {
+		return
+	}
 	returnJSONMessage(w, http.StatusOK, session)
 
 }
 
 // APIGetBoard ...
-func APIGetBoard(w http.ResponseWriter, r *http.Request) {
+func (sv *Server) APIGetBoard(w http.ResponseWriter, r *http.Request) {
 
 	re := regexp.MustCompile(APISession + "/([a-zA-Z0-9]+)" + APISessionBoard)
 	sessionIDMatch := re.FindStringSubmatch(r.URL.Path)
@@ -172,16 +283,24 @@ func APIGetBoard(w http.ResponseWriter, r *http.Request) {
 	}
 
 	sessionID := sessionIDMatch[1]
-	board := GetBoard(sessionID)
+	session, err := sv.GetSessionInfo(sessionID)
+	if err != nil {
+		returnSessionError(w, err)
+		return
+	}
+	if checkNotModified(w, r, session) {
+		return
+	}
+
 	returnJSONMessage(w, http.StatusOK, &GetBoardResponse{
 		Status: "success",
-		Board:  board,
+		Board:  session.Board,
 	})
 
 }
 
 // APIGetCandidates ...
-func APIGetCandidates(w http.ResponseWriter, r *http.Request) {
+func (sv *Server) APIGetCandidates(w http.ResponseWriter, r *http.Request) {
 
 	re := regexp.MustCompile(APISession + "/([a-zA-Z0-9]+)" + APISessionCand)
 	sessionIDMatch := re.FindStringSubmatch(r.URL.Path)
@@ -194,8 +313,17 @@ func APIGetCandidates(w http.ResponseWriter, r *http.Request) {
 	}
 
 	sessionID := sessionIDMatch[1]
-	session := GetSessionInfo(sessionID)
-	cand := FindCandidates(sessionID, session.Turn)
+	session, err := sv.GetSessionInfo(sessionID)
+	if err != nil {
+		returnSessionError(w, err)
+		return
+	}
+	if checkNotModified(w, r, session) {
+		return
+	}
+
+	// the copy is private to this request, so no lock is needed
+	cand := findCandidates(session, session.Turn)
 	returnJSONMessage(w, http.StatusOK, &GetCandidatesResponse{
 		Status:     "success",
 		Candidates: cand,
@@ -203,8 +331,8 @@ func APIGetCandidates(w http.ResponseWriter, r *http.Request) {
 
 }
 
-// APIPostBoard ...
-func APIPostBoard(w http.ResponseWriter, r *http.Request) {
+// APIPostBoard puts a disc of the user of the access token
+func (sv *Server) APIPostBoard(w http.ResponseWriter, r *http.Request) {
 
 	re := regexp.MustCompile(APISession + "/([a-zA-Z0-9]+)")
 	sessionIDMatch := re.FindStringSubmatch(r.URL.Path)
@@ -216,12 +344,14 @@ func APIPostBoard(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	body, err := ioutil.ReadAll(r.Body)
+	user, err := sv.authenticate(r)
 	if err != nil {
-		returnJSONMessage(w, http.StatusInternalServerError, &GeneralMessageResponse{
-			Status:      "fail",
-			Description: "Cannot read body",
-		})
+		returnAuthError(w, err)
+		return
+	}
+
+	body, ok := readBody(w, r)
+	if !ok {
 		return
 	}
 
@@ -237,42 +367,402 @@ func APIPostBoard(w http.ResponseWriter, r *http.Request) {
 	}
 
 	sessionID := sessionIDMatch[1]
-	session := GetSessionInfo(sessionID)
-	if session.State < StateEstablished {
+	err = sv.PlayMove(sessionID, user.UserID, reqBody.PosX, reqBody.PosY)
+	switch err {
+	case nil:
+	case ErrBanned:
+		returnAuthError(w, err)
+		return
+	case ErrSessionNotStarted, ErrNotYourTurn, ErrCannotPut, ErrGameFinished:
 		returnJSONMessage(w, http.StatusOK, &GeneralMessageResponse{
 			Status:      "success",
-			Description: "Session does not start yet",
+			Description: err.Error(),
 		})
 		return
+	default:
+		returnSessionError(w, err)
+		return
 	}
 
-	user := GetUser(reqBody.UserID)
-	if user.UserID != session.Players[session.Turn-1].UserID {
-		returnJSONMessage(w, http.StatusOK, &GeneralMessageResponse{
-			Status:      "success",
-			Description: "Not your turn",
+	session, err := sv.GetSessionInfo(sessionID)
+	if err != nil {
+		returnSessionError(w, err)
+		return
+	}
+	returnJSONMessage(w, http.StatusOK, session.Board)
+}
+
+// APIPostResign resigns the session for the user of the access token
+func (sv *Server) APIPostResign(w http.ResponseWriter, r *http.Request) {
+
+	re := regexp.MustCompile(APISession + "/([a-zA-Z0-9]+)" + APISessionResign)
+	sessionIDMatch := re.FindStringSubmatch(r.URL.Path)
+	if len(sessionIDMatch) < 2 {
+		returnJSONMessage(w, http.StatusInternalServerError, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: "Invalid session",
 		})
 		return
 	}
 
-	if ret := PutDisc(sessionID, session.Turn, reqBody.PosX, reqBody.PosY); ret != 0 {
+	user, err := sv.authenticate(r)
+	if err != nil {
+		returnAuthError(w, err)
+		return
+	}
+
+	sessionID := sessionIDMatch[1]
+	err = sv.Resign(sessionID, user.UserID)
+	switch err {
+	case nil:
+	case ErrSessionNotStarted, ErrNotYourTurn, ErrNotPlayer, ErrGameFinished:
 		returnJSONMessage(w, http.StatusOK, &GeneralMessageResponse{
 			Status:      "success",
-			Description: "Cannot put a disc",
+			Description: err.Error(),
+		})
+		return
+	default:
+		returnSessionError(w, err)
+		return
+	}
+
+	session, err := sv.GetSessionInfo(sessionID)
+	if err != nil {
+		returnSessionError(w, err)
+		return
+	}
+	returnJSONMessage(w, http.StatusOK, session)
+}
+
+// APIGetJournal returns the events of the session, or the session restored
+// right after the event given by ?seq=N
+func (sv *Server) APIGetJournal(w http.ResponseWriter, r *http.Request) {
+
+	re := regexp.MustCompile(APISession + "/([a-zA-Z0-9]+)" + APISessionJournal)
+	sessionIDMatch := re.FindStringSubmatch(r.URL.Path)
+	if len(sessionIDMatch) < 2 {
+		returnJSONMessage(w, http.StatusInternalServerError, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: "Invalid session",
+		})
+		return
+	}
+
+	j, err := sv.journal()
+	if err != nil {
+		returnJSONMessage(w, http.StatusNotFound, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: err.Error(),
+		})
+		return
+	}
+
+	sessionID := sessionIDMatch[1]
+	if q := r.URL.Query().Get("seq"); q != "" {
+		seq, err := strconv.Atoi(q)
+		if err != nil || seq <= 0 {
+			returnJSONMessage(w, http.StatusBadRequest, &GeneralMessageResponse{
+				Status:      "fail",
+				Description: "Invalid seq",
+			})
+			return
+		}
+		session, err := j.Restore(sessionID, seq)
+		if err != nil {
+			returnSessionError(w, err)
+			return
+		}
+		returnJSONMessage(w, http.StatusOK, session)
+		return
+	}
+
+	events, err := j.Events(sessionID)
+	if err != nil {
+		returnSessionError(w, err)
+		return
+	}
+	returnJSONMessage(w, http.StatusOK, events)
+}
+
+// GetGamesResponse ...
+type GetGamesResponse struct {
+	Status string        `json:"status"`
+	Total  int           `json:"total"`
+	Offset int           `json:"offset"`
+	Limit  int           `json:"limit"`
+	Games  []*GameRecord `json:"games"`
+}
+
+// APIGetGames searches the archive by player, from, to, result, opening and
+// min_length, sorted by sort and paged by offset and limit
+func (sv *Server) APIGetGames(w http.ResponseWriter, r *http.Request) {
+
+	q, err := parseGameQuery(r.URL.Query())
+	if err != nil {
+		returnJSONMessage(w, http.StatusBadRequest, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: err.Error(),
+		})
+		return
+	}
+
+	games, total, err := sv.Games.Search(q)
+	if err != nil {
+		fmt.Println("APIGetGames: " + err.Error())
+		returnJSONMessage(w, http.StatusInternalServerError, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: "Cannot search games",
+		})
+		return
+	}
+
+	returnJSONMessage(w, http.StatusOK, &GetGamesResponse{
+		Status: "success",
+		Total:  total,
+		Offset: q.Offset,
+		Limit:  q.Limit,
+		Games:  games,
+	})
+}
+
+// APIGetGame ...
+func (sv *Server) APIGetGame(w http.ResponseWriter, r *http.Request) {
+
+	re := regexp.MustCompile(APIGames + "/([a-zA-Z0-9]+)")
+	gameIDMatch := re.FindStringSubmatch(r.URL.Path)
+	if len(gameIDMatch) < 2 {
+		returnJSONMessage(w, http.StatusInternalServerError, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: "Invalid game",
+		})
+		return
+	}
+
+	game, err := sv.Games.Get(gameIDMatch[1])
+	switch err {
+	case nil:
+	case ErrGameNotFound:
+		returnJSONMessage(w, http.StatusNotFound, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: "Invalid game",
+		})
+		return
+	default:
+		fmt.Println("APIGetGame: " + err.Error())
+		returnJSONMessage(w, http.StatusInternalServerError, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: "Cannot access the game",
+		})
+		return
+	}
+	returnJSONMessage(w, http.StatusOK, game)
+}
+
+// APIGetExport returns the session as text in the format given by ?format=transcript or ggf
+func (sv *Server) APIGetExport(w http.ResponseWriter, r *http.Request) {
+
+	re := regexp.MustCompile(APISession + "/([a-zA-Z0-9]+)" + APISessionExport)
+	sessionIDMatch := re.FindStringSubmatch(r.URL.Path)
+	if len(sessionIDMatch) < 2 {
+		returnJSONMessage(w, http.StatusInternalServerError, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: "Invalid session",
+		})
+		return
+	}
+
+	session, err := sv.GetSessionInfo(sessionIDMatch[1])
+	if err != nil {
+		returnSessionError(w, err)
+		return
+	}
+
+	var text string
+	switch r.URL.Query().Get("format") {
+	case "", FormatTranscript:
+		text = transcript(session.MoveLog)
+	case FormatGGF:
+		text = ExportGGF(session)
+	default:
+		returnJSONMessage(w, http.StatusBadRequest, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: "Invalid format",
 		})
 		return
 	}
 
-	fmt.Println("API: call UpdateSessionState")
-	// update board
-	UpdateSessionState(sessionID, session.Turn, reqBody.PosX, reqBody.PosY)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, text)
+}
 
-	board := GetBoard(sessionID)
-	returnJSONMessage(w, http.StatusOK, board)
+// GetPositionResponse ...
+type GetPositionResponse struct {
+	Status   string `json:"status"`
+	Position string `json:"position"`
+}
+
+// APIGetPosition ...
+func (sv *Server) APIGetPosition(w http.ResponseWriter, r *http.Request) {
+
+	re := regexp.MustCompile(APISession + "/([a-zA-Z0-9]+)" + APISessionPosition)
+	sessionIDMatch := re.FindStringSubmatch(r.URL.Path)
+	if len(sessionIDMatch) < 2 {
+		returnJSONMessage(w, http.StatusInternalServerError, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: "Invalid session",
+		})
+		return
+	}
+
+	session, err := sv.GetSessionInfo(sessionIDMatch[1])
+	if err != nil {
+		returnSessionError(w, err)
+		return
+	}
+	if checkNotModified(w, r, session) {
+		return
+	}
+
+	returnJSONMessage(w, http.StatusOK, &GetPositionResponse{
+		Status:   "success",
+		Position: FormatPosition(session.Board, session.Turn),
+	})
+}
+
+// PostAnalysisRequest ...
+type PostAnalysisRequest struct {
+	Name     string `json:"name"`
+	Position string `json:"position"`
+}
+
+// APIPostAnalysis creates a session played by a single user from a position
+func (sv *Server) APIPostAnalysis(w http.ResponseWriter, r *http.Request) {
+
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+
+	var reqBody PostAnalysisRequest
+	if err := json.Unmarshal(body, &reqBody); err != nil {
+		returnJSONMessage(w, http.StatusInternalServerError, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: "Cannot parse to json",
+		})
+		return
+	}
+
+	user, session, err := sv.CreateAnalysisSession(reqBody.Name, reqBody.Position)
+	if errors.Is(err, ErrInvalidPosition) {
+		returnJSONMessage(w, http.StatusBadRequest, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		fmt.Println("APIPostAnalysis: " + err.Error())
+		returnJSONMessage(w, http.StatusInternalServerError, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: "Cannot create a session",
+		})
+		return
+	}
+
+	tokens, err := sv.IssueTokens(user)
+	if err != nil {
+		fmt.Println("APIPostAnalysis: " + err.Error())
+		returnJSONMessage(w, http.StatusInternalServerError, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: "Cannot issue a token",
+		})
+		return
+	}
+
+	returnJSONMessage(w, http.StatusOK, &GetSessionInfoResponse{
+		Status:       "success",
+		Username:     user.Name,
+		UserID:       user.UserID,
+		SessionID:    session.SessionID,
+		Token:        tokens.AccessToken,
+		RefreshToken: tokens.RefreshToken,
+		ExpiresIn:    tokens.ExpiresIn,
+	})
+}
+
+// PostImportRequest ...
+type PostImportRequest struct {
+	Format string `json:"format"`
+	Data   string `json:"data"`
+}
+
+// APIPostImport adds a game in a notation to the archive and returns its record
+func (sv *Server) APIPostImport(w http.ResponseWriter, r *http.Request) {
+
+	if _, err := sv.authenticate(r); err != nil {
+		returnAuthError(w, err)
+		return
+	}
+
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+
+	var reqBody PostImportRequest
+	if err := json.Unmarshal(body, &reqBody); err != nil {
+		returnJSONMessage(w, http.StatusInternalServerError, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: "Cannot parse to json",
+		})
+		return
+	}
+
+	game, err := sv.ImportGame(reqBody.Format, reqBody.Data)
+	if errors.Is(err, ErrInvalidNotation) {
+		returnJSONMessage(w, http.StatusBadRequest, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		fmt.Println("APIPostImport: " + err.Error())
+		returnJSONMessage(w, http.StatusInternalServerError, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: "Cannot import the game",
+		})
+		return
+	}
+	returnJSONMessage(w, http.StatusOK, game)
+}
+
+// returnSessionError replies an error of reading or changing a session
+func returnSessionError(w http.ResponseWriter, err error) {
+
+	if err == ErrSessionNotFound {
+		returnJSONMessage(w, http.StatusNotFound, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: "Invalid session",
+		})
+		return
+	}
+
+	fmt.Println("returnSessionError: " + err.Error())
+	returnJSONMessage(w, http.StatusInternalServerError, &GeneralMessageResponse{
+		Status:      "fail",
+		Description: "Cannot access the session",
+	})
 }
 
 func returnJSONMessage(w http.ResponseWriter, returnCode int, res interface{}) {
 
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if w.Header().Get("Cache-Control") == "" {
+		// clients have to revalidate with ETag since the game goes on
+		w.Header().Set("Cache-Control", "no-cache")
+	}
 	w.WriteHeader(returnCode)
 	resJSON, err := json.Marshal(res)
 	if err != nil {
@@ -281,6 +771,9 @@ func returnJSONMessage(w http.ResponseWriter, returnCode int, res interface{}) {
 		return
 	}
 	w.Write(resJSON)
+	if rd, ok := res.(redactor); ok {
+		resJSON, _ = json.Marshal(rd.redacted())
+	}
 	fmt.Println(string(resJSON))
 
 }
@@ -14,10 +14,18 @@ import (
 
 type FakeHTTPResponseWriter struct {
 	http.ResponseWriter
+	FakeHeader      http.Header
 	FakeWriteHeader func(statusCode int)
 	FakeWrite       func(stream []byte) (int, error)
 }
 
+func (f *FakeHTTPResponseWriter) Header() http.Header {
+	if f.FakeHeader == nil {
+		f.FakeHeader = make(http.Header)
+	}
+	return f.FakeHeader
+}
+
 func (f *FakeHTTPResponseWriter) WriteHeader(statusCode int) {
 	f.FakeWriteHeader(statusCode)
 }
@@ -0,0 +1,432 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ResultWhite is the result of a game won by white
+	ResultWhite string = "white"
+
+	// ResultBlack is the result of a game won by black
+	ResultBlack string = "black"
+
+	// ResultDraw is the result of a game with as many white discs as black ones
+	ResultDraw string = "draw"
+
+	// ResultNone is the result of a game closed without a winner
+	ResultNone string = "none"
+)
+
+const (
+	// DefaultGamesLimit is the number of games in a page when the query does not tell
+	DefaultGamesLimit int = 20
+
+	// MaxGamesLimit is the upper bound of the number of games in a page
+	MaxGamesLimit int = 100
+)
+
+// ErrGameNotFound is returned when the game is not in the archive
+var ErrGameNotFound = errors.New("Invalid game")
+
+// GameRecord is a finished game kept in the archive
+type GameRecord struct {
+	GameID     string    `json:"gameID"`
+	White      User      `json:"white"`
+	Black      User      `json:"black"`
+	Result     string    `json:"result"`
+	WhiteDiscs int       `json:"whiteDiscs"`
+	BlackDiscs int       `json:"blackDiscs"`
+	Length     int       `json:"length"`
+	Moves      string    `json:"moves"`
+	FinishedAt time.Time `json:"finishedAt"`
+
+	// StartPosition is the position the game started from, if it is not the initial one
+	StartPosition string `json:"startPosition,omitempty"`
+
+	// Rated is true for a game which changed the ratings of the players
+	Rated bool `json:"rated,omitempty"`
+
+	// Counted is true once the game is counted in the profiles, the ratings and the leaderboards
+	Counted bool `json:"counted,omitempty"`
+
+	// Session is the session as it finished. Search results leave it out
+	Session *Session `json:"session,omitempty"`
+}
+
+// NewGameRecord returns the record of the finished session
+func NewGameRecord(s *Session) *GameRecord {
+
+	game := &GameRecord{
+		GameID:     s.SessionID,
+		Result:     ResultNone,
+		Length:     len(s.MoveLog),
+		Moves:      transcript(s.MoveLog),
+		FinishedAt: s.UpdatedAt,
+		Session:    s.Clone(),
+
+		StartPosition: s.StartPosition,
+		Rated:         s.Rated,
+	}
+	if len(s.Players) > 0 {
+		game.White = s.Players[0]
+	}
+	if len(s.Players) > 1 {
+		game.Black = s.Players[1]
+	}
+	game.WhiteDiscs, game.BlackDiscs = CountDiscs(s.Board)
+
+	switch s.State {
+	case StateWonWhite:
+		game.Result = ResultWhite
+	case StateWonBlack:
+		game.Result = ResultBlack
+	case StateDraw:
+		game.Result = ResultDraw
+	}
+	return game
+}
+
+// summary returns the record without the session
+func (game *GameRecord) summary() *GameRecord {
+	c := *game
+	c.Session = nil
+	return &c
+}
+
+// GameQuery selects games from the archive. Zero values do not filter
+type GameQuery struct {
+	// Player matches the user ID or the name of either player
+	Player string
+
+	// From and To bound the time the game finished: From <= FinishedAt < To
+	From time.Time
+	To   time.Time
+
+	Result string
+
+	// Opening is a prefix of the moves, like "f5d6"
+	Opening string
+
+	MinLength int
+
+	// Sort is "finished" or "length", ascending, or descending with a "-" prefix
+	Sort string
+
+	Offset int
+	Limit  int
+}
+
+// match returns whether the game is selected by the query, ignoring the pagination
+func (q *GameQuery) match(game *GameRecord) bool {
+
+	if q.Player != "" && q.Player != game.White.UserID && q.Player != game.White.Name &&
+		q.Player != game.Black.UserID && q.Player != game.Black.Name {
+		return false
+	}
+	if !q.From.IsZero() && game.FinishedAt.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && !game.FinishedAt.Before(q.To) {
+		return false
+	}
+	if q.Result != "" && q.Result != game.Result {
+		return false
+	}
+	if !strings.HasPrefix(game.Moves, q.Opening) {
+		return false
+	}
+	return game.Length >= q.MinLength
+}
+
+// GameArchive keeps finished games. Implementations must be safe for concurrent use
+type GameArchive interface {
+	// Put adds or replaces the game
+	Put(game *GameRecord) error
+
+	// Get returns the game, or ErrGameNotFound
+	Get(gameID string) (*GameRecord, error)
+
+	// Search returns a page of the games selected by the query without their
+	// sessions, and the number of all selected games
+	Search(q *GameQuery) ([]*GameRecord, int, error)
+
+	// Played returns which of the users played an archived game
+	Played(userIDs []string) (map[string]bool, error)
+}
+
+// MemoryArchive keeps games in memory
+type MemoryArchive struct {
+	mu    sync.RWMutex
+	games map[string]*GameRecord
+
+	// save lets a durable archive write a game through before it is committed
+	save func(*GameRecord) error
+}
+
+// NewMemoryArchive returns an empty MemoryArchive
+func NewMemoryArchive() *MemoryArchive {
+	return &MemoryArchive{games: make(map[string]*GameRecord)}
+}
+
+// Put ...
+func (a *MemoryArchive) Put(game *GameRecord) error {
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.save != nil {
+		if err := a.save(game); err != nil {
+			return err
+		}
+	}
+	a.games[game.GameID] = game
+	return nil
+}
+
+// Get ...
+func (a *MemoryArchive) Get(gameID string) (*GameRecord, error) {
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	game, ok := a.games[gameID]
+	if !ok {
+		return nil, ErrGameNotFound
+	}
+	c := *game
+	c.Session = game.Session.Clone()
+	return &c, nil
+}
+
+// Search ...
+func (a *MemoryArchive) Search(q *GameQuery) ([]*GameRecord, int, error) {
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	games := make([]*GameRecord, 0)
+	for _, game := range a.games {
+		if q.match(game) {
+			games = append(games, game.summary())
+		}
+	}
+
+	less := func(i, j int) bool {
+		if !games[i].FinishedAt.Equal(games[j].FinishedAt) {
+			return games[i].FinishedAt.Before(games[j].FinishedAt)
+		}
+		return games[i].GameID < games[j].GameID
+	}
+	if strings.TrimPrefix(q.Sort, "-") == "length" {
+		less = func(i, j int) bool {
+			if games[i].Length != games[j].Length {
+				return games[i].Length < games[j].Length
+			}
+			return games[i].GameID < games[j].GameID
+		}
+	}
+	if strings.HasPrefix(q.Sort, "-") {
+		sort.Slice(games, func(i, j int) bool { return less(j, i) })
+	} else {
+		sort.Slice(games, less)
+	}
+
+	total := len(games)
+	if q.Offset >= total {
+		return []*GameRecord{}, total, nil
+	}
+	games = games[q.Offset:]
+	if q.Limit > 0 && q.Limit < len(games) {
+		games = games[:q.Limit]
+	}
+	return games, total, nil
+}
+
+// Played ...
+func (a *MemoryArchive) Played(userIDs []string) (map[string]bool, error) {
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	wanted := make(map[string]bool, len(userIDs))
+	for _, id := range userIDs {
+		wanted[id] = true
+	}
+	played := make(map[string]bool)
+	for _, game := range a.games {
+		for _, id := range []string{game.White.UserID, game.Black.UserID} {
+			if wanted[id] {
+				played[id] = true
+			}
+		}
+	}
+	return played, nil
+}
+
+// NewFileArchive returns an archive which keeps every game as a JSON file under dir/games
+func NewFileArchive(dir string) (*MemoryArchive, error) {
+
+	dir = filepath.Join(dir, "games")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	a := NewMemoryArchive()
+	err := readJSONFiles(dir, func(data []byte) error {
+		game := new(GameRecord)
+		if err := json.Unmarshal(data, game); err != nil {
+			return err
+		}
+		a.games[game.GameID] = game
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	a.save = func(game *GameRecord) error {
+		return writeJSONFile(filepath.Join(dir, game.GameID+".json"), game)
+	}
+	return a, nil
+}
+
+// archiveFinished moves the session to the archive once it is finished.
+// A session closed before pairing is not a game, so it is only removed.
+// Every step may be run again after a failure: the game is put in the archive first,
+// counted unless it is marked Counted, and the session is removed last. The janitor
+// archives again the finished sessions a failure left in the live store
+func (sv *Server) archiveFinished(sessionID string) error {
+
+	// a second finisher waits, and finds the session removed
+	sv.archiving.Lock()
+	defer sv.archiving.Unlock()
+
+	s, err := sv.Sessions.Get(sessionID)
+	if err == ErrSessionNotFound {
+		return nil
+	}
+	if err != nil || !IsSessionFinished(s) {
+		return err
+	}
+
+	if len(s.Players) > 1 {
+		game, err := sv.Games.Get(sessionID)
+		if err == ErrGameNotFound {
+			game = NewGameRecord(s)
+			err = sv.Games.Put(game)
+		}
+		if err != nil {
+			return err
+		}
+		// a single user plays both sides of an analysis session, which is no game against anyone
+		if !game.Counted && !s.IsAnalysis() {
+			if err := sv.countGame(game); err != nil {
+				return err
+			}
+		}
+	}
+	return sv.Sessions.Delete(sessionID)
+}
+
+// countGame counts the archived game in the profiles, the ratings and the leaderboards
+// of its players, which skip a game counted already, and marks it Counted
+func (sv *Server) countGame(game *GameRecord) error {
+
+	if err := sv.recordGame(game); err != nil {
+		return err
+	}
+	if err := sv.rateGame(game); err != nil {
+		return err
+	}
+	if err := sv.rankGame(game); err != nil {
+		return err
+	}
+	game.Counted = true
+	return sv.Games.Put(game)
+}
+
+// parseGameQuery reads a GameQuery from the query string of GET /games.
+// Dates are RFC 3339 or YYYY-MM-DD, in which case to includes the whole day
+func parseGameQuery(v url.Values) (*GameQuery, error) {
+
+	q := &GameQuery{
+		Player:  v.Get("player"),
+		Result:  v.Get("result"),
+		Opening: strings.ToLower(v.Get("opening")),
+		Sort:    v.Get("sort"),
+		Limit:   DefaultGamesLimit,
+	}
+
+	var err error
+	if q.From, err = parseQueryTime(v.Get("from"), false); err != nil {
+		return nil, errors.New("Invalid from")
+	}
+	if q.To, err = parseQueryTime(v.Get("to"), true); err != nil {
+		return nil, errors.New("Invalid to")
+	}
+
+	switch q.Result {
+	case "", ResultWhite, ResultBlack, ResultDraw, ResultNone:
+	default:
+		return nil, errors.New("Invalid result")
+	}
+
+	if match, _ := regexp.MatchString("^([a-h][1-8])*$", q.Opening); !match {
+		return nil, errors.New("Invalid opening")
+	}
+
+	switch q.Sort {
+	case "":
+		q.Sort = "-finished"
+	case "finished", "-finished", "length", "-length":
+	default:
+		return nil, errors.New("Invalid sort")
+	}
+
+	ints := []struct {
+		name string
+		dst  *int
+	}{
+		{"min_length", &q.MinLength},
+		{"offset", &q.Offset},
+		{"limit", &q.Limit},
+	}
+	for _, i := range ints {
+		if s := v.Get(i.name); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 {
+				return nil, errors.New("Invalid " + i.name)
+			}
+			*i.dst = n
+		}
+	}
+	if q.Limit == 0 || q.Limit > MaxGamesLimit {
+		q.Limit = MaxGamesLimit
+	}
+	return q, nil
+}
+
+func parseQueryTime(s string, end bool) (time.Time, error) {
+
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		if end {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
@@ -0,0 +1,243 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func archivedGame(id string, white, black string, state SessionState, moves [][]int, finishedAt time.Time) *GameRecord {
+
+	s := NewSession(id, User{Name: white, UserID: white + "ID"})
+	s.Pair(User{Name: black, UserID: black + "ID"})
+	s.MoveLog = moves
+	s.State = state
+	s.UpdatedAt = finishedAt
+	return NewGameRecord(s)
+}
+
+func testArchiveSearch(t *testing.T, a GameArchive) {
+
+	day := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	games := []*GameRecord{
+		archivedGame("g1", "alice", "bob", StateWonWhite, [][]int{{WHITE, 4, 2}, {BLACK, 5, 2}}, day),
+		archivedGame("g2", "bob", "carol", StateWonBlack, [][]int{{WHITE, 4, 2}, {BLACK, 3, 2}, {WHITE, 2, 2}}, day.AddDate(0, 0, 1)),
+		archivedGame("g3", "carol", "alice", StateDraw, [][]int{{WHITE, 5, 3}}, day.AddDate(0, 0, 2)),
+	}
+	for _, g := range games {
+		assert.Nil(t, a.Put(g))
+	}
+
+	ids := func(q *GameQuery) ([]string, int) {
+		found, total, err := a.Search(q)
+		assert.Nil(t, err)
+		ids := make([]string, 0)
+		for _, g := range found {
+			assert.Nil(t, g.Session)
+			ids = append(ids, g.GameID)
+		}
+		return ids, total
+	}
+
+	got, total := ids(&GameQuery{Sort: "-finished"})
+	assert.Equal(t, []string{"g3", "g2", "g1"}, got)
+	assert.Equal(t, 3, total)
+
+	got, _ = ids(&GameQuery{Player: "alice", Sort: "finished"})
+	assert.Equal(t, []string{"g1", "g3"}, got)
+
+	got, _ = ids(&GameQuery{Player: "bobID", Result: ResultBlack})
+	assert.Equal(t, []string{"g2"}, got)
+
+	got, _ = ids(&GameQuery{From: day.AddDate(0, 0, 1), To: day.AddDate(0, 0, 2), Sort: "finished"})
+	assert.Equal(t, []string{"g2"}, got)
+
+	got, _ = ids(&GameQuery{Opening: "e6", Sort: "-length"})
+	assert.Equal(t, []string{"g2", "g1"}, got)
+
+	got, _ = ids(&GameQuery{MinLength: 2, Opening: "e6f6"})
+	assert.Equal(t, []string{"g1"}, got)
+
+	got, total = ids(&GameQuery{Sort: "length", Offset: 1, Limit: 1})
+	assert.Equal(t, []string{"g1"}, got)
+	assert.Equal(t, 3, total)
+
+	got, total = ids(&GameQuery{Offset: 5, Limit: 1})
+	assert.Equal(t, []string{}, got)
+	assert.Equal(t, 3, total)
+
+	g, err := a.Get("g2")
+	assert.Nil(t, err)
+	assert.Equal(t, "e6d6c6", g.Moves)
+	assert.Equal(t, "carol", g.Black.Name)
+	assert.Equal(t, StateWonBlack, g.Session.State)
+
+	_, err = a.Get("nothing")
+	assert.Equal(t, ErrGameNotFound, err)
+
+	played, err := a.Played([]string{"aliceID", "carolID", "daveID"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]bool{"aliceID": true, "carolID": true}, played)
+}
+
+func TestMemoryArchive(t *testing.T) {
+	testArchiveSearch(t, NewMemoryArchive())
+}
+
+func TestFileArchive(t *testing.T) {
+
+	dir := t.TempDir()
+	a, err := NewFileArchive(dir)
+	if !assert.Nil(t, err) {
+		return
+	}
+	testArchiveSearch(t, a)
+
+	// a restarted server sees the same games
+	a, err = NewFileArchive(dir)
+	assert.Nil(t, err)
+	g, err := a.Get("g1")
+	assert.Nil(t, err)
+	assert.Equal(t, ResultWhite, g.Result)
+}
+
+func TestSQLiteArchive(t *testing.T) {
+
+	st, err := OpenSQLiteStore(filepath.Join(t.TempDir(), "reversi.db"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer st.Close()
+	testArchiveSearch(t, st.Games())
+}
+
+func TestArchiveFinishedSession(t *testing.T) {
+
+	sv := NewServer(NewMemorySessionStore(), NewMemoryUserStore())
+	ts := httptest.NewServer(sv)
+	defer ts.Close()
+
+	white, session, _ := sv.CreateSession("white")
+	sv.CreateSession("black")
+	assert.Nil(t, sv.PlayMove(session.SessionID, white.UserID, 4, 2))
+	assert.Nil(t, sv.Resign(session.SessionID, white.UserID))
+
+	// the finished session moves to the archive, and is still served
+	_, err := sv.Sessions.Get(session.SessionID)
+	assert.Equal(t, ErrSessionNotFound, err)
+	s, err := sv.GetSessionInfo(session.SessionID)
+	assert.Nil(t, err)
+	assert.Equal(t, StateWonBlack, s.State)
+	assert.Equal(t, ErrGameFinished, sv.PlayMove(session.SessionID, white.UserID, 5, 3))
+
+	res, err := http.Get(ts.URL + APISession + "/" + session.SessionID)
+	if !assert.Nil(t, err) {
+		return
+	}
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	res, err = http.Get(ts.URL + APIGames + "?player=white&result=black&opening=e6")
+	if !assert.Nil(t, err) {
+		return
+	}
+	var games GetGamesResponse
+	assert.Nil(t, json.NewDecoder(res.Body).Decode(&games))
+	res.Body.Close()
+	assert.Equal(t, 1, games.Total)
+	if assert.Len(t, games.Games, 1) {
+		assert.Equal(t, session.SessionID, games.Games[0].GameID)
+		assert.Equal(t, 1, games.Games[0].Length)
+	}
+
+	res, err = http.Get(ts.URL + APIGames + "?sort=random")
+	if !assert.Nil(t, err) {
+		return
+	}
+	res.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	res, err = http.Get(ts.URL + APIGames + "/" + session.SessionID)
+	if !assert.Nil(t, err) {
+		return
+	}
+	var game GameRecord
+	assert.Nil(t, json.NewDecoder(res.Body).Decode(&game))
+	res.Body.Close()
+	assert.Equal(t, "e6", game.Moves)
+	assert.Equal(t, ResultBlack, game.Result)
+}
+
+// flakyArchive fails the put of the given number, counting from 1
+type flakyArchive struct {
+	GameArchive
+	puts, fail int
+}
+
+func (a *flakyArchive) Put(game *GameRecord) error {
+	a.puts++
+	if a.puts == a.fail {
+		return errBrokenStore
+	}
+	return a.GameArchive.Put(game)
+}
+
+func TestArchiveRetry(t *testing.T) {
+
+	for fail := 1; fail <= 2; fail++ {
+		sv := NewServer(NewMemorySessionStore(), NewMemoryUserStore())
+		sv.Games = &flakyArchive{GameArchive: NewMemoryArchive(), fail: fail}
+		janitor := NewJanitor(sv, JanitorConfig{})
+
+		white, session, _ := sv.CreateSession("white")
+		sv.CreateSession("black")
+		assert.Nil(t, sv.PlayMove(session.SessionID, white.UserID, 4, 2))
+		assert.Nil(t, sv.Resign(session.SessionID, white.UserID))
+
+		// the failure leaves the finished session in the live store
+		s, err := sv.Sessions.Get(session.SessionID)
+		assert.Nil(t, err)
+		assert.Equal(t, StateWonBlack, s.State)
+		assert.Equal(t, ErrGameFinished, sv.PlayMove(session.SessionID, white.UserID, 5, 3))
+
+		// the janitor archives it again, and the game is counted once
+		assert.Equal(t, 1, janitor.Sweep().ArchivedGames)
+		_, err = sv.Sessions.Get(session.SessionID)
+		assert.Equal(t, ErrSessionNotFound, err)
+		game, err := sv.Games.Get(session.SessionID)
+		assert.Nil(t, err)
+		assert.True(t, game.Counted)
+		p, err := sv.Profiles.Get(white.UserID)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, p.Stats.Played)
+
+		assert.Equal(t, 0, janitor.Sweep().ArchivedGames)
+		assert.Nil(t, sv.archiveFinished(session.SessionID))
+		p, _ = sv.Profiles.Get(white.UserID)
+		assert.Equal(t, 1, p.Stats.Played)
+	}
+}
+
+func TestArchiveAnalysis(t *testing.T) {
+
+	sv := NewServer(NewMemorySessionStore(), NewMemoryUserStore())
+	user, session, err := sv.CreateAnalysisSession("analyst", initialPosition)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Nil(t, sv.Resign(session.SessionID, user.UserID))
+
+	// an analysis session is archived, but counted for nobody
+	game, err := sv.Games.Get(session.SessionID)
+	assert.Nil(t, err)
+	assert.False(t, game.Counted)
+	if p, err := sv.Profiles.Get(user.UserID); err == nil {
+		assert.Equal(t, 0, p.Stats.Played)
+		assert.Empty(t, p.Recent)
+	}
+}
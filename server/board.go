@@ -0,0 +1,116 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrInvalidPosition is returned when a position string cannot be read
+var ErrInvalidPosition = errors.New("Invalid position")
+
+// positionMarks are the characters of a position string for EMPTY, WHITE and BLACK
+var positionMarks = map[int]byte{
+	EMPTY: '-',
+	WHITE: 'O',
+	BLACK: 'X',
+}
+
+// newBoard returns an empty board
+func newBoard() [][]int {
+
+	board := make([][]int, MaxBoardSize)
+	for y := range board {
+		board[y] = make([]int, MaxBoardSize)
+	}
+	return board
+}
+
+// FormatPosition returns the board and the side to move as a position string: a character per grid
+// row by row from y=0 of the session, which is a8 in standard notation, - for empty, O for WHITE and
+// X for BLACK, then a space and the side to move. The letters name the colors of the session, so O
+// moves first, while in standard notation and in the BO of GGF O is white, which moves second
+func FormatPosition(board [][]int, turn int) string {
+
+	var b strings.Builder
+	for _, row := range board {
+		for _, c := range row {
+			b.WriteByte(positionMarks[c])
+		}
+	}
+	b.WriteByte(' ')
+	b.WriteByte(positionMarks[turn])
+	return b.String()
+}
+
+// ParsePosition reads a position string. The size of the board is told by the number of grids,
+// which must be MaxBoardSize squared. Lower case letters, . for empty and * for black are accepted
+func ParsePosition(position string) ([][]int, int, error) {
+
+	fields := strings.Fields(position)
+	if len(fields) != 2 {
+		return nil, EMPTY, fmt.Errorf("%w: give the grids and the side to move separated by a space", ErrInvalidPosition)
+	}
+	grids, side := fields[0], fields[1]
+
+	size := 0
+	for size*size < len(grids) {
+		size++
+	}
+	if size*size != len(grids) {
+		return nil, EMPTY, fmt.Errorf("%w: %d grids do not make a square board", ErrInvalidPosition, len(grids))
+	}
+	if size != MaxBoardSize {
+		return nil, EMPTY, fmt.Errorf("%w: board size %d is not supported", ErrInvalidPosition, size)
+	}
+
+	board := newBoard()
+	for i := 0; i < len(grids); i++ {
+		c, ok := positionDisc(grids[i])
+		if !ok {
+			return nil, EMPTY, fmt.Errorf("%w: unknown grid %q", ErrInvalidPosition, grids[i])
+		}
+		board[i/size][i%size] = c
+	}
+
+	turn, ok := positionDisc(side[0])
+	if len(side) != 1 || !ok || turn == EMPTY {
+		return nil, EMPTY, fmt.Errorf("%w: side to move %q is neither X nor O", ErrInvalidPosition, side)
+	}
+	return board, turn, nil
+}
+
+func positionDisc(c byte) (int, bool) {
+
+	switch c {
+	case '-', '.':
+		return EMPTY, true
+	case 'O', 'o':
+		return WHITE, true
+	case 'X', 'x', '*':
+		return BLACK, true
+	}
+	return EMPTY, false
+}
+
+// initialPosition is the position of a new session
+const initialPosition string = "---------------------------OX------XO--------------------------- O"
+
+// playablePosition checks that a game can go on from the position, and passes
+// the turn to the opponent when the side to move has no grid to put a disc on
+func playablePosition(position string) (string, error) {
+
+	board, turn, err := ParsePosition(position)
+	if err != nil {
+		return "", err
+	}
+
+	s := &Session{Board: board}
+	if len(findCandidates(s, turn)) > 0 {
+		return FormatPosition(board, turn), nil
+	}
+	if len(findCandidates(s, opponent(turn))) > 0 {
+		return FormatPosition(board, opponent(turn)), nil
+	}
+	return "", fmt.Errorf("%w: neither side can put a disc", ErrInvalidPosition)
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPosition(t *testing.T) {
+
+	initial := "---------------------------OX------XO--------------------------- O"
+	assert.Equal(t, initial, initialPosition)
+
+	board, turn, err := ParsePosition(initial)
+	assert.Nil(t, err)
+	assert.Equal(t, WHITE, turn)
+	assert.Equal(t, NewSession("", User{}).Board, board)
+
+	// lower case, dots and stars are read too
+	board, turn, err = ParsePosition(strings.Repeat(".", 27) + "ox......*o" + strings.Repeat(".", 27) + " x")
+	assert.Nil(t, err)
+	assert.Equal(t, BLACK, turn)
+	assert.Equal(t, initial[:len(initial)-1]+"X", FormatPosition(board, turn))
+
+	for _, bad := range []string{
+		"",
+		initial[:len(initial)-2],
+		initial[:len(initial)-2] + " -",
+		initial[1:],
+		"-------------------------OX--XO- O",
+		strings.Replace(initial, "O", "Q", 1),
+		strings.Repeat("-", 100) + " O",
+	} {
+		_, _, err := ParsePosition(bad)
+		assert.ErrorIs(t, err, ErrInvalidPosition, bad)
+	}
+
+	// the side without a grid to put a disc on passes
+	position := "XO" + strings.Repeat("-", 62) + " O"
+	p, err := playablePosition(position)
+	assert.Nil(t, err)
+	assert.Equal(t, "XO"+strings.Repeat("-", 62)+" X", p)
+
+	_, err = playablePosition("OO" + strings.Repeat("-", 62) + " X")
+	assert.ErrorIs(t, err, ErrInvalidPosition)
+}
+
+func TestAnalysisSession(t *testing.T) {
+
+	j, err := OpenJournal(t.TempDir(), 0)
+	if !assert.Nil(t, err) {
+		return
+	}
+	st, err := NewJournalSessionStore(j)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	sv := NewServer(st, NewMemoryUserStore())
+	ts := httptest.NewServer(sv)
+	defer ts.Close()
+
+	// black to move, and black owns the row 4 but d4
+	position := strings.Repeat("-", 24) + "XXXO----" + "---XO---" + strings.Repeat("-", 24) + " X"
+	body, _ := json.Marshal(&PostAnalysisRequest{Name: "analyst", Position: position})
+	res, err := http.Post(ts.URL+APIAnalysis, "application/json", bytes.NewReader(body))
+	if !assert.Nil(t, err) {
+		return
+	}
+	var info GetSessionInfoResponse
+	assert.Nil(t, json.NewDecoder(res.Body).Decode(&info))
+	res.Body.Close()
+	assert.Equal(t, "success", info.Status)
+
+	s, err := sv.GetSessionInfo(info.SessionID)
+	assert.Nil(t, err)
+	assert.True(t, s.IsAnalysis())
+	assert.Equal(t, StateEstablished, s.State)
+	assert.Equal(t, BLACK, s.Turn)
+	assert.Equal(t, position, s.StartPosition)
+
+	// a single user plays both sides
+	assert.Nil(t, sv.PlayMove(info.SessionID, info.UserID, 4, 3))
+	assert.Nil(t, sv.PlayMove(info.SessionID, info.UserID, 4, 2))
+
+	res, err = http.Get(ts.URL + APISession + "/" + info.SessionID + APISessionPosition)
+	if !assert.Nil(t, err) {
+		return
+	}
+	var got GetPositionResponse
+	assert.Nil(t, json.NewDecoder(res.Body).Decode(&got))
+	res.Body.Close()
+	s, _ = sv.GetSessionInfo(info.SessionID)
+	assert.Equal(t, FormatPosition(s.Board, s.Turn), got.Position)
+
+	// the journal and GGF start from the position too
+	restored, err := j.Restore(info.SessionID, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, s.Board, restored.Board)
+
+	imported, err := ParseGGF("g", ExportGGF(s))
+	assert.Nil(t, err)
+	assert.Equal(t, s.Board, imported.Board)
+	assert.Equal(t, position, imported.StartPosition)
+
+	body, _ = json.Marshal(&PostAnalysisRequest{Name: "analyst", Position: "nothing"})
+	res, err = http.Post(ts.URL+APIAnalysis, "application/json", bytes.NewReader(body))
+	if !assert.Nil(t, err) {
+		return
+	}
+	res.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// SessionETag returns the entity tag of the resources derived from the session
+func SessionETag(session *Session) string {
+	return fmt.Sprintf(`"%s-%d"`, session.SessionID, session.Version)
+}
+
+// setSessionValidators sets ETag and Last-Modified of the session on the response
+func setSessionValidators(w http.ResponseWriter, session *Session) {
+
+	w.Header().Set("ETag", SessionETag(session))
+	if !session.UpdatedAt.IsZero() {
+		w.Header().Set("Last-Modified", session.UpdatedAt.UTC().Format(http.TimeFormat))
+	}
+}
+
+// checkNotModified sets the validators of the session and replies 304 Not Modified
+// when the client already has the current version. It returns true if it replied
+func checkNotModified(w http.ResponseWriter, r *http.Request, session *Session) bool {
+
+	if session == nil {
+		return false
+	}
+	setSessionValidators(w, session)
+
+	if !isNotModified(r, session) {
+		return false
+	}
+
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+func isNotModified(r *http.Request, session *Session) bool {
+
+	// If-None-Match takes precedence over If-Modified-Since
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := SessionETag(session)
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == etag || tag == "*" {
+				return true
+			}
+		}
+		return false
+	}
+
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" && !session.UpdatedAt.IsZero() {
+		t, err := http.ParseTime(ims)
+		if err != nil {
+			return false
+		}
+		// Last-Modified has a resolution of a second, and the session may have changed again
+		// in the second of it, so only a later second proves the client has the current version
+		return !session.UpdatedAt.After(t)
+	}
+
+	return false
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_APIGetBoard_ETag(t *testing.T) {
+
+	InitSessionStore(true)
+	InitUserStore(true)
+	_, sessionID := CreateSession("test")
+	_, _ = CreateSession("test2")
+
+	ts := httptest.NewServer(http.HandlerFunc(APIRoute))
+	defer ts.Close()
+
+	get := func(header, value string) *http.Response {
+		req, _ := http.NewRequest("GET", ts.URL+"/session/"+sessionID+"/board", nil)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if !assert.Nil(t, err) {
+			t.FailNow()
+		}
+		res.Body.Close()
+		return res
+	}
+
+	res := get("", "")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "application/json; charset=utf-8", res.Header.Get("Content-Type"))
+	assert.Equal(t, "no-cache", res.Header.Get("Cache-Control"))
+	etag := res.Header.Get("ETag")
+	assert.NotEmpty(t, etag)
+	lastModified := res.Header.Get("Last-Modified")
+	assert.NotEmpty(t, lastModified)
+
+	res = get("If-None-Match", etag)
+	assert.Equal(t, http.StatusNotModified, res.StatusCode)
+	assert.Equal(t, etag, res.Header.Get("ETag"))
+
+	// Last-Modified drops the fraction of the second, in which the session may change again
+	modified, err := http.ParseTime(lastModified)
+	assert.Nil(t, err)
+	res = get("If-Modified-Since", modified.Add(time.Second).Format(http.TimeFormat))
+	assert.Equal(t, http.StatusNotModified, res.StatusCode)
+
+	PutDisc(sessionID, WHITE, 4, 2)
+	UpdateSessionState(sessionID, WHITE, 4, 2)
+
+	res = get("If-None-Match", etag)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.NotEqual(t, etag, res.Header.Get("ETag"))
+
+	res = get("If-Modified-Since", lastModified)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	res = get("If-Modified-Since", time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat))
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+}
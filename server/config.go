@@ -0,0 +1,220 @@
+package server
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// StoreMemory keeps everything in memory and loses it on restart
+	StoreMemory string = "memory"
+
+	// StoreFile keeps users and sessions as JSON files under Config.DataDir
+	StoreFile string = "file"
+
+	// StoreSQLite keeps users, sessions and moves in Config.DataDir/reversi.db
+	StoreSQLite string = "sqlite"
+
+	// StoreJournal keeps sessions as event journals under Config.DataDir/journal
+	// and users as JSON files under Config.DataDir
+	StoreJournal string = "journal"
+)
+
+// Config is the configuration of the server given by the command line
+type Config struct {
+	// Store is the backend of the stores: memory, file, sqlite or journal
+	Store string
+
+	// DataDir is the directory of the durable backends
+	DataDir string
+
+	// Janitor tells when sessions are abandoned
+	Janitor JanitorConfig
+
+	// Auth configures the tokens issued
+	Auth AuthConfig
+
+	// Limits protects the server from abuse
+	Limits LimitConfig
+}
+
+// AuthConfig configures the tokens issued
+type AuthConfig struct {
+	// Keyring is the path of the keyring file signing access tokens. A random key
+	// is used when it is empty, so that only this process accepts the tokens
+	Keyring string
+
+	// AccessTTL and RefreshTTL are the lifetimes of access tokens and refresh tokens
+	AccessTTL  time.Duration
+	RefreshTTL time.Duration
+
+	// Admins are the usernames of the accounts made admins on start
+	Admins []string
+
+	// OIDC is the OpenID Connect provider users sign in with. None is used when its Issuer is empty
+	OIDC OIDCConfig
+}
+
+// ParseConfig parses the command line. args[0] is the name of the program
+func ParseConfig(args []string) (*Config, error) {
+
+	config := new(Config)
+
+	name := "rest_reversi"
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.StringVar(&config.Store, "store", StoreMemory, "backend of the stores: memory, file, sqlite or journal")
+	flags.StringVar(&config.DataDir, "data-dir", "data", "directory of the durable backends")
+	flags.DurationVar(&config.Janitor.Interval, "janitor-interval", DefaultJanitorInterval, "time between sweeps of abandoned sessions")
+	flags.DurationVar(&config.Janitor.WaitTTL, "wait-ttl", DefaultWaitTTL, "time a session waits for an opponent before it expires, 0 to never expire")
+	flags.DurationVar(&config.Janitor.IdleTTL, "idle-ttl", DefaultIdleTTL, "time a game may go without a move before it is adjudicated, 0 to never adjudicate")
+	flags.StringVar(&config.Auth.Keyring, "keyring", "", "JSON file of the keys signing access tokens, shared by the servers accepting the same tokens")
+	flags.DurationVar(&config.Auth.AccessTTL, "access-ttl", DefaultAccessTTL, "lifetime of an access token")
+	flags.DurationVar(&config.Auth.RefreshTTL, "refresh-ttl", DefaultRefreshTTL, "lifetime of a refresh token")
+	flags.Float64Var(&config.Limits.IP.Rate, "ip-rate", 20, "requests a second a client address may make, 0 for no limit")
+	flags.IntVar(&config.Limits.IP.Burst, "ip-burst", 60, "requests a client address may make at once")
+	flags.Float64Var(&config.Limits.User.Rate, "user-rate", 10, "requests a second a user may make, 0 for no limit")
+	flags.IntVar(&config.Limits.User.Burst, "user-burst", 30, "requests a user may make at once")
+	flags.Float64Var(&config.Limits.Signup.Rate, "signup-rate", 0.1, "users a second a client address may create, 0 for no limit")
+	flags.IntVar(&config.Limits.Signup.Burst, "signup-burst", 10, "users a client address may create at once")
+	flags.BoolVar(&config.Limits.TrustProxy, "trust-proxy", false, "take the client address from X-Forwarded-For set by a reverse proxy")
+	flags.IntVar(&config.Limits.MaxOpenSessions, "max-open-sessions", DefaultMaxOpenSessions, "sessions a user may wait in or play at once, 0 for no limit")
+	flags.Int64Var(&config.Limits.MaxBodyBytes, "max-body-bytes", DefaultMaxBodyBytes, "size limit of a request body")
+	flags.StringVar(&config.Auth.OIDC.Issuer, "oidc-issuer", "", "URL of the OpenID Connect provider users sign in with, empty for none")
+	flags.StringVar(&config.Auth.OIDC.ClientID, "oidc-client-id", "", "client ID of the server at the OpenID Connect provider")
+	flags.StringVar(&config.Auth.OIDC.ClientSecret, "oidc-client-secret", os.Getenv("OIDC_CLIENT_SECRET"), "client secret of the server at the OpenID Connect provider, $OIDC_CLIENT_SECRET by default")
+	flags.StringVar(&config.Auth.OIDC.RedirectURL, "oidc-redirect-url", "", "URL of "+APIOIDC+APIOIDCCallback+" of the server registered at the OpenID Connect provider")
+	admins := flags.String("admins", "", "comma separated usernames of the accounts made admins on start")
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	for _, username := range strings.Split(*admins, ",") {
+		if username = strings.TrimSpace(username); username != "" {
+			config.Auth.Admins = append(config.Auth.Admins, username)
+		}
+	}
+	if config.Auth.AccessTTL <= 0 || config.Auth.RefreshTTL <= 0 {
+		return nil, fmt.Errorf("token lifetimes must be positive")
+	}
+	if config.Auth.OIDC.Issuer != "" && (config.Auth.OIDC.ClientID == "" || config.Auth.OIDC.RedirectURL == "") {
+		return nil, fmt.Errorf("an OpenID Connect provider needs a client ID and a redirect URL")
+	}
+	if config.Limits.IP.Rate < 0 || config.Limits.User.Rate < 0 || config.Limits.Signup.Rate < 0 || config.Limits.MaxOpenSessions < 0 {
+		return nil, fmt.Errorf("limits must not be negative")
+	}
+	if config.Limits.MaxBodyBytes <= 0 {
+		return nil, fmt.Errorf("body size limit must be positive")
+	}
+
+	return config, nil
+}
+
+// Stores are the stores of a server, which all keep their data in one backend
+type Stores struct {
+	Sessions     SessionStore
+	Users        UserStore
+	Games        GameArchive
+	Tokens       TokenStore
+	Accounts     AccountStore
+	Profiles     ProfileStore
+	Ratings      RatingStore
+	Leaderboards LeaderboardStore
+	Identities   IdentityStore
+	Relations    RelationStore
+}
+
+// NewStores returns the stores of the backend selected by the configuration
+func NewStores(config *Config) (*Stores, error) {
+
+	switch config.Store {
+	case StoreMemory:
+		return &Stores{
+			Sessions:     NewMemorySessionStore(),
+			Users:        NewMemoryUserStore(),
+			Games:        NewMemoryArchive(),
+			Tokens:       NewMemoryTokenStore(),
+			Accounts:     NewMemoryAccountStore(),
+			Profiles:     NewMemoryProfileStore(),
+			Ratings:      NewMemoryRatingStore(),
+			Leaderboards: NewMemoryLeaderboardStore(),
+			Identities:   NewMemoryIdentityStore(),
+			Relations:    NewMemoryRelationStore(),
+		}, nil
+	case StoreFile:
+		sessions, err := NewFileSessionStore(config.DataDir)
+		if err != nil {
+			return nil, err
+		}
+		return newFileStores(config.DataDir, sessions)
+	case StoreSQLite:
+		st, err := OpenSQLiteStore(filepath.Join(config.DataDir, "reversi.db"))
+		if err != nil {
+			return nil, err
+		}
+		return &Stores{
+			Sessions:     st,
+			Users:        st.Users(),
+			Games:        st.Games(),
+			Tokens:       st.Tokens(),
+			Accounts:     st.Accounts(),
+			Profiles:     st.Profiles(),
+			Ratings:      st.Ratings(),
+			Leaderboards: st.Leaderboards(),
+			Identities:   st.Identities(),
+			Relations:    st.Relations(),
+		}, nil
+	case StoreJournal:
+		j, err := OpenJournal(filepath.Join(config.DataDir, "journal"), DefaultSnapshotEvery)
+		if err != nil {
+			return nil, err
+		}
+		sessions, err := NewJournalSessionStore(j)
+		if err != nil {
+			return nil, err
+		}
+		return newFileStores(config.DataDir, sessions)
+	}
+	return nil, fmt.Errorf("unknown store %q", config.Store)
+}
+
+// newFileStores returns the sessions and the stores keeping everything else as JSON files under dir
+func newFileStores(dir string, sessions SessionStore) (*Stores, error) {
+
+	st := &Stores{Sessions: sessions}
+	var err error
+	if st.Users, err = NewFileUserStore(dir); err != nil {
+		return nil, err
+	}
+	if st.Games, err = NewFileArchive(dir); err != nil {
+		return nil, err
+	}
+	if st.Tokens, err = NewFileTokenStore(dir); err != nil {
+		return nil, err
+	}
+	if st.Accounts, err = NewFileAccountStore(dir); err != nil {
+		return nil, err
+	}
+	if st.Profiles, err = NewFileProfileStore(dir); err != nil {
+		return nil, err
+	}
+	if st.Ratings, err = NewFileRatingStore(dir); err != nil {
+		return nil, err
+	}
+	if st.Leaderboards, err = NewFileLeaderboardStore(dir); err != nil {
+		return nil, err
+	}
+	if st.Identities, err = NewFileIdentityStore(dir); err != nil {
+		return nil, err
+	}
+	if st.Relations, err = NewFileRelationStore(dir); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
@@ -0,0 +1,31 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewStores(t *testing.T) {
+
+	for _, backend := range []string{StoreMemory, StoreFile, StoreSQLite, StoreJournal} {
+		stores, err := NewStores(&Config{Store: backend, DataDir: t.TempDir()})
+		if !assert.Nil(t, err, backend) {
+			continue
+		}
+
+		// every store is of the backend, and works
+		sv := NewServerWithStores(stores)
+		assert.Equal(t, stores.Games, sv.Games, backend)
+		assert.Equal(t, stores.Relations, sv.Relations, backend)
+		user, err := sv.Register("alice", "correct horse")
+		assert.Nil(t, err, backend)
+		_, err = stores.Accounts.Get("alice")
+		assert.Nil(t, err, backend)
+		_, err = stores.Profiles.Get(user.UserID)
+		assert.Nil(t, err, backend)
+	}
+
+	_, err := NewStores(&Config{Store: "tape"})
+	assert.EqualError(t, err, `unknown store "tape"`)
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+const (
+	// LongPollTimeout is the default time to wait for a session change
+	LongPollTimeout time.Duration = 30 * time.Second
+
+	// MaxLongPollTimeout is the upper bound of the timeout a client can request
+	MaxLongPollTimeout time.Duration = 120 * time.Second
+
+	// EventsKeepAlive is the interval of comment lines sent to keep an idle stream open
+	EventsKeepAlive time.Duration = 15 * time.Second
+)
+
+// APIGetSessionEvents streams the session as Server-Sent Events every time it changes
+func (sv *Server) APIGetSessionEvents(w http.ResponseWriter, r *http.Request) {
+
+	re := regexp.MustCompile(APISession + "/([a-zA-Z0-9]+)" + APISessionEvents)
+	sessionIDMatch := re.FindStringSubmatch(r.URL.Path)
+	if len(sessionIDMatch) < 2 {
+		returnJSONMessage(w, http.StatusInternalServerError, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: "Invalid session",
+		})
+		return
+	}
+
+	sessionID := sessionIDMatch[1]
+	if _, err := sv.GetSessionInfo(sessionID); err != nil {
+		returnSessionError(w, err)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		returnJSONMessage(w, http.StatusInternalServerError, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: "Streaming is not supported",
+		})
+		return
+	}
+
+	// a user watching a session is online until the stream is closed
+	if user, err := sv.authenticate(r); err == nil {
+		defer sv.presence.connect(user.UserID, time.Now())()
+	}
+
+	// the stream outlives the write timeout of the server
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	keepAlive := time.NewTicker(EventsKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		// watch before reading so that no change is missed in between
+		changed := sv.notifier.Watch(sessionID)
+
+		session, err := sv.GetSessionInfo(sessionID)
+		if err != nil {
+			fmt.Fprint(w, "event: close\ndata: {}\n\n")
+			flusher.Flush()
+			return
+		}
+
+		if err := writeSessionEvent(w, session); err != nil {
+			fmt.Println("APIGetSessionEvents: " + err.Error())
+			return
+		}
+		flusher.Flush()
+
+		if IsSessionFinished(session) {
+			return
+		}
+
+	wait:
+		for {
+			select {
+			case <-changed:
+				break wait
+			case <-keepAlive.C:
+				fmt.Fprint(w, ": keep-alive\n\n")
+				flusher.Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+}
+
+func writeSessionEvent(w http.ResponseWriter, session *Session) error {
+
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: session\nid: %d\ndata: %s\n\n", session.ElapsedTurn, data)
+	return err
+}
+
+// waitSessionAdvance replies the session once its ElapsedTurn exceeds elapsedTurn,
+// or as it is when the timeout expires
+func (sv *Server) waitSessionAdvance(w http.ResponseWriter, r *http.Request, sessionID string, elapsedTurn int) {
+
+	timeout := LongPollTimeout
+	if t := r.URL.Query().Get("timeout"); t != "" {
+		sec, err := strconv.Atoi(t)
+		if err != nil || sec < 0 {
+			returnJSONMessage(w, http.StatusBadRequest, &GeneralMessageResponse{
+				Status:      "fail",
+				Description: "Invalid timeout",
+			})
+			return
+		}
+		timeout = time.Duration(sec) * time.Second
+		if timeout > MaxLongPollTimeout {
+			timeout = MaxLongPollTimeout
+		}
+	}
+
+	// the reply may come later than the write timeout of the server
+	http.NewResponseController(w).SetWriteDeadline(time.Now().Add(timeout + 10*time.Second))
+
+	expired := time.NewTimer(timeout)
+	defer expired.Stop()
+
+	for {
+		changed := sv.notifier.Watch(sessionID)
+
+		session, err := sv.GetSessionInfo(sessionID)
+		if err != nil {
+			returnSessionError(w, err)
+			return
+		}
+		if session.ElapsedTurn > elapsedTurn || IsSessionFinished(session) {
+			setSessionValidators(w, session)
+			returnJSONMessage(w, http.StatusOK, session)
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-expired.C:
+			setSessionValidators(w, session)
+			returnJSONMessage(w, http.StatusOK, session)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
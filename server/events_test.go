@@ -0,0 +1,99 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_APIGetSession_LongPoll(t *testing.T) {
+
+	InitSessionStore(true)
+	InitUserStore(true)
+	_, sessionID := CreateSession("test")
+	_, _ = CreateSession("test2")
+
+	ts := httptest.NewServer(http.HandlerFunc(APIRoute))
+	defer ts.Close()
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		PutDisc(sessionID, WHITE, 4, 2)
+		UpdateSessionState(sessionID, WHITE, 4, 2)
+	}()
+
+	res, err := http.Get(ts.URL + "/session/" + sessionID + "?since=1")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer res.Body.Close()
+
+	s := new(Session)
+	assert.Nil(t, json.NewDecoder(res.Body).Decode(s))
+	assert.Equal(t, 2, s.ElapsedTurn)
+	assert.Equal(t, []int{WHITE, 4, 2}, s.LastMove)
+}
+
+func Test_APIGetSession_LongPollTimeout(t *testing.T) {
+
+	InitSessionStore(true)
+	InitUserStore(true)
+	_, sessionID := CreateSession("test")
+	_, _ = CreateSession("test2")
+
+	ts := httptest.NewServer(http.HandlerFunc(APIRoute))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/session/" + sessionID + "?since=1&timeout=0")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer res.Body.Close()
+
+	s := new(Session)
+	assert.Nil(t, json.NewDecoder(res.Body).Decode(s))
+	assert.Equal(t, 1, s.ElapsedTurn)
+}
+
+func Test_APIGetSessionEvents(t *testing.T) {
+
+	InitSessionStore(true)
+	InitUserStore(true)
+	_, sessionID := CreateSession("test")
+	_, _ = CreateSession("test2")
+
+	ts := httptest.NewServer(http.HandlerFunc(APIRoute))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/session/" + sessionID + "/events")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer res.Body.Close()
+	assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+
+	ids := make([]int, 0)
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() && len(ids) < 2 {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "id: ") {
+			continue
+		}
+		id, _ := strconv.Atoi(strings.TrimPrefix(line, "id: "))
+		ids = append(ids, id)
+
+		if len(ids) == 1 {
+			PutDisc(sessionID, WHITE, 4, 2)
+			UpdateSessionState(sessionID, WHITE, 4, 2)
+		}
+	}
+
+	assert.Equal(t, []int{1, 2}, ids)
+}
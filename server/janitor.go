@@ -0,0 +1,351 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultJanitorInterval is the default time between sweeps of the janitor
+	DefaultJanitorInterval time.Duration = time.Minute
+
+	// DefaultWaitTTL is the default time a session waits for an opponent before it expires
+	DefaultWaitTTL time.Duration = 10 * time.Minute
+
+	// DefaultIdleTTL is the default time a game may go without a move before it is adjudicated
+	DefaultIdleTTL time.Duration = time.Hour
+)
+
+// APIMetrics is an API endpoint of the counters of the server, for admins
+const APIMetrics string = "/metrics"
+
+// JanitorConfig tells the janitor when sessions are abandoned. A zero TTL never expires
+type JanitorConfig struct {
+	Interval time.Duration
+	WaitTTL  time.Duration
+	IdleTTL  time.Duration
+}
+
+// JanitorStats counts what the janitor reaped
+type JanitorStats struct {
+	Sweeps int `json:"sweeps"`
+
+	// ExpiredSessions waited for an opponent longer than WaitTTL and were closed
+	ExpiredSessions int `json:"expiredSessions"`
+
+	// ClosedGames were paired but idle longer than IdleTTL before the first move, and were closed
+	ClosedGames int `json:"closedGames"`
+
+	// AdjudicatedGames were idle longer than IdleTTL and lost on time by the player to move
+	AdjudicatedGames int `json:"adjudicatedGames"`
+
+	// RemovedUsers never played a game and had no session in two sweeps in a row
+	RemovedUsers int `json:"removedUsers"`
+
+	// ArchivedGames were finished but left in the live store by a failure, and were archived
+	ArchivedGames int `json:"archivedGames"`
+
+	Errors    int       `json:"errors"`
+	LastSweep time.Time `json:"lastSweep"`
+}
+
+func (st *JanitorStats) add(pass *JanitorStats) {
+	st.Sweeps += pass.Sweeps
+	st.ExpiredSessions += pass.ExpiredSessions
+	st.ClosedGames += pass.ClosedGames
+	st.AdjudicatedGames += pass.AdjudicatedGames
+	st.RemovedUsers += pass.RemovedUsers
+	st.ArchivedGames += pass.ArchivedGames
+	st.Errors += pass.Errors
+	st.LastSweep = pass.LastSweep
+}
+
+// Janitor reaps abandoned sessions and orphan users of a server
+type Janitor struct {
+	sv     *Server
+	config JanitorConfig
+
+	mu    sync.Mutex
+	stats JanitorStats
+
+	// orphans are the users without a session in the last sweep
+	orphans map[string]bool
+
+	now func() time.Time
+}
+
+// NewJanitor returns a janitor of the server
+func NewJanitor(sv *Server, config JanitorConfig) *Janitor {
+
+	if config.Interval <= 0 {
+		config.Interval = DefaultJanitorInterval
+	}
+	return &Janitor{
+		sv:      sv,
+		config:  config,
+		orphans: make(map[string]bool),
+		now:     time.Now,
+	}
+}
+
+// Run sweeps every interval until ctx is done
+func (j *Janitor) Run(ctx context.Context) {
+
+	ticker := time.NewTicker(j.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			pass := j.Sweep()
+			if pass.ExpiredSessions+pass.ClosedGames+pass.AdjudicatedGames+pass.ArchivedGames+pass.RemovedUsers > 0 {
+				fmt.Printf("Janitor: expired %d, closed %d, adjudicated %d, archived %d sessions, removed %d users\n",
+					pass.ExpiredSessions, pass.ClosedGames, pass.AdjudicatedGames, pass.ArchivedGames, pass.RemovedUsers)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Stats returns the counters since the janitor started
+func (j *Janitor) Stats() JanitorStats {
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.stats
+}
+
+var errNotAbandoned = errors.New("not abandoned")
+
+// Sweep reaps the abandoned sessions and the orphan users once, and returns what it reaped
+func (j *Janitor) Sweep() JanitorStats {
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	now := j.now()
+	pass := JanitorStats{Sweeps: 1, LastSweep: now}
+
+	sessions, err := j.sv.Sessions.All()
+	if err != nil {
+		fmt.Println("Janitor: " + err.Error())
+		pass.Errors++
+		j.stats.add(&pass)
+		return pass
+	}
+
+	active := make(map[string]bool)
+	for _, s := range sessions {
+		if IsSessionFinished(s) {
+			// archiveFinished failed after the session finished, so try again
+			if err := j.sv.archiveFinished(s.SessionID); err != nil {
+				fmt.Println("Janitor: " + err.Error())
+				pass.Errors++
+			} else {
+				pass.ArchivedGames++
+			}
+		}
+
+		reaped, err := j.reap(s, now, &pass)
+		if err != nil {
+			fmt.Println("Janitor: " + err.Error())
+			pass.Errors++
+		}
+		if !reaped {
+			for _, p := range s.Players {
+				active[p.UserID] = true
+			}
+		}
+	}
+
+	users, err := j.sv.Users.All()
+	if err != nil {
+		fmt.Println("Janitor: " + err.Error())
+		pass.Errors++
+		users = nil
+	}
+
+	// a guest is registered just before joining a session, so it is removed
+	// only when it has no session in two sweeps in a row. Accounts are kept
+	guests := make([]User, 0)
+	guestIDs := make([]string, 0)
+	for _, user := range users {
+		if !active[user.UserID] && !user.Registered {
+			guests = append(guests, user)
+			guestIDs = append(guestIDs, user.UserID)
+		}
+	}
+	played, err := j.sv.Games.Played(guestIDs)
+	if err != nil {
+		fmt.Println("Janitor: " + err.Error())
+		pass.Errors++
+		guests = nil
+	}
+
+	orphans := make(map[string]bool)
+	for _, user := range guests {
+		if played[user.UserID] {
+			continue
+		}
+		if !j.orphans[user.UserID] {
+			orphans[user.UserID] = true
+			continue
+		}
+		if err := j.sv.Users.Delete(user.UserID); err != nil {
+			fmt.Println("Janitor: " + err.Error())
+			pass.Errors++
+			continue
+		}
+		if err := j.sv.Tokens.DeleteUser(user.UserID); err != nil {
+			fmt.Println("Janitor: " + err.Error())
+			pass.Errors++
+		}
+		if err := j.sv.Profiles.Delete(user.UserID); err != nil {
+			fmt.Println("Janitor: " + err.Error())
+			pass.Errors++
+		}
+		if err := j.sv.Relations.Delete(user.UserID); err != nil {
+			fmt.Println("Janitor: " + err.Error())
+			pass.Errors++
+		}
+		pass.RemovedUsers++
+	}
+	j.orphans = orphans
+
+	if err := j.sv.Tokens.Purge(now); err != nil {
+		fmt.Println("Janitor: " + err.Error())
+		pass.Errors++
+	}
+	if err := j.sv.Leaderboards.Purge(now); err != nil {
+		fmt.Println("Janitor: " + err.Error())
+		pass.Errors++
+	}
+	if j.sv.Limits != nil {
+		j.sv.Limits.Purge(now)
+	}
+	if j.sv.OIDC != nil {
+		j.sv.OIDC.Purge(now)
+	}
+	j.sv.presence.purge(now)
+
+	j.stats.add(&pass)
+	return pass
+}
+
+// reap closes or adjudicates the session if it is abandoned, and returns whether it did
+func (j *Janitor) reap(s *Session, now time.Time, pass *JanitorStats) (bool, error) {
+
+	ttl := j.config.IdleTTL
+	if s.State == StateWait {
+		ttl = j.config.WaitTTL
+	}
+	if ttl <= 0 || IsSessionFinished(s) || now.Sub(s.UpdatedAt) <= ttl {
+		return false, nil
+	}
+
+	var counter *int
+	err := j.sv.updateSession(s.SessionID, func(s *Session) error {
+
+		// the session may have moved since it was read
+		if IsSessionFinished(s) || now.Sub(s.UpdatedAt) <= ttl {
+			return errNotAbandoned
+		}
+
+		state := StateClose
+		switch {
+		case s.State == StateWait:
+			counter = &pass.ExpiredSessions
+		case len(s.MoveLog) == 0:
+			counter = &pass.ClosedGames
+		default:
+			// the player to move ran out of time
+			counter = &pass.AdjudicatedGames
+			state = StateWonWhite
+			if s.Turn == WHITE {
+				state = StateWonBlack
+			}
+		}
+
+		s.Apply(GameEvent{Type: EventExpired, Time: now, Color: s.Turn, State: state})
+		s.Apply(GameEvent{Type: EventFinished, Time: now, State: state})
+		return nil
+	})
+	if err == errNotAbandoned || err == ErrSessionNotFound || err == ErrGameFinished {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	*counter++
+	return true, nil
+}
+
+// GetMetricsResponse ...
+type GetMetricsResponse struct {
+	Status          string        `json:"status"`
+	WaitingSessions int           `json:"waitingSessions"`
+	PlayingSessions int           `json:"playingSessions"`
+	Users           int           `json:"users"`
+	Games           int           `json:"games"`
+	Janitor         *JanitorStats `json:"janitor,omitempty"`
+}
+
+// APIGetMetrics returns the counters of the server to an admin
+func (sv *Server) APIGetMetrics(w http.ResponseWriter, r *http.Request) {
+
+	if _, err := sv.authorize(r, RoleAdmin); err != nil {
+		returnAuthError(w, err)
+		return
+	}
+
+	metrics, _, err := sv.metrics()
+	if err != nil {
+		fmt.Println("APIGetMetrics: " + err.Error())
+		returnJSONMessage(w, http.StatusInternalServerError, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: "Cannot read metrics",
+		})
+		return
+	}
+	returnJSONMessage(w, http.StatusOK, metrics)
+}
+
+// metrics returns the counters of the server and the users it counted
+func (sv *Server) metrics() (*GetMetricsResponse, []User, error) {
+
+	metrics := &GetMetricsResponse{Status: "success"}
+
+	sessions, err := sv.Sessions.All()
+	if err == nil {
+		for _, s := range sessions {
+			if s.State == StateWait {
+				metrics.WaitingSessions++
+			} else if !IsSessionFinished(s) {
+				metrics.PlayingSessions++
+			}
+		}
+	}
+
+	var users []User
+	if err == nil {
+		users, err = sv.Users.All()
+		metrics.Users = len(users)
+	}
+	if err == nil {
+		_, metrics.Games, err = sv.Games.Search(&GameQuery{Limit: 1})
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if sv.Janitor != nil {
+		stats := sv.Janitor.Stats()
+		metrics.Janitor = &stats
+	}
+	return metrics, users, nil
+}
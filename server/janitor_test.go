@@ -0,0 +1,104 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJanitor(t *testing.T) {
+
+	sv := NewServer(NewMemorySessionStore(), NewMemoryUserStore())
+	j := NewJanitor(sv, JanitorConfig{WaitTTL: 10 * time.Minute, IdleTTL: time.Hour})
+	sv.Janitor = j
+
+	now := time.Now()
+	j.now = func() time.Time { return now }
+
+	// an idle game, a game idle before the first move and a waiting session
+	white, playing, _ := sv.CreateSession("white")
+	black, _, _ := sv.CreateSession("black")
+	assert.Nil(t, sv.PlayMove(playing.SessionID, white.UserID, 4, 2))
+	_, idle, _ := sv.CreateSession("idle1")
+	sv.CreateSession("idle2")
+	lonely, waiting, _ := sv.CreateSession("lonely")
+
+	pass := j.Sweep()
+	assert.Equal(t, 0, pass.ExpiredSessions+pass.ClosedGames+pass.AdjudicatedGames+pass.RemovedUsers)
+
+	now = now.Add(30 * time.Minute)
+	pass = j.Sweep()
+	assert.Equal(t, 1, pass.ExpiredSessions)
+	assert.Equal(t, 0, pass.AdjudicatedGames)
+	s, err := sv.GetSessionInfo(waiting.SessionID)
+	assert.Equal(t, ErrSessionNotFound, err)
+
+	// the lonely user is removed only in the second sweep without a session
+	_, err = sv.Users.Get(lonely.UserID)
+	assert.Nil(t, err)
+
+	now = now.Add(time.Hour)
+	pass = j.Sweep()
+	assert.Equal(t, 1, pass.ClosedGames)
+	assert.Equal(t, 1, pass.AdjudicatedGames)
+	assert.Equal(t, 1, pass.RemovedUsers)
+	_, err = sv.Users.Get(lonely.UserID)
+	assert.Equal(t, ErrUserNotFound, err)
+
+	// black ran out of time
+	s, err = sv.GetSessionInfo(playing.SessionID)
+	assert.Nil(t, err)
+	assert.Equal(t, StateWonWhite, s.State)
+	s, err = sv.GetSessionInfo(idle.SessionID)
+	assert.Nil(t, err)
+	assert.Equal(t, StateClose, s.State)
+
+	// players of archived games are kept
+	j.Sweep()
+	pass = j.Sweep()
+	assert.Equal(t, 0, pass.RemovedUsers)
+	_, err = sv.Users.Get(black.UserID)
+	assert.Nil(t, err)
+
+	stats := j.Stats()
+	assert.Equal(t, 5, stats.Sweeps)
+	assert.Equal(t, 1, stats.ExpiredSessions)
+	assert.Equal(t, 1, stats.AdjudicatedGames)
+
+	ts := httptest.NewServer(sv)
+	defer ts.Close()
+
+	// only admins read the metrics
+	res, err := http.Get(ts.URL + APIMetrics)
+	if !assert.Nil(t, err) {
+		return
+	}
+	res.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+	sv.Register("root", "correct horse")
+	assert.Nil(t, sv.GrantAdmin("root"))
+	root, _ := sv.Login("root", "correct horse")
+	tokens, err := sv.IssueTokens(root)
+	assert.Nil(t, err)
+	req, _ := http.NewRequest("GET", ts.URL+APIMetrics, nil)
+	req.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+	res, err = http.DefaultClient.Do(req)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	var metrics GetMetricsResponse
+	assert.Nil(t, json.NewDecoder(res.Body).Decode(&metrics))
+	assert.Equal(t, 0, metrics.PlayingSessions)
+	assert.Equal(t, 2, metrics.Games)
+	if assert.NotNil(t, metrics.Janitor) {
+		assert.Equal(t, 1, metrics.Janitor.RemovedUsers)
+	}
+}
@@ -0,0 +1,392 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// EventCreated is recorded when a session is created by its first player
+	EventCreated string = "created"
+
+	// EventJoined is recorded when an opponent joins the session
+	EventJoined string = "joined"
+
+	// EventMove is recorded when a disc is put
+	EventMove string = "move"
+
+	// EventPass is recorded when a player has no grid to put a disc on
+	EventPass string = "pass"
+
+	// EventResign is recorded when a player resigns
+	EventResign string = "resign"
+
+	// EventExpired is recorded when the janitor reaps an abandoned session
+	EventExpired string = "expired"
+
+	// EventAdjudicated is recorded when a moderator closes or decides a session
+	EventAdjudicated string = "adjudicated"
+
+	// EventFinished is recorded when the session reaches a terminal state
+	EventFinished string = "finished"
+
+	// EventRemoved is recorded when the session is removed from the store
+	EventRemoved string = "removed"
+)
+
+// DefaultSnapshotEvery is the number of events between snapshots of a session
+const DefaultSnapshotEvery int = 16
+
+// GameEvent is a change of a session. Folding the events of a session with Apply rebuilds it
+type GameEvent struct {
+	Seq       int          `json:"seq"`
+	SessionID string       `json:"sessionID"`
+	Type      string       `json:"type"`
+	Time      time.Time    `json:"time"`
+	User      *User        `json:"user,omitempty"`
+	Color     int          `json:"color,omitempty"`
+	PosX      int          `json:"posX"`
+	PosY      int          `json:"posY"`
+	State     SessionState `json:"state"`
+
+	// Position is the position a created session starts from, if it is not the initial one
+	Position string `json:"position,omitempty"`
+
+	// Rated is true when a created session is rated
+	Rated bool `json:"rated,omitempty"`
+}
+
+// Apply changes the session by the event and keeps the event to be journaled
+func (s *Session) Apply(e GameEvent) {
+
+	if e.User != nil {
+		player := e.User.player()
+		e.User = &player
+	}
+
+	switch e.Type {
+	case EventCreated:
+		s.assign(&Session{
+			SessionID: e.SessionID,
+			Players:   []User{*e.User},
+			State:     StateWait,
+			Turn:      1,
+			Board: [][]int{
+				{0, 0, 0, 0, 0, 0, 0, 0},
+				{0, 0, 0, 0, 0, 0, 0, 0},
+				{0, 0, 0, 0, 0, 0, 0, 0},
+				{0, 0, 0, WHITE, BLACK, 0, 0, 0},
+				{0, 0, 0, BLACK, WHITE, 0, 0, 0},
+				{0, 0, 0, 0, 0, 0, 0, 0},
+				{0, 0, 0, 0, 0, 0, 0, 0},
+				{0, 0, 0, 0, 0, 0, 0, 0},
+			},
+			ElapsedTurn: 1,
+			Rated:       e.Rated,
+		})
+		if e.Position != "" && e.Position != initialPosition {
+			if board, turn, err := ParsePosition(e.Position); err == nil {
+				s.Board, s.Turn, s.StartPosition = board, turn, e.Position
+			}
+		}
+		s.pending = nil
+	case EventJoined:
+		s.Players = append(s.Players, *e.User)
+		s.State = StateEstablished
+	case EventMove:
+		putDisc(s, e.Color, e.PosX, e.PosY)
+		updateSessionState(s, e.Color, e.PosX, e.PosY)
+	case EventPass, EventResign, EventExpired, EventAdjudicated, EventFinished:
+		s.State = e.State
+	}
+
+	s.Version++
+	s.UpdatedAt = e.Time
+	e.Seq = s.Version
+	e.SessionID = s.SessionID
+	s.pending = append(s.pending, e)
+}
+
+// applyMove applies the move and the pass or the end of the game following it
+func applyMove(s *Session, color, posX, posY int) {
+
+	s.Apply(GameEvent{Type: EventMove, Time: time.Now(), Color: color, PosX: posX, PosY: posY})
+
+	switch {
+	case IsSessionFinished(s):
+		s.Apply(GameEvent{Type: EventFinished, Time: time.Now(), State: s.State})
+	case s.State == StatePassedWhite || s.State == StatePassedBlack:
+		s.Apply(GameEvent{Type: EventPass, Time: time.Now(), State: s.State})
+	}
+}
+
+// snapshot is a session at an event
+type snapshot struct {
+	Seq     int      `json:"seq"`
+	Session *Session `json:"session"`
+}
+
+// Journal appends the events of every session to dir/<sessionID>.events and
+// snapshots of it to dir/<sessionID>.snapshots. Both files are append-only
+type Journal struct {
+	dir string
+
+	// SnapshotEvery is the number of events between snapshots
+	SnapshotEvery int
+
+	mu sync.Mutex
+}
+
+// OpenJournal opens the journal in dir
+func OpenJournal(dir string, snapshotEvery int) (*Journal, error) {
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if snapshotEvery <= 0 {
+		snapshotEvery = DefaultSnapshotEvery
+	}
+	return &Journal{dir: dir, SnapshotEvery: snapshotEvery}, nil
+}
+
+// Append appends the events and takes a snapshot of s when the events pass a multiple of SnapshotEvery
+func (j *Journal) Append(s *Session, events []GameEvent) error {
+
+	if len(events) == 0 {
+		return nil
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	lines := make([]interface{}, len(events))
+	for i := range events {
+		lines[i] = events[i]
+	}
+	if err := appendJSONLines(filepath.Join(j.dir, s.SessionID+".events"), lines); err != nil {
+		return err
+	}
+
+	first, last := events[0].Seq, events[len(events)-1].Seq
+	if last/j.SnapshotEvery > (first-1)/j.SnapshotEvery {
+		snap := &snapshot{Seq: last, Session: s.Clone()}
+		return appendJSONLines(filepath.Join(j.dir, s.SessionID+".snapshots"), []interface{}{snap})
+	}
+	return nil
+}
+
+// Events returns all events of the session
+func (j *Journal) Events(sessionID string) ([]GameEvent, error) {
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	events := make([]GameEvent, 0)
+	err := readJSONLines(filepath.Join(j.dir, sessionID+".events"), func(data []byte) error {
+		var e GameEvent
+		if err := json.Unmarshal(data, &e); err != nil {
+			return err
+		}
+		events = append(events, e)
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil, ErrSessionNotFound
+	}
+	return events, err
+}
+
+// Restore rebuilds the session as it was right after the event seq, or the latest when seq is 0,
+// starting from the latest snapshot before it
+func (j *Journal) Restore(sessionID string, seq int) (*Session, error) {
+
+	events, err := j.Events(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	// Seq is the version of the session, which Touch raises without an event, so it
+	// is not the index of the event. EventRemoved has no Seq
+	last := 0
+	for _, e := range events {
+		if e.Seq > last {
+			last = e.Seq
+		}
+	}
+	if seq <= 0 || seq > last {
+		seq = last
+	}
+
+	j.mu.Lock()
+	var base *snapshot
+	err = readJSONLines(filepath.Join(j.dir, sessionID+".snapshots"), func(data []byte) error {
+		snap := new(snapshot)
+		if err := json.Unmarshal(data, snap); err != nil {
+			return err
+		}
+		if snap.Seq <= seq && (base == nil || snap.Seq > base.Seq) {
+			base = snap
+		}
+		return nil
+	})
+	j.mu.Unlock()
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	s := new(Session)
+	if base != nil {
+		s = base.Session
+	}
+	for _, e := range events {
+		if e.Seq <= s.Version || e.Seq > seq {
+			continue
+		}
+		s.Apply(e)
+		s.Version = e.Seq
+	}
+	s.pending = nil
+
+	if s.SessionID == "" {
+		return nil, ErrSessionNotFound
+	}
+	return s, nil
+}
+
+// SessionIDs returns the sessions in the journal which are not removed
+func (j *Journal) SessionIDs() ([]string, error) {
+
+	entries, err := os.ReadDir(j.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0)
+	for _, e := range entries {
+		if id := strings.TrimSuffix(e.Name(), ".events"); id != e.Name() {
+			events, err := j.Events(id)
+			if err != nil {
+				return nil, err
+			}
+			if len(events) > 0 && events[len(events)-1].Type == EventRemoved {
+				continue
+			}
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// remove records the removal of the session. Its events are kept for audit
+func (j *Journal) remove(sessionID string) error {
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	e := GameEvent{SessionID: sessionID, Type: EventRemoved, Time: time.Now()}
+	return appendJSONLines(filepath.Join(j.dir, sessionID+".events"), []interface{}{e})
+}
+
+// JournalSessionStore serves sessions from memory and journals every change of them
+type JournalSessionStore struct {
+	*MemorySessionStore
+	journal *Journal
+}
+
+// NewJournalSessionStore rebuilds the sessions in the journal and journals their changes from now on
+func NewJournalSessionStore(j *Journal) (*JournalSessionStore, error) {
+
+	ids, err := j.SessionIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	st := NewMemorySessionStore()
+	for _, id := range ids {
+		s, err := j.Restore(id, 0)
+		if err != nil {
+			return nil, err
+		}
+		st.sessions[id] = s
+	}
+
+	st.save = func(s *Session) error {
+		events := s.pending
+		s.pending = nil
+		return j.Append(s, events)
+	}
+	st.remove = j.remove
+	return &JournalSessionStore{MemorySessionStore: st, journal: j}, nil
+}
+
+// Journal returns the journal of the store
+func (st *JournalSessionStore) Journal() *Journal {
+	return st.journal
+}
+
+// ErrNoJournal is returned when the store of the server does not journal events
+var ErrNoJournal = errors.New("Journal is not enabled")
+
+// journal returns the journal of the session store, if it has one
+func (sv *Server) journal() (*Journal, error) {
+	if js, ok := sv.Sessions.(interface{ Journal() *Journal }); ok {
+		return js.Journal(), nil
+	}
+	return nil, ErrNoJournal
+}
+
+func appendJSONLines(path string, lines []interface{}) error {
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	for _, line := range lines {
+		data, err := json.Marshal(line)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		w.Write(data)
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readJSONLines calls fn with every complete line. A torn last line left by a crash is ignored
+func readJSONLines(path string, fn func([]byte) error) error {
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	lines := strings.Split(string(data), "\n")
+	for i, line := range lines {
+		if line == "" {
+			continue
+		}
+		if err := fn([]byte(line)); err != nil {
+			if i == len(lines)-1 {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJournalSessionStore(t *testing.T) {
+
+	dir := t.TempDir()
+
+	j, err := OpenJournal(dir, 4)
+	if !assert.Nil(t, err) {
+		return
+	}
+	st, err := NewJournalSessionStore(j)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	sv := NewServer(st, NewMemoryUserStore())
+	white, session, err := sv.CreateSession("white")
+	assert.Nil(t, err)
+	black, _, err := sv.CreateSession("black")
+	assert.Nil(t, err)
+
+	moves := [][]int{{4, 2}, {5, 2}, {5, 3}, {3, 2}, {2, 2}}
+	for i, m := range moves {
+		player := white
+		if i%2 == 1 {
+			player = black
+		}
+		assert.Nil(t, sv.PlayMove(session.SessionID, player.UserID, m[0], m[1]))
+	}
+	assert.Equal(t, ErrCannotPut, sv.PlayMove(session.SessionID, black.UserID, 0, 0))
+
+	events, err := j.Events(session.SessionID)
+	assert.Nil(t, err)
+	if !assert.Len(t, events, 7) {
+		return
+	}
+	assert.Equal(t, EventCreated, events[0].Type)
+	assert.Equal(t, EventJoined, events[1].Type)
+	assert.Equal(t, EventMove, events[2].Type)
+	for i, e := range events {
+		assert.Equal(t, i+1, e.Seq)
+	}
+
+	// folding the events gives the live session
+	live, err := sv.GetSessionInfo(session.SessionID)
+	assert.Nil(t, err)
+	restored, err := j.Restore(session.SessionID, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, live.Board, restored.Board)
+	assert.Equal(t, live.MoveLog, restored.MoveLog)
+	assert.Equal(t, live.Version, restored.Version)
+
+	// restore right after the first move, before the latest snapshot
+	past, err := j.Restore(session.SessionID, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, past.Version)
+	assert.Equal(t, [][]int{{WHITE, 4, 2}}, past.MoveLog)
+	assert.Equal(t, WHITE, past.Board[2][4])
+
+	// a restarted server sees the same state
+	st, err = NewJournalSessionStore(j)
+	if !assert.Nil(t, err) {
+		return
+	}
+	s, err := st.Get(session.SessionID)
+	assert.Nil(t, err)
+	assert.Equal(t, live.Board, s.Board)
+	assert.Equal(t, []User{white, black}, s.Players)
+
+	// removed sessions are not restored, but their events are kept
+	assert.Nil(t, st.Delete(session.SessionID))
+	st, err = NewJournalSessionStore(j)
+	assert.Nil(t, err)
+	_, err = st.Get(session.SessionID)
+	assert.Equal(t, ErrSessionNotFound, err)
+	events, err = j.Events(session.SessionID)
+	assert.Nil(t, err)
+	assert.Equal(t, EventRemoved, events[len(events)-1].Type)
+}
+
+func TestJournalRestoreSeqGaps(t *testing.T) {
+
+	j, err := OpenJournal(t.TempDir(), 100)
+	if !assert.Nil(t, err) {
+		return
+	}
+	st, err := NewJournalSessionStore(j)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	sv := NewServer(st, NewMemoryUserStore())
+	white, session, _ := sv.CreateSession("white")
+	sv.CreateSession("black")
+
+	// Touch raises the version without an event
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, st.Update(session.SessionID, func(s *Session) error {
+			s.Touch()
+			return nil
+		}))
+	}
+	assert.Nil(t, sv.PlayMove(session.SessionID, white.UserID, 4, 2))
+
+	events, err := j.Events(session.SessionID)
+	assert.Nil(t, err)
+	if !assert.Len(t, events, 3) {
+		return
+	}
+	assert.Equal(t, 6, events[2].Seq)
+
+	live, _ := st.Get(session.SessionID)
+	restored, err := j.Restore(session.SessionID, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]int{{WHITE, 4, 2}}, restored.MoveLog)
+	assert.Equal(t, live.Board, restored.Board)
+	assert.Equal(t, live.Version, restored.Version)
+
+	// EventRemoved has no Seq, and does not cut the events before it
+	assert.Nil(t, st.Delete(session.SessionID))
+	restored, err = j.Restore(session.SessionID, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]int{{WHITE, 4, 2}}, restored.MoveLog)
+
+	past, err := j.Restore(session.SessionID, 5)
+	assert.Nil(t, err)
+	assert.Empty(t, past.MoveLog)
+}
+
+func TestResign(t *testing.T) {
+
+	j, err := OpenJournal(t.TempDir(), 0)
+	if !assert.Nil(t, err) {
+		return
+	}
+	st, err := NewJournalSessionStore(j)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	sv := NewServer(st, NewMemoryUserStore())
+	white, session, _ := sv.CreateSession("white")
+	assert.Equal(t, ErrSessionNotStarted, sv.Resign(session.SessionID, white.UserID))
+	sv.CreateSession("black")
+
+	assert.Equal(t, ErrNotPlayer, sv.Resign(session.SessionID, "nobody"))
+	assert.Nil(t, sv.Resign(session.SessionID, white.UserID))
+	assert.Equal(t, ErrGameFinished, sv.Resign(session.SessionID, white.UserID))
+
+	s, err := sv.GetSessionInfo(session.SessionID)
+	assert.Nil(t, err)
+	assert.Equal(t, StateWonBlack, s.State)
+
+	events, err := j.Events(session.SessionID)
+	assert.Nil(t, err)
+	assert.Equal(t, EventResign, events[len(events)-3].Type)
+	assert.Equal(t, EventFinished, events[len(events)-2].Type)
+	assert.Equal(t, EventRemoved, events[len(events)-1].Type)
+
+	restored, err := j.Restore(session.SessionID, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, StateWonBlack, restored.State)
+}
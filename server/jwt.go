@@ -0,0 +1,210 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// RoleGuest is the role of a user who plays without an account
+	RoleGuest string = "guest"
+
+	// RolePlayer is the role of the user of an account
+	RolePlayer string = "player"
+
+	// RoleModerator is the role of a user who closes and adjudicates games and bans players
+	RoleModerator string = "moderator"
+
+	// RoleAdmin is the role of a user who manages the server and the roles of users
+	RoleAdmin string = "admin"
+)
+
+// roleRanks orders the roles. A user has every role up to its own
+var roleRanks = map[string]int{RoleGuest: 0, RolePlayer: 1, RoleModerator: 2, RoleAdmin: 3}
+
+// minKeyBytes is the shortest signing key accepted, which is the size of the HMAC-SHA256 output
+const minKeyBytes = 32
+
+// ErrInvalidKeyring is returned when a keyring has no usable signing key
+var ErrInvalidKeyring = errors.New("invalid keyring")
+
+// Claims is the payload of an access token
+type Claims struct {
+	ID        string   `json:"jti"`
+	Subject   string   `json:"sub"`
+	Name      string   `json:"name"`
+	Roles     []string `json:"roles"`
+	IssuedAt  int64    `json:"iat"`
+	ExpiresAt int64    `json:"exp"`
+}
+
+// User returns the user the claims are about
+func (c *Claims) User() User {
+	return User{Name: c.Name, UserID: c.Subject, Registered: !c.HasRole(RoleGuest)}
+}
+
+// HasRole returns whether the claims grant the role
+func (c *Claims) HasRole(role string) bool {
+	for _, r := range c.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// userRole returns the role of the user
+func userRole(user User) string {
+	switch {
+	case !user.Registered:
+		return RoleGuest
+	case user.Role == "":
+		return RolePlayer
+	}
+	return user.Role
+}
+
+// hasRole returns whether the role of the user is role or above it
+func hasRole(user User, role string) bool {
+	return roleRanks[userRole(user)] >= roleRanks[role]
+}
+
+// userRoles returns the roles granted to the user
+func userRoles(user User) []string {
+
+	if !user.Registered {
+		return []string{RoleGuest}
+	}
+	roles := make([]string, 0, len(roleRanks))
+	for _, role := range []string{RolePlayer, RoleModerator, RoleAdmin} {
+		if hasRole(user, role) {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
+// jwtHeader is the header of a token signed with HMAC-SHA256 by the key of KeyID
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyID     string `json:"kid"`
+}
+
+// Keyring keeps the keys which sign access tokens. Tokens are signed by the current key
+// and verified by any key, so that a key is rotated by adding a new current key and
+// removing the old one once the tokens signed by it have expired. Every server sharing
+// a keyring accepts the tokens of the others
+type Keyring struct {
+	Current string            `json:"current"`
+	Keys    map[string][]byte `json:"keys"`
+}
+
+// NewRandomKeyring returns a keyring of a random key, whose tokens only this process accepts
+func NewRandomKeyring() *Keyring {
+
+	key := make([]byte, minKeyBytes)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return &Keyring{Current: "random", Keys: map[string][]byte{"random": key}}
+}
+
+// LoadKeyring reads a keyring from the JSON file at path, e.g.
+//
+//	{"current": "2024-02", "keys": {"2024-01": "<base64>", "2024-02": "<base64>"}}
+func LoadKeyring(path string) (*Keyring, error) {
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	kr := new(Keyring)
+	if err := json.Unmarshal(data, kr); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidKeyring, err.Error())
+	}
+	return kr, kr.validate()
+}
+
+func (kr *Keyring) validate() error {
+
+	if _, ok := kr.Keys[kr.Current]; !ok {
+		return fmt.Errorf("%w: no key %q", ErrInvalidKeyring, kr.Current)
+	}
+	for kid, key := range kr.Keys {
+		if len(key) < minKeyBytes {
+			return fmt.Errorf("%w: key %q is shorter than %d bytes", ErrInvalidKeyring, kid, minKeyBytes)
+		}
+	}
+	return nil
+}
+
+// Sign returns the claims signed by the current key
+func (kr *Keyring) Sign(claims *Claims) (string, error) {
+
+	header, err := json.Marshal(&jwtHeader{Algorithm: "HS256", Type: "JWT", KeyID: kr.Current})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign(kr.Keys[kr.Current], signed)), nil
+}
+
+// Verify returns the claims of the token when a key of the keyring signed it and it has not expired
+func (kr *Keyring) Verify(token string, now time.Time) (*Claims, error) {
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrUnauthorized
+	}
+
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil || header.Algorithm != "HS256" {
+		return nil, ErrUnauthorized
+	}
+	key, ok := kr.Keys[header.KeyID]
+	if !ok {
+		return nil, ErrUnauthorized
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(sig, sign(key, parts[0]+"."+parts[1])) {
+		return nil, ErrUnauthorized
+	}
+
+	claims := new(Claims)
+	if err := decodeSegment(parts[1], claims); err != nil || claims.Subject == "" {
+		return nil, ErrUnauthorized
+	}
+	if now.Unix() >= claims.ExpiresAt {
+		return nil, ErrUnauthorized
+	}
+	return claims, nil
+}
+
+func sign(key []byte, signed string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(signed))
+	return mac.Sum(nil)
+}
+
+func decodeSegment(segment string, v interface{}) error {
+
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
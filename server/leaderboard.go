@@ -0,0 +1,508 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// APILeaderboard is an API endpoint of the ranking of players, followed by what they are ranked by
+	APILeaderboard string = "/leaderboard"
+
+	// LeaderboardDaily, LeaderboardWeekly and LeaderboardAllTime are the time windows of leaderboards.
+	// Days and weeks are in UTC, and weeks are ISO weeks starting on Monday
+	LeaderboardDaily   string = "daily"
+	LeaderboardWeekly  string = "weekly"
+	LeaderboardAllTime string = "all"
+
+	// RankByRating, RankByWins and RankByWinRate are what players are ranked by
+	RankByRating  string = "rating"
+	RankByWins    string = "wins"
+	RankByWinRate string = "winrate"
+
+	// VariantStandard is a game from the initial position, and VariantCustom one from another position
+	VariantStandard string = "standard"
+	VariantCustom   string = "custom"
+
+	// DefaultLeaderboardLimit is the number of players in a leaderboard when the query does not tell
+	DefaultLeaderboardLimit int = 20
+
+	// MaxLeaderboardLimit is the upper bound of the number of players in a leaderboard
+	MaxLeaderboardLimit int = 100
+)
+
+// leaderboardWindows are the windows every game is counted in
+var leaderboardWindows = []string{LeaderboardDaily, LeaderboardWeekly, LeaderboardAllTime}
+
+// LeaderboardKey names a leaderboard, which counts the games of a variant finished in a period of a window
+type LeaderboardKey struct {
+	Variant string `json:"variant"`
+	Window  string `json:"window"`
+	Period  string `json:"period"`
+}
+
+// leaderboardKey returns the key of the leaderboard of the window counting the games finished at t
+func leaderboardKey(variant, window string, t time.Time) LeaderboardKey {
+
+	t = t.UTC()
+	period := "all"
+	switch window {
+	case LeaderboardDaily:
+		period = t.Format("2006-01-02")
+	case LeaderboardWeekly:
+		year, week := t.ISOWeek()
+		period = fmt.Sprintf("%04d-W%02d", year, week)
+	}
+	return LeaderboardKey{Variant: variant, Window: window, Period: period}
+}
+
+// gameVariant returns the variant of the game
+func gameVariant(game *GameRecord) string {
+	if game.StartPosition != "" {
+		return VariantCustom
+	}
+	return VariantStandard
+}
+
+// LeaderboardEntry counts the decided games of a player in a leaderboard
+type LeaderboardEntry struct {
+	UserID string `json:"userID"`
+	Name   string `json:"name"`
+	Games  int    `json:"games"`
+	Wins   int    `json:"wins"`
+	Losses int    `json:"losses"`
+	Draws  int    `json:"draws"`
+
+	// RatedGames counts the rated games, and Rating is the rating after the last of them
+	RatedGames int     `json:"ratedGames"`
+	Rating     float64 `json:"rating"`
+
+	// LastGameID is the last game counted, so that a game is not counted twice
+	LastGameID string `json:"lastGameID"`
+}
+
+// WinRate returns the ratio of the wins to the games
+func (e *LeaderboardEntry) WinRate() float64 {
+	if e.Games == 0 {
+		return 0
+	}
+	return float64(e.Wins) / float64(e.Games)
+}
+
+// LeaderboardQuery selects the top of a leaderboard
+type LeaderboardQuery struct {
+	LeaderboardKey
+	By       string
+	MinGames int
+	Limit    int
+}
+
+// LeaderboardStore keeps leaderboards, which are changed game by game so that ranking
+// never reads the sessions or the archive. Implementations must be safe for concurrent use
+type LeaderboardStore interface {
+	// Update changes the entry of the user in the leaderboard by fn atomically, starting
+	// from an empty entry. Nothing is changed when fn returns an error
+	Update(key LeaderboardKey, userID string, fn func(*LeaderboardEntry) error) error
+
+	// Top returns the entries of the leaderboard with at least MinGames games ranked by By,
+	// at most Limit of them. Ranking by rating only counts rated games
+	Top(q *LeaderboardQuery) ([]LeaderboardEntry, error)
+
+	// Purge removes the daily and weekly leaderboards of the periods before now
+	Purge(now time.Time) error
+
+	// DeleteUser removes the entries of the user
+	DeleteUser(userID string) error
+}
+
+// rankGame counts the finished game in the leaderboards of its registered players
+func (sv *Server) rankGame(game *GameRecord) error {
+
+	if game.Result == ResultNone {
+		return nil
+	}
+
+	for color, user := range map[int]User{WHITE: game.White, BLACK: game.Black} {
+		if !user.Registered {
+			continue
+		}
+
+		rating := 0.0
+		if game.Rated {
+			ur, err := sv.Ratings.Get(user.UserID)
+			if err != nil {
+				return err
+			}
+			rating = ur.Rating.Rating
+		}
+
+		won := (color == WHITE && game.Result == ResultWhite) || (color == BLACK && game.Result == ResultBlack)
+		for _, window := range leaderboardWindows {
+			err := sv.Leaderboards.Update(leaderboardKey(gameVariant(game), window, game.FinishedAt), user.UserID, func(e *LeaderboardEntry) error {
+				if e.LastGameID == game.GameID {
+					return nil
+				}
+				e.Name = user.Name
+				e.Games++
+				switch {
+				case game.Result == ResultDraw:
+					e.Draws++
+				case won:
+					e.Wins++
+				default:
+					e.Losses++
+				}
+				if game.Rated {
+					e.RatedGames++
+					e.Rating = rating
+				}
+				e.LastGameID = game.GameID
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// rankEntries sorts the entries as the query asks and returns the top of them
+func rankEntries(entries []LeaderboardEntry, q *LeaderboardQuery) []LeaderboardEntry {
+
+	ranked := make([]LeaderboardEntry, 0, len(entries))
+	for _, e := range entries {
+		games := e.Games
+		if q.By == RankByRating {
+			games = e.RatedGames
+		}
+		if games > 0 && games >= q.MinGames {
+			ranked = append(ranked, e)
+		}
+	}
+
+	sort.Slice(ranked, func(i, j int) bool {
+		a, b := &ranked[i], &ranked[j]
+		switch q.By {
+		case RankByRating:
+			if a.Rating != b.Rating {
+				return a.Rating > b.Rating
+			}
+		case RankByWins:
+			if a.Wins != b.Wins {
+				return a.Wins > b.Wins
+			}
+			if a.Games != b.Games {
+				return a.Games < b.Games
+			}
+		case RankByWinRate:
+			if a.WinRate() != b.WinRate() {
+				return a.WinRate() > b.WinRate()
+			}
+			if a.Games != b.Games {
+				return a.Games > b.Games
+			}
+		}
+		return a.UserID < b.UserID
+	})
+
+	if len(ranked) > q.Limit {
+		ranked = ranked[:q.Limit]
+	}
+	return ranked
+}
+
+// MemoryLeaderboardStore keeps leaderboards in memory
+type MemoryLeaderboardStore struct {
+	mu     sync.Mutex
+	boards map[LeaderboardKey]map[string]*LeaderboardEntry
+
+	// save and remove let a durable store write a change of a leaderboard through before it is committed
+	save   func(key LeaderboardKey, entries map[string]*LeaderboardEntry) error
+	remove func(key LeaderboardKey) error
+}
+
+// NewMemoryLeaderboardStore returns an empty MemoryLeaderboardStore
+func NewMemoryLeaderboardStore() *MemoryLeaderboardStore {
+	return &MemoryLeaderboardStore{boards: make(map[LeaderboardKey]map[string]*LeaderboardEntry)}
+}
+
+// Update ...
+func (st *MemoryLeaderboardStore) Update(key LeaderboardKey, userID string, fn func(*LeaderboardEntry) error) error {
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	e := &LeaderboardEntry{UserID: userID}
+	if stored, ok := st.boards[key][userID]; ok {
+		c := *stored
+		e = &c
+	}
+	if err := fn(e); err != nil {
+		return err
+	}
+
+	board, ok := st.boards[key]
+	if !ok {
+		board = make(map[string]*LeaderboardEntry)
+		st.boards[key] = board
+	}
+	stored, ok := board[userID]
+	board[userID] = e
+	if st.save != nil {
+		if err := st.save(key, board); err != nil {
+			// put the leaderboard back as it was
+			if ok {
+				board[userID] = stored
+			} else {
+				delete(board, userID)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Top ...
+func (st *MemoryLeaderboardStore) Top(q *LeaderboardQuery) ([]LeaderboardEntry, error) {
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	entries := make([]LeaderboardEntry, 0, len(st.boards[q.LeaderboardKey]))
+	for _, e := range st.boards[q.LeaderboardKey] {
+		entries = append(entries, *e)
+	}
+	return rankEntries(entries, q), nil
+}
+
+// Purge ...
+func (st *MemoryLeaderboardStore) Purge(now time.Time) error {
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	for key := range st.boards {
+		if key.Window == LeaderboardAllTime || key.Period >= leaderboardKey(key.Variant, key.Window, now).Period {
+			continue
+		}
+		if st.remove != nil {
+			if err := st.remove(key); err != nil {
+				return err
+			}
+		}
+		delete(st.boards, key)
+	}
+	return nil
+}
+
+// DeleteUser ...
+func (st *MemoryLeaderboardStore) DeleteUser(userID string) error {
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	for key, board := range st.boards {
+		if _, ok := board[userID]; !ok {
+			continue
+		}
+		c := make(map[string]*LeaderboardEntry, len(board))
+		for id, e := range board {
+			if id != userID {
+				c[id] = e
+			}
+		}
+		if st.save != nil {
+			if err := st.save(key, c); err != nil {
+				return err
+			}
+		}
+		st.boards[key] = c
+	}
+	return nil
+}
+
+// leaderboardFile is a leaderboard as kept in a file
+type leaderboardFile struct {
+	Key     LeaderboardKey               `json:"key"`
+	Entries map[string]*LeaderboardEntry `json:"entries"`
+}
+
+// NewFileLeaderboardStore returns a leaderboard store which keeps every leaderboard as a JSON file under dir/leaderboards
+func NewFileLeaderboardStore(dir string) (*MemoryLeaderboardStore, error) {
+
+	dir = filepath.Join(dir, "leaderboards")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	st := NewMemoryLeaderboardStore()
+	err := readJSONFiles(dir, func(data []byte) error {
+		f := new(leaderboardFile)
+		if err := json.Unmarshal(data, f); err != nil {
+			return err
+		}
+		st.boards[f.Key] = f.Entries
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	path := func(key LeaderboardKey) string {
+		return filepath.Join(dir, key.Variant+"_"+key.Window+"_"+key.Period+".json")
+	}
+	st.save = func(key LeaderboardKey, entries map[string]*LeaderboardEntry) error {
+		return writeJSONFile(path(key), &leaderboardFile{Key: key, Entries: entries})
+	}
+	st.remove = func(key LeaderboardKey) error {
+		return removeFile(path(key))
+	}
+	return st, nil
+}
+
+// LeaderboardRow is a ranked player
+type LeaderboardRow struct {
+	Rank       int     `json:"rank"`
+	UserID     string  `json:"userID"`
+	Name       string  `json:"name"`
+	Games      int     `json:"games"`
+	Wins       int     `json:"wins"`
+	Losses     int     `json:"losses"`
+	Draws      int     `json:"draws"`
+	WinRate    float64 `json:"winRate"`
+	RatedGames int     `json:"ratedGames"`
+	Rating     float64 `json:"rating,omitempty"`
+}
+
+// GetLeaderboardResponse is the top of a leaderboard
+type GetLeaderboardResponse struct {
+	Status  string `json:"status"`
+	By      string `json:"by"`
+	Variant string `json:"variant"`
+	Window  string `json:"window"`
+	Period  string `json:"period"`
+
+	Players []LeaderboardRow `json:"players"`
+}
+
+// parseLeaderboardQuery reads a LeaderboardQuery ranking by by from the query string of GET /leaderboard
+func parseLeaderboardQuery(by string, v url.Values, now time.Time) (*LeaderboardQuery, error) {
+
+	switch by {
+	case RankByRating, RankByWins, RankByWinRate:
+	default:
+		return nil, errors.New("Invalid leaderboard")
+	}
+
+	variant := v.Get("variant")
+	switch variant {
+	case "":
+		variant = VariantStandard
+	case VariantStandard, VariantCustom:
+	default:
+		return nil, errors.New("Invalid variant")
+	}
+
+	window := v.Get("window")
+	switch window {
+	case "":
+		window = LeaderboardAllTime
+	case LeaderboardDaily, LeaderboardWeekly, LeaderboardAllTime:
+	default:
+		return nil, errors.New("Invalid window")
+	}
+
+	q := &LeaderboardQuery{
+		LeaderboardKey: leaderboardKey(variant, window, now),
+		By:             by,
+		Limit:          DefaultLeaderboardLimit,
+	}
+
+	ints := []struct {
+		name string
+		dst  *int
+	}{
+		{"min_games", &q.MinGames},
+		{"limit", &q.Limit},
+	}
+	for _, i := range ints {
+		if s := v.Get(i.name); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 {
+				return nil, errors.New("Invalid " + i.name)
+			}
+			*i.dst = n
+		}
+	}
+	if q.Limit == 0 {
+		return nil, errors.New("Invalid limit")
+	}
+	if q.Limit > MaxLeaderboardLimit {
+		q.Limit = MaxLeaderboardLimit
+	}
+	return q, nil
+}
+
+// APIGetLeaderboard returns the top players of the current period of a leaderboard, ranked by rating unless the path tells
+func (sv *Server) APIGetLeaderboard(w http.ResponseWriter, r *http.Request) {
+
+	by := RankByRating
+	re := regexp.MustCompile(APILeaderboard + "/([a-z]+)")
+	if byMatch := re.FindStringSubmatch(r.URL.Path); len(byMatch) == 2 {
+		by = byMatch[1]
+	}
+
+	q, err := parseLeaderboardQuery(by, r.URL.Query(), time.Now())
+	if err != nil {
+		returnJSONMessage(w, http.StatusBadRequest, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: err.Error(),
+		})
+		return
+	}
+
+	entries, err := sv.Leaderboards.Top(q)
+	if err != nil {
+		fmt.Println("APIGetLeaderboard: " + err.Error())
+		returnJSONMessage(w, http.StatusInternalServerError, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: "Cannot read the leaderboard",
+		})
+		return
+	}
+
+	res := &GetLeaderboardResponse{
+		Status:  "success",
+		By:      q.By,
+		Variant: q.Variant,
+		Window:  q.Window,
+		Period:  q.Period,
+		Players: make([]LeaderboardRow, 0, len(entries)),
+	}
+	for i, e := range entries {
+		res.Players = append(res.Players, LeaderboardRow{
+			Rank:       i + 1,
+			UserID:     e.UserID,
+			Name:       e.Name,
+			Games:      e.Games,
+			Wins:       e.Wins,
+			Losses:     e.Losses,
+			Draws:      e.Draws,
+			WinRate:    e.WinRate(),
+			RatedGames: e.RatedGames,
+			Rating:     e.Rating,
+		})
+	}
+	returnJSONMessage(w, http.StatusOK, res)
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// winGame plays a session the winner wins by the resignation of the loser
+func winGame(t *testing.T, sv *Server, winner, loser User, rated bool) {
+
+	s, err := sv.JoinSession(winner, rated)
+	assert.Nil(t, err)
+	_, err = sv.JoinSession(loser, rated)
+	assert.Nil(t, err)
+	assert.Nil(t, sv.Resign(s.SessionID, loser.UserID))
+}
+
+func TestLeaderboard(t *testing.T) {
+
+	sv := NewServer(NewMemorySessionStore(), NewMemoryUserStore())
+	ts := httptest.NewServer(sv)
+	defer ts.Close()
+
+	alice, _ := sv.Register("alice", "correct horse")
+	bob, _ := sv.Register("bob", "correct horse")
+	carol, _ := sv.Register("carol", "correct horse")
+	guest, _ := sv.CreateUser("guest")
+
+	winGame(t, sv, alice, bob, true)
+	winGame(t, sv, alice, carol, false)
+	winGame(t, sv, carol, bob, false)
+	winGame(t, sv, guest, bob, false)
+
+	get := func(query string) *GetLeaderboardResponse {
+		res, err := http.Get(ts.URL + APILeaderboard + query)
+		if !assert.Nil(t, err) {
+			return nil
+		}
+		defer res.Body.Close()
+		board := new(GetLeaderboardResponse)
+		assert.Nil(t, json.NewDecoder(res.Body).Decode(board))
+		return board
+	}
+	ranking := func(board *GetLeaderboardResponse) []string {
+		names := make([]string, 0)
+		for _, p := range board.Players {
+			names = append(names, p.Name)
+		}
+		return names
+	}
+
+	wins := get("/wins")
+	assert.Equal(t, "success", wins.Status)
+	assert.Equal(t, LeaderboardAllTime, wins.Window)
+	assert.Equal(t, []string{"alice", "carol", "bob"}, ranking(wins))
+	assert.Equal(t, LeaderboardRow{Rank: 3, UserID: bob.UserID, Name: "bob", Games: 3, Losses: 3, RatedGames: 1, Rating: wins.Players[2].Rating}, wins.Players[2])
+	assert.Less(t, wins.Players[2].Rating, DefaultRating)
+
+	// only rated games rank by rating, which is the default
+	rating := get("?window=daily")
+	assert.Equal(t, RankByRating, rating.By)
+	assert.Equal(t, time.Now().UTC().Format("2006-01-02"), rating.Period)
+	assert.Equal(t, []string{"alice", "bob"}, ranking(rating))
+
+	assert.Equal(t, []string{"alice", "carol", "bob"}, ranking(get("/winrate?window=weekly&min_games=2")))
+	assert.Equal(t, []string{"bob"}, ranking(get("/winrate?min_games=3")))
+	assert.Equal(t, []string{"alice"}, ranking(get("/wins?limit=1")))
+	assert.Empty(t, get("/wins?variant=custom").Players)
+
+	for _, query := range []string{"/elo", "?window=monthly", "?variant=tiny", "?min_games=-1", "?limit=-1", "?limit=0"} {
+		res, err := http.Get(ts.URL + APILeaderboard + query)
+		if !assert.Nil(t, err) {
+			return
+		}
+		res.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, res.StatusCode, query)
+	}
+}
+
+func TestLeaderboardStores(t *testing.T) {
+
+	dir := t.TempDir()
+	sqlite, err := OpenSQLiteStore(filepath.Join(dir, "reversi.db"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer sqlite.Close()
+
+	files, err := NewFileLeaderboardStore(dir)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	now := time.Date(2024, 3, 4, 12, 0, 0, 0, time.UTC)
+	today := leaderboardKey(VariantStandard, LeaderboardDaily, now)
+	yesterday := leaderboardKey(VariantStandard, LeaderboardDaily, now.AddDate(0, 0, -1))
+	allTime := leaderboardKey(VariantStandard, LeaderboardAllTime, now.AddDate(-1, 0, 0))
+	assert.Equal(t, "2024-03-04", today.Period)
+	assert.Equal(t, "2024-W10", leaderboardKey(VariantStandard, LeaderboardWeekly, now).Period)
+
+	entries := []LeaderboardEntry{
+		{UserID: "u1", Games: 4, Wins: 2, RatedGames: 2, Rating: 1600},
+		{UserID: "u2", Games: 2, Wins: 2},
+		{UserID: "u3", Games: 3, Wins: 2, RatedGames: 3, Rating: 1700},
+		{UserID: "u4", Games: 1, Losses: 1, RatedGames: 1, Rating: 1400},
+	}
+
+	for _, st := range []LeaderboardStore{NewMemoryLeaderboardStore(), files, sqlite.Leaderboards()} {
+		for _, key := range []LeaderboardKey{today, yesterday, allTime} {
+			for _, e := range entries {
+				e := e
+				assert.Nil(t, st.Update(key, e.UserID, func(stored *LeaderboardEntry) error {
+					*stored = e
+					return nil
+				}))
+			}
+		}
+		assert.Equal(t, errBrokenStore, st.Update(today, "u4", func(e *LeaderboardEntry) error {
+			e.Wins = 100
+			return errBrokenStore
+		}))
+
+		top := func(by string, minGames int) []string {
+			got, err := st.Top(&LeaderboardQuery{LeaderboardKey: today, By: by, MinGames: minGames, Limit: 10})
+			assert.Nil(t, err)
+			ids := make([]string, 0)
+			for _, e := range got {
+				ids = append(ids, e.UserID)
+			}
+			return ids
+		}
+		assert.Equal(t, []string{"u3", "u1", "u4"}, top(RankByRating, 0))
+		assert.Equal(t, []string{"u3", "u1"}, top(RankByRating, 2))
+		assert.Equal(t, []string{"u2", "u3", "u1", "u4"}, top(RankByWins, 0))
+		assert.Equal(t, []string{"u2", "u3", "u1", "u4"}, top(RankByWinRate, 0))
+		assert.Equal(t, []string{"u3", "u1"}, top(RankByWinRate, 3))
+
+		assert.Nil(t, st.Purge(now))
+		got, err := st.Top(&LeaderboardQuery{LeaderboardKey: yesterday, By: RankByWins, Limit: 10})
+		assert.Nil(t, err)
+		assert.Empty(t, got)
+		got, err = st.Top(&LeaderboardQuery{LeaderboardKey: allTime, By: RankByWins, Limit: 10})
+		assert.Nil(t, err)
+		assert.Len(t, got, 4)
+
+		assert.Nil(t, st.DeleteUser("u2"))
+		assert.Equal(t, []string{"u3", "u1", "u4"}, top(RankByWins, 0))
+	}
+
+	files, err = NewFileLeaderboardStore(dir)
+	if !assert.Nil(t, err) {
+		return
+	}
+	got, err := files.Top(&LeaderboardQuery{LeaderboardKey: today, By: RankByRating, Limit: 1})
+	assert.Nil(t, err)
+	assert.Equal(t, []LeaderboardEntry{entries[2]}, got)
+}
@@ -0,0 +1,342 @@
+package server
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// FormatTranscript is a move list of standard Othello notation like "f5d6c3", black first,
+	// column a-h from the left and row 1-8 from the top
+	FormatTranscript string = "transcript"
+
+	// FormatGGF is the Generic Game Format used by online Othello servers
+	FormatGGF string = "ggf"
+)
+
+// ErrInvalidNotation is returned when a game cannot be read from its notation
+var ErrInvalidNotation = errors.New("Invalid notation")
+
+// Standard Othello notation starts with black to move, white on d4 and e5 and black on d5 and e4.
+// A session starts with WHITE to move from the same grids of the other colors, so notations swap
+// the colors and mirror the rows: WHITE of a session is black, and its grid (x, y) is on row 8-y
+
+// standardColor converts a color of a session to the color of standard notation, and back
+func standardColor(color int) int {
+	if color == EMPTY {
+		return EMPTY
+	}
+	return opponent(color)
+}
+
+// standardBoard converts a board of a session to the board of standard notation, and back
+func standardBoard(board [][]int) [][]int {
+
+	std := newBoard()
+	for y, row := range board {
+		for x, c := range row {
+			std[MaxBoardSize-1-y][x] = standardColor(c)
+		}
+	}
+	return std
+}
+
+// FormatMove converts (x, y) of a session to a move of standard notation like "d3"
+func FormatMove(x, y int) string {
+	return string(rune('a'+x)) + strconv.Itoa(MaxBoardSize-y)
+}
+
+// ParseMove converts a move of standard notation like "d3" to (x, y) of a session
+func ParseMove(move string) (int, int, error) {
+
+	move = strings.ToLower(move)
+	if len(move) != 2 || move[0] < 'a' || move[0] >= byte('a'+MaxBoardSize) ||
+		move[1] < '1' || move[1] >= byte('1'+MaxBoardSize) {
+		return 0, 0, fmt.Errorf("%w: move %q", ErrInvalidNotation, move)
+	}
+	return int(move[0] - 'a'), MaxBoardSize - 1 - int(move[1]-'1'), nil
+}
+
+// transcript returns the moves of a MoveLog, whose entries are [color, x, y], like "f5d6c3"
+func transcript(moveLog [][]int) string {
+
+	var b strings.Builder
+	for _, m := range moveLog {
+		b.WriteString(FormatMove(m[1], m[2]))
+	}
+	return b.String()
+}
+
+// notatedMove is a move read from a notation, in the colors and the grids of a session.
+// Color is EMPTY when the notation leaves it to the side to move
+type notatedMove struct {
+	Color int
+	X, Y  int
+	Pass  bool
+}
+
+// replayGame plays the moves from the start position, or the initial one when it is empty, and returns the
+// session after them. white plays WHITE of the session, which is black of standard notation. A side without a grid to put a disc on passes by itself, so explicit passes only have to agree with it
+func replayGame(sessionID string, white, black User, start string, moves []notatedMove) (*Session, error) {
+
+	if start != "" {
+		if _, _, err := ParsePosition(start); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidNotation, err)
+		}
+	}
+
+	s := newSessionAt(sessionID, white, start)
+	s.Pair(black)
+
+	for i, m := range moves {
+		if IsSessionFinished(s) {
+			return nil, fmt.Errorf("%w: move %d after the end of the game", ErrInvalidNotation, i+1)
+		}
+		if m.Pass {
+			if m.Color == s.Turn {
+				return nil, fmt.Errorf("%w: move %d passes with a grid to put a disc on", ErrInvalidNotation, i+1)
+			}
+			continue
+		}
+		if m.Color != EMPTY && m.Color != s.Turn {
+			return nil, fmt.Errorf("%w: move %d is out of turn", ErrInvalidNotation, i+1)
+		}
+		if putDisc(s.Clone(), s.Turn, m.X, m.Y) != 0 {
+			return nil, fmt.Errorf("%w: move %d %s is illegal", ErrInvalidNotation, i+1, FormatMove(m.X, m.Y))
+		}
+		applyMove(s, s.Turn, m.X, m.Y)
+	}
+	return s, nil
+}
+
+// ParseTranscript replays a transcript of standard notation from the initial position.
+// white plays WHITE of the session, which moves first as black of the transcript
+func ParseTranscript(sessionID string, white, black User, t string) (*Session, error) {
+
+	t = strings.Join(strings.Fields(t), "")
+	if len(t)%2 != 0 {
+		return nil, fmt.Errorf("%w: transcript has an odd length", ErrInvalidNotation)
+	}
+
+	moves := make([]notatedMove, 0, len(t)/2)
+	for i := 0; i < len(t); i += 2 {
+		x, y, err := ParseMove(t[i : i+2])
+		if err != nil {
+			return nil, err
+		}
+		moves = append(moves, notatedMove{X: x, Y: y})
+	}
+	return replayGame(sessionID, white, black, "", moves)
+}
+
+// ggfBoard returns the BO value of GGF for the position of a session. * is black and O is white
+func ggfBoard(position string) string {
+
+	board, turn, _ := ParsePosition(position)
+	marks := map[int]string{EMPTY: "-", WHITE: "O", BLACK: "*"}
+
+	var b strings.Builder
+	b.WriteString(strconv.Itoa(MaxBoardSize))
+	for _, row := range standardBoard(board) {
+		b.WriteString(" ")
+		for _, c := range row {
+			b.WriteString(marks[c])
+		}
+	}
+	b.WriteString(" " + marks[standardColor(turn)])
+	return b.String()
+}
+
+// ggfPosition converts the BO value of GGF to the position string of a session
+func ggfPosition(bo string) (string, error) {
+
+	fields := strings.Fields(bo)
+	if len(fields) != MaxBoardSize+2 || fields[0] != strconv.Itoa(MaxBoardSize) {
+		return "", fmt.Errorf("%w: board %q", ErrInvalidNotation, bo)
+	}
+
+	board, turn, err := ParsePosition(strings.Join(fields[1:len(fields)-1], "") + " " + fields[len(fields)-1])
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidNotation, err)
+	}
+	return FormatPosition(standardBoard(board), standardColor(turn)), nil
+}
+
+// ggfResult returns the RE value of GGF: the discs of black, WHITE of the session, minus the discs
+// of white. A game ended by resignation or time scores all grids for the winner, suffixed by :r
+func ggfResult(s *Session) string {
+
+	if !IsSessionFinished(s) || s.State == StateClose {
+		return "?"
+	}
+
+	first, second := CountDiscs(s.Board)
+	suffix := ""
+	if gameResult(s.Board) != s.State {
+		first, second = MaxBoardSize*MaxBoardSize, 0
+		if s.State == StateWonBlack {
+			first, second = second, first
+		}
+		suffix = ":r"
+	}
+	if first == second {
+		return "0.000"
+	}
+	return fmt.Sprintf("%+d.000", first-second) + suffix
+}
+
+// ExportGGF returns the session in GGF. Passes are written as PA.
+// The player of WHITE of the session is black of GGF, and moves first
+func ExportGGF(s *Session) string {
+
+	black, white := User{}, User{}
+	if len(s.Players) > 0 {
+		black = s.Players[0]
+	}
+	if len(s.Players) > 1 {
+		white = s.Players[1]
+	}
+
+	start := s.StartPosition
+	if start == "" {
+		start = initialPosition
+	}
+
+	var b strings.Builder
+	b.WriteString("(;GM[Othello]PC[rest_reversi]")
+	fmt.Fprintf(&b, "DT[%s]PB[%s]PW[%s]RE[%s]TY[%d]BO[%s]",
+		s.UpdatedAt.UTC().Format(time.RFC3339), ggfEscape(black.Name), ggfEscape(white.Name),
+		ggfResult(s), MaxBoardSize, ggfBoard(start))
+
+	tags := map[int]string{WHITE: "B", BLACK: "W"}
+	prev := EMPTY
+	for _, m := range s.MoveLog {
+		if m[0] == prev {
+			fmt.Fprintf(&b, "%s[PA]", tags[opponent(m[0])])
+		}
+		fmt.Fprintf(&b, "%s[%s]", tags[m[0]], FormatMove(m[1], m[2]))
+		prev = m[0]
+	}
+	b.WriteString(";)")
+	return b.String()
+}
+
+func ggfEscape(s string) string {
+	return strings.NewReplacer("\\", "\\\\", "]", "\\]").Replace(s)
+}
+
+var ggfProperty = regexp.MustCompile(`([A-Z]+)\[((?:[^\]\\]|\\.)*)\]`)
+
+// ParseGGF replays the first game of a GGF text
+func ParseGGF(sessionID string, text string) (*Session, error) {
+
+	begin := strings.Index(text, "(;")
+	end := strings.Index(text, ";)")
+	if begin < 0 || end < begin {
+		return nil, fmt.Errorf("%w: no game in GGF", ErrInvalidNotation)
+	}
+
+	// black of GGF plays WHITE of the session
+	var white, black User
+	start := ""
+	result := ""
+	moves := make([]notatedMove, 0)
+
+	for _, p := range ggfProperty.FindAllStringSubmatch(text[begin+2:end], -1) {
+		value := strings.NewReplacer("\\]", "]", "\\\\", "\\").Replace(p[2])
+		switch p[1] {
+		case "GM":
+			if !strings.EqualFold(value, "Othello") {
+				return nil, fmt.Errorf("%w: game %q is not Othello", ErrInvalidNotation, value)
+			}
+		case "PB":
+			white.Name = value
+		case "PW":
+			black.Name = value
+		case "RE":
+			result = value
+		case "BO":
+			position, err := ggfPosition(value)
+			if err != nil {
+				return nil, err
+			}
+			start = position
+		case "B", "W":
+			color := WHITE
+			if p[1] == "W" {
+				color = BLACK
+			}
+			move := strings.SplitN(value, "/", 2)[0]
+			if strings.EqualFold(move, "PA") {
+				moves = append(moves, notatedMove{Color: color, Pass: true})
+				continue
+			}
+			x, y, err := ParseMove(move)
+			if err != nil {
+				return nil, err
+			}
+			moves = append(moves, notatedMove{Color: color, X: x, Y: y})
+		}
+	}
+	if start == "" {
+		return nil, fmt.Errorf("%w: GGF has no BO", ErrInvalidNotation)
+	}
+
+	s, err := replayGame(sessionID, white, black, start, moves)
+	if err != nil {
+		return nil, err
+	}
+
+	// a game ended by resignation or time carries the winner in RE
+	if !IsSessionFinished(s) && result != "" && result != "?" {
+		state := StateDraw
+		switch result[0] {
+		case '+':
+			state = StateWonWhite
+		case '-':
+			state = StateWonBlack
+		}
+		s.Apply(GameEvent{Type: EventFinished, Time: time.Now(), State: state})
+	}
+	return s, nil
+}
+
+func opponent(color int) int {
+	if color == WHITE {
+		return BLACK
+	}
+	return WHITE
+}
+
+// ImportGame replays a game in the format and adds it to the archive
+func (sv *Server) ImportGame(format string, data string) (*GameRecord, error) {
+
+	gameID := fmt.Sprintf("%x", sha256.Sum224([]byte(data+strconv.FormatInt(time.Now().UnixNano(), 10))))
+
+	var s *Session
+	var err error
+	switch format {
+	case FormatTranscript:
+		s, err = ParseTranscript(gameID, User{}, User{}, data)
+	case FormatGGF:
+		s, err = ParseGGF(gameID, data)
+	default:
+		return nil, fmt.Errorf("%w: unknown format %q", ErrInvalidNotation, format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// an imported game can no longer be played
+	if !IsSessionFinished(s) {
+		s.Apply(GameEvent{Type: EventFinished, Time: time.Now(), State: StateClose})
+	}
+
+	game := NewGameRecord(s)
+	return game, sv.Games.Put(game)
+}
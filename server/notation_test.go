@@ -0,0 +1,217 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// randomGame plays random legal moves until the game is over
+func randomGame(seed int64) *Session {
+
+	r := rand.New(rand.NewSource(seed))
+	s := NewSession("random", User{Name: "white", UserID: "whiteID"})
+	s.Pair(User{Name: "black", UserID: "blackID"})
+	for !IsSessionFinished(s) {
+		cand := findCandidates(s, s.Turn)
+		c := cand[r.Intn(len(cand))]
+		applyMove(s, s.Turn, c[1], c[0])
+	}
+	return s
+}
+
+func TestParseMove(t *testing.T) {
+
+	// row 1 of standard notation is the last row of a session
+	x, y, err := ParseMove("d3")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, x)
+	assert.Equal(t, 5, y)
+	assert.Equal(t, "d3", FormatMove(x, y))
+
+	x, y, err = ParseMove("H8")
+	assert.Nil(t, err)
+	assert.Equal(t, 7, x)
+	assert.Equal(t, 0, y)
+
+	for _, move := range []string{"", "d", "i1", "a0", "a9", "3d", "dd", "d10"} {
+		_, _, err := ParseMove(move)
+		assert.ErrorIs(t, err, ErrInvalidNotation, move)
+	}
+}
+
+func TestTranscriptRoundTrip(t *testing.T) {
+
+	// black of the transcript plays WHITE of the session, on the mirrored row
+	s, err := ParseTranscript("t", User{}, User{}, "f5d6c3")
+	assert.Nil(t, err)
+	assert.Equal(t, [][]int{{WHITE, 5, 3}, {BLACK, 3, 2}, {WHITE, 2, 5}}, s.MoveLog)
+	assert.Equal(t, "f5d6c3", transcript(s.MoveLog))
+
+	for seed := int64(0); seed < 20; seed++ {
+		game := randomGame(seed)
+		s, err := ParseTranscript("t", User{}, User{}, transcript(game.MoveLog))
+		if !assert.Nil(t, err) {
+			return
+		}
+		assert.Equal(t, game.MoveLog, s.MoveLog)
+		assert.Equal(t, game.Board, s.Board)
+		assert.Equal(t, game.State, s.State)
+	}
+
+	for _, bad := range []string{"f5d", "f5f5", "z9", "e3", "f5d6c3c3", "a1"} {
+		_, err := ParseTranscript("t", User{}, User{}, bad)
+		assert.ErrorIs(t, err, ErrInvalidNotation, bad)
+	}
+}
+
+func TestStandardTranscript(t *testing.T) {
+
+	// the Rose, a main line of the opening books
+	rose := "f5d6c3d3c4f4c5b3c2e6c6b4b5d2e3a6c1b1"
+	s, err := ParseTranscript("t", User{}, User{}, rose)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, rose, transcript(s.MoveLog))
+	game := NewGameRecord(s)
+	assert.Equal(t, rose, game.Moves)
+
+	// black moves first, and f5 flips e5 of white
+	opening, err := ParseTranscript("t", User{}, User{}, "f5")
+	assert.Nil(t, err)
+	board := standardBoard(opening.Board)
+	assert.Equal(t, []int{EMPTY, EMPTY, EMPTY, WHITE, BLACK, EMPTY, EMPTY, EMPTY}, board[3])
+	assert.Equal(t, []int{EMPTY, EMPTY, EMPTY, BLACK, BLACK, BLACK, EMPTY, EMPTY}, board[4])
+	assert.Equal(t, WHITE, standardColor(opening.Turn))
+
+	text := ExportGGF(s)
+	assert.Contains(t, text, "BO[8 -------- -------- -------- ---O*--- ---*O--- -------- -------- -------- *]B[f5]W[d6]B[c3]W[d3]")
+	imported, err := ParseGGF("g", text)
+	assert.Nil(t, err)
+	assert.Equal(t, rose, transcript(imported.MoveLog))
+}
+
+func TestGGFRoundTrip(t *testing.T) {
+
+	passes := 0
+	for seed := int64(0); seed < 20; seed++ {
+		game := randomGame(seed)
+		text := ExportGGF(game)
+		passes += strings.Count(text, "[PA]")
+
+		s, err := ParseGGF("g", text)
+		if !assert.Nil(t, err, text) {
+			return
+		}
+		assert.Equal(t, game.MoveLog, s.MoveLog)
+		assert.Equal(t, game.Board, s.Board)
+		assert.Equal(t, game.State, s.State)
+		assert.Equal(t, "white", s.Players[0].Name)
+		assert.Equal(t, "black", s.Players[1].Name)
+		assert.Equal(t, text[strings.Index(text, "BO["):], ExportGGF(s)[strings.Index(ExportGGF(s), "BO["):])
+	}
+	assert.NotZero(t, passes, "no game with a pass")
+
+	// a resigned game keeps its winner. White of GGF plays BLACK of the session
+	s, err := ParseTranscript("t", User{Name: "b"}, User{Name: "w"}, "f5d6c3")
+	assert.Nil(t, err)
+	s.Apply(GameEvent{Type: EventResign, State: StateWonBlack})
+	text := ExportGGF(s)
+	assert.Contains(t, text, "PB[b]PW[w]RE[-64.000:r]")
+	assert.Contains(t, text, "BO[8 -------- -------- -------- ---O*--- ---*O--- -------- -------- -------- *]B[f5]W[d6]B[c3];)")
+	s, err = ParseGGF("g", text)
+	assert.Nil(t, err)
+	assert.Equal(t, StateWonBlack, s.State)
+
+	// as written by the online servers
+	s, err = ParseGGF("g", "(;GM[Othello]PB[b\\]]PW[w]TY[8]BO[8 -------- -------- -------- ---O*--- ---*O--- -------- -------- -------- *]B[f5//0.5]W[d6];)")
+	assert.Nil(t, err)
+	assert.Equal(t, [][]int{{WHITE, 5, 3}, {BLACK, 3, 2}}, s.MoveLog)
+	assert.Equal(t, "b]", s.Players[0].Name)
+	assert.Equal(t, "w", s.Players[1].Name)
+
+	for _, bad := range []string{
+		"",
+		"(;GM[Chess];)",
+		"(;GM[Othello]TY[8]W[e3];)",
+		"(;GM[Othello]BO[4 ---- -OX- -XO- ---- O];)",
+		"(;GM[Othello]BO[8 -------- -------- -------- ---O*--- ---*O--- -------- -------- -------- O]B[f5];)",
+		"(;GM[Othello]BO[8 -------- -------- -------- ---O*--- ---*O--- -------- -------- -------- O]W[PA];)",
+	} {
+		_, err := ParseGGF("g", bad)
+		assert.ErrorIs(t, err, ErrInvalidNotation, bad)
+	}
+}
+
+func TestImportExport(t *testing.T) {
+
+	sv := NewServer(NewMemorySessionStore(), NewMemoryUserStore())
+	ts := httptest.NewServer(sv)
+	defer ts.Close()
+
+	user, _ := sv.CreateUser("importer")
+	tokens, _ := sv.IssueTokens(user)
+	token := tokens.AccessToken
+
+	game := randomGame(1)
+	body, _ := json.Marshal(&PostImportRequest{Format: FormatGGF, Data: ExportGGF(game)})
+	res, err := http.Post(ts.URL+APIGames+APIGamesImport, "application/json", bytes.NewReader(body))
+	if !assert.Nil(t, err) {
+		return
+	}
+	res.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+	res, err = postWithToken(ts.URL+APIGames+APIGamesImport, token, body)
+	if !assert.Nil(t, err) {
+		return
+	}
+	var record GameRecord
+	assert.Nil(t, json.NewDecoder(res.Body).Decode(&record))
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, transcript(game.MoveLog), record.Moves)
+
+	// the imported game is replayable from the archive like any finished session
+	res, err = http.Get(ts.URL + APISession + "/" + record.GameID + APISessionExport)
+	if !assert.Nil(t, err) {
+		return
+	}
+	text, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, transcript(game.MoveLog)+"\n", string(text))
+
+	res, err = http.Get(ts.URL + APISession + "/" + record.GameID + APISessionExport + "?format=ggf")
+	if !assert.Nil(t, err) {
+		return
+	}
+	text, _ = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.True(t, strings.HasPrefix(string(text), "(;GM[Othello]"))
+
+	// an unfinished transcript is closed
+	body, _ = json.Marshal(&PostImportRequest{Format: FormatTranscript, Data: "f5d6"})
+	res, err = postWithToken(ts.URL+APIGames+APIGamesImport, token, body)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Nil(t, json.NewDecoder(res.Body).Decode(&record))
+	res.Body.Close()
+	assert.Equal(t, ResultNone, record.Result)
+
+	body, _ = json.Marshal(&PostImportRequest{Format: FormatTranscript, Data: "a1"})
+	res, err = postWithToken(ts.URL+APIGames+APIGamesImport, token, body)
+	if !assert.Nil(t, err) {
+		return
+	}
+	res.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
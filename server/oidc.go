@@ -0,0 +1,755 @@
+package server
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// APIOIDC is the prefix of the API endpoints signing in through an OpenID Connect provider
+	APIOIDC string = "/oidc"
+
+	// APIOIDCLogin is an API endpoint that redirects to the provider to sign in
+	APIOIDCLogin string = "/login"
+
+	// APIOIDCLink is an API endpoint that returns the URL of the provider which
+	// links the identity signed in to the user of the access token
+	APIOIDCLink string = "/link"
+
+	// APIOIDCCallback is the API endpoint the provider redirects back to with a code
+	APIOIDCCallback string = "/callback"
+)
+
+const (
+	// OIDCStateTTL is the time a sign in may take at the provider
+	OIDCStateTTL time.Duration = 10 * time.Minute
+
+	// oidcClockSkew is the difference of the clocks of the provider and the server allowed
+	oidcClockSkew = time.Minute
+
+	// OIDCStateCookie is the cookie which binds a sign in to the browser that started it.
+	// It holds the hash of the state
+	OIDCStateCookie string = "oidc_state"
+)
+
+var (
+	// ErrOIDCDisabled is returned when no OpenID Connect provider is configured
+	ErrOIDCDisabled = errors.New("OpenID Connect is not configured")
+
+	// ErrInvalidState is returned when a callback has an unknown or expired state
+	ErrInvalidState = errors.New("Invalid state")
+
+	// ErrInvalidIDToken is returned when an ID token is not signed by the provider,
+	// is not for this client or has expired
+	ErrInvalidIDToken = errors.New("Invalid ID token")
+
+	// ErrIdentityNotFound is returned when no user is linked to the identity
+	ErrIdentityNotFound = errors.New("Identity not found")
+
+	// ErrIdentityLinked is returned when the identity is linked to another user
+	ErrIdentityLinked = errors.New("Identity is linked to another user")
+)
+
+// OIDCConfig configures the OpenID Connect provider users sign in with
+type OIDCConfig struct {
+	// Issuer is the URL of the provider, which serves Issuer/.well-known/openid-configuration
+	Issuer string
+
+	// ClientID and ClientSecret are the credentials of the server at the provider
+	ClientID     string
+	ClientSecret string
+
+	// RedirectURL is the URL of APIOIDC+APIOIDCCallback registered at the provider
+	RedirectURL string
+}
+
+// Identity is a user of the provider linked to a user of the server
+type Identity struct {
+	Issuer   string    `json:"issuer"`
+	Subject  string    `json:"subject"`
+	UserID   string    `json:"userID"`
+	Email    string    `json:"email,omitempty"`
+	LinkedAt time.Time `json:"linkedAt"`
+}
+
+// IdentityStore keeps the identities of users. Implementations must be safe for concurrent use
+type IdentityStore interface {
+	// Get returns the identity of the subject of the issuer, or ErrIdentityNotFound
+	Get(issuer, subject string) (Identity, error)
+
+	// Link adds the identity, or returns ErrIdentityLinked when it is linked already
+	Link(identity Identity) error
+
+	// DeleteUser removes the identities of the user
+	DeleteUser(userID string) error
+}
+
+// identityKey is the key of the identity in the stores
+func identityKey(issuer, subject string) string {
+	return fmt.Sprintf("%x", sha256.Sum224([]byte(issuer+"\x00"+subject)))
+}
+
+// oidcDiscovery is the part of the configuration of a provider the server uses
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// jsonWebKey is an RSA key of a JWK set
+type jsonWebKey struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Use     string `json:"use"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+}
+
+// oidcState is a sign in waiting for the callback. UserID is the user the identity is linked to,
+// or "" to sign in by the identity
+type oidcState struct {
+	Nonce    string
+	Verifier string
+	UserID   string
+	Expires  time.Time
+}
+
+// IDClaims is the payload of an ID token
+type IDClaims struct {
+	Issuer            string       `json:"iss"`
+	Subject           string       `json:"sub"`
+	Audience          oidcAudience `json:"aud"`
+	ExpiresAt         int64        `json:"exp"`
+	IssuedAt          int64        `json:"iat"`
+	Nonce             string       `json:"nonce"`
+	Email             string       `json:"email"`
+	Name              string       `json:"name"`
+	PreferredUsername string       `json:"preferred_username"`
+}
+
+// oidcAudience is the audience of an ID token, which is a string or an array of them
+type oidcAudience []string
+
+func (a *oidcAudience) UnmarshalJSON(data []byte) error {
+
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*a = oidcAudience{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	*a = many
+	return nil
+}
+
+// OIDCProvider signs users in by the authorization code flow of an OpenID Connect provider.
+// The configuration and the keys of the provider are fetched on the first sign in
+type OIDCProvider struct {
+	config OIDCConfig
+	client *http.Client
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]*rsa.PublicKey
+	states    map[string]oidcState
+}
+
+// NewOIDCProvider returns a provider of the configuration
+func NewOIDCProvider(config OIDCConfig) *OIDCProvider {
+	return &OIDCProvider{
+		config: config,
+		client: &http.Client{Timeout: 10 * time.Second},
+		keys:   make(map[string]*rsa.PublicKey),
+		states: make(map[string]oidcState),
+	}
+}
+
+// discover returns the configuration of the provider
+func (p *OIDCProvider) discover() (*oidcDiscovery, error) {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	d := new(oidcDiscovery)
+	if err := p.getJSON(strings.TrimSuffix(p.config.Issuer, "/")+"/.well-known/openid-configuration", d); err != nil {
+		return nil, err
+	}
+	if d.Issuer != p.config.Issuer {
+		return nil, fmt.Errorf("issuer %q of the provider is not %q", d.Issuer, p.config.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, fmt.Errorf("provider %q has no endpoints", d.Issuer)
+	}
+	p.discovery = d
+	return d, nil
+}
+
+// getJSON reads the JSON at the URL into v
+func (p *OIDCProvider) getJSON(url string, v interface{}) error {
+
+	res, err := p.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// randomString returns a random URL safe string
+func randomString() (string, error) {
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// AuthCodeURL returns the URL of the provider where a user signs in, and the state of the
+// sign in. The identity is linked to the user of userID, or signs in by itself when userID is ""
+func (p *OIDCProvider) AuthCodeURL(userID string) (string, string, error) {
+
+	d, err := p.discover()
+	if err != nil {
+		return "", "", err
+	}
+
+	state, err := randomString()
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := randomString()
+	if err != nil {
+		return "", "", err
+	}
+	verifier, err := randomString()
+	if err != nil {
+		return "", "", err
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+
+	p.mu.Lock()
+	p.states[state] = oidcState{Nonce: nonce, Verifier: verifier, UserID: userID, Expires: time.Now().Add(OIDCStateTTL)}
+	p.mu.Unlock()
+
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.config.ClientID},
+		"redirect_uri":          {p.config.RedirectURL},
+		"scope":                 {"openid profile email"},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + query.Encode(), state, nil
+}
+
+// Exchange redeems the code of the callback of the state, and returns the claims of the ID
+// token and the user the identity is linked to, or "" to sign in by the identity. binding is
+// the OIDCStateCookie of the browser, which must be the hash of the state
+func (p *OIDCProvider) Exchange(state, binding, code string) (*IDClaims, string, error) {
+
+	if subtle.ConstantTimeCompare([]byte(binding), []byte(hashToken(state))) != 1 {
+		return nil, "", ErrInvalidState
+	}
+
+	p.mu.Lock()
+	s, ok := p.states[state]
+	delete(p.states, state)
+	p.mu.Unlock()
+	if !ok || time.Now().After(s.Expires) {
+		return nil, "", ErrInvalidState
+	}
+
+	d, err := p.discover()
+	if err != nil {
+		return nil, "", err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.config.RedirectURL},
+		"code_verifier": {s.Verifier},
+	}
+	req, err := http.NewRequest("POST", d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, "", ErrInvalidIDToken
+	}
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&tokens); err != nil {
+		return nil, "", err
+	}
+
+	claims, err := p.verify(tokens.IDToken, time.Now())
+	if err != nil {
+		return nil, "", err
+	}
+	if claims.Nonce != s.Nonce {
+		return nil, "", ErrInvalidIDToken
+	}
+	return claims, s.UserID, nil
+}
+
+// verify returns the claims of the ID token when the provider signed it for this client
+func (p *OIDCProvider) verify(token string, now time.Time) (*IDClaims, error) {
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidIDToken
+	}
+
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil || header.Algorithm != "RS256" {
+		return nil, ErrInvalidIDToken
+	}
+	key, err := p.key(header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidIDToken
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) != nil {
+		return nil, ErrInvalidIDToken
+	}
+
+	claims := new(IDClaims)
+	if err := decodeSegment(parts[1], claims); err != nil || claims.Subject == "" {
+		return nil, ErrInvalidIDToken
+	}
+	if claims.Issuer != p.config.Issuer || !claims.Audience.has(p.config.ClientID) {
+		return nil, ErrInvalidIDToken
+	}
+	if now.Add(-oidcClockSkew).Unix() >= claims.ExpiresAt {
+		return nil, ErrInvalidIDToken
+	}
+	return claims, nil
+}
+
+func (a oidcAudience) has(clientID string) bool {
+	for _, aud := range a {
+		if aud == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// key returns the signing key of the provider. The keys are fetched again for an unknown
+// key ID, since the provider rotates them
+func (p *OIDCProvider) key(keyID string) (*rsa.PublicKey, error) {
+
+	p.mu.Lock()
+	key, ok := p.keys[keyID]
+	p.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	d, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := p.getJSON(d.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, jwk := range set.Keys {
+		if jwk.KeyType != "RSA" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(jwk.N)
+		e, errE := base64.RawURLEncoding.DecodeString(jwk.E)
+		if errN != nil || errE != nil || len(e) > 4 {
+			continue
+		}
+		keys[jwk.KeyID] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+
+	p.mu.Lock()
+	p.keys = keys
+	p.mu.Unlock()
+
+	if key, ok := keys[keyID]; ok {
+		return key, nil
+	}
+	return nil, ErrInvalidIDToken
+}
+
+// Purge forgets the sign ins which took longer than OIDCStateTTL
+func (p *OIDCProvider) Purge(now time.Time) {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for state, s := range p.states {
+		if now.After(s.Expires) {
+			delete(p.states, state)
+		}
+	}
+}
+
+// SignInIdentity returns the user linked to the identity of the claims. An identity first signed
+// in is linked to the user of linkUserID, or to a new registered user when linkUserID is ""
+func (sv *Server) SignInIdentity(claims *IDClaims, linkUserID string) (User, error) {
+
+	identity, err := sv.Identities.Get(claims.Issuer, claims.Subject)
+	if err == nil {
+		if linkUserID != "" && linkUserID != identity.UserID {
+			return User{}, ErrIdentityLinked
+		}
+		user, err := sv.Users.Get(identity.UserID)
+		if err == nil && user.Banned {
+			return User{}, ErrBanned
+		}
+		return user, err
+	}
+	if err != ErrIdentityNotFound {
+		return User{}, err
+	}
+
+	var user User
+	if linkUserID != "" {
+		if user, err = sv.Users.Get(linkUserID); err != nil {
+			return User{}, err
+		}
+		if user.Banned {
+			return User{}, ErrBanned
+		}
+		// a guest linking an identity keeps it as a registered user
+		if !user.Registered {
+			err := sv.Users.Update(linkUserID, func(u *User) error {
+				u.Registered = true
+				user = *u
+				return nil
+			})
+			if err != nil {
+				return User{}, err
+			}
+		}
+	} else {
+		user = newUser(identityName(claims))
+		user.Registered = true
+		if err := sv.Users.Put(user); err != nil {
+			return User{}, err
+		}
+		if err := sv.createProfile(user); err != nil {
+			return User{}, err
+		}
+	}
+
+	err = sv.Identities.Link(Identity{
+		Issuer:   claims.Issuer,
+		Subject:  claims.Subject,
+		UserID:   user.UserID,
+		Email:    claims.Email,
+		LinkedAt: time.Now(),
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+// identityName returns the name of a new user of the identity
+func identityName(claims *IDClaims) string {
+
+	switch {
+	case claims.PreferredUsername != "":
+		return claims.PreferredUsername
+	case claims.Name != "":
+		return claims.Name
+	case claims.Email != "":
+		name, _, _ := strings.Cut(claims.Email, "@")
+		return name
+	}
+	return "player"
+}
+
+// APIGetOIDCLogin redirects to the provider to sign in
+func (sv *Server) APIGetOIDCLogin(w http.ResponseWriter, r *http.Request) {
+
+	if sv.OIDC == nil {
+		returnJSONMessage(w, http.StatusNotFound, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: ErrOIDCDisabled.Error(),
+		})
+		return
+	}
+
+	authURL, state, err := sv.OIDC.AuthCodeURL("")
+	if err != nil {
+		fmt.Println("APIGetOIDCLogin: " + err.Error())
+		returnJSONMessage(w, http.StatusBadGateway, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: "Cannot reach the provider",
+		})
+		return
+	}
+	sv.setOIDCStateCookie(w, r, state)
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// setOIDCStateCookie sets the OIDCStateCookie of the state, or removes it when state is "".
+// SameSite=Lax lets the browser send it on the redirect back from the provider
+func (sv *Server) setOIDCStateCookie(w http.ResponseWriter, r *http.Request, state string) {
+
+	cookie := &http.Cookie{
+		Name:     OIDCStateCookie,
+		Path:     APIOIDC,
+		HttpOnly: true,
+		Secure:   r.TLS != nil || strings.HasPrefix(sv.OIDC.config.RedirectURL, "https:"),
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   -1,
+	}
+	if state != "" {
+		cookie.Value = hashToken(state)
+		cookie.MaxAge = int(OIDCStateTTL / time.Second)
+	}
+	http.SetCookie(w, cookie)
+}
+
+// PostOIDCLinkResponse ...
+type PostOIDCLinkResponse struct {
+	Status string `json:"status"`
+	URL    string `json:"url"`
+}
+
+// APIPostOIDCLink returns the URL of the provider where the user of the access token signs in
+// to link the identity to itself
+func (sv *Server) APIPostOIDCLink(w http.ResponseWriter, r *http.Request) {
+
+	if sv.OIDC == nil {
+		returnJSONMessage(w, http.StatusNotFound, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: ErrOIDCDisabled.Error(),
+		})
+		return
+	}
+
+	user, err := sv.authenticate(r)
+	if err != nil {
+		returnAuthError(w, err)
+		return
+	}
+
+	authURL, state, err := sv.OIDC.AuthCodeURL(user.UserID)
+	if err != nil {
+		fmt.Println("APIPostOIDCLink: " + err.Error())
+		returnJSONMessage(w, http.StatusBadGateway, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: "Cannot reach the provider",
+		})
+		return
+	}
+	sv.setOIDCStateCookie(w, r, state)
+	returnJSONMessage(w, http.StatusOK, &PostOIDCLinkResponse{
+		Status: "success",
+		URL:    authURL,
+	})
+}
+
+// APIGetOIDCCallback signs in the user of the identity the provider redirected back with
+func (sv *Server) APIGetOIDCCallback(w http.ResponseWriter, r *http.Request) {
+
+	if sv.OIDC == nil {
+		returnJSONMessage(w, http.StatusNotFound, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: ErrOIDCDisabled.Error(),
+		})
+		return
+	}
+
+	var binding string
+	if cookie, err := r.Cookie(OIDCStateCookie); err == nil {
+		binding = cookie.Value
+	}
+	sv.setOIDCStateCookie(w, r, "")
+
+	query := r.URL.Query()
+	if reason := query.Get("error"); reason != "" {
+		returnJSONMessage(w, http.StatusUnauthorized, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: "Sign in failed: " + reason,
+		})
+		return
+	}
+
+	claims, linkUserID, err := sv.OIDC.Exchange(query.Get("state"), binding, query.Get("code"))
+	if err == nil {
+		var user User
+		if user, err = sv.SignInIdentity(claims, linkUserID); err == nil {
+			sv.returnLogin(w, user)
+			return
+		}
+	}
+
+	switch err {
+	case ErrInvalidState, ErrInvalidIDToken:
+		returnJSONMessage(w, http.StatusUnauthorized, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: err.Error(),
+		})
+	case ErrBanned:
+		returnAuthError(w, err)
+	case ErrIdentityLinked:
+		returnJSONMessage(w, http.StatusConflict, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: err.Error(),
+		})
+	default:
+		fmt.Println("APIGetOIDCCallback: " + err.Error())
+		returnJSONMessage(w, http.StatusBadGateway, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: "Cannot sign in",
+		})
+	}
+}
+
+// MemoryIdentityStore keeps identities in memory
+type MemoryIdentityStore struct {
+	mu         sync.RWMutex
+	identities map[string]Identity
+
+	// save and remove let a durable store write a change through before it is committed
+	save   func(Identity) error
+	remove func(Identity) error
+}
+
+// NewMemoryIdentityStore returns an empty MemoryIdentityStore
+func NewMemoryIdentityStore() *MemoryIdentityStore {
+	return &MemoryIdentityStore{identities: make(map[string]Identity)}
+}
+
+// Get ...
+func (st *MemoryIdentityStore) Get(issuer, subject string) (Identity, error) {
+
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	identity, ok := st.identities[identityKey(issuer, subject)]
+	if !ok {
+		return identity, ErrIdentityNotFound
+	}
+	return identity, nil
+}
+
+// Link ...
+func (st *MemoryIdentityStore) Link(identity Identity) error {
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	key := identityKey(identity.Issuer, identity.Subject)
+	if _, ok := st.identities[key]; ok {
+		return ErrIdentityLinked
+	}
+	if st.save != nil {
+		if err := st.save(identity); err != nil {
+			return err
+		}
+	}
+	st.identities[key] = identity
+	return nil
+}
+
+// DeleteUser ...
+func (st *MemoryIdentityStore) DeleteUser(userID string) error {
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	for key, identity := range st.identities {
+		if identity.UserID != userID {
+			continue
+		}
+		if st.remove != nil {
+			if err := st.remove(identity); err != nil {
+				return err
+			}
+		}
+		delete(st.identities, key)
+	}
+	return nil
+}
+
+// NewFileIdentityStore returns an identity store which keeps every identity as a JSON file under dir/identities
+func NewFileIdentityStore(dir string) (*MemoryIdentityStore, error) {
+
+	dir = filepath.Join(dir, "identities")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	st := NewMemoryIdentityStore()
+	err := readJSONFiles(dir, func(data []byte) error {
+		var identity Identity
+		if err := json.Unmarshal(data, &identity); err != nil {
+			return err
+		}
+		st.identities[identityKey(identity.Issuer, identity.Subject)] = identity
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	st.save = func(identity Identity) error {
+		return writeJSONFile(filepath.Join(dir, identityKey(identity.Issuer, identity.Subject)+".json"), identity)
+	}
+	st.remove = func(identity Identity) error {
+		return removeFile(filepath.Join(dir, identityKey(identity.Issuer, identity.Subject)+".json"))
+	}
+	return st, nil
+}
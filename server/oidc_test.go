@@ -0,0 +1,347 @@
+package server
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// mockOIDCProvider is an OpenID Connect provider which signs in the identity it is told to
+// without asking anyone
+type mockOIDCProvider struct {
+	*httptest.Server
+
+	key          *rsa.PrivateKey
+	clientID     string
+	clientSecret string
+
+	mu sync.Mutex
+	// claims are those of the next sign in, and err is the error it is denied by
+	claims IDClaims
+	err    string
+	codes  map[string]url.Values
+}
+
+func newMockOIDCProvider(t *testing.T) *mockOIDCProvider {
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &mockOIDCProvider{key: key, clientID: "reversi", clientSecret: "s3cret", codes: make(map[string]url.Values)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 p.URL,
+			"authorization_endpoint": p.URL + "/authorize",
+			"token_endpoint":         p.URL + "/token",
+			"jwks_uri":               p.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "k1",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		back := url.Values{"state": {query.Get("state")}}
+
+		p.mu.Lock()
+		if p.err != "" {
+			back.Set("error", p.err)
+		} else if query.Get("client_id") != p.clientID || query.Get("response_type") != "code" {
+			back.Set("error", "unauthorized_client")
+		} else {
+			code, _ := randomString()
+			p.codes[code] = query
+			back.Set("code", code)
+		}
+		p.mu.Unlock()
+
+		http.Redirect(w, r, query.Get("redirect_uri")+"?"+back.Encode(), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		id, secret, _ := r.BasicAuth()
+		r.ParseForm()
+		auth, ok := p.codes[r.PostForm.Get("code")]
+		delete(p.codes, r.PostForm.Get("code"))
+		challenge := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if !ok || id != p.clientID || secret != p.clientSecret ||
+			r.PostForm.Get("redirect_uri") != auth.Get("redirect_uri") ||
+			base64.RawURLEncoding.EncodeToString(challenge[:]) != auth.Get("code_challenge") {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+
+		claims := p.claims
+		claims.Issuer = p.URL
+		claims.Nonce = auth.Get("nonce")
+		if claims.Audience == nil {
+			claims.Audience = oidcAudience{p.clientID}
+		}
+		if claims.ExpiresAt == 0 {
+			claims.ExpiresAt = time.Now().Add(time.Hour).Unix()
+		}
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "at", "token_type": "Bearer", "id_token": p.sign(&claims)})
+	})
+
+	p.Server = httptest.NewServer(mux)
+	return p
+}
+
+// sign returns the ID token of the claims
+func (p *mockOIDCProvider) sign(claims *IDClaims) string {
+
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": "k1"})
+	payload, _ := json.Marshal(map[string]interface{}{
+		"iss":                claims.Issuer,
+		"sub":                claims.Subject,
+		"aud":                []string(claims.Audience),
+		"exp":                claims.ExpiresAt,
+		"iat":                time.Now().Unix(),
+		"nonce":              claims.Nonce,
+		"email":              claims.Email,
+		"preferred_username": claims.PreferredUsername,
+	})
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, _ := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, digest[:])
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// signInAs makes the next sign in that of the identity
+func (p *mockOIDCProvider) signInAs(claims IDClaims, err string) {
+	p.mu.Lock()
+	p.claims, p.err = claims, err
+	p.mu.Unlock()
+}
+
+func TestOIDC(t *testing.T) {
+
+	provider := newMockOIDCProvider(t)
+	defer provider.Close()
+
+	sv := NewServer(NewMemorySessionStore(), NewMemoryUserStore())
+	ts := httptest.NewServer(sv)
+	defer ts.Close()
+
+	// the endpoints are not served without a provider
+	res, err := http.Get(ts.URL + APIOIDC + APIOIDCLogin)
+	if !assert.Nil(t, err) {
+		return
+	}
+	res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	sv.OIDC = NewOIDCProvider(OIDCConfig{
+		Issuer:       provider.URL,
+		ClientID:     provider.clientID,
+		ClientSecret: provider.clientSecret,
+		RedirectURL:  ts.URL + APIOIDC + APIOIDCCallback,
+	})
+
+	// browser keeps the OIDCStateCookie between the start of a sign in and the callback
+	jar, _ := cookiejar.New(nil)
+	browser := &http.Client{Jar: jar}
+
+	// signIn follows the redirects of the sign in at the URL to the callback
+	signIn := func(url string) (int, *LoginResponse) {
+		res, err := browser.Get(url)
+		if !assert.Nil(t, err) {
+			return 0, nil
+		}
+		defer res.Body.Close()
+		login := new(LoginResponse)
+		if res.StatusCode == http.StatusOK {
+			assert.Nil(t, json.NewDecoder(res.Body).Decode(login))
+		}
+		return res.StatusCode, login
+	}
+
+	// an identity first signed in is a new registered user
+	provider.signInAs(IDClaims{Subject: "sub-1", PreferredUsername: "carol", Email: "carol@example.com"}, "")
+	status, carol := signIn(ts.URL + APIOIDC + APIOIDCLogin)
+	if !assert.Equal(t, http.StatusOK, status) {
+		return
+	}
+	assert.Equal(t, "carol", carol.Username)
+	user, err := sv.Users.Get(carol.UserID)
+	assert.Nil(t, err)
+	assert.True(t, user.Registered)
+	claims, err := sv.Authenticate(carol.Token)
+	if assert.Nil(t, err) {
+		assert.True(t, claims.HasRole(RolePlayer))
+	}
+
+	status, again := signIn(ts.URL + APIOIDC + APIOIDCLogin)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, carol.UserID, again.UserID)
+
+	// a user links an identity to itself
+	alice, _ := sv.Register("alice", "correct horse")
+	tokens, _ := sv.IssueTokens(alice)
+	link := func(token string) string {
+		req, _ := http.NewRequest("POST", ts.URL+APIOIDC+APIOIDCLink, strings.NewReader("{}"))
+		req.Header.Set("Authorization", "Bearer "+token)
+		res, err := browser.Do(req)
+		if !assert.Nil(t, err) {
+			return ""
+		}
+		defer res.Body.Close()
+		var got PostOIDCLinkResponse
+		assert.Nil(t, json.NewDecoder(res.Body).Decode(&got))
+		return got.URL
+	}
+
+	provider.signInAs(IDClaims{Subject: "sub-2"}, "")
+	status, linked := signIn(link(tokens.AccessToken))
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, alice.UserID, linked.UserID)
+	identity, err := sv.Identities.Get(provider.URL, "sub-2")
+	if assert.Nil(t, err) {
+		assert.Equal(t, alice.UserID, identity.UserID)
+	}
+
+	provider.signInAs(IDClaims{Subject: "sub-1"}, "")
+	status, _ = signIn(link(tokens.AccessToken))
+	assert.Equal(t, http.StatusConflict, status)
+
+	// a guest linking an identity is registered
+	guest, _ := sv.CreateUser("guest")
+	tokens, _ = sv.IssueTokens(guest)
+	provider.signInAs(IDClaims{Subject: "sub-3"}, "")
+	status, _ = signIn(link(tokens.AccessToken))
+	assert.Equal(t, http.StatusOK, status)
+	user, _ = sv.Users.Get(guest.UserID)
+	assert.True(t, user.Registered)
+
+	// sign ins are refused when they are denied, replayed or not for this client
+	provider.signInAs(IDClaims{Subject: "sub-1"}, "access_denied")
+	status, _ = signIn(ts.URL + APIOIDC + APIOIDCLogin)
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	status, _ = signIn(ts.URL + APIOIDC + APIOIDCCallback + "?state=nothing&code=nothing")
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	// a callback is refused in a browser which did not start the sign in
+	provider.signInAs(IDClaims{Subject: "sub-1"}, "")
+	noRedirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	callback := ts.URL + APIOIDC + APIOIDCLogin
+	for _, hop := range []string{"provider", "callback"} {
+		res, err := noRedirect.Get(callback)
+		if !assert.Nil(t, err) {
+			return
+		}
+		res.Body.Close()
+		if !assert.Equal(t, http.StatusFound, res.StatusCode, hop) {
+			return
+		}
+		callback = res.Header.Get("Location")
+	}
+	res, err = http.Get(callback)
+	if assert.Nil(t, err) {
+		res.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	}
+	status, _ = signIn(callback)
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	for _, claims := range []IDClaims{
+		{Subject: "sub-1", Audience: oidcAudience{"someone else"}},
+		{Subject: "sub-1", ExpiresAt: time.Now().Add(-time.Hour).Unix()},
+		{Subject: ""},
+	} {
+		provider.signInAs(claims, "")
+		status, _ = signIn(ts.URL + APIOIDC + APIOIDCLogin)
+		assert.Equal(t, http.StatusUnauthorized, status)
+	}
+
+	// banned users do not sign in
+	assert.Nil(t, sv.Ban(carol.UserID, true))
+	provider.signInAs(IDClaims{Subject: "sub-1"}, "")
+	status, _ = signIn(ts.URL + APIOIDC + APIOIDCLogin)
+	assert.Equal(t, http.StatusForbidden, status)
+
+	// a sign in never finished is forgotten
+	_, _, err = sv.OIDC.AuthCodeURL("")
+	assert.Nil(t, err)
+	sv.OIDC.Purge(time.Now().Add(OIDCStateTTL + time.Second))
+	assert.Empty(t, sv.OIDC.states)
+}
+
+func TestIdentityStores(t *testing.T) {
+
+	dir := t.TempDir()
+	sqlite, err := OpenSQLiteStore(filepath.Join(dir, "reversi.db"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer sqlite.Close()
+
+	files, err := NewFileIdentityStore(dir)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	linkedAt := time.Now().UTC().Truncate(time.Second)
+	identities := []Identity{
+		{Issuer: "https://idp.example.com", Subject: "s1", UserID: "u1", Email: "u1@example.com", LinkedAt: linkedAt},
+		{Issuer: "https://idp.example.com", Subject: "s2", UserID: "u1", LinkedAt: linkedAt},
+		{Issuer: "https://other.example.com", Subject: "s1", UserID: "u2", LinkedAt: linkedAt},
+	}
+
+	for _, st := range []IdentityStore{NewMemoryIdentityStore(), files, sqlite.Identities()} {
+		_, err := st.Get("https://idp.example.com", "s1")
+		assert.Equal(t, ErrIdentityNotFound, err)
+
+		for _, identity := range identities {
+			assert.Nil(t, st.Link(identity))
+		}
+		assert.Equal(t, ErrIdentityLinked, st.Link(Identity{Issuer: "https://idp.example.com", Subject: "s1", UserID: "u3"}))
+
+		got, err := st.Get("https://other.example.com", "s1")
+		assert.Nil(t, err)
+		assert.Equal(t, identities[2], got)
+	}
+
+	files, err = NewFileIdentityStore(dir)
+	if !assert.Nil(t, err) {
+		return
+	}
+	got, err := files.Get("https://idp.example.com", "s1")
+	assert.Nil(t, err)
+	assert.Equal(t, identities[0], got)
+
+	for _, st := range []IdentityStore{files, sqlite.Identities()} {
+		assert.Nil(t, st.DeleteUser("u1"))
+		_, err = st.Get("https://idp.example.com", "s2")
+		assert.Equal(t, ErrIdentityNotFound, err)
+		_, err = st.Get("https://other.example.com", "s1")
+		assert.Nil(t, err)
+	}
+}
@@ -0,0 +1,359 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// RecentGamesLimit is the number of recent games a profile keeps
+const RecentGamesLimit int = 10
+
+// ErrProfileNotFound is returned when the user has no profile
+var ErrProfileNotFound = errors.New("Invalid profile")
+
+// ColorStats counts the decided games of a user with one color
+type ColorStats struct {
+	Played int `json:"played"`
+	Wins   int `json:"wins"`
+	Losses int `json:"losses"`
+	Draws  int `json:"draws"`
+}
+
+func (c *ColorStats) add(result int) {
+	c.Played++
+	switch {
+	case result > 0:
+		c.Wins++
+	case result < 0:
+		c.Losses++
+	default:
+		c.Draws++
+	}
+}
+
+// UserStats counts the decided games of a user. Games closed without a winner are not counted
+type UserStats struct {
+	ColorStats
+
+	White ColorStats `json:"white"`
+	Black ColorStats `json:"black"`
+
+	// DiscDiff is the sum of the own discs less the discs of the opponent at the end of the games
+	DiscDiff int `json:"discDiff"`
+
+	// Streak is the number of wins in a row up to the last game, and LongestStreak the most ever
+	Streak        int `json:"streak"`
+	LongestStreak int `json:"longestStreak"`
+}
+
+// AverageDiscDiff returns the average of the own discs less the discs of the opponent
+func (st *UserStats) AverageDiscDiff() float64 {
+	if st.Played == 0 {
+		return 0
+	}
+	return float64(st.DiscDiff) / float64(st.Played)
+}
+
+// Profile is what the server knows about a user besides the name
+type Profile struct {
+	UserID    string    `json:"userID"`
+	CreatedAt time.Time `json:"createdAt"`
+	Stats     UserStats `json:"stats"`
+
+	// Recent has the IDs of the last games of the user, the latest first
+	Recent []string `json:"recent"`
+}
+
+// record counts the game played by the user with color, unless it has been counted already
+func (p *Profile) record(game *GameRecord, color int) {
+
+	for _, id := range p.Recent {
+		if id == game.GameID {
+			return
+		}
+	}
+	p.Recent = append([]string{game.GameID}, p.Recent...)
+	if len(p.Recent) > RecentGamesLimit {
+		p.Recent = p.Recent[:RecentGamesLimit]
+	}
+
+	if game.Result == ResultNone {
+		return
+	}
+
+	own, other := game.WhiteDiscs, game.BlackDiscs
+	won, lost := ResultWhite, ResultBlack
+	byColor := &p.Stats.White
+	if color == BLACK {
+		own, other = other, own
+		won, lost = lost, won
+		byColor = &p.Stats.Black
+	}
+
+	result := 0
+	switch game.Result {
+	case won:
+		result = 1
+	case lost:
+		result = -1
+	}
+
+	p.Stats.add(result)
+	byColor.add(result)
+	p.Stats.DiscDiff += own - other
+	if result > 0 {
+		p.Stats.Streak++
+	} else {
+		p.Stats.Streak = 0
+	}
+	if p.Stats.Streak > p.Stats.LongestStreak {
+		p.Stats.LongestStreak = p.Stats.Streak
+	}
+}
+
+// ProfileStore keeps profiles. Implementations must be safe for concurrent use
+type ProfileStore interface {
+	// Get returns the profile of the user, or ErrProfileNotFound
+	Get(userID string) (*Profile, error)
+
+	// Update changes the profile of the user by fn atomically, starting from an empty
+	// profile when the user has none. Nothing is changed when fn returns an error
+	Update(userID string, fn func(*Profile) error) error
+
+	// Delete removes the profile of the user
+	Delete(userID string) error
+}
+
+// recordGame counts the finished game in the profiles of its players
+func (sv *Server) recordGame(game *GameRecord) error {
+
+	for color, user := range map[int]User{WHITE: game.White, BLACK: game.Black} {
+		err := sv.Profiles.Update(user.UserID, func(p *Profile) error {
+			p.record(game, color)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createProfile starts the profile of a user registered now
+func (sv *Server) createProfile(user User) error {
+	return sv.Profiles.Update(user.UserID, func(p *Profile) error {
+		p.CreatedAt = time.Now()
+		return nil
+	})
+}
+
+// MemoryProfileStore keeps profiles in memory
+type MemoryProfileStore struct {
+	mu       sync.Mutex
+	profiles map[string]*Profile
+
+	// save and remove let a durable store write a change through before it is committed
+	save   func(*Profile) error
+	remove func(userID string) error
+}
+
+// NewMemoryProfileStore returns an empty MemoryProfileStore
+func NewMemoryProfileStore() *MemoryProfileStore {
+	return &MemoryProfileStore{profiles: make(map[string]*Profile)}
+}
+
+// Get ...
+func (st *MemoryProfileStore) Get(userID string) (*Profile, error) {
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	p, ok := st.profiles[userID]
+	if !ok {
+		return nil, ErrProfileNotFound
+	}
+	return p.clone(), nil
+}
+
+// Update ...
+func (st *MemoryProfileStore) Update(userID string, fn func(*Profile) error) error {
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	p := &Profile{UserID: userID}
+	if stored, ok := st.profiles[userID]; ok {
+		p = stored.clone()
+	}
+	if err := fn(p); err != nil {
+		return err
+	}
+	if st.save != nil {
+		if err := st.save(p); err != nil {
+			return err
+		}
+	}
+	st.profiles[userID] = p
+	return nil
+}
+
+// Delete ...
+func (st *MemoryProfileStore) Delete(userID string) error {
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.remove != nil {
+		if err := st.remove(userID); err != nil {
+			return err
+		}
+	}
+	delete(st.profiles, userID)
+	return nil
+}
+
+func (p *Profile) clone() *Profile {
+	c := *p
+	c.Recent = append([]string(nil), p.Recent...)
+	return &c
+}
+
+// NewFileProfileStore returns a profile store which keeps every profile as a JSON file under dir/profiles
+func NewFileProfileStore(dir string) (*MemoryProfileStore, error) {
+
+	dir = filepath.Join(dir, "profiles")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	st := NewMemoryProfileStore()
+	err := readJSONFiles(dir, func(data []byte) error {
+		p := new(Profile)
+		if err := json.Unmarshal(data, p); err != nil {
+			return err
+		}
+		st.profiles[p.UserID] = p
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	st.save = func(p *Profile) error {
+		return writeJSONFile(filepath.Join(dir, p.UserID+".json"), p)
+	}
+	st.remove = func(userID string) error {
+		return removeFile(filepath.Join(dir, userID+".json"))
+	}
+	return st, nil
+}
+
+// UserStatsResponse is UserStats with the averages
+type UserStatsResponse struct {
+	UserStats
+	AverageDiscDiff float64 `json:"averageDiscDiff"`
+}
+
+// GetUserResponse is the profile of a user
+type GetUserResponse struct {
+	Status     string            `json:"status"`
+	Name       string            `json:"name"`
+	UserID     string            `json:"userID"`
+	Registered bool              `json:"registered"`
+	CreatedAt  *time.Time        `json:"createdAt,omitempty"`
+	Stats      UserStatsResponse `json:"stats"`
+
+	// RecentGames are the summaries of the last games, the latest first
+	RecentGames []*GameRecord `json:"recentGames"`
+
+	// Rating is the rating of a registered user by the rated games
+	Rating *RatingResponse `json:"rating,omitempty"`
+}
+
+// GetProfile returns the profile of the user
+func (sv *Server) GetProfile(userID string) (*GetUserResponse, error) {
+
+	user, err := sv.Users.Get(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := sv.Profiles.Get(userID)
+	if err == ErrProfileNotFound {
+		// the user was registered before profiles were kept
+		p, err = &Profile{UserID: userID}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res := &GetUserResponse{
+		Status:      "success",
+		Name:        user.Name,
+		UserID:      user.UserID,
+		Registered:  user.Registered,
+		Stats:       UserStatsResponse{UserStats: p.Stats, AverageDiscDiff: p.Stats.AverageDiscDiff()},
+		RecentGames: make([]*GameRecord, 0, len(p.Recent)),
+	}
+	if !p.CreatedAt.IsZero() {
+		res.CreatedAt = &p.CreatedAt
+	}
+	for _, id := range p.Recent {
+		game, err := sv.Games.Get(id)
+		if err == ErrGameNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		res.RecentGames = append(res.RecentGames, game.summary())
+	}
+
+	if user.Registered {
+		ur, err := sv.GetRating(userID)
+		if err != nil {
+			return nil, err
+		}
+		res.Rating = newRatingResponse(ur)
+	}
+	return res, nil
+}
+
+// APIGetUser returns the profile of the user
+func (sv *Server) APIGetUser(w http.ResponseWriter, r *http.Request) {
+
+	re := regexp.MustCompile(APIUser + "/([a-zA-Z0-9]+)")
+	userIDMatch := re.FindStringSubmatch(r.URL.Path)
+	if len(userIDMatch) < 2 {
+		returnJSONMessage(w, http.StatusInternalServerError, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: "Invalid username",
+		})
+		return
+	}
+
+	profile, err := sv.GetProfile(userIDMatch[1])
+	if err == ErrUserNotFound {
+		returnJSONMessage(w, http.StatusNotFound, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		fmt.Println("APIGetUser: " + err.Error())
+		returnJSONMessage(w, http.StatusInternalServerError, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: "Cannot read the user",
+		})
+		return
+	}
+	returnJSONMessage(w, http.StatusOK, profile)
+}
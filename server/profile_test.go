@@ -0,0 +1,141 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProfileStats(t *testing.T) {
+
+	sv := NewServer(NewMemorySessionStore(), NewMemoryUserStore())
+	ts := httptest.NewServer(sv)
+	defer ts.Close()
+
+	alice, _ := sv.Register("alice", "correct horse")
+	bob, _ := sv.Register("bob", "correct horse")
+
+	// alice wins with white by 4 discs to 1
+	first, _ := sv.JoinSession(alice, false)
+	sv.JoinSession(bob, false)
+	assert.Nil(t, sv.PlayMove(first.SessionID, alice.UserID, 4, 2))
+	assert.Nil(t, sv.Resign(first.SessionID, bob.UserID))
+
+	// and with black as bob resigns at once
+	second, _ := sv.JoinSession(bob, false)
+	sv.JoinSession(alice, false)
+	assert.Nil(t, sv.Resign(second.SessionID, bob.UserID))
+
+	profile, err := sv.GetProfile(alice.UserID)
+	if !assert.Nil(t, err) {
+		return
+	}
+	stats := profile.Stats
+	assert.Equal(t, ColorStats{Played: 2, Wins: 2}, stats.ColorStats)
+	assert.Equal(t, ColorStats{Played: 1, Wins: 1}, stats.White)
+	assert.Equal(t, ColorStats{Played: 1, Wins: 1}, stats.Black)
+	assert.Equal(t, 3, stats.DiscDiff)
+	assert.Equal(t, 1.5, stats.AverageDiscDiff)
+	assert.Equal(t, 2, stats.Streak)
+	assert.Equal(t, 2, stats.LongestStreak)
+	assert.NotNil(t, profile.CreatedAt)
+	if assert.Len(t, profile.RecentGames, 2) {
+		assert.Equal(t, second.SessionID, profile.RecentGames[0].GameID)
+		assert.Nil(t, profile.RecentGames[0].Session)
+	}
+
+	// a game is counted once
+	game, _ := sv.Games.Get(first.SessionID)
+	assert.Nil(t, sv.recordGame(game))
+
+	res, err := http.Get(ts.URL + APIUser + "/" + bob.UserID)
+	if !assert.Nil(t, err) {
+		return
+	}
+	var got GetUserResponse
+	assert.Nil(t, json.NewDecoder(res.Body).Decode(&got))
+	res.Body.Close()
+	assert.Equal(t, "success", got.Status)
+	assert.Equal(t, "bob", got.Name)
+	assert.True(t, got.Registered)
+	assert.Equal(t, ColorStats{Played: 2, Losses: 2}, got.Stats.ColorStats)
+	assert.Equal(t, -3, got.Stats.DiscDiff)
+	assert.Equal(t, 0, got.Stats.LongestStreak)
+	assert.Len(t, got.RecentGames, 2)
+
+	res, err = http.Get(ts.URL + APIUser + "/nobody")
+	if !assert.Nil(t, err) {
+		return
+	}
+	res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
+func TestProfileRecord(t *testing.T) {
+
+	p := &Profile{}
+	for i, result := range []string{ResultWhite, ResultWhite, ResultBlack, ResultDraw, ResultNone, ResultWhite} {
+		p.record(&GameRecord{GameID: string(rune('a' + i)), Result: result, WhiteDiscs: 40, BlackDiscs: 24}, WHITE)
+	}
+	assert.Equal(t, ColorStats{Played: 5, Wins: 3, Losses: 1, Draws: 1}, p.Stats.ColorStats)
+	assert.Equal(t, 5*16, p.Stats.DiscDiff)
+	assert.Equal(t, 1, p.Stats.Streak)
+	assert.Equal(t, 2, p.Stats.LongestStreak)
+	assert.Equal(t, []string{"f", "e", "d", "c", "b", "a"}, p.Recent)
+
+	for i := 0; i < RecentGamesLimit; i++ {
+		p.record(&GameRecord{GameID: string(rune('A' + i)), Result: ResultNone}, BLACK)
+	}
+	assert.Len(t, p.Recent, RecentGamesLimit)
+	assert.Equal(t, 0, p.Stats.Black.Played)
+}
+
+func TestProfileStores(t *testing.T) {
+
+	dir := t.TempDir()
+	sqlite, err := OpenSQLiteStore(filepath.Join(dir, "reversi.db"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer sqlite.Close()
+
+	files, err := NewFileProfileStore(dir)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	for _, st := range []ProfileStore{NewMemoryProfileStore(), files, sqlite.Profiles()} {
+		_, err := st.Get("u1")
+		assert.Equal(t, ErrProfileNotFound, err)
+
+		assert.Nil(t, st.Update("u1", func(p *Profile) error {
+			p.Recent = append(p.Recent, "g1")
+			return nil
+		}))
+		assert.Equal(t, errBrokenStore, st.Update("u1", func(p *Profile) error {
+			p.Recent = append(p.Recent, "g2")
+			return errBrokenStore
+		}))
+
+		p, err := st.Get("u1")
+		assert.Nil(t, err)
+		assert.Equal(t, "u1", p.UserID)
+		assert.Equal(t, []string{"g1"}, p.Recent)
+	}
+
+	files, err = NewFileProfileStore(dir)
+	if !assert.Nil(t, err) {
+		return
+	}
+	p, err := files.Get("u1")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"g1"}, p.Recent)
+
+	assert.Nil(t, files.Delete("u1"))
+	_, err = files.Get("u1")
+	assert.Equal(t, ErrProfileNotFound, err)
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMaxBodyBytes is the default size limit of a request body
+	DefaultMaxBodyBytes int64 = 64 << 10
+
+	// DefaultMaxOpenSessions is the default number of sessions a user may wait in or play at once
+	DefaultMaxOpenSessions int = 5
+)
+
+// ErrTooManySessions is returned when a user joins a session with MaxOpenSessions open already
+var ErrTooManySessions = errors.New("Too many open sessions")
+
+// RateLimit allows Burst requests at once, refilled at Rate requests a second. A zero Rate is no limit
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// LimitConfig configures the limits protecting the server from abuse
+type LimitConfig struct {
+	// IP limits every request by the address of the client
+	IP RateLimit
+
+	// User limits the requests with an access token by its user
+	User RateLimit
+
+	// Signup limits the requests creating users, POST /user, /account and /analysis and
+	// the callback of the OpenID Connect provider, by the address of the client
+	Signup RateLimit
+
+	// TrustProxy takes the address of the client from X-Forwarded-For, which only
+	// a reverse proxy in front of the server may set
+	TrustProxy bool
+
+	// MaxOpenSessions is the number of sessions a user may wait in or play at once, 0 for no limit
+	MaxOpenSessions int
+
+	// MaxBodyBytes is the size limit of a request body
+	MaxBodyBytes int64
+}
+
+// tokenBucket holds the requests a key may make now
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter limits requests by their key with a token bucket of each key.
+// A nil RateLimiter allows every request
+type RateLimiter struct {
+	limit RateLimit
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// NewRateLimiter returns a limiter of the limit, or nil when the limit has no rate
+func NewRateLimiter(limit RateLimit) *RateLimiter {
+
+	if limit.Rate <= 0 {
+		return nil
+	}
+	if limit.Burst < 1 {
+		limit.Burst = 1
+	}
+	return &RateLimiter{
+		limit:   limit,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// Allow takes a token of the key at now. When none is left, it returns false and
+// the time until the next token
+func (l *RateLimiter) Allow(key string, now time.Time) (bool, time.Duration) {
+
+	if l == nil {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(l.limit.Burst), last: now}
+		l.buckets[key] = b
+	}
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(float64(l.limit.Burst), b.tokens+elapsed*l.limit.Rate)
+		b.last = now
+	}
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.limit.Rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// Purge forgets the keys whose buckets are full at now, which are the same as new ones
+func (l *RateLimiter) Purge(now time.Time) {
+
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.limit.Rate >= float64(l.limit.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Limiter applies the limits of a LimitConfig to the requests of a server
+type Limiter struct {
+	config LimitConfig
+
+	ip     *RateLimiter
+	user   *RateLimiter
+	signup *RateLimiter
+}
+
+// NewLimiter returns a limiter of the configuration
+func NewLimiter(config LimitConfig) *Limiter {
+
+	if config.MaxBodyBytes <= 0 {
+		config.MaxBodyBytes = DefaultMaxBodyBytes
+	}
+	return &Limiter{
+		config: config,
+		ip:     NewRateLimiter(config.IP),
+		user:   NewRateLimiter(config.User),
+		signup: NewRateLimiter(config.Signup),
+	}
+}
+
+// Purge forgets the clients and users which are not limited any more
+func (l *Limiter) Purge(now time.Time) {
+	l.ip.Purge(now)
+	l.user.Purge(now)
+	l.signup.Purge(now)
+}
+
+// clientIP returns the address of the client of the request
+func (l *Limiter) clientIP(r *http.Request) string {
+
+	if l.config.TrustProxy {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			client, _, _ := strings.Cut(forwarded, ",")
+			return strings.TrimSpace(client)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// isSignup tells whether the request creates a user
+func isSignup(r *http.Request) bool {
+	if r.Method == "GET" {
+		return r.URL.Path == APIOIDC+APIOIDCCallback
+	}
+	return r.Method == "POST" && (r.URL.Path == APIUser || r.URL.Path == APIAccount || r.URL.Path == APIAnalysis)
+}
+
+// limit caps the body of the request, and replies 429 when the client or the user of userID
+// made too many requests. userID is "" for a request without a valid access token.
+// It returns whether the request is served
+func (sv *Server) limit(w http.ResponseWriter, r *http.Request, userID string) bool {
+
+	l := sv.Limits
+	if l == nil {
+		return true
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, l.config.MaxBodyBytes)
+
+	now := time.Now()
+	ip := l.clientIP(r)
+	ok, retry := l.ip.Allow(ip, now)
+	if ok && isSignup(r) {
+		ok, retry = l.signup.Allow(ip, now)
+	}
+	if ok && userID != "" {
+		ok, retry = l.user.Allow(userID, now)
+	}
+	if ok {
+		return true
+	}
+
+	returnTooManyRequests(w, retry, "Too many requests")
+	return false
+}
+
+// returnTooManyRequests replies 429 telling the client to retry after the duration
+func returnTooManyRequests(w http.ResponseWriter, retry time.Duration, description string) {
+
+	seconds := int(math.Ceil(retry.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	returnJSONMessage(w, http.StatusTooManyRequests, &GeneralMessageResponse{
+		Status:      "fail",
+		Description: description,
+	})
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+
+	now := time.Date(2024, 3, 4, 12, 0, 0, 0, time.UTC)
+	l := NewRateLimiter(RateLimit{Rate: 2, Burst: 3})
+
+	for i := 0; i < 3; i++ {
+		ok, _ := l.Allow("a", now)
+		assert.True(t, ok)
+	}
+	ok, retry := l.Allow("a", now)
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, retry)
+
+	// keys do not share a bucket
+	ok, _ = l.Allow("b", now)
+	assert.True(t, ok)
+
+	ok, _ = l.Allow("a", now.Add(500*time.Millisecond))
+	assert.True(t, ok)
+
+	// full buckets are forgotten
+	l.Purge(now.Add(time.Second))
+	assert.Len(t, l.buckets, 1)
+	l.Purge(now.Add(time.Minute))
+	assert.Empty(t, l.buckets)
+
+	var unlimited *RateLimiter = NewRateLimiter(RateLimit{})
+	assert.Nil(t, unlimited)
+	ok, _ = unlimited.Allow("a", now)
+	assert.True(t, ok)
+}
+
+func TestLimits(t *testing.T) {
+
+	sv := NewServer(NewMemorySessionStore(), NewMemoryUserStore())
+	sv.Limits = NewLimiter(LimitConfig{
+		IP:              RateLimit{Rate: 100, Burst: 100},
+		User:            RateLimit{Rate: 0.01, Burst: 4},
+		Signup:          RateLimit{Rate: 0.01, Burst: 2},
+		MaxOpenSessions: 2,
+		MaxBodyBytes:    64,
+	})
+	ts := httptest.NewServer(sv)
+	defer ts.Close()
+
+	post := func(path, token, body string) *http.Response {
+		res, err := postWithToken(ts.URL+path, token, []byte(body))
+		if !assert.Nil(t, err) {
+			return &http.Response{}
+		}
+		res.Body.Close()
+		return res
+	}
+
+	// users are created up to the burst of the client
+	assert.Equal(t, http.StatusOK, post(APIUser, "", `{"name": "alice"}`).StatusCode)
+	assert.Equal(t, http.StatusBadRequest, post(APIUser, "", "").StatusCode)
+	res := post(APIUser, "", `{"name": "bob"}`)
+	assert.Equal(t, http.StatusTooManyRequests, res.StatusCode)
+	assert.Equal(t, "100", res.Header.Get("Retry-After"))
+
+	// bodies are capped
+	alice, _ := sv.Register("alice", "correct horse")
+	tokens, _ := sv.IssueTokens(alice)
+	big := `{"rated": false, "padding": "` + strings.Repeat("x", 64) + `"}`
+	assert.Equal(t, http.StatusRequestEntityTooLarge, post(APISession, tokens.AccessToken, big).StatusCode)
+
+	// a user opens sessions up to the limit, then is limited by its own bucket
+	assert.Equal(t, http.StatusOK, post(APISession, tokens.AccessToken, "").StatusCode)
+	assert.Equal(t, http.StatusOK, post(APISession, tokens.AccessToken, "").StatusCode)
+	res = post(APISession, tokens.AccessToken, "")
+	assert.Equal(t, http.StatusTooManyRequests, res.StatusCode)
+	assert.Equal(t, "60", res.Header.Get("Retry-After"))
+	_, err := sv.JoinSession(alice, false)
+	assert.Equal(t, ErrTooManySessions, err)
+	res = post(APISession, tokens.AccessToken, "")
+	assert.Equal(t, http.StatusTooManyRequests, res.StatusCode)
+	assert.Equal(t, "100", res.Header.Get("Retry-After"))
+
+	// another user of the same client is not limited by alice
+	bob, _ := sv.Register("bob", "correct horse")
+	tokens, _ = sv.IssueTokens(bob)
+	req, _ := http.NewRequest("GET", ts.URL+APIUser+"/"+bob.UserID, bytes.NewReader(nil))
+	req.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+	res, err = http.DefaultClient.Do(req)
+	if assert.Nil(t, err) {
+		res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+	}
+}
+
+func TestMaxOpenSessions_ConcurrentJoin(t *testing.T) {
+
+	st, err := OpenSQLiteStore(filepath.Join(t.TempDir(), "reversi.db"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer st.Close()
+
+	for name, sv := range map[string]*Server{
+		"memory": NewServer(NewMemorySessionStore(), NewMemoryUserStore()),
+		"sqlite": NewServer(st, st.Users()),
+	} {
+		sv.Limits = NewLimiter(LimitConfig{MaxOpenSessions: 3})
+		alice, _ := sv.Register("alice", "correct horse")
+
+		// the user is never paired with itself, so every join which passes the limit opens a session
+		const joins = 20
+		var wg sync.WaitGroup
+		errs := make([]error, joins)
+		for i := 0; i < joins; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				_, errs[i] = sv.JoinSession(alice, false)
+			}(i)
+		}
+		wg.Wait()
+
+		opened := 0
+		for _, err := range errs {
+			if err == nil {
+				opened++
+			} else {
+				assert.Equal(t, ErrTooManySessions, err, name)
+			}
+		}
+		assert.Equal(t, 3, opened, name)
+
+		sessions, _ := sv.Sessions.All()
+		assert.Len(t, sessions, 3, name)
+	}
+}
@@ -0,0 +1,406 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultRating, DefaultDeviation and DefaultVolatility are the rating of a user before the first rated game
+	DefaultRating     float64 = 1500
+	DefaultDeviation  float64 = 350
+	DefaultVolatility float64 = 0.06
+
+	// RatingTau constrains the change of the volatility. Glickman suggests 0.3 to 1.2
+	RatingTau float64 = 0.5
+
+	// RatingPeriod is the time after which the deviation of an idle user grows as by a period without games
+	RatingPeriod time.Duration = 7 * 24 * time.Hour
+
+	// ProvisionalDeviation is the deviation above which a rating is provisional
+	ProvisionalDeviation float64 = 110
+
+	// RatingHistoryLimit is the number of rating changes in the response of a user
+	RatingHistoryLimit int = 20
+)
+
+// glicko2Scale converts a rating to the Glicko-2 scale
+const glicko2Scale float64 = 173.7178
+
+// ErrRatingNotFound is returned when the user has played no rated game
+var ErrRatingNotFound = errors.New("Invalid rating")
+
+// ErrRatedGuest is returned when a guest asks for a rated game
+var ErrRatedGuest = errors.New("Guests cannot play rated games")
+
+// Rating is a Glicko-2 rating
+type Rating struct {
+	Rating     float64 `json:"rating"`
+	Deviation  float64 `json:"deviation"`
+	Volatility float64 `json:"volatility"`
+}
+
+// NewRating returns the rating of a user before the first rated game
+func NewRating() Rating {
+	return Rating{Rating: DefaultRating, Deviation: DefaultDeviation, Volatility: DefaultVolatility}
+}
+
+// Provisional returns whether the rating is too uncertain to compare with others
+func (r Rating) Provisional() bool {
+	return r.Deviation > ProvisionalDeviation
+}
+
+// ratingOutcome is a game against an opponent. Score is 1 for a win, 0.5 for a draw and 0 for a loss
+type ratingOutcome struct {
+	Opponent Rating
+	Score    float64
+}
+
+// decay returns the rating after periods rating periods without games, which make it less certain
+func (r Rating) decay(periods int) Rating {
+
+	phi := r.Deviation / glicko2Scale
+	for i := 0; i < periods && phi*glicko2Scale < DefaultDeviation; i++ {
+		phi = math.Sqrt(phi*phi + r.Volatility*r.Volatility)
+	}
+	r.Deviation = math.Min(phi*glicko2Scale, DefaultDeviation)
+	return r
+}
+
+// update returns the rating after the games of a rating period by the Glicko-2 algorithm
+// described in http://www.glicko.net/glicko/glicko2.pdf
+func (r Rating) update(outcomes []ratingOutcome) Rating {
+
+	if len(outcomes) == 0 {
+		return r.decay(1)
+	}
+
+	mu := (r.Rating - DefaultRating) / glicko2Scale
+	phi := r.Deviation / glicko2Scale
+	sigma := r.Volatility
+
+	// the estimated variance v and improvement delta of the rating by the games
+	v, delta := 0.0, 0.0
+	for _, o := range outcomes {
+		muJ := (o.Opponent.Rating - DefaultRating) / glicko2Scale
+		g := glickoG(o.Opponent.Deviation / glicko2Scale)
+		e := 1 / (1 + math.Exp(-g*(mu-muJ)))
+		v += g * g * e * (1 - e)
+		delta += g * (o.Score - e)
+	}
+	v = 1 / v
+	delta *= v
+
+	sigma = newVolatility(phi, sigma, v, delta)
+
+	phiStar := math.Sqrt(phi*phi + sigma*sigma)
+	phi = 1 / math.Sqrt(1/(phiStar*phiStar)+1/v)
+	mu += phi * phi * delta / v
+
+	return Rating{
+		Rating:     mu*glicko2Scale + DefaultRating,
+		Deviation:  math.Min(phi*glicko2Scale, DefaultDeviation),
+		Volatility: sigma,
+	}
+}
+
+func glickoG(phi float64) float64 {
+	return 1 / math.Sqrt(1+3*phi*phi/(math.Pi*math.Pi))
+}
+
+// newVolatility solves for the volatility after the period by the Illinois algorithm
+func newVolatility(phi, sigma, v, delta float64) float64 {
+
+	const epsilon = 0.000001
+
+	a := math.Log(sigma * sigma)
+	f := func(x float64) float64 {
+		ex := math.Exp(x)
+		d := phi*phi + v + ex
+		return ex*(delta*delta-phi*phi-v-ex)/(2*d*d) - (x-a)/(RatingTau*RatingTau)
+	}
+
+	lower, upper := a, 0.0
+	if delta*delta > phi*phi+v {
+		upper = math.Log(delta*delta - phi*phi - v)
+	} else {
+		k := 1.0
+		for f(a-k*RatingTau) < 0 {
+			k++
+		}
+		upper = a - k*RatingTau
+	}
+
+	fLower, fUpper := f(lower), f(upper)
+	for math.Abs(upper-lower) > epsilon {
+		c := lower + (lower-upper)*fLower/(fUpper-fLower)
+		fc := f(c)
+		if fc*fUpper <= 0 {
+			lower, fLower = upper, fUpper
+		} else {
+			fLower /= 2
+		}
+		upper, fUpper = c, fc
+	}
+	return math.Exp(lower / 2)
+}
+
+// RatingChange is the change of the rating of a user by a rated game
+type RatingChange struct {
+	GameID     string    `json:"gameID"`
+	OpponentID string    `json:"opponentID"`
+	Score      float64   `json:"score"`
+	Before     Rating    `json:"before"`
+	After      Rating    `json:"after"`
+	Time       time.Time `json:"time"`
+}
+
+// UserRating is the rating of a user and how it came to be
+type UserRating struct {
+	UserID string `json:"userID"`
+	Rating
+	Games     int       `json:"games"`
+	UpdatedAt time.Time `json:"updatedAt"`
+
+	// History has the changes of the rating, the latest first
+	History []RatingChange `json:"history"`
+}
+
+// current returns the rating as of now, as uncertain as the idle periods since the last game make it
+func (ur *UserRating) current(now time.Time) Rating {
+	if ur.UpdatedAt.IsZero() || now.Before(ur.UpdatedAt) {
+		return ur.Rating
+	}
+	return ur.Rating.decay(int(now.Sub(ur.UpdatedAt) / RatingPeriod))
+}
+
+// rated returns whether the game has changed the rating already
+func (ur *UserRating) rated(gameID string) bool {
+	for _, c := range ur.History {
+		if c.GameID == gameID {
+			return true
+		}
+	}
+	return false
+}
+
+// RatingStore keeps the ratings of users. Implementations must be safe for concurrent use
+type RatingStore interface {
+	// Get returns the rating of the user with its history, or ErrRatingNotFound
+	Get(userID string) (*UserRating, error)
+
+	// Update changes the ratings of both players of a game by fn atomically, starting from
+	// NewRating for a user who has none. Nothing is changed when fn returns an error
+	Update(whiteID, blackID string, fn func(white, black *UserRating) error) error
+
+	// Delete removes the rating of the user
+	Delete(userID string) error
+}
+
+// rateGame updates the ratings of the players of a finished rated game, once
+func (sv *Server) rateGame(game *GameRecord) error {
+
+	if !game.Rated || game.Result == ResultNone {
+		return nil
+	}
+
+	score := 0.5
+	switch game.Result {
+	case ResultWhite:
+		score = 1
+	case ResultBlack:
+		score = 0
+	}
+
+	return sv.Ratings.Update(game.White.UserID, game.Black.UserID, func(white, black *UserRating) error {
+
+		if white.rated(game.GameID) || black.rated(game.GameID) {
+			return nil
+		}
+
+		// both ratings change by the ratings before the game
+		w, b := white.current(game.FinishedAt), black.current(game.FinishedAt)
+		white.change(game, black.UserID, score, w, w.update([]ratingOutcome{{Opponent: b, Score: score}}))
+		black.change(game, white.UserID, 1-score, b, b.update([]ratingOutcome{{Opponent: w, Score: 1 - score}}))
+		return nil
+	})
+}
+
+func (ur *UserRating) change(game *GameRecord, opponentID string, score float64, before, after Rating) {
+
+	ur.Rating = after
+	ur.Games++
+	ur.UpdatedAt = game.FinishedAt
+	ur.History = append([]RatingChange{{
+		GameID:     game.GameID,
+		OpponentID: opponentID,
+		Score:      score,
+		Before:     before,
+		After:      after,
+		Time:       game.FinishedAt,
+	}}, ur.History...)
+}
+
+// GetRating returns the rating of the user as of now, or NewRating when the user has played no rated game
+func (sv *Server) GetRating(userID string) (*UserRating, error) {
+
+	ur, err := sv.Ratings.Get(userID)
+	if err == ErrRatingNotFound {
+		return &UserRating{UserID: userID, Rating: NewRating(), History: []RatingChange{}}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	ur.Rating = ur.current(time.Now())
+	return ur, nil
+}
+
+// ratedPlayer returns the user with the rating of the user, to be kept by a rated session
+func (sv *Server) ratedPlayer(user User) (User, error) {
+
+	if !user.Registered {
+		return user, ErrRatedGuest
+	}
+	ur, err := sv.GetRating(user.UserID)
+	if err != nil {
+		return user, err
+	}
+	user.Rating = int(math.Round(ur.Rating.Rating))
+	return user, nil
+}
+
+// MemoryRatingStore keeps ratings in memory
+type MemoryRatingStore struct {
+	mu      sync.Mutex
+	ratings map[string]*UserRating
+
+	// save and remove let a durable store write a change through before it is committed
+	save   func(*UserRating) error
+	remove func(userID string) error
+}
+
+// NewMemoryRatingStore returns an empty MemoryRatingStore
+func NewMemoryRatingStore() *MemoryRatingStore {
+	return &MemoryRatingStore{ratings: make(map[string]*UserRating)}
+}
+
+// Get ...
+func (st *MemoryRatingStore) Get(userID string) (*UserRating, error) {
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	ur, ok := st.ratings[userID]
+	if !ok {
+		return nil, ErrRatingNotFound
+	}
+	return ur.clone(), nil
+}
+
+// Update ...
+func (st *MemoryRatingStore) Update(whiteID, blackID string, fn func(white, black *UserRating) error) error {
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	white, black := st.load(whiteID), st.load(blackID)
+	if err := fn(white, black); err != nil {
+		return err
+	}
+	if st.save != nil {
+		for _, ur := range []*UserRating{white, black} {
+			if err := st.save(ur); err != nil {
+				return err
+			}
+		}
+	}
+	st.ratings[whiteID], st.ratings[blackID] = white, black
+	return nil
+}
+
+func (st *MemoryRatingStore) load(userID string) *UserRating {
+	if ur, ok := st.ratings[userID]; ok {
+		return ur.clone()
+	}
+	return &UserRating{UserID: userID, Rating: NewRating()}
+}
+
+// Delete ...
+func (st *MemoryRatingStore) Delete(userID string) error {
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.remove != nil {
+		if err := st.remove(userID); err != nil {
+			return err
+		}
+	}
+	delete(st.ratings, userID)
+	return nil
+}
+
+func (ur *UserRating) clone() *UserRating {
+	c := *ur
+	c.History = append([]RatingChange{}, ur.History...)
+	return &c
+}
+
+// NewFileRatingStore returns a rating store which keeps every rating as a JSON file under dir/ratings
+func NewFileRatingStore(dir string) (*MemoryRatingStore, error) {
+
+	dir = filepath.Join(dir, "ratings")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	st := NewMemoryRatingStore()
+	err := readJSONFiles(dir, func(data []byte) error {
+		ur := new(UserRating)
+		if err := json.Unmarshal(data, ur); err != nil {
+			return err
+		}
+		st.ratings[ur.UserID] = ur
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	st.save = func(ur *UserRating) error {
+		return writeJSONFile(filepath.Join(dir, ur.UserID+".json"), ur)
+	}
+	st.remove = func(userID string) error {
+		return removeFile(filepath.Join(dir, userID+".json"))
+	}
+	return st, nil
+}
+
+// RatingResponse is the rating of a user as of now
+type RatingResponse struct {
+	Rating
+	Games       int  `json:"games"`
+	Provisional bool `json:"provisional"`
+
+	// History has the last changes of the rating, the latest first
+	History []RatingChange `json:"history"`
+}
+
+func newRatingResponse(ur *UserRating) *RatingResponse {
+
+	history := ur.History
+	if len(history) > RatingHistoryLimit {
+		history = history[:RatingHistoryLimit]
+	}
+	return &RatingResponse{
+		Rating:      ur.Rating,
+		Games:       ur.Games,
+		Provisional: ur.Provisional(),
+		History:     history,
+	}
+}
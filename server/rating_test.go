@@ -0,0 +1,187 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGlicko2(t *testing.T) {
+
+	// the example of http://www.glicko.net/glicko/glicko2.pdf
+	r := Rating{Rating: 1500, Deviation: 200, Volatility: 0.06}.update([]ratingOutcome{
+		{Opponent: Rating{Rating: 1400, Deviation: 30}, Score: 1},
+		{Opponent: Rating{Rating: 1550, Deviation: 100}, Score: 0},
+		{Opponent: Rating{Rating: 1700, Deviation: 300}, Score: 0},
+	})
+	assert.InDelta(t, 1464.06, r.Rating, 0.01)
+	assert.InDelta(t, 151.52, r.Deviation, 0.01)
+	assert.InDelta(t, 0.05999, r.Volatility, 0.00001)
+
+	// an idle user becomes less certain, up to a new one
+	idle := Rating{Rating: 1500, Deviation: 50, Volatility: 0.06}
+	assert.InDelta(t, 51.07, idle.decay(1).Deviation, 0.01)
+	assert.Equal(t, DefaultDeviation, idle.decay(100000).Deviation)
+	assert.Equal(t, idle, idle.decay(0))
+}
+
+func TestRatedGames(t *testing.T) {
+
+	sv := NewServer(NewMemorySessionStore(), NewMemoryUserStore())
+	ts := httptest.NewServer(sv)
+	defer ts.Close()
+
+	alice, _ := sv.Register("alice", "correct horse")
+	bob, _ := sv.Register("bob", "correct horse")
+	guest, _ := sv.CreateUser("guest")
+
+	_, err := sv.JoinSession(guest, true)
+	assert.Equal(t, ErrRatedGuest, err)
+
+	// a rated game is not paired with a casual one
+	casual, _ := sv.JoinSession(alice, false)
+	rated, _ := sv.JoinSession(bob, true)
+	assert.NotEqual(t, casual.SessionID, rated.SessionID)
+	assert.False(t, casual.Rated)
+	assert.True(t, rated.Rated)
+
+	joined, err := sv.JoinSession(alice, true)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, rated.SessionID, joined.SessionID)
+	assert.Equal(t, StateEstablished, joined.State)
+	assert.Equal(t, int(DefaultRating), joined.Players[0].Rating)
+	assert.Equal(t, int(DefaultRating), joined.Players[1].Rating)
+
+	assert.Nil(t, sv.Resign(rated.SessionID, bob.UserID))
+
+	won, _ := sv.GetRating(alice.UserID)
+	lost, _ := sv.GetRating(bob.UserID)
+	assert.InDelta(t, 1662.31, won.Rating.Rating, 0.01)
+	assert.InDelta(t, 1337.69, lost.Rating.Rating, 0.01)
+	assert.InDelta(t, 290.32, won.Deviation, 0.01)
+	assert.Equal(t, 1, won.Games)
+	if assert.Len(t, lost.History, 1) {
+		assert.Equal(t, rated.SessionID, lost.History[0].GameID)
+		assert.Equal(t, alice.UserID, lost.History[0].OpponentID)
+		assert.Equal(t, 0.0, lost.History[0].Score)
+		assert.Equal(t, NewRating(), lost.History[0].Before)
+	}
+
+	// a game is rated once, and a casual one never
+	game, _ := sv.Games.Get(rated.SessionID)
+	assert.True(t, game.Rated)
+	assert.Nil(t, sv.rateGame(game))
+	again, _ := sv.GetRating(alice.UserID)
+	assert.Equal(t, won.Games, again.Games)
+
+	sv.JoinSession(bob, false)
+	assert.Nil(t, sv.Resign(casual.SessionID, alice.UserID))
+	again, _ = sv.GetRating(alice.UserID)
+	assert.Equal(t, won.Games, again.Games)
+
+	res, err := http.Get(ts.URL + APIUser + "/" + alice.UserID)
+	if !assert.Nil(t, err) {
+		return
+	}
+	var got GetUserResponse
+	assert.Nil(t, json.NewDecoder(res.Body).Decode(&got))
+	res.Body.Close()
+	if assert.NotNil(t, got.Rating) {
+		assert.InDelta(t, 1662.31, got.Rating.Rating.Rating, 0.01)
+		assert.True(t, got.Rating.Provisional)
+		assert.Len(t, got.Rating.History, 1)
+	}
+
+	res, err = http.Get(ts.URL + APIUser + "/" + guest.UserID)
+	if !assert.Nil(t, err) {
+		return
+	}
+	got = GetUserResponse{}
+	assert.Nil(t, json.NewDecoder(res.Body).Decode(&got))
+	res.Body.Close()
+	assert.Nil(t, got.Rating)
+
+	// guests are refused rated games over HTTP too
+	tokens, _ := sv.IssueTokens(guest)
+	body, _ := json.Marshal(&PostSessionRequest{Rated: true})
+	req, _ := http.NewRequest("POST", ts.URL+APISession, bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+	res, err = http.DefaultClient.Do(req)
+	if !assert.Nil(t, err) {
+		return
+	}
+	res.Body.Close()
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+}
+
+func TestRatingStores(t *testing.T) {
+
+	dir := t.TempDir()
+	sqlite, err := OpenSQLiteStore(filepath.Join(dir, "reversi.db"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer sqlite.Close()
+
+	files, err := NewFileRatingStore(dir)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	game := func(gameID string, at time.Time) *GameRecord {
+		return &GameRecord{GameID: gameID, FinishedAt: at}
+	}
+
+	for _, st := range []RatingStore{NewMemoryRatingStore(), files, sqlite.Ratings()} {
+		_, err := st.Get("u1")
+		assert.Equal(t, ErrRatingNotFound, err)
+
+		for i, gameID := range []string{"g1", "g2"} {
+			assert.Nil(t, st.Update("u1", "u2", func(white, black *UserRating) error {
+				at := now.Add(time.Duration(i) * time.Minute)
+				white.change(game(gameID, at), "u2", 1, white.Rating, Rating{Rating: white.Rating.Rating + 10})
+				black.change(game(gameID, at), "u1", 0, black.Rating, Rating{Rating: black.Rating.Rating - 10})
+				return nil
+			}))
+		}
+		assert.Equal(t, errBrokenStore, st.Update("u1", "u2", func(white, black *UserRating) error {
+			white.change(game("g3", now), "u2", 1, white.Rating, Rating{})
+			return errBrokenStore
+		}))
+
+		ur, err := st.Get("u2")
+		if !assert.Nil(t, err) {
+			continue
+		}
+		assert.Equal(t, 1480.0, ur.Rating.Rating)
+		assert.Equal(t, 2, ur.Games)
+		assert.True(t, now.Add(time.Minute).Equal(ur.UpdatedAt))
+		if assert.Len(t, ur.History, 2) {
+			assert.Equal(t, "g2", ur.History[0].GameID)
+			assert.Equal(t, 1490.0, ur.History[0].Before.Rating)
+		}
+	}
+
+	files, err = NewFileRatingStore(dir)
+	if !assert.Nil(t, err) {
+		return
+	}
+	ur, err := files.Get("u1")
+	assert.Nil(t, err)
+	assert.Equal(t, 1520.0, ur.Rating.Rating)
+
+	for _, st := range []RatingStore{files, sqlite.Ratings()} {
+		assert.Nil(t, st.Delete("u1"))
+		_, err = st.Get("u1")
+		assert.Equal(t, ErrRatingNotFound, err)
+	}
+}
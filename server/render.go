@@ -0,0 +1,376 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// APISessionBoardSVG is an API endpoint of the board drawn as SVG
+	APISessionBoardSVG string = "/board.svg"
+
+	// APISessionBoardPNG is an API endpoint of the board drawn as PNG
+	APISessionBoardPNG string = "/board.png"
+)
+
+const (
+	// DefaultImageSize is the default width and height of board images in pixels
+	DefaultImageSize int = 400
+
+	// MinImageSize and MaxImageSize bound the size a client can request
+	MinImageSize int = 100
+	MaxImageSize int = 1600
+)
+
+// ErrInvalidPly is returned when the ply is not in the move log of the session
+var ErrInvalidPly = errors.New("Invalid ply")
+
+// boardPicture is what a board image shows
+type boardPicture struct {
+	Board [][]int
+
+	// LastMove is [x, y] of the last disc, or nil
+	LastMove []int
+
+	// Candidates and Flipped are grids as [y, x]
+	Candidates [][]int
+	Flipped    [][]int
+}
+
+// boardAtPly returns the board of the session after ply moves, and the side to move then
+func boardAtPly(s *Session, ply int) (*boardPicture, int, error) {
+
+	if ply < 0 || ply > len(s.MoveLog) {
+		return nil, EMPTY, ErrInvalidPly
+	}
+	if ply == len(s.MoveLog) {
+		pic := &boardPicture{Board: copyBoard(s.Board)}
+		if len(s.LastMove) == 3 {
+			pic.LastMove = s.LastMove[1:]
+		}
+		return pic, s.Turn, nil
+	}
+
+	return replayPictures(s)[ply], s.MoveLog[ply][0], nil
+}
+
+// flippedDiscs returns the grids as [y, x] which changed color between the boards, except the one put on (x, y)
+func flippedDiscs(before, after [][]int, x, y int) [][]int {
+
+	flipped := make([][]int, 0)
+	for i := range after {
+		for j := range after[i] {
+			if before[i][j] != EMPTY && before[i][j] != after[i][j] && !(i == y && j == x) {
+				flipped = append(flipped, []int{i, j})
+			}
+		}
+	}
+	return flipped
+}
+
+// boardPalette is the colors of board images. PNG and GIF images share it
+var boardPalette = color.Palette{
+	color.RGBA{0x3e, 0x27, 0x23, 0xff}, // frame
+	color.RGBA{0x2e, 0x7d, 0x32, 0xff}, // board
+	color.RGBA{0x1b, 0x4d, 0x1f, 0xff}, // lines and candidates
+	color.RGBA{0x11, 0x11, 0x11, 0xff}, // black disc
+	color.RGBA{0xf5, 0xf5, 0xf5, 0xff}, // white disc
+	color.RGBA{0xe5, 0x39, 0x35, 0xff}, // last move
+	color.RGBA{0xff, 0xca, 0x28, 0xff}, // flipped discs
+	color.RGBA{0xd7, 0xcc, 0xc8, 0xff}, // labels
+}
+
+const (
+	paletteFrame uint8 = iota
+	paletteBoard
+	paletteLine
+	paletteBlack
+	paletteWhite
+	paletteLastMove
+	paletteFlipped
+	paletteLabel
+)
+
+// boardGeometry places the grids and the labels in an image of size pixels
+type boardGeometry struct {
+	size, margin, cell int
+}
+
+func newBoardGeometry(size int) boardGeometry {
+	margin := size / 16
+	return boardGeometry{size: size, margin: margin, cell: (size - 2*margin) / MaxBoardSize}
+}
+
+// center returns the center of the grid (x, y) in pixels
+func (g boardGeometry) center(x, y int) (int, int) {
+	return g.margin + x*g.cell + g.cell/2, g.margin + y*g.cell + g.cell/2
+}
+
+// renderBoardImage draws the picture on a paletted image of size pixels
+func renderBoardImage(pic *boardPicture, size int) *image.Paletted {
+
+	g := newBoardGeometry(size)
+	img := image.NewPaletted(image.Rect(0, 0, size, size), boardPalette)
+	fillRect(img, img.Rect, paletteFrame)
+
+	end := g.margin + g.cell*MaxBoardSize
+	fillRect(img, image.Rect(g.margin, g.margin, end, end), paletteBoard)
+
+	line := g.cell/40 + 1
+	for i := 0; i <= MaxBoardSize; i++ {
+		p := g.margin + i*g.cell
+		fillRect(img, image.Rect(p, g.margin, p+line, end+line), paletteLine)
+		fillRect(img, image.Rect(g.margin, p, end+line, p+line), paletteLine)
+	}
+
+	scale := g.margin / 10
+	if scale < 1 {
+		scale = 1
+	}
+	for i := 0; i < MaxBoardSize; i++ {
+		cx, cy := g.center(i, i)
+		drawText(img, string(rune('a'+i)), cx-glyphWidth*scale/2, (g.margin-glyphHeight*scale)/2, scale, paletteLabel)
+		drawText(img, strconv.Itoa(i+1), (g.margin-glyphWidth*scale)/2, cy-glyphHeight*scale/2, scale, paletteLabel)
+	}
+
+	radius := g.cell * 42 / 100
+	for _, f := range pic.Flipped {
+		cx, cy := g.center(f[1], f[0])
+		fillCircle(img, cx, cy, g.cell*48/100, paletteFlipped)
+	}
+	for y, row := range pic.Board {
+		for x, c := range row {
+			cx, cy := g.center(x, y)
+			switch c {
+			case BLACK:
+				fillCircle(img, cx, cy, radius, paletteBlack)
+			case WHITE:
+				fillCircle(img, cx, cy, radius, paletteWhite)
+			}
+		}
+	}
+	for _, c := range pic.Candidates {
+		cx, cy := g.center(c[1], c[0])
+		fillCircle(img, cx, cy, g.cell/10, paletteLine)
+	}
+	if pic.LastMove != nil {
+		cx, cy := g.center(pic.LastMove[0], pic.LastMove[1])
+		fillCircle(img, cx, cy, g.cell/10, paletteLastMove)
+	}
+	return img
+}
+
+func fillRect(img *image.Paletted, r image.Rectangle, c uint8) {
+
+	r = r.Intersect(img.Rect)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			img.SetColorIndex(x, y, c)
+		}
+	}
+}
+
+func fillCircle(img *image.Paletted, cx, cy, r int, c uint8) {
+
+	for y := -r; y <= r; y++ {
+		for x := -r; x <= r; x++ {
+			if x*x+y*y <= r*r {
+				img.SetColorIndex(cx+x, cy+y, c)
+			}
+		}
+	}
+}
+
+const (
+	glyphWidth  int = 5
+	glyphHeight int = 7
+)
+
+// glyphs is a bitmap font of the characters of the coordinates
+var glyphs = map[rune][glyphHeight]string{
+	'a': {".....", ".....", ".###.", "....#", ".####", "#...#", ".####"},
+	'b': {"#....", "#....", "####.", "#...#", "#...#", "#...#", "####."},
+	'c': {".....", ".....", ".####", "#....", "#....", "#....", ".####"},
+	'd': {"....#", "....#", ".####", "#...#", "#...#", "#...#", ".####"},
+	'e': {".....", ".....", ".###.", "#...#", "#####", "#....", ".###."},
+	'f': {"..##.", ".#...", "####.", ".#...", ".#...", ".#...", ".#..."},
+	'g': {".....", ".####", "#...#", "#...#", ".####", "....#", ".###."},
+	'h': {"#....", "#....", "####.", "#...#", "#...#", "#...#", "#...#"},
+	'1': {"..#..", ".##..", "..#..", "..#..", "..#..", "..#..", ".###."},
+	'2': {".###.", "#...#", "....#", "...#.", "..#..", ".#...", "#####"},
+	'3': {".###.", "#...#", "....#", "..##.", "....#", "#...#", ".###."},
+	'4': {"...#.", "..##.", ".#.#.", "#..#.", "#####", "...#.", "...#."},
+	'5': {"#####", "#....", "####.", "....#", "....#", "#...#", ".###."},
+	'6': {"..##.", ".#...", "#....", "####.", "#...#", "#...#", ".###."},
+	'7': {"#####", "....#", "...#.", "..#..", ".#...", ".#...", ".#..."},
+	'8': {".###.", "#...#", "#...#", ".###.", "#...#", "#...#", ".###."},
+}
+
+// drawText draws the text with the bitmap font at (x, y), each dot scale pixels wide
+func drawText(img *image.Paletted, text string, x, y, scale int, c uint8) {
+
+	for _, r := range text {
+		for row, line := range glyphs[r] {
+			for col, dot := range line {
+				if dot == '#' {
+					px, py := x+col*scale, y+row*scale
+					fillRect(img, image.Rect(px, py, px+scale, py+scale), c)
+				}
+			}
+		}
+		x += (glyphWidth + 1) * scale
+	}
+}
+
+// renderBoardSVG draws the picture as SVG of size pixels
+func renderBoardSVG(pic *boardPicture, size int) string {
+
+	g := newBoardGeometry(size)
+	hex := func(i uint8) string {
+		c := boardPalette[i].(color.RGBA)
+		return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d">`, size, size, size, size)
+	fmt.Fprintf(&b, `<rect width="%d" height="%d" fill="%s"/>`, size, size, hex(paletteFrame))
+
+	end := g.margin + g.cell*MaxBoardSize
+	fmt.Fprintf(&b, `<rect x="%d" y="%d" width="%d" height="%d" fill="%s"/>`, g.margin, g.margin, end-g.margin, end-g.margin, hex(paletteBoard))
+	for i := 0; i <= MaxBoardSize; i++ {
+		p := g.margin + i*g.cell
+		fmt.Fprintf(&b, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="%s"/>`, p, g.margin, p, end, hex(paletteLine))
+		fmt.Fprintf(&b, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="%s"/>`, g.margin, p, end, p, hex(paletteLine))
+	}
+
+	font := g.margin * 2 / 3
+	for i := 0; i < MaxBoardSize; i++ {
+		cx, cy := g.center(i, i)
+		fmt.Fprintf(&b, `<text x="%d" y="%d" font-family="monospace" font-size="%d" fill="%s" text-anchor="middle" dominant-baseline="central">%c</text>`,
+			cx, g.margin/2, font, hex(paletteLabel), 'a'+i)
+		fmt.Fprintf(&b, `<text x="%d" y="%d" font-family="monospace" font-size="%d" fill="%s" text-anchor="middle" dominant-baseline="central">%d</text>`,
+			g.margin/2, cy, font, hex(paletteLabel), i+1)
+	}
+
+	circle := func(x, y, r int, c uint8) {
+		cx, cy := g.center(x, y)
+		fmt.Fprintf(&b, `<circle cx="%d" cy="%d" r="%d" fill="%s"/>`, cx, cy, r, hex(c))
+	}
+	for _, f := range pic.Flipped {
+		circle(f[1], f[0], g.cell*48/100, paletteFlipped)
+	}
+	for y, row := range pic.Board {
+		for x, c := range row {
+			switch c {
+			case BLACK:
+				circle(x, y, g.cell*42/100, paletteBlack)
+			case WHITE:
+				circle(x, y, g.cell*42/100, paletteWhite)
+			}
+		}
+	}
+	for _, c := range pic.Candidates {
+		circle(c[1], c[0], g.cell/10, paletteLine)
+	}
+	if pic.LastMove != nil {
+		circle(pic.LastMove[0], pic.LastMove[1], g.cell/10, paletteLastMove)
+	}
+
+	b.WriteString(`</svg>`)
+	return b.String()
+}
+
+// imageQuery reads ?ply, ?cand and ?size of an image of the session
+func imageQuery(r *http.Request, s *Session) (*boardPicture, int, error) {
+
+	q := r.URL.Query()
+
+	ply := len(s.MoveLog)
+	if v := q.Get("ply"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, 0, ErrInvalidPly
+		}
+		ply = n
+	}
+
+	pic, turn, err := boardAtPly(s, ply)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if cand, _ := strconv.ParseBool(q.Get("cand")); cand && !(ply == len(s.MoveLog) && IsSessionFinished(s)) {
+		pic.Candidates = findCandidates(&Session{Board: copyBoard(pic.Board)}, turn)
+	}
+
+	size := DefaultImageSize
+	if v := q.Get("size"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < MinImageSize || n > MaxImageSize {
+			return nil, 0, errors.New("Invalid size")
+		}
+		size = n
+	}
+	return pic, size, nil
+}
+
+// APIGetBoardImage draws the board of the session, or of the session after ?ply moves,
+// as SVG or PNG. ?cand=true marks the grids the side to move can put a disc on
+func (sv *Server) APIGetBoardImage(w http.ResponseWriter, r *http.Request) {
+
+	re := regexp.MustCompile(APISession + "/([a-zA-Z0-9]+)/board\\.(svg|png)")
+	match := re.FindStringSubmatch(r.URL.Path)
+	if len(match) < 3 {
+		returnJSONMessage(w, http.StatusInternalServerError, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: "Invalid session",
+		})
+		return
+	}
+
+	session, err := sv.GetSessionInfo(match[1])
+	if err != nil {
+		returnSessionError(w, err)
+		return
+	}
+
+	pic, size, err := imageQuery(r, session)
+	if err != nil {
+		returnJSONMessage(w, http.StatusBadRequest, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: err.Error(),
+		})
+		return
+	}
+	if checkNotModified(w, r, session) {
+		return
+	}
+
+	if match[2] == "svg" {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, renderBoardSVG(pic, size))
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, renderBoardImage(pic, size)); err != nil {
+		fmt.Println("APIGetBoardImage: " + err.Error())
+		returnJSONMessage(w, http.StatusInternalServerError, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: "Cannot draw the board",
+		})
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
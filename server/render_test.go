@@ -0,0 +1,107 @@
+package server
+
+import (
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBoardAtPly(t *testing.T) {
+
+	s, err := ParseTranscript("t", User{}, User{}, "e6d6c6")
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	pic, turn, err := boardAtPly(s, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, NewSession("", User{}).Board, pic.Board)
+	assert.Nil(t, pic.LastMove)
+	assert.Equal(t, WHITE, turn)
+
+	pic, turn, err = boardAtPly(s, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []int{3, 2}, pic.LastMove)
+	assert.Equal(t, [][]int{{3, 3}}, pic.Flipped)
+	assert.Equal(t, WHITE, turn)
+
+	pic, turn, err = boardAtPly(s, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, s.Board, pic.Board)
+	assert.Equal(t, s.Turn, turn)
+
+	_, _, err = boardAtPly(s, 4)
+	assert.Equal(t, ErrInvalidPly, err)
+}
+
+func TestRenderBoardImage(t *testing.T) {
+
+	pic := &boardPicture{Board: NewSession("", User{}).Board, LastMove: []int{3, 3}, Candidates: [][]int{{2, 4}}}
+	img := renderBoardImage(pic, 400)
+
+	g := newBoardGeometry(400)
+	at := func(x, y int) uint8 {
+		cx, cy := g.center(x, y)
+		return img.ColorIndexAt(cx+g.cell/4, cy)
+	}
+	assert.Equal(t, paletteWhite, at(3, 3))
+	assert.Equal(t, paletteBlack, at(4, 3))
+	assert.Equal(t, paletteBoard, at(0, 0))
+
+	cx, cy := g.center(3, 3)
+	assert.Equal(t, paletteLastMove, img.ColorIndexAt(cx, cy))
+	cx, cy = g.center(4, 2)
+	assert.Equal(t, paletteLine, img.ColorIndexAt(cx, cy))
+
+	svg := renderBoardSVG(pic, 400)
+	assert.True(t, strings.HasPrefix(svg, "<svg "))
+	assert.Equal(t, 4+1+1, strings.Count(svg, "<circle"))
+	assert.Equal(t, 16, strings.Count(svg, "<text"))
+}
+
+func TestAPIGetBoardImage(t *testing.T) {
+
+	sv := NewServer(NewMemorySessionStore(), NewMemoryUserStore())
+	ts := httptest.NewServer(sv)
+	defer ts.Close()
+
+	white, session, _ := sv.CreateSession("white")
+	sv.CreateSession("black")
+	assert.Nil(t, sv.PlayMove(session.SessionID, white.UserID, 4, 2))
+
+	url := ts.URL + APISession + "/" + session.SessionID
+
+	res, err := http.Get(url + APISessionBoardPNG + "?size=200&cand=true")
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, "image/png", res.Header.Get("Content-Type"))
+	img, err := png.Decode(res.Body)
+	res.Body.Close()
+	if assert.Nil(t, err) {
+		assert.Equal(t, 200, img.Bounds().Dx())
+	}
+
+	res, err = http.Get(url + APISessionBoardSVG + "?ply=0")
+	if !assert.Nil(t, err) {
+		return
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, "image/svg+xml", res.Header.Get("Content-Type"))
+	assert.Equal(t, 4, strings.Count(string(body), "<circle"))
+
+	for _, q := range []string{"?ply=2", "?ply=x", "?size=10"} {
+		res, err = http.Get(url + APISessionBoardSVG + q)
+		if !assert.Nil(t, err) {
+			return
+		}
+		res.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, res.StatusCode, q)
+	}
+}
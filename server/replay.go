@@ -0,0 +1,135 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"net/http"
+	"regexp"
+	"strconv"
+)
+
+// APISessionReplay is an API endpoint of the moves of the session animated as GIF
+const APISessionReplay string = "/replay.gif"
+
+const (
+	// DefaultReplayDelay is the default time a frame of a replay is shown, in milliseconds
+	DefaultReplayDelay int = 800
+
+	// MinReplayDelay and MaxReplayDelay bound the delay a client can request
+	MinReplayDelay int = 50
+	MaxReplayDelay int = 10000
+
+	// MaxReplaySize bounds the size of a replay, which is lower than MaxImageSize
+	// since every frame of it is drawn and encoded on each request
+	MaxReplaySize int = 600
+
+	// replayHold is how many times longer the last frame stays
+	replayHold int = 4
+)
+
+// replayPictures returns the board before the first move and after every move of the session,
+// highlighting the disc put and the discs flipped by it
+func replayPictures(s *Session) []*boardPicture {
+
+	r := newSessionAt("", User{}, s.StartPosition)
+	pics := []*boardPicture{{Board: copyBoard(r.Board)}}
+	for _, m := range s.MoveLog {
+		before := copyBoard(r.Board)
+		putDisc(r, m[0], m[1], m[2])
+		pics = append(pics, &boardPicture{
+			Board:    copyBoard(r.Board),
+			LastMove: m[1:],
+			Flipped:  flippedDiscs(before, r.Board, m[1], m[2]),
+		})
+	}
+	return pics
+}
+
+// renderReplay animates the moves of the session, each frame shown for delay milliseconds
+func renderReplay(s *Session, size, delay int) *gif.GIF {
+
+	pics := replayPictures(s)
+	anim := &gif.GIF{
+		Image: make([]*image.Paletted, 0, len(pics)),
+		Delay: make([]int, 0, len(pics)),
+	}
+	for _, pic := range pics {
+		anim.Image = append(anim.Image, renderBoardImage(pic, size))
+		anim.Delay = append(anim.Delay, delay/10)
+	}
+	anim.Delay[len(anim.Delay)-1] *= replayHold
+	return anim
+}
+
+// APIGetReplay animates the moves of the session as GIF. ?delay is the time
+// a frame is shown in milliseconds and ?size the width of the image in pixels
+func (sv *Server) APIGetReplay(w http.ResponseWriter, r *http.Request) {
+
+	re := regexp.MustCompile(APISession + "/([a-zA-Z0-9]+)" + regexp.QuoteMeta(APISessionReplay))
+	sessionIDMatch := re.FindStringSubmatch(r.URL.Path)
+	if len(sessionIDMatch) < 2 {
+		returnJSONMessage(w, http.StatusInternalServerError, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: "Invalid session",
+		})
+		return
+	}
+
+	session, err := sv.GetSessionInfo(sessionIDMatch[1])
+	if err != nil {
+		returnSessionError(w, err)
+		return
+	}
+
+	size, delay, err := replayQuery(r)
+	if err != nil {
+		returnJSONMessage(w, http.StatusBadRequest, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: err.Error(),
+		})
+		return
+	}
+	if checkNotModified(w, r, session) {
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, renderReplay(session, size, delay)); err != nil {
+		fmt.Println("APIGetReplay: " + err.Error())
+		returnJSONMessage(w, http.StatusInternalServerError, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: "Cannot draw the replay",
+		})
+		return
+	}
+	w.Header().Set("Content-Type", "image/gif")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
+
+func replayQuery(r *http.Request) (int, int, error) {
+
+	q := r.URL.Query()
+
+	size := DefaultImageSize
+	if v := q.Get("size"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < MinImageSize || n > MaxReplaySize {
+			return 0, 0, errors.New("Invalid size")
+		}
+		size = n
+	}
+
+	delay := DefaultReplayDelay
+	if v := q.Get("delay"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < MinReplayDelay || n > MaxReplayDelay {
+			return 0, 0, errors.New("Invalid delay")
+		}
+		delay = n
+	}
+	return size, delay, nil
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"image/gif"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplayPictures(t *testing.T) {
+
+	s, err := ParseTranscript("t", User{}, User{}, "e6d6c6")
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	pics := replayPictures(s)
+	if !assert.Len(t, pics, 4) {
+		return
+	}
+	assert.Nil(t, pics[0].LastMove)
+	assert.Equal(t, []int{4, 2}, pics[1].LastMove)
+	assert.Equal(t, [][]int{{3, 4}}, pics[1].Flipped)
+	assert.Equal(t, [][]int{{3, 3}}, pics[2].Flipped)
+	assert.Equal(t, s.Board, pics[3].Board)
+}
+
+func TestAPIGetReplay(t *testing.T) {
+
+	sv := NewServer(NewMemorySessionStore(), NewMemoryUserStore())
+	ts := httptest.NewServer(sv)
+	defer ts.Close()
+
+	white, session, _ := sv.CreateSession("white")
+	black, _, _ := sv.CreateSession("black")
+	assert.Nil(t, sv.PlayMove(session.SessionID, white.UserID, 4, 2))
+	assert.Nil(t, sv.PlayMove(session.SessionID, black.UserID, 3, 2))
+	assert.Nil(t, sv.Resign(session.SessionID, black.UserID))
+
+	url := ts.URL + APISession + "/" + session.SessionID + APISessionReplay
+
+	res, err := http.Get(url + "?delay=500&size=120")
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, "image/gif", res.Header.Get("Content-Type"))
+	anim, err := gif.DecodeAll(res.Body)
+	res.Body.Close()
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Len(t, anim.Image, 3)
+	assert.Equal(t, []int{50, 50, 50 * replayHold}, anim.Delay)
+	assert.Equal(t, 120, anim.Image[0].Bounds().Dx())
+
+	for _, q := range []string{"?delay=1", "?delay=x", "?size=5000", "?size=800"} {
+		res, err = http.Get(url + q)
+		if !assert.Nil(t, err) {
+			return
+		}
+		res.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, res.StatusCode, q)
+	}
+}
@@ -1,18 +1,117 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"strconv"
+	"sync"
 	"time"
 )
 
-func myHandler(w http.ResponseWriter, r *http.Request) {
+// Server serves the API with the stores given to it
+type Server struct {
+	Sessions SessionStore
+	Users    UserStore
+
+	// Games keeps the finished sessions
+	Games GameArchive
+
+	// Tokens keeps the refresh tokens of users
+	Tokens TokenStore
+
+	// Keyring signs and verifies access tokens
+	Keyring *Keyring
+
+	// AccessTTL and RefreshTTL are the lifetimes of the tokens issued
+	AccessTTL  time.Duration
+	RefreshTTL time.Duration
+
+	// Accounts keeps the users who log in with a password
+	Accounts AccountStore
+
+	// Profiles keeps the statistics of users
+	Profiles ProfileStore
+
+	// Ratings keeps the ratings of users by their rated games
+	Ratings RatingStore
+
+	// Leaderboards ranks the players of every period by their games
+	Leaderboards LeaderboardStore
+
+	// Identities links the users of the OpenID Connect provider to users
+	Identities IdentityStore
+
+	// OIDC signs users in through an OpenID Connect provider. It is nil unless one is configured
+	OIDC *OIDCProvider
+
+	// Relations keeps the friends and the blocked users of users
+	Relations RelationStore
+
+	// Limits protects the server from abuse. It is nil when nothing is limited
+	Limits *Limiter
+
+	// Janitor reaps abandoned sessions. It is nil unless the server runs one
+	Janitor *Janitor
+
+	notifier  *sessionNotifier
+	presence  *presenceTracker
+	startedAt time.Time
+
+	// archiving serializes archiveFinished
+	archiving sync.Mutex
+}
+
+// NewServer returns a server backed by the stores
+func NewServer(sessions SessionStore, users UserStore) *Server {
+	return &Server{
+		Sessions: sessions,
+		Users:    users,
+		Games:    NewMemoryArchive(),
+		Tokens:   NewMemoryTokenStore(),
+		Accounts: NewMemoryAccountStore(),
+		Profiles: NewMemoryProfileStore(),
+		Ratings:  NewMemoryRatingStore(),
+		notifier: newSessionNotifier(),
+		presence: newPresenceTracker(),
+
+		Leaderboards: NewMemoryLeaderboardStore(),
+		Identities:   NewMemoryIdentityStore(),
+		Relations:    NewMemoryRelationStore(),
+		Limits:       NewLimiter(LimitConfig{}),
+		startedAt:    time.Now(),
+
+		Keyring:    NewRandomKeyring(),
+		AccessTTL:  DefaultAccessTTL,
+		RefreshTTL: DefaultRefreshTTL,
+	}
+}
+
+// NewServerWithStores returns a server keeping everything in the stores
+func NewServerWithStores(st *Stores) *Server {
+
+	sv := NewServer(st.Sessions, st.Users)
+	sv.Games = st.Games
+	sv.Tokens = st.Tokens
+	sv.Accounts = st.Accounts
+	sv.Profiles = st.Profiles
+	sv.Ratings = st.Ratings
+	sv.Leaderboards = st.Leaderboards
+	sv.Identities = st.Identities
+	sv.Relations = st.Relations
+	return sv
+}
+
+// defaultServer serves APIRoute and the package level functions
+var defaultServer = NewServer(NewMemorySessionStore(), NewMemoryUserStore())
+
+// ServeHTTP ...
+func (sv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	fmt.Println("------")
 
 	fmt.Printf("Host:             %s\n", r.Host)
-	fmt.Printf("Header:           %s\n", r.Header)
+	fmt.Printf("Header:           %s\n", redactHeader(r.Header))
 	fmt.Printf("RequestURI:       %s\n", r.RequestURI)
 	// fmt.Printf("Body:             %s\n", r.Body)
 	fmt.Printf("Form:             %s\n", r.Form)
@@ -20,21 +119,72 @@ func myHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Printf("RemoteAddr:       %s\n", r.RemoteAddr)
 	fmt.Printf("TransferEncoding: %s\n", r.TransferEncoding)
 
-	APIRoute(w, r)
+	// the user of a valid access token is limited and seen by its ID. An invalid one is refused by the handler
+	userID := ""
+	if claims, err := sv.Authenticate(bearerToken(r)); err == nil {
+		userID = claims.Subject
+	}
+	if !sv.limit(w, r, userID) {
+		return
+	}
+	if userID != "" {
+		sv.presence.touch(userID, time.Now())
+	}
+	sv.APIRoute(w, r)
+}
+
+// redactHeader returns a copy of the header without the access token to log it
+func redactHeader(h http.Header) http.Header {
+
+	if h.Get("Authorization") == "" {
+		return h
+	}
+	h = h.Clone()
+	h.Set("Authorization", "[redacted]")
+	return h
 }
 
 // Run ...
 func Run(port int, args []string) error {
 
+	config, err := ParseConfig(args)
+	if err != nil {
+		return err
+	}
+
+	stores, err := NewStores(config)
+	if err != nil {
+		return err
+	}
+
+	sv := NewServerWithStores(stores)
+	if config.Auth.OIDC.Issuer != "" {
+		sv.OIDC = NewOIDCProvider(config.Auth.OIDC)
+	}
+	if config.Auth.Keyring != "" {
+		if sv.Keyring, err = LoadKeyring(config.Auth.Keyring); err != nil {
+			return err
+		}
+	}
+	sv.AccessTTL, sv.RefreshTTL = config.Auth.AccessTTL, config.Auth.RefreshTTL
+	for _, username := range config.Auth.Admins {
+		if err := sv.GrantAdmin(username); err != nil {
+			fmt.Printf("Run: cannot make %s an admin: %s\n", username, err.Error())
+		}
+	}
+	sv.Limits = NewLimiter(config.Limits)
+	sv.Janitor = NewJanitor(sv, config.Janitor)
+	go sv.Janitor.Run(context.Background())
+
 	s := &http.Server{
 		Addr:           ":" + strconv.Itoa(port),
-		Handler:        http.HandlerFunc(myHandler),
+		Handler:        sv,
 		ReadTimeout:    10 * time.Second,
 		WriteTimeout:   10 * time.Second,
 		MaxHeaderBytes: 1 << 20,
 	}
 
-	err := s.ListenAndServe()
+	err = s.ListenAndServe()
 	if err != nil {
 		return err
 	}
@@ -2,8 +2,10 @@ package server
 
 import (
 	"crypto/sha256"
+	"errors"
 	"fmt"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -19,6 +21,7 @@ const (
 	StateWonWhite
 	StateWonBlack
 	StateClose
+	StateDraw
 )
 
 const (
@@ -40,90 +43,397 @@ type Session struct {
 	ElapsedTurn int          `json:"elapsed_turn"`
 	LastMove    []int        `json:"last_move"`
 	MoveLog     [][]int      `json:"move_log"`
+	Version     int          `json:"version"`
+	UpdatedAt   time.Time    `json:"updated_at"`
+
+	// StartPosition is the position the session started from, if it is not the initial one
+	StartPosition string `json:"start_position,omitempty"`
+
+	// Rated is true for a session whose result changes the ratings of the players
+	Rated bool `json:"rated"`
+
+	// pending holds the events applied since the session was read from its store
+	pending []GameEvent
+
+	// removed is set when the session is deleted from its store, so that an update
+	// holding the session already does not write it back
+	removed bool
+
+	// mu guards the fields above against concurrent handlers
+	mu sync.Mutex
 }
 
-var sessionStore map[string]*Session
+var (
+	// ErrSessionNotFound is returned when the session does not exist
+	ErrSessionNotFound = errors.New("Invalid session")
+
+	// ErrSessionNotStarted is returned when a move is played before pairing
+	ErrSessionNotStarted = errors.New("Session does not start yet")
+
+	// ErrNotYourTurn is returned when a move is played by the player who does not have the turn
+	ErrNotYourTurn = errors.New("Not your turn")
+
+	// ErrGameFinished is returned when a finished session, live or archived, is played
+	ErrGameFinished = errors.New("Game is finished")
+
+	// ErrCannotPut is returned when a disc cannot be put on the grid
+	ErrCannotPut = errors.New("Cannot put a disc")
+
+	// ErrNotPlayer is returned when the user does not play in the session
+	ErrNotPlayer = errors.New("Not a player of the session")
+)
 
 func InitSessionStore(force bool) {
-	if sessionStore == nil || force {
-		sessionStore = make(map[string]*Session)
+	if defaultServer.Sessions == nil || force {
+		defaultServer.Sessions = NewMemorySessionStore()
 	}
 }
 
 func CreateSession(username string) (string, string) {
 
-	InitSessionStore(false)
+	user, session, err := defaultServer.CreateSession(username)
+	if err != nil {
+		fmt.Println("CreateSession: " + err.Error())
+		return user.UserID, ""
+	}
+	return user.UserID, session.SessionID
+}
 
-	user := CreateUser(username)
+// CreateSession registers a user and pairs it with a waiting session, or creates a new session
+func (sv *Server) CreateSession(username string) (User, *Session, error) {
 
-	sessionID := func(user User) string {
-		for _, s := range sessionStore {
-			// pairing
-			if len(s.Players) == 1 && s.State == StateWait {
-				s.Players = append(s.Players, user)
-				s.State = StateEstablished
-				return s.SessionID
-			}
+	user, err := sv.CreateUser(username)
+	if err != nil {
+		return user, nil, err
+	}
+
+	session, err := sv.JoinSession(user, false)
+	return user, session, err
+}
+
+// JoinSession pairs the user with a session waiting for a rated or a casual game as asked,
+// or creates a new session. Only registered users play rated games
+func (sv *Server) JoinSession(user User, rated bool) (*Session, error) {
+
+	if err := sv.checkBanned(user.UserID); err != nil {
+		return nil, err
+	}
+
+	if rated {
+		var err error
+		if user, err = sv.ratedPlayer(user); err != nil {
+			return nil, err
 		}
-		return ""
-	}(user)
+	}
 
-	if sessionID == "" {
+	// blocked users are never paired
+	relations, err := sv.Relations.Get(user.UserID)
+	if err != nil {
+		return nil, err
+	}
 
+	maxOpen := 0
+	if sv.Limits != nil {
+		maxOpen = sv.Limits.config.MaxOpenSessions
+	}
+	session, err := sv.Sessions.Join(user, rated, relations.avoided(), maxOpen, func() *Session {
 		// create a new session
-		sessionID = fmt.Sprintf("%x", sha256.Sum224([]byte((username + strconv.FormatInt(time.Now().UnixNano(), 10)))))
+		sessionID := fmt.Sprintf("%x", sha256.Sum224([]byte((user.UserID + strconv.FormatInt(time.Now().UnixNano(), 10)))))
+		s := new(Session)
+		s.Apply(GameEvent{SessionID: sessionID, Type: EventCreated, Time: time.Now(), User: &user, Rated: rated})
+		return s
+	})
+	if err != nil {
+		return nil, err
+	}
 
-		sessionStore[sessionID] = &Session{
-			SessionID: sessionID,
-			Players:   []User{user},
-			State:     StateWait,
-			Turn:      1,
-			Board: [][]int{
-				{0, 0, 0, 0, 0, 0, 0, 0},
-				{0, 0, 0, 0, 0, 0, 0, 0},
-				{0, 0, 0, 0, 0, 0, 0, 0},
-				{0, 0, 0, WHITE, BLACK, 0, 0, 0},
-				{0, 0, 0, BLACK, WHITE, 0, 0, 0},
-				{0, 0, 0, 0, 0, 0, 0, 0},
-				{0, 0, 0, 0, 0, 0, 0, 0},
-				{0, 0, 0, 0, 0, 0, 0, 0},
-			},
-			ElapsedTurn: 1,
-		}
+	sv.notifier.Notify(session.SessionID)
+	return session, nil
+}
+
+// NewSession returns a session waiting for an opponent of the user
+func NewSession(sessionID string, user User) *Session {
+
+	s := new(Session)
+	s.Apply(GameEvent{SessionID: sessionID, Type: EventCreated, Time: time.Now(), User: &user})
+	return s
+}
+
+// newSessionAt returns a session waiting for an opponent of the user which starts from the position
+func newSessionAt(sessionID string, user User, position string) *Session {
+
+	s := new(Session)
+	s.Apply(GameEvent{SessionID: sessionID, Type: EventCreated, Time: time.Now(), User: &user, Position: position})
+	return s
+}
+
+// CreateAnalysisSession registers a user who plays both sides of a session starting from the position
+func (sv *Server) CreateAnalysisSession(username string, position string) (User, *Session, error) {
+
+	position, err := playablePosition(position)
+	if err != nil {
+		return User{}, nil, err
 	}
 
-	userStore[user.UserID] = user
+	user, err := sv.CreateUser(username)
+	if err != nil {
+		return user, nil, err
+	}
+
+	sessionID := fmt.Sprintf("%x", sha256.Sum224([]byte((username + position + strconv.FormatInt(time.Now().UnixNano(), 10)))))
+	s := newSessionAt(sessionID, user, position)
+	s.Pair(user)
+	if err := sv.Sessions.Add(s); err != nil {
+		return user, nil, err
+	}
+
+	sv.notifier.Notify(sessionID)
+	return user, s.Clone(), nil
+}
 
-	return user.UserID, sessionID
+// IsAnalysis returns whether a single user plays both sides of the session
+func (s *Session) IsAnalysis() bool {
+	return len(s.Players) == 2 && s.Players[0].UserID == s.Players[1].UserID
+}
+
+// Pair adds the user as the opponent of a waiting session
+func (s *Session) Pair(user User) {
+	s.Apply(GameEvent{Type: EventJoined, Time: time.Now(), User: &user})
+}
+
+// Touch records a change of the session made without an event
+func (s *Session) Touch() {
+	s.Version++
+	s.UpdatedAt = time.Now()
 }
 
 func RemoveSession(sessionID string) {
-	delete(sessionStore, sessionID)
+	defaultServer.RemoveSession(sessionID)
+}
+
+// RemoveSession removes the session and wakes up its watchers
+func (sv *Server) RemoveSession(sessionID string) error {
+
+	err := sv.Sessions.Delete(sessionID)
+	sv.notifier.Notify(sessionID)
+	return err
 }
 
+// GetSession returns copies of all sessions
 func GetSession() map[string]*Session {
-	return sessionStore
+
+	sessions := make(map[string]*Session)
+	all, err := defaultServer.Sessions.All()
+	if err != nil {
+		fmt.Println("GetSession: " + err.Error())
+	}
+	for _, s := range all {
+		sessions[s.SessionID] = s
+	}
+	return sessions
 }
 
+// GetSessionInfo returns a copy of the session, or nil if it does not exist
 func GetSessionInfo(sessionID string) *Session {
-	return sessionStore[sessionID]
+
+	s, err := defaultServer.GetSessionInfo(sessionID)
+	if err != nil {
+		return nil
+	}
+	return s
+}
+
+// GetSessionInfo returns a copy of the session, or ErrSessionNotFound if it does not exist.
+// A finished session is read from the archive
+func (sv *Server) GetSessionInfo(sessionID string) (*Session, error) {
+
+	s, err := sv.Sessions.Get(sessionID)
+	if err != ErrSessionNotFound {
+		return s, err
+	}
+
+	game, err := sv.Games.Get(sessionID)
+	if err == ErrGameNotFound {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return game.Session, nil
 }
 
+// GetBoard returns a copy of the board, or nil if the session does not exist
 func GetBoard(sessionID string) [][]int {
-	return sessionStore[sessionID].Board
+
+	s := GetSessionInfo(sessionID)
+	if s == nil {
+		return nil
+	}
+	return s.Board
 }
 
 func IsTurn(sessionID string, color int) bool {
-	return sessionStore[sessionID].Turn == color
+
+	s := GetSessionInfo(sessionID)
+	return s != nil && s.Turn == color
+}
+
+// Lock locks the session for reading or changing it
+func (s *Session) Lock() {
+	s.mu.Lock()
+}
+
+// Unlock unlocks the session
+func (s *Session) Unlock() {
+	s.mu.Unlock()
+}
+
+// Clone returns a deep copy of the session. The caller must hold the lock of the session
+func (s *Session) Clone() *Session {
+
+	c := new(Session)
+	c.assign(s)
+	return c
+}
+
+// assign overwrites the session with a deep copy of src
+func (s *Session) assign(src *Session) {
+
+	s.SessionID = src.SessionID
+	s.Players = append([]User(nil), src.Players...)
+	s.State = src.State
+	s.Turn = src.Turn
+	s.Board = copyBoard(src.Board)
+	s.ElapsedTurn = src.ElapsedTurn
+	s.LastMove = append([]int(nil), src.LastMove...)
+	s.MoveLog = nil
+	for _, m := range src.MoveLog {
+		s.MoveLog = append(s.MoveLog, append([]int(nil), m...))
+	}
+	s.Version = src.Version
+	s.UpdatedAt = src.UpdatedAt
+	s.StartPosition = src.StartPosition
+	s.Rated = src.Rated
+}
+
+func copyBoard(board [][]int) [][]int {
+
+	c := make([][]int, len(board))
+	for i := range board {
+		c[i] = make([]int, len(board[i]))
+		copy(c[i], board[i])
+	}
+	return c
+}
+
+// updateSession changes the session atomically by fn and notifies the change.
+// Nothing is changed when fn returns an error
+func (sv *Server) updateSession(sessionID string, fn func(*Session) error) error {
+
+	if err := sv.Sessions.Update(sessionID, fn); err != nil {
+		if err == ErrSessionNotFound {
+			if _, aerr := sv.Games.Get(sessionID); aerr == nil {
+				return ErrGameFinished
+			}
+		}
+		return err
+	}
+
+	if err := sv.archiveFinished(sessionID); err != nil {
+		fmt.Println("updateSession: " + err.Error())
+	}
+	sv.notifier.Notify(sessionID)
+	return nil
+}
+
+func PlayMove(sessionID string, userID string, posX, posY int) error {
+	return defaultServer.PlayMove(sessionID, userID, posX, posY)
+}
+
+// PlayMove puts a disc of the user on (posX, posY) and advances the session.
+// Checking the turn and applying the move happen atomically. A banned user cannot move
+func (sv *Server) PlayMove(sessionID string, userID string, posX, posY int) error {
+
+	if err := sv.checkBanned(userID); err != nil {
+		return err
+	}
+
+	return sv.updateSession(sessionID, func(s *Session) error {
+
+		if s.State < StateEstablished || len(s.Players) < 2 {
+			return ErrSessionNotStarted
+		}
+
+		if IsSessionFinished(s) {
+			return ErrGameFinished
+		}
+		if userID != s.Players[s.Turn-1].UserID {
+			return ErrNotYourTurn
+		}
+
+		// try on a copy, since the move is applied as an event
+		if ret := putDisc(s.Clone(), s.Turn, posX, posY); ret != 0 {
+			return ErrCannotPut
+		}
+
+		fmt.Println("API: call UpdateSessionState")
+		applyMove(s, s.Turn, posX, posY)
+		return nil
+	})
+}
+
+// Resign ends the session by the resignation of the user. The opponent wins
+func (sv *Server) Resign(sessionID string, userID string) error {
+
+	return sv.updateSession(sessionID, func(s *Session) error {
+
+		if s.State < StateEstablished || len(s.Players) < 2 {
+			return ErrSessionNotStarted
+		}
+
+		color := EMPTY
+		for i, p := range s.Players {
+			if p.UserID == userID {
+				color = i + 1
+			}
+		}
+		if color == EMPTY {
+			return ErrNotPlayer
+		}
+		if IsSessionFinished(s) {
+			return ErrGameFinished
+		}
+
+		state := StateWonWhite
+		if color == WHITE {
+			state = StateWonBlack
+		}
+		s.Apply(GameEvent{Type: EventResign, Time: time.Now(), Color: color, State: state})
+		s.Apply(GameEvent{Type: EventFinished, Time: time.Now(), State: state})
+		return nil
+	})
 }
 
 func PutDisc(sessionID string, color int, posX, posY int) int {
 
+	ret := 1
+	defaultServer.updateSession(sessionID, func(s *Session) error {
+		if ret = putDisc(s, color, posX, posY); ret != 0 {
+			return ErrCannotPut
+		}
+		s.Touch()
+		return nil
+	})
+	return ret
+}
+
+func putDisc(s *Session, color int, posX, posY int) int {
+
 	if posY < 0 || posY >= MaxBoardSize || posX < 0 || posX >= MaxBoardSize {
 		return 2
 	}
 
-	board := sessionStore[sessionID].Board
+	board := s.Board
 	if board[posY][posX] != EMPTY {
 		return 3
 	}
@@ -138,7 +448,7 @@ func PutDisc(sessionID string, color int, posX, posY int) int {
 	move := false
 
 	// parse for up
-	move = move || func() bool {
+	move = func() bool {
 		move := false
 		side_y := -1
 		for y := posY - 1; y >= 0; y-- {
@@ -160,10 +470,10 @@ func PutDisc(sessionID string, color int, posX, posY int) int {
 			}
 		}
 		return move
-	}()
+	}() || move
 
 	// parse for up right
-	move = move || func() bool {
+	move = func() bool {
 		move := false
 		side_y, side_x := -1, -1
 		for y, x := posY-1, posX+1; y >= 0 && x < MaxBoardSize; y, x = y-1, x+1 {
@@ -184,10 +494,10 @@ func PutDisc(sessionID string, color int, posX, posY int) int {
 			}
 		}
 		return move
-	}()
+	}() || move
 
 	// parse for right
-	move = move || func() bool {
+	move = func() bool {
 		move := false
 		side_x := -1
 		for x := posX + 1; x < MaxBoardSize; x++ {
@@ -208,10 +518,10 @@ func PutDisc(sessionID string, color int, posX, posY int) int {
 			}
 		}
 		return move
-	}()
+	}() || move
 
 	// parse for down right
-	move = move || func() bool {
+	move = func() bool {
 		move := false
 		side_y, side_x := -1, -1
 		for y, x := posY+1, posX+1; y < MaxBoardSize && x < MaxBoardSize; y, x = y+1, x+1 {
@@ -232,10 +542,10 @@ func PutDisc(sessionID string, color int, posX, posY int) int {
 			}
 		}
 		return move
-	}()
+	}() || move
 
 	// parse for down
-	move = move || func() bool {
+	move = func() bool {
 		move := false
 		side_y := -1
 		for y := posY + 1; y < MaxBoardSize; y++ {
@@ -256,10 +566,10 @@ func PutDisc(sessionID string, color int, posX, posY int) int {
 			}
 		}
 		return move
-	}()
+	}() || move
 
 	// parse for down left
-	move = move || func() bool {
+	move = func() bool {
 		move := false
 		side_y, side_x := -1, -1
 		for y, x := posY+1, posX-1; y < MaxBoardSize && x >= 0; y, x = y+1, x-1 {
@@ -280,10 +590,10 @@ func PutDisc(sessionID string, color int, posX, posY int) int {
 			}
 		}
 		return move
-	}()
+	}() || move
 
 	// parse for left
-	move = move || func() bool {
+	move = func() bool {
 		move := false
 		side_x := -1
 		for x := posX - 1; x >= 0; x-- {
@@ -304,10 +614,10 @@ func PutDisc(sessionID string, color int, posX, posY int) int {
 			}
 		}
 		return move
-	}()
+	}() || move
 
 	// parse for up left
-	move = move || func() bool {
+	move = func() bool {
 		move := false
 		side_y, side_x := -1, -1
 		for y, x := posY-1, posX-1; y >= 0 && x >= 0; y, x = y-1, x-1 {
@@ -328,7 +638,7 @@ func PutDisc(sessionID string, color int, posX, posY int) int {
 			}
 		}
 		return move
-	}()
+	}() || move
 
 	// rollback to previous state if no moves
 	if !move {
@@ -346,11 +656,21 @@ func PutDisc(sessionID string, color int, posX, posY int) int {
 
 //
 // Find all candidate to put a disc on to the board
-//
 func FindCandidates(sessionID string, color int) [][]int {
 
+	s := GetSessionInfo(sessionID)
+	if s == nil {
+		return [][]int{}
+	}
+
+	// the copy is private to the caller, so no lock is needed
+	return findCandidates(s, color)
+}
+
+func findCandidates(s *Session, color int) [][]int {
+
 	// save previous state
-	board := sessionStore[sessionID].Board
+	board := s.Board
 	boardBackup := make([][]int, len(board))
 	for i := range board {
 		boardBackup[i] = make([]int, len(board[i]))
@@ -361,7 +681,7 @@ func FindCandidates(sessionID string, color int) [][]int {
 	for y := 0; y < MaxBoardSize; y++ {
 		for x := 0; x < MaxBoardSize; x++ {
 
-			if PutDisc(sessionID, color, x, y) == 0 {
+			if putDisc(s, color, x, y) == 0 {
 				candidates = append(candidates, []int{y, x})
 			}
 
@@ -376,52 +696,152 @@ func FindCandidates(sessionID string, color int) [][]int {
 }
 
 func RotateTurn(sessionID string) {
+
+	defaultServer.updateSession(sessionID, func(s *Session) error {
+		rotateTurn(s)
+		s.Touch()
+		return nil
+	})
+}
+
+func rotateTurn(s *Session) {
 	// rotate a turn
-	if sessionStore[sessionID].Turn == WHITE {
-		sessionStore[sessionID].Turn = BLACK
+	if s.Turn == WHITE {
+		s.Turn = BLACK
 	} else {
-		sessionStore[sessionID].Turn = WHITE
+		s.Turn = WHITE
 	}
 }
 
 func UpdateSessionState(sessionID string, color int, posX int, posY int) {
 
-	turn := sessionStore[sessionID].Turn
+	defaultServer.updateSession(sessionID, func(s *Session) error {
+		updateSessionState(s, color, posX, posY)
+		s.Touch()
+		return nil
+	})
+}
+
+func updateSessionState(s *Session, color int, posX int, posY int) {
+
+	turn := s.Turn
 
 	// increment number of elapsed turn
-	sessionStore[sessionID].ElapsedTurn++
+	s.ElapsedTurn++
 
-	sessionStore[sessionID].LastMove = []int{color, posX, posY}
-	sessionStore[sessionID].MoveLog = append(sessionStore[sessionID].MoveLog, []int{color, posX, posY})
+	s.LastMove = []int{color, posX, posY}
+	s.MoveLog = append(s.MoveLog, []int{color, posX, posY})
 
 	if turn == WHITE {
-		fmt.Printf("black cand: %x, %d\n", FindCandidates(sessionID, BLACK), len(FindCandidates(sessionID, BLACK)))
-		if len(FindCandidates(sessionID, BLACK)) == 0 {
-			if len(FindCandidates(sessionID, WHITE)) == 0 {
-				sessionStore[sessionID].State = StateWonWhite
+		fmt.Printf("black cand: %x, %d\n", findCandidates(s, BLACK), len(findCandidates(s, BLACK)))
+		if len(findCandidates(s, BLACK)) == 0 {
+			if len(findCandidates(s, WHITE)) == 0 {
+				s.State = gameResult(s.Board)
 			} else {
 				// pass a turn
-				sessionStore[sessionID].State = StatePassedBlack
+				s.State = StatePassedBlack
 			}
 		} else {
 			fmt.Println("Rotate a turn to BLACK")
-			RotateTurn(sessionID)
-			sessionStore[sessionID].State = StatePutWhite
+			rotateTurn(s)
+			s.State = StatePutWhite
 		}
 
 	} else if turn == BLACK {
-		fmt.Printf("white cand: %d\n", len(FindCandidates(sessionID, WHITE)))
-		if len(FindCandidates(sessionID, WHITE)) == 0 {
-			if len(FindCandidates(sessionID, BLACK)) == 0 {
-				sessionStore[sessionID].State = StateWonBlack
+		fmt.Printf("white cand: %d\n", len(findCandidates(s, WHITE)))
+		if len(findCandidates(s, WHITE)) == 0 {
+			if len(findCandidates(s, BLACK)) == 0 {
+				s.State = gameResult(s.Board)
 			} else {
 				// pass a turn
-				sessionStore[sessionID].State = StatePassedWhite
+				s.State = StatePassedWhite
 			}
 		} else {
 			fmt.Println("Rotate a turn to WHITE")
-			RotateTurn(sessionID)
-			sessionStore[sessionID].State = StatePutBlack
+			rotateTurn(s)
+			s.State = StatePutBlack
 		}
 	}
 }
+
+// WatchSession returns a channel which is closed on the next change of the session
+func WatchSession(sessionID string) <-chan struct{} {
+	return defaultServer.notifier.Watch(sessionID)
+}
+
+// NotifySession wakes up all watchers of the session
+func NotifySession(sessionID string) {
+	defaultServer.notifier.Notify(sessionID)
+}
+
+// sessionNotifier holds a channel per session which is closed and replaced
+// every time the session changes, waking up everyone waiting on it.
+type sessionNotifier struct {
+	mu       sync.Mutex
+	watchers map[string]chan struct{}
+}
+
+func newSessionNotifier() *sessionNotifier {
+	return &sessionNotifier{watchers: make(map[string]chan struct{})}
+}
+
+// Watch returns a channel which is closed on the next change of the session
+func (n *sessionNotifier) Watch(sessionID string) <-chan struct{} {
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	ch, ok := n.watchers[sessionID]
+	if !ok {
+		ch = make(chan struct{})
+		n.watchers[sessionID] = ch
+	}
+	return ch
+}
+
+// Notify wakes up all watchers of the session
+func (n *sessionNotifier) Notify(sessionID string) {
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if ch, ok := n.watchers[sessionID]; ok {
+		close(ch)
+		delete(n.watchers, sessionID)
+	}
+}
+
+// CountDiscs returns the number of white and black discs on the board
+func CountDiscs(board [][]int) (int, int) {
+
+	white, black := 0, 0
+	for _, row := range board {
+		for _, c := range row {
+			switch c {
+			case WHITE:
+				white++
+			case BLACK:
+				black++
+			}
+		}
+	}
+	return white, black
+}
+
+// gameResult returns the terminal state of a game over on the board. The player with more discs wins
+func gameResult(board [][]int) SessionState {
+
+	white, black := CountDiscs(board)
+	switch {
+	case white > black:
+		return StateWonWhite
+	case black > white:
+		return StateWonBlack
+	}
+	return StateDraw
+}
+
+// IsSessionFinished returns whether the session reached a terminal state
+func IsSessionFinished(session *Session) bool {
+	return session.State >= StateWonWhite
+}
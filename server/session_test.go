@@ -198,3 +198,42 @@ func TestSearchCandidates2(t *testing.T) {
 	fmt.Println(cand)
 	assert.Equal(t, fmt.Sprintf("%x", cand), "[[2 3] [2 5] [4 5]]")
 }
+
+func TestPutDiscMultipleDirections(t *testing.T) {
+	InitSessionStore(true)
+	InitUserStore(true)
+	_, sessionID := CreateSession("test")
+	_, _ = CreateSession("test2")
+
+	defaultServer.Sessions.Update(sessionID, func(s *Session) error {
+		for y := range s.Board {
+			for x := range s.Board[y] {
+				s.Board[y][x] = EMPTY
+			}
+		}
+		s.Board[2][4], s.Board[3][4] = WHITE, BLACK
+		s.Board[4][2], s.Board[4][3] = WHITE, BLACK
+		return nil
+	})
+
+	// flip discs both of up and left
+	assert.Equal(t, 0, PutDisc(sessionID, WHITE, 4, 4))
+	assert.Equal(t, fmt.Sprintf("%x", GetBoard(sessionID)), "[[0 0 0 0 0 0 0 0] [0 0 0 0 0 0 0 0] [0 0 0 0 1 0 0 0] [0 0 0 0 1 0 0 0] [0 0 1 1 1 0 0 0] [0 0 0 0 0 0 0 0] [0 0 0 0 0 0 0 0] [0 0 0 0 0 0 0 0]]")
+}
+
+func TestGameResult(t *testing.T) {
+
+	board := make([][]int, MaxBoardSize)
+	for y := range board {
+		board[y] = make([]int, MaxBoardSize)
+	}
+	board[0][0], board[0][1], board[0][2] = BLACK, BLACK, WHITE
+	assert.Equal(t, StateWonBlack, gameResult(board))
+
+	board[0][1] = WHITE
+	assert.Equal(t, StateWonWhite, gameResult(board))
+
+	board[0][2] = EMPTY
+	assert.Equal(t, StateDraw, gameResult(board))
+	assert.True(t, IsSessionFinished(&Session{State: StateDraw}))
+}
@@ -0,0 +1,626 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	// APIFriends is an API endpoint of the friends, friend requests and blocked users of the user
+	APIFriends string = "/friends"
+
+	// APIFriendsRequest, APIFriendsAccept and APIFriendsRemove are API endpoints that send a
+	// friend request to a user, accept the request of a user, and remove a friend or a request
+	APIFriendsRequest string = "/request"
+	APIFriendsAccept  string = "/accept"
+	APIFriendsRemove  string = "/remove"
+
+	// APIFriendsBlock and APIFriendsUnblock are API endpoints that block a user and lift the block
+	APIFriendsBlock   string = "/block"
+	APIFriendsUnblock string = "/unblock"
+)
+
+const (
+	// PresenceOnlineTTL is the time a user is online after its last request
+	PresenceOnlineTTL time.Duration = 2 * time.Minute
+
+	// PresenceIdleTTL is the time a user is idle after its last request, and offline after it
+	PresenceIdleTTL time.Duration = 15 * time.Minute
+)
+
+const (
+	// PresenceOffline is a user who has made no request for PresenceIdleTTL
+	PresenceOffline string = "offline"
+
+	// PresenceOnline is a user who made a request in PresenceOnlineTTL, or watches a session
+	PresenceOnline string = "online"
+
+	// PresenceIdle is a user who made no request in PresenceOnlineTTL, but did in PresenceIdleTTL
+	PresenceIdle string = "idle"
+
+	// PresenceInGame is a user who is not offline and plays a session
+	PresenceInGame string = "in-game"
+)
+
+var (
+	// ErrSelfRelation is returned when a user befriends or blocks itself
+	ErrSelfRelation = errors.New("Cannot befriend or block yourself")
+
+	// ErrFriendGuest is returned when a guest sends or is sent a friend request
+	ErrFriendGuest = errors.New("Only registered users have friends")
+
+	// ErrBlocked is returned when a user sends a friend request to a user it blocked or is blocked by
+	ErrBlocked = errors.New("Blocked")
+
+	// ErrNoFriendRequest is returned when a user accepts a friend request which was not sent
+	ErrNoFriendRequest = errors.New("No friend request")
+)
+
+// Relations are the friends, friend requests and blocks of a user. Both sides of a relation
+// are kept, so that a user who blocked another is in its BlockedBy
+type Relations struct {
+	UserID    string   `json:"userID"`
+	Friends   []string `json:"friends"`
+	Incoming  []string `json:"incoming"`
+	Outgoing  []string `json:"outgoing"`
+	Blocked   []string `json:"blocked"`
+	BlockedBy []string `json:"blockedBy"`
+}
+
+// RelationStore keeps the relations of users. Implementations must be safe for concurrent use
+type RelationStore interface {
+	// Get returns the relations of the user, which are empty when it has none
+	Get(userID string) (*Relations, error)
+
+	// Update changes the relations of both users by fn atomically. Nothing is changed
+	// when fn returns an error, which is returned as it is
+	Update(userID, otherID string, fn func(user, other *Relations) error) error
+
+	// Delete removes the relations of the user, and the user from the relations of others
+	Delete(userID string) error
+}
+
+func containsID(ids []string, id string) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+func addID(ids []string, id string) []string {
+	if containsID(ids, id) {
+		return ids
+	}
+	return append(ids, id)
+}
+
+func removeID(ids []string, id string) []string {
+	kept := ids[:0]
+	for _, v := range ids {
+		if v != id {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
+
+func (rel *Relations) clone() *Relations {
+	c := *rel
+	c.Friends = append([]string{}, rel.Friends...)
+	c.Incoming = append([]string{}, rel.Incoming...)
+	c.Outgoing = append([]string{}, rel.Outgoing...)
+	c.Blocked = append([]string{}, rel.Blocked...)
+	c.BlockedBy = append([]string{}, rel.BlockedBy...)
+	return &c
+}
+
+// forget removes the user from the relations, and returns whether it was in them
+func (rel *Relations) forget(userID string) bool {
+
+	lists := []*[]string{&rel.Friends, &rel.Incoming, &rel.Outgoing, &rel.Blocked, &rel.BlockedBy}
+	found := false
+	for _, ids := range lists {
+		if containsID(*ids, userID) {
+			*ids = removeID(*ids, userID)
+			found = true
+		}
+	}
+	return found
+}
+
+// avoided returns the users the user is never paired with
+func (rel *Relations) avoided() map[string]bool {
+
+	avoid := make(map[string]bool)
+	for _, id := range rel.Blocked {
+		avoid[id] = true
+	}
+	for _, id := range rel.BlockedBy {
+		avoid[id] = true
+	}
+	return avoid
+}
+
+// befriend makes the users friends, which has no request any more
+func befriend(user, other *Relations) {
+	unfriend(user, other)
+	user.Friends = addID(user.Friends, other.UserID)
+	other.Friends = addID(other.Friends, user.UserID)
+}
+
+// unfriend removes the friendship and the friend requests of the users
+func unfriend(user, other *Relations) {
+	for _, pair := range [][2]*Relations{{user, other}, {other, user}} {
+		pair[0].Friends = removeID(pair[0].Friends, pair[1].UserID)
+		pair[0].Incoming = removeID(pair[0].Incoming, pair[1].UserID)
+		pair[0].Outgoing = removeID(pair[0].Outgoing, pair[1].UserID)
+	}
+}
+
+// friendable returns an error unless the users are registered users other than each other
+func (sv *Server) friendable(userID, otherID string) error {
+
+	if userID == otherID {
+		return ErrSelfRelation
+	}
+	for _, id := range []string{userID, otherID} {
+		user, err := sv.Users.Get(id)
+		if err != nil {
+			return err
+		}
+		if !user.Registered {
+			return ErrFriendGuest
+		}
+	}
+	return nil
+}
+
+// RequestFriend sends a friend request to the other user. When the other user has sent
+// one already, they become friends
+func (sv *Server) RequestFriend(userID, otherID string) error {
+
+	if err := sv.friendable(userID, otherID); err != nil {
+		return err
+	}
+	return sv.Relations.Update(userID, otherID, func(user, other *Relations) error {
+		if containsID(user.Blocked, otherID) || containsID(user.BlockedBy, otherID) {
+			return ErrBlocked
+		}
+		if containsID(user.Friends, otherID) {
+			return nil
+		}
+		if containsID(user.Incoming, otherID) {
+			befriend(user, other)
+			return nil
+		}
+		user.Outgoing = addID(user.Outgoing, otherID)
+		other.Incoming = addID(other.Incoming, userID)
+		return nil
+	})
+}
+
+// AcceptFriend accepts the friend request of the other user
+func (sv *Server) AcceptFriend(userID, otherID string) error {
+
+	if err := sv.friendable(userID, otherID); err != nil {
+		return err
+	}
+	return sv.Relations.Update(userID, otherID, func(user, other *Relations) error {
+		if !containsID(user.Incoming, otherID) {
+			return ErrNoFriendRequest
+		}
+		befriend(user, other)
+		return nil
+	})
+}
+
+// RemoveFriend removes the other user from the friends, or declines or withdraws a friend request
+func (sv *Server) RemoveFriend(userID, otherID string) error {
+
+	if userID == otherID {
+		return ErrSelfRelation
+	}
+	if _, err := sv.Users.Get(otherID); err != nil {
+		return err
+	}
+	return sv.Relations.Update(userID, otherID, func(user, other *Relations) error {
+		unfriend(user, other)
+		return nil
+	})
+}
+
+// Block blocks the other user, which ends their friendship. Blocked users are never paired
+func (sv *Server) Block(userID, otherID string, blocked bool) error {
+
+	if userID == otherID {
+		return ErrSelfRelation
+	}
+	if _, err := sv.Users.Get(otherID); err != nil {
+		return err
+	}
+	return sv.Relations.Update(userID, otherID, func(user, other *Relations) error {
+		if !blocked {
+			user.Blocked = removeID(user.Blocked, otherID)
+			other.BlockedBy = removeID(other.BlockedBy, userID)
+			return nil
+		}
+		unfriend(user, other)
+		user.Blocked = addID(user.Blocked, otherID)
+		other.BlockedBy = addID(other.BlockedBy, userID)
+		return nil
+	})
+}
+
+// presenceTracker keeps when users made their last requests and the streams they watch
+type presenceTracker struct {
+	mu    sync.Mutex
+	seen  map[string]time.Time
+	conns map[string]int
+}
+
+func newPresenceTracker() *presenceTracker {
+	return &presenceTracker{seen: make(map[string]time.Time), conns: make(map[string]int)}
+}
+
+// touch records a request of the user
+func (pt *presenceTracker) touch(userID string, now time.Time) {
+	pt.mu.Lock()
+	pt.seen[userID] = now
+	pt.mu.Unlock()
+}
+
+// connect records a stream the user watches until the returned function is called
+func (pt *presenceTracker) connect(userID string, now time.Time) func() {
+
+	pt.mu.Lock()
+	pt.seen[userID] = now
+	pt.conns[userID]++
+	pt.mu.Unlock()
+
+	return func() {
+		pt.mu.Lock()
+		defer pt.mu.Unlock()
+		pt.seen[userID] = time.Now()
+		if pt.conns[userID]--; pt.conns[userID] <= 0 {
+			delete(pt.conns, userID)
+		}
+	}
+}
+
+// get returns the last request of the user and whether it watches a stream
+func (pt *presenceTracker) get(userID string) (time.Time, bool) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	return pt.seen[userID], pt.conns[userID] > 0
+}
+
+// purge forgets the users offline at now
+func (pt *presenceTracker) purge(now time.Time) {
+
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+
+	for userID, seen := range pt.seen {
+		if pt.conns[userID] == 0 && now.Sub(seen) > PresenceIdleTTL {
+			delete(pt.seen, userID)
+		}
+	}
+}
+
+// Presence tells whether a user is online. A user in game has the session it plays
+type Presence struct {
+	State     string     `json:"state"`
+	SessionID string     `json:"sessionID,omitempty"`
+	Link      string     `json:"link,omitempty"`
+	LastSeen  *time.Time `json:"lastSeen,omitempty"`
+}
+
+// playingSessions returns the sessions being played by their players
+func (sv *Server) playingSessions() (map[string]string, error) {
+
+	sessions, err := sv.Sessions.All()
+	if err != nil {
+		return nil, err
+	}
+	playing := make(map[string]string)
+	for _, s := range sessions {
+		if s.State < StateEstablished || IsSessionFinished(s) {
+			continue
+		}
+		for _, p := range s.Players {
+			playing[p.UserID] = s.SessionID
+		}
+	}
+	return playing, nil
+}
+
+// presenceOf returns the presence of the user at now, who plays the sessions of playing
+func (sv *Server) presenceOf(userID string, playing map[string]string, now time.Time) Presence {
+
+	seen, live := sv.presence.get(userID)
+	if seen.IsZero() {
+		return Presence{State: PresenceOffline}
+	}
+	p := Presence{LastSeen: &seen}
+	switch {
+	case !live && now.Sub(seen) > PresenceIdleTTL:
+		p.State = PresenceOffline
+	case playing[userID] != "":
+		p.State = PresenceInGame
+		p.SessionID = playing[userID]
+		p.Link = APISession + "/" + p.SessionID
+	case live || now.Sub(seen) <= PresenceOnlineTTL:
+		p.State = PresenceOnline
+	default:
+		p.State = PresenceIdle
+	}
+	return p
+}
+
+// Presence returns the presence of the user as of now
+func (sv *Server) Presence(userID string) (Presence, error) {
+
+	playing, err := sv.playingSessions()
+	if err != nil {
+		return Presence{}, err
+	}
+	return sv.presenceOf(userID, playing, time.Now()), nil
+}
+
+// FriendResponse is a user related to the user. Only friends have a presence
+type FriendResponse struct {
+	UserID   string    `json:"userID"`
+	Name     string    `json:"name"`
+	Presence *Presence `json:"presence,omitempty"`
+}
+
+// GetFriendsResponse ...
+type GetFriendsResponse struct {
+	Status   string           `json:"status"`
+	Friends  []FriendResponse `json:"friends"`
+	Incoming []FriendResponse `json:"incoming"`
+	Outgoing []FriendResponse `json:"outgoing"`
+	Blocked  []FriendResponse `json:"blocked"`
+}
+
+// APIGetFriends returns the friends with their presences, the friend requests and the
+// blocked users of the user of the access token
+func (sv *Server) APIGetFriends(w http.ResponseWriter, r *http.Request) {
+
+	user, err := sv.authenticate(r)
+	if err != nil {
+		returnAuthError(w, err)
+		return
+	}
+
+	rel, err := sv.Relations.Get(user.UserID)
+	var playing map[string]string
+	if err == nil {
+		playing, err = sv.playingSessions()
+	}
+	if err != nil {
+		fmt.Println("APIGetFriends: " + err.Error())
+		returnJSONMessage(w, http.StatusInternalServerError, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: "Cannot read friends",
+		})
+		return
+	}
+
+	now := time.Now()
+	users := func(ids []string, presence bool) []FriendResponse {
+		res := make([]FriendResponse, 0, len(ids))
+		for _, id := range ids {
+			// a user removed by the janitor is left out
+			u, err := sv.Users.Get(id)
+			if err != nil {
+				continue
+			}
+			f := FriendResponse{UserID: id, Name: u.Name}
+			if presence {
+				p := sv.presenceOf(id, playing, now)
+				f.Presence = &p
+			}
+			res = append(res, f)
+		}
+		return res
+	}
+
+	returnJSONMessage(w, http.StatusOK, &GetFriendsResponse{
+		Status:   "success",
+		Friends:  users(rel.Friends, true),
+		Incoming: users(rel.Incoming, false),
+		Outgoing: users(rel.Outgoing, false),
+		Blocked:  users(rel.Blocked, false),
+	})
+}
+
+// APIPostFriend sends, accepts or removes a friend request, removes a friend, or blocks
+// a user or lifts the block
+func (sv *Server) APIPostFriend(w http.ResponseWriter, r *http.Request) {
+
+	user, err := sv.authenticate(r)
+	if err != nil {
+		returnAuthError(w, err)
+		return
+	}
+
+	re := regexp.MustCompile(APIFriends + "/([a-zA-Z0-9]+)(/[a-z]+)")
+	match := re.FindStringSubmatch(r.URL.Path)
+	if len(match) < 3 {
+		returnJSONMessage(w, http.StatusInternalServerError, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: "Invalid user",
+		})
+		return
+	}
+
+	switch match[2] {
+	case APIFriendsRequest:
+		err = sv.RequestFriend(user.UserID, match[1])
+	case APIFriendsAccept:
+		err = sv.AcceptFriend(user.UserID, match[1])
+	case APIFriendsRemove:
+		err = sv.RemoveFriend(user.UserID, match[1])
+	case APIFriendsBlock:
+		err = sv.Block(user.UserID, match[1], true)
+	default:
+		err = sv.Block(user.UserID, match[1], false)
+	}
+
+	switch err {
+	case nil:
+		returnJSONMessage(w, http.StatusOK, &GeneralMessageResponse{
+			Status: "success",
+		})
+	case ErrSelfRelation:
+		returnJSONMessage(w, http.StatusBadRequest, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: err.Error(),
+		})
+	case ErrFriendGuest, ErrBlocked:
+		returnJSONMessage(w, http.StatusForbidden, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: err.Error(),
+		})
+	case ErrNoFriendRequest:
+		returnJSONMessage(w, http.StatusConflict, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: err.Error(),
+		})
+	case ErrUserNotFound:
+		returnJSONMessage(w, http.StatusNotFound, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: err.Error(),
+		})
+	default:
+		fmt.Println("APIPostFriend: " + err.Error())
+		returnJSONMessage(w, http.StatusInternalServerError, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: "Cannot change friends",
+		})
+	}
+}
+
+// MemoryRelationStore keeps relations in memory
+type MemoryRelationStore struct {
+	mu        sync.Mutex
+	relations map[string]*Relations
+
+	// save and remove let a durable store write a change through before it is committed
+	save   func(*Relations) error
+	remove func(userID string) error
+}
+
+// NewMemoryRelationStore returns an empty MemoryRelationStore
+func NewMemoryRelationStore() *MemoryRelationStore {
+	return &MemoryRelationStore{relations: make(map[string]*Relations)}
+}
+
+// Get ...
+func (st *MemoryRelationStore) Get(userID string) (*Relations, error) {
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	return st.load(userID), nil
+}
+
+func (st *MemoryRelationStore) load(userID string) *Relations {
+	if rel, ok := st.relations[userID]; ok {
+		return rel.clone()
+	}
+	return &Relations{UserID: userID}
+}
+
+// Update ...
+func (st *MemoryRelationStore) Update(userID, otherID string, fn func(user, other *Relations) error) error {
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	user, other := st.load(userID), st.load(otherID)
+	if err := fn(user, other); err != nil {
+		return err
+	}
+	if st.save != nil {
+		for _, rel := range []*Relations{user, other} {
+			if err := st.save(rel); err != nil {
+				return err
+			}
+		}
+	}
+	st.relations[userID], st.relations[otherID] = user, other
+	return nil
+}
+
+// Delete ...
+func (st *MemoryRelationStore) Delete(userID string) error {
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	for id, rel := range st.relations {
+		if id == userID {
+			continue
+		}
+		c := rel.clone()
+		if !c.forget(userID) {
+			continue
+		}
+		if st.save != nil {
+			if err := st.save(c); err != nil {
+				return err
+			}
+		}
+		st.relations[id] = c
+	}
+
+	if st.remove != nil {
+		if err := st.remove(userID); err != nil {
+			return err
+		}
+	}
+	delete(st.relations, userID)
+	return nil
+}
+
+// NewFileRelationStore returns a relation store which keeps the relations of every user
+// as a JSON file under dir/relations
+func NewFileRelationStore(dir string) (*MemoryRelationStore, error) {
+
+	dir = filepath.Join(dir, "relations")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	st := NewMemoryRelationStore()
+	err := readJSONFiles(dir, func(data []byte) error {
+		rel := new(Relations)
+		if err := json.Unmarshal(data, rel); err != nil {
+			return err
+		}
+		st.relations[rel.UserID] = rel
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	st.save = func(rel *Relations) error {
+		return writeJSONFile(filepath.Join(dir, rel.UserID+".json"), rel)
+	}
+	st.remove = func(userID string) error {
+		return removeFile(filepath.Join(dir, userID+".json"))
+	}
+	return st, nil
+}
@@ -0,0 +1,245 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFriends(t *testing.T) {
+
+	sv := NewServer(NewMemorySessionStore(), NewMemoryUserStore())
+	ts := httptest.NewServer(sv)
+	defer ts.Close()
+
+	alice, _ := sv.Register("alice", "correct horse")
+	bob, _ := sv.Register("bob", "correct horse")
+	carol, _ := sv.Register("carol", "correct horse")
+	guest, _ := sv.CreateUser("guest")
+
+	token := func(user User) string {
+		tokens, err := sv.IssueTokens(user)
+		assert.Nil(t, err)
+		return tokens.AccessToken
+	}
+	post := func(user User, otherID, action string) int {
+		res, err := postWithToken(ts.URL+APIFriends+"/"+otherID+action, token(user), nil)
+		if !assert.Nil(t, err) {
+			return 0
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	friends := func(user User) *GetFriendsResponse {
+		req, _ := http.NewRequest("GET", ts.URL+APIFriends, nil)
+		req.Header.Set("Authorization", "Bearer "+token(user))
+		res, err := http.DefaultClient.Do(req)
+		if !assert.Nil(t, err) {
+			return &GetFriendsResponse{}
+		}
+		defer res.Body.Close()
+		got := new(GetFriendsResponse)
+		assert.Nil(t, json.NewDecoder(res.Body).Decode(got))
+		return got
+	}
+	ids := func(users []FriendResponse) []string {
+		got := make([]string, 0)
+		for _, u := range users {
+			got = append(got, u.UserID)
+		}
+		return got
+	}
+
+	// a request is accepted by the user it was sent to
+	assert.Equal(t, http.StatusOK, post(alice, bob.UserID, APIFriendsRequest))
+	assert.Equal(t, []string{bob.UserID}, ids(friends(alice).Outgoing))
+	assert.Equal(t, []string{alice.UserID}, ids(friends(bob).Incoming))
+	assert.Equal(t, http.StatusConflict, post(alice, bob.UserID, APIFriendsAccept))
+	assert.Equal(t, http.StatusOK, post(bob, alice.UserID, APIFriendsAccept))
+
+	got := friends(alice)
+	assert.Equal(t, []string{bob.UserID}, ids(got.Friends))
+	assert.Empty(t, got.Outgoing)
+	if assert.Len(t, got.Friends, 1) {
+		assert.Equal(t, "bob", got.Friends[0].Name)
+		assert.NotNil(t, got.Friends[0].Presence)
+	}
+
+	// requests sent both ways make friends
+	assert.Equal(t, http.StatusOK, post(alice, carol.UserID, APIFriendsRequest))
+	assert.Equal(t, http.StatusOK, post(carol, alice.UserID, APIFriendsRequest))
+	assert.Equal(t, []string{bob.UserID, carol.UserID}, ids(friends(alice).Friends))
+	assert.Equal(t, http.StatusOK, post(carol, alice.UserID, APIFriendsRemove))
+	assert.Equal(t, []string{bob.UserID}, ids(friends(alice).Friends))
+
+	assert.Equal(t, http.StatusBadRequest, post(alice, alice.UserID, APIFriendsRequest))
+	assert.Equal(t, http.StatusForbidden, post(alice, guest.UserID, APIFriendsRequest))
+	assert.Equal(t, http.StatusNotFound, post(alice, "nobody", APIFriendsRequest))
+
+	// a block ends the friendship and refuses requests both ways
+	assert.Equal(t, http.StatusOK, post(bob, alice.UserID, APIFriendsBlock))
+	assert.Empty(t, friends(alice).Friends)
+	assert.Equal(t, []string{alice.UserID}, ids(friends(bob).Blocked))
+	assert.Equal(t, http.StatusForbidden, post(alice, bob.UserID, APIFriendsRequest))
+	assert.Equal(t, http.StatusForbidden, post(bob, alice.UserID, APIFriendsRequest))
+	assert.Equal(t, http.StatusOK, post(bob, alice.UserID, APIFriendsUnblock))
+	assert.Equal(t, http.StatusOK, post(alice, bob.UserID, APIFriendsRequest))
+
+	// guests block too, and a removed user leaves no relation behind
+	assert.Equal(t, http.StatusOK, post(guest, alice.UserID, APIFriendsBlock))
+	assert.Nil(t, sv.Relations.Delete(guest.UserID))
+	rel, _ := sv.Relations.Get(alice.UserID)
+	assert.Empty(t, rel.BlockedBy)
+}
+
+func TestBlockedPairing(t *testing.T) {
+
+	sv := NewServer(NewMemorySessionStore(), NewMemoryUserStore())
+
+	alice, _ := sv.Register("alice", "correct horse")
+	bob, _ := sv.Register("bob", "correct horse")
+	carol, _ := sv.Register("carol", "correct horse")
+	assert.Nil(t, sv.Block(alice.UserID, bob.UserID, true))
+
+	// neither the blocked nor the blocking user is paired with the other
+	waiting, err := sv.JoinSession(alice, false)
+	assert.Nil(t, err)
+	blocked, err := sv.JoinSession(bob, false)
+	assert.Nil(t, err)
+	assert.NotEqual(t, waiting.SessionID, blocked.SessionID)
+	assert.Equal(t, StateWait, blocked.State)
+
+	again, err := sv.JoinSession(alice, false)
+	assert.Nil(t, err)
+	assert.NotEqual(t, blocked.SessionID, again.SessionID)
+	assert.Equal(t, StateWait, again.State)
+
+	// others are paired with either of them
+	paired, err := sv.JoinSession(carol, false)
+	assert.Nil(t, err)
+	assert.Equal(t, StateEstablished, paired.State)
+}
+
+func TestPresence(t *testing.T) {
+
+	sv := NewServer(NewMemorySessionStore(), NewMemoryUserStore())
+	ts := httptest.NewServer(sv)
+	defer ts.Close()
+
+	alice, _ := sv.Register("alice", "correct horse")
+	bob, _ := sv.Register("bob", "correct horse")
+
+	p, err := sv.Presence(alice.UserID)
+	assert.Nil(t, err)
+	assert.Equal(t, Presence{State: PresenceOffline}, p)
+
+	// a request with an access token is activity
+	tokens, _ := sv.IssueTokens(alice)
+	req, _ := http.NewRequest("GET", ts.URL+APIFriends, nil)
+	req.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+	res, err := http.DefaultClient.Do(req)
+	if assert.Nil(t, err) {
+		res.Body.Close()
+	}
+	p, _ = sv.Presence(alice.UserID)
+	assert.Equal(t, PresenceOnline, p.State)
+	assert.NotNil(t, p.LastSeen)
+
+	now := time.Now()
+	assert.Equal(t, PresenceIdle, sv.presenceOf(alice.UserID, nil, now.Add(PresenceOnlineTTL+time.Second)).State)
+	assert.Equal(t, PresenceOffline, sv.presenceOf(alice.UserID, nil, now.Add(PresenceIdleTTL+time.Second)).State)
+
+	// a user playing is in game with its session
+	s, _ := sv.JoinSession(alice, false)
+	sv.JoinSession(bob, false)
+	p, _ = sv.Presence(alice.UserID)
+	assert.Equal(t, PresenceInGame, p.State)
+	assert.Equal(t, s.SessionID, p.SessionID)
+	assert.Equal(t, APISession+"/"+s.SessionID, p.Link)
+
+	// a user watching a stream stays online
+	disconnect := sv.presence.connect(bob.UserID, now)
+	assert.Equal(t, PresenceInGame, sv.presenceOf(bob.UserID, map[string]string{bob.UserID: s.SessionID}, now.Add(time.Hour)).State)
+	assert.Equal(t, PresenceOnline, sv.presenceOf(bob.UserID, nil, now.Add(time.Hour)).State)
+	sv.presence.purge(now.Add(time.Hour))
+	disconnect()
+	assert.Equal(t, PresenceIdle, sv.presenceOf(bob.UserID, nil, time.Now().Add(PresenceOnlineTTL+time.Second)).State)
+
+	sv.presence.purge(time.Now().Add(PresenceIdleTTL + time.Second))
+	p, _ = sv.Presence(bob.UserID)
+	assert.Equal(t, Presence{State: PresenceOffline}, p)
+}
+
+func TestRelationStores(t *testing.T) {
+
+	dir := t.TempDir()
+	sqlite, err := OpenSQLiteStore(filepath.Join(dir, "reversi.db"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer sqlite.Close()
+
+	files, err := NewFileRelationStore(dir)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	for _, st := range []RelationStore{NewMemoryRelationStore(), files, sqlite.Relations()} {
+		rel, err := st.Get("u1")
+		assert.Nil(t, err)
+		assert.Equal(t, &Relations{UserID: "u1"}, rel)
+
+		assert.Nil(t, st.Update("u1", "u2", func(user, other *Relations) error {
+			befriend(user, other)
+			return nil
+		}))
+		assert.Nil(t, st.Update("u1", "u3", func(user, other *Relations) error {
+			user.Outgoing = addID(user.Outgoing, "u3")
+			other.Incoming = addID(other.Incoming, "u1")
+			return nil
+		}))
+		assert.Nil(t, st.Update("u3", "u2", func(user, other *Relations) error {
+			user.Blocked = addID(user.Blocked, "u2")
+			other.BlockedBy = addID(other.BlockedBy, "u3")
+			return nil
+		}))
+		assert.Equal(t, errBrokenStore, st.Update("u1", "u2", func(user, other *Relations) error {
+			unfriend(user, other)
+			return errBrokenStore
+		}))
+
+		rel, err = st.Get("u1")
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"u2"}, rel.Friends)
+		assert.Equal(t, []string{"u3"}, rel.Outgoing)
+		rel, _ = st.Get("u2")
+		assert.Equal(t, []string{"u1"}, rel.Friends)
+		assert.Equal(t, []string{"u3"}, rel.BlockedBy)
+		assert.Equal(t, map[string]bool{"u3": true}, rel.avoided())
+	}
+
+	files, err = NewFileRelationStore(dir)
+	if !assert.Nil(t, err) {
+		return
+	}
+	rel, err := files.Get("u3")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"u1"}, rel.Incoming)
+	assert.Equal(t, []string{"u2"}, rel.Blocked)
+
+	for _, st := range []RelationStore{files, sqlite.Relations()} {
+		assert.Nil(t, st.Delete("u3"))
+		rel, _ = st.Get("u3")
+		assert.Empty(t, rel.Incoming)
+		rel, _ = st.Get("u1")
+		assert.Empty(t, rel.Outgoing)
+		rel, _ = st.Get("u2")
+		assert.Empty(t, rel.BlockedBy)
+		assert.Equal(t, []string{"u1"}, rel.Friends)
+	}
+}
@@ -0,0 +1,326 @@
+package server
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrUserNotFound is returned when the user does not exist
+var ErrUserNotFound = errors.New("Invalid user")
+
+// SessionStore keeps sessions. Implementations must be safe for concurrent use
+// and hand out copies, so that callers never share a session with each other
+type SessionStore interface {
+	// Get returns a copy of the session, or ErrSessionNotFound
+	Get(sessionID string) (*Session, error)
+
+	// All returns copies of all sessions
+	All() ([]*Session, error)
+
+	// Join pairs the user with a session waiting for someone else which is rated or not as asked
+	// and not of a user in avoid, or adds the session made by create when nobody is waiting,
+	// and returns a copy of it. Concurrent users are paired. When maxOpen is above 0 and the
+	// user waits in or plays maxOpen sessions already, it returns ErrTooManySessions
+	Join(user User, rated bool, avoid map[string]bool, maxOpen int, create func() *Session) (*Session, error)
+
+	// Add adds the session, which is not offered to users joining
+	Add(s *Session) error
+
+	// Update changes the session by fn atomically. Nothing is changed when fn
+	// returns an error, which is returned as it is
+	Update(sessionID string, fn func(*Session) error) error
+
+	// Delete removes the session
+	Delete(sessionID string) error
+}
+
+// UserStore keeps users. Implementations must be safe for concurrent use
+type UserStore interface {
+	// Get returns the user, or ErrUserNotFound
+	Get(userID string) (User, error)
+
+	// All returns all users
+	All() ([]User, error)
+
+	// Put adds or replaces the user
+	Put(user User) error
+
+	// Update changes the user by fn atomically, or returns ErrUserNotFound. Nothing is
+	// changed when fn returns an error, which is returned as it is
+	Update(userID string, fn func(*User) error) error
+
+	// Delete removes the user
+	Delete(userID string) error
+}
+
+// MemorySessionStore keeps sessions in memory. The fields of each session
+// are guarded by the lock of the session itself
+type MemorySessionStore struct {
+	mu       sync.RWMutex
+	sessions map[string]*Session
+
+	// save and remove let a durable store write a change through before it is committed
+	save   func(*Session) error
+	remove func(sessionID string) error
+}
+
+// NewMemorySessionStore returns an empty MemorySessionStore
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{sessions: make(map[string]*Session)}
+}
+
+func (st *MemorySessionStore) get(sessionID string) *Session {
+
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	return st.sessions[sessionID]
+}
+
+// Get ...
+func (st *MemorySessionStore) Get(sessionID string) (*Session, error) {
+
+	s := st.get(sessionID)
+	if s == nil {
+		return nil, ErrSessionNotFound
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	return s.Clone(), nil
+}
+
+// All ...
+func (st *MemorySessionStore) All() ([]*Session, error) {
+
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	sessions := make([]*Session, 0, len(st.sessions))
+	for _, s := range st.sessions {
+		s.Lock()
+		sessions = append(sessions, s.Clone())
+		s.Unlock()
+	}
+	return sessions, nil
+}
+
+// Join ...
+func (st *MemorySessionStore) Join(user User, rated bool, avoid map[string]bool, maxOpen int, create func() *Session) (*Session, error) {
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if maxOpen > 0 && st.open(user.UserID) >= maxOpen {
+		return nil, ErrTooManySessions
+	}
+
+	for _, s := range st.sessions {
+		s.Lock()
+		// pairing
+		if len(s.Players) == 1 && s.State == StateWait && s.Players[0].UserID != user.UserID && s.Rated == rated && !avoid[s.Players[0].UserID] {
+			c := s.Clone()
+			c.Pair(user)
+			if st.save != nil {
+				if err := st.save(c); err != nil {
+					s.Unlock()
+					return nil, err
+				}
+			}
+			s.assign(c)
+			s.Unlock()
+			return c, nil
+		}
+		s.Unlock()
+	}
+
+	s := create()
+	if st.save != nil {
+		if err := st.save(s); err != nil {
+			return nil, err
+		}
+	}
+	st.sessions[s.SessionID] = s.Clone()
+	return s, nil
+}
+
+// open counts the sessions the user waits in or plays. The caller holds st.mu
+func (st *MemorySessionStore) open(userID string) int {
+
+	open := 0
+	for _, s := range st.sessions {
+		s.Lock()
+		if !IsSessionFinished(s) {
+			for _, p := range s.Players {
+				if p.UserID == userID {
+					open++
+					break
+				}
+			}
+		}
+		s.Unlock()
+	}
+	return open
+}
+
+// Add ...
+func (st *MemorySessionStore) Add(s *Session) error {
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.save != nil {
+		if err := st.save(s); err != nil {
+			return err
+		}
+	}
+	st.sessions[s.SessionID] = s.Clone()
+	return nil
+}
+
+// Update ...
+func (st *MemorySessionStore) Update(sessionID string, fn func(*Session) error) error {
+
+	s := st.get(sessionID)
+	if s == nil {
+		return ErrSessionNotFound
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	// the session may be deleted between get and Lock
+	if s.removed {
+		return ErrSessionNotFound
+	}
+
+	// work on a copy so that a failure leaves the session as it was
+	c := s.Clone()
+	if err := fn(c); err != nil {
+		return err
+	}
+	if st.save != nil {
+		if err := st.save(c); err != nil {
+			return err
+		}
+	}
+	s.assign(c)
+	return nil
+}
+
+// Delete ...
+func (st *MemorySessionStore) Delete(sessionID string) error {
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	// wait for an update of the session in progress, which would write it back otherwise
+	s := st.sessions[sessionID]
+	if s != nil {
+		s.Lock()
+		defer s.Unlock()
+	}
+
+	if st.remove != nil {
+		if err := st.remove(sessionID); err != nil {
+			return err
+		}
+	}
+	delete(st.sessions, sessionID)
+	if s != nil {
+		s.removed = true
+	}
+	return nil
+}
+
+// MemoryUserStore keeps users in memory
+type MemoryUserStore struct {
+	mu    sync.RWMutex
+	users map[string]User
+
+	// save and remove let a durable store write a change through before it is committed
+	save   func(User) error
+	remove func(userID string) error
+}
+
+// NewMemoryUserStore returns an empty MemoryUserStore
+func NewMemoryUserStore() *MemoryUserStore {
+	return &MemoryUserStore{users: make(map[string]User)}
+}
+
+// Get ...
+func (st *MemoryUserStore) Get(userID string) (User, error) {
+
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	user, ok := st.users[userID]
+	if !ok {
+		return user, ErrUserNotFound
+	}
+	return user, nil
+}
+
+// All ...
+func (st *MemoryUserStore) All() ([]User, error) {
+
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	users := make([]User, 0, len(st.users))
+	for _, user := range st.users {
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+// Put ...
+func (st *MemoryUserStore) Put(user User) error {
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.save != nil {
+		if err := st.save(user); err != nil {
+			return err
+		}
+	}
+	st.users[user.UserID] = user
+	return nil
+}
+
+// Update ...
+func (st *MemoryUserStore) Update(userID string, fn func(*User) error) error {
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	user, ok := st.users[userID]
+	if !ok {
+		return ErrUserNotFound
+	}
+	if err := fn(&user); err != nil {
+		return err
+	}
+	if st.save != nil {
+		if err := st.save(user); err != nil {
+			return err
+		}
+	}
+	st.users[userID] = user
+	return nil
+}
+
+// Delete ...
+func (st *MemoryUserStore) Delete(userID string) error {
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.remove != nil {
+		if err := st.remove(userID); err != nil {
+			return err
+		}
+	}
+	delete(st.users, userID)
+	return nil
+}
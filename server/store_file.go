@@ -0,0 +1,127 @@
+package server
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// NewFileSessionStore returns a session store which keeps every session as a JSON
+// file under dir/sessions and loads the existing ones. Sessions are served from
+// memory and each change is written to its file before it is committed
+func NewFileSessionStore(dir string) (*MemorySessionStore, error) {
+
+	dir = filepath.Join(dir, "sessions")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	st := NewMemorySessionStore()
+	err := readJSONFiles(dir, func(data []byte) error {
+		s := new(Session)
+		if err := json.Unmarshal(data, s); err != nil {
+			return err
+		}
+		st.sessions[s.SessionID] = s
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	st.save = func(s *Session) error {
+		return writeJSONFile(filepath.Join(dir, s.SessionID+".json"), s)
+	}
+	st.remove = func(sessionID string) error {
+		return removeFile(filepath.Join(dir, sessionID+".json"))
+	}
+	return st, nil
+}
+
+// NewFileUserStore returns a user store which keeps every user as a JSON file under dir/users
+func NewFileUserStore(dir string) (*MemoryUserStore, error) {
+
+	dir = filepath.Join(dir, "users")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	st := NewMemoryUserStore()
+	err := readJSONFiles(dir, func(data []byte) error {
+		var user User
+		if err := json.Unmarshal(data, &user); err != nil {
+			return err
+		}
+		st.users[user.UserID] = user
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	st.save = func(user User) error {
+		return writeJSONFile(filepath.Join(dir, user.UserID+".json"), user)
+	}
+	st.remove = func(userID string) error {
+		return removeFile(filepath.Join(dir, userID+".json"))
+	}
+	return st, nil
+}
+
+func readJSONFiles(dir string, fn func([]byte) error) error {
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return err
+		}
+		if err := fn(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeJSONFile replaces the file atomically, so that a crash leaves either the old or the new content
+func writeJSONFile(path string, v interface{}) error {
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func removeFile(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
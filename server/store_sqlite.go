@@ -0,0 +1,1391 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteMigrations are applied in order. Append new ones; never edit applied ones
+var sqliteMigrations = []string{
+	`CREATE TABLE users (
+		user_id TEXT PRIMARY KEY,
+		name    TEXT NOT NULL,
+		data    TEXT NOT NULL
+	)`,
+	`CREATE TABLE sessions (
+		session_id TEXT PRIMARY KEY,
+		state      INTEGER NOT NULL,
+		updated_at TIMESTAMP NOT NULL,
+		data       TEXT NOT NULL
+	)`,
+	`CREATE INDEX sessions_state ON sessions (state)`,
+	`CREATE TABLE moves (
+		session_id TEXT NOT NULL REFERENCES sessions (session_id) ON DELETE CASCADE,
+		ply        INTEGER NOT NULL,
+		color      INTEGER NOT NULL,
+		pos_x      INTEGER NOT NULL,
+		pos_y      INTEGER NOT NULL,
+		board      TEXT NOT NULL,
+		PRIMARY KEY (session_id, ply)
+	)`,
+	`CREATE TABLE games (
+		game_id     TEXT PRIMARY KEY,
+		white_id    TEXT NOT NULL,
+		white_name  TEXT NOT NULL,
+		black_id    TEXT NOT NULL,
+		black_name  TEXT NOT NULL,
+		result      TEXT NOT NULL,
+		length      INTEGER NOT NULL,
+		moves       TEXT NOT NULL,
+		finished_at TIMESTAMP NOT NULL,
+		data        TEXT NOT NULL
+	)`,
+	`CREATE INDEX games_finished_at ON games (finished_at)`,
+	`CREATE TABLE tokens (
+		token_hash TEXT PRIMARY KEY,
+		user_id    TEXT NOT NULL
+	)`,
+	`CREATE INDEX tokens_user_id ON tokens (user_id)`,
+	`CREATE TABLE accounts (
+		username      TEXT PRIMARY KEY,
+		user_id       TEXT NOT NULL,
+		password_hash TEXT NOT NULL,
+		created_at    TIMESTAMP NOT NULL,
+		data          TEXT NOT NULL
+	)`,
+	// the tokens issued so far were access tokens, which are signed now
+	`DELETE FROM tokens`,
+	`ALTER TABLE tokens ADD COLUMN expires_at INTEGER NOT NULL DEFAULT 0`,
+	`CREATE TABLE profiles (
+		user_id TEXT PRIMARY KEY,
+		data    TEXT NOT NULL
+	)`,
+	`CREATE TABLE ratings (
+		user_id    TEXT PRIMARY KEY,
+		rating     REAL NOT NULL,
+		deviation  REAL NOT NULL,
+		volatility REAL NOT NULL,
+		games      INTEGER NOT NULL,
+		updated_at TIMESTAMP NOT NULL
+	)`,
+	`CREATE TABLE rating_history (
+		user_id TEXT NOT NULL,
+		game_id TEXT NOT NULL,
+		time    TIMESTAMP NOT NULL,
+		data    TEXT NOT NULL,
+		PRIMARY KEY (user_id, game_id)
+	)`,
+	`CREATE INDEX rating_history_time ON rating_history (user_id, time)`,
+	`CREATE TABLE leaderboards (
+		variant      TEXT NOT NULL,
+		time_window  TEXT NOT NULL,
+		period       TEXT NOT NULL,
+		user_id      TEXT NOT NULL,
+		name         TEXT NOT NULL,
+		games        INTEGER NOT NULL,
+		wins         INTEGER NOT NULL,
+		losses       INTEGER NOT NULL,
+		draws        INTEGER NOT NULL,
+		rated_games  INTEGER NOT NULL,
+		rating       REAL NOT NULL,
+		last_game_id TEXT NOT NULL,
+		PRIMARY KEY (variant, time_window, period, user_id)
+	)`,
+	`CREATE INDEX leaderboards_user_id ON leaderboards (user_id)`,
+	`CREATE TABLE identities (
+		issuer  TEXT NOT NULL,
+		subject TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		data    TEXT NOT NULL,
+		PRIMARY KEY (issuer, subject)
+	)`,
+	`CREATE INDEX identities_user_id ON identities (user_id)`,
+	`CREATE TABLE relations (
+		user_id  TEXT NOT NULL,
+		other_id TEXT NOT NULL,
+		kind     TEXT NOT NULL,
+		PRIMARY KEY (user_id, other_id, kind)
+	)`,
+	`CREATE INDEX relations_other_id ON relations (other_id)`,
+}
+
+// SQLiteStore keeps users, sessions and every move with the board after it in a SQLite database.
+// Changes of a session are applied in a transaction, so a crash never leaves a half-applied move
+type SQLiteStore struct {
+	db *sql.DB
+
+	// mu serializes changes, which SQLite serializes anyway
+	mu sync.Mutex
+}
+
+// OpenSQLiteStore opens the database at path, applies the migrations and recovers in-progress sessions
+func OpenSQLiteStore(path string) (*SQLiteStore, error) {
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("sqlite3", "file:"+path+"?_foreign_keys=on&_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+
+	st := &SQLiteStore{db: db}
+	if err := st.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := st.recover(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return st, nil
+}
+
+// Close closes the database
+func (st *SQLiteStore) Close() error {
+	return st.db.Close()
+}
+
+func (st *SQLiteStore) migrate() error {
+
+	if _, err := st.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`); err != nil {
+		return err
+	}
+
+	var version int
+	if err := st.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version); err != nil {
+		return err
+	}
+
+	for i := version; i < len(sqliteMigrations); i++ {
+		tx, err := st.db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(sqliteMigrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version) VALUES (?)`, i+1); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recover reloads the in-progress sessions and replays their moves, repairing
+// the board of a session whose snapshot does not agree with its move history
+func (st *SQLiteStore) recover() error {
+
+	rows, err := st.db.Query(`SELECT session_id FROM sessions WHERE state < ?`, StateWonWhite)
+	if err != nil {
+		return err
+	}
+	ids := make([]string, 0)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	repaired := 0
+	for _, id := range ids {
+		err := st.Update(id, func(s *Session) error {
+			board := replayBoard(s.StartPosition, s.MoveLog)
+			if board == nil || fmt.Sprint(board) == fmt.Sprint(s.Board) {
+				return errNothingToRepair
+			}
+			s.Board = board
+			repaired++
+			return nil
+		})
+		if err != nil && err != errNothingToRepair {
+			return err
+		}
+	}
+
+	fmt.Printf("SQLiteStore: recovered %d in-progress sessions (%d repaired)\n", len(ids), repaired)
+	return nil
+}
+
+var errNothingToRepair = fmt.Errorf("nothing to repair")
+
+// replayBoard returns the board after the moves from the start position, or nil if a move is illegal
+func replayBoard(start string, moveLog [][]int) [][]int {
+
+	s := newSessionAt("", User{}, start)
+	for _, m := range moveLog {
+		if putDisc(s, m[0], m[1], m[2]) != 0 {
+			return nil
+		}
+	}
+	return s.Board
+}
+
+type sqlQueryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func loadSession(q sqlQueryer, sessionID string) (*Session, error) {
+
+	var data string
+	err := q.QueryRow(`SELECT data FROM sessions WHERE session_id = ?`, sessionID).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s := new(Session)
+	if err := json.Unmarshal([]byte(data), s); err != nil {
+		return nil, err
+	}
+
+	rows, err := q.Query(`SELECT color, pos_x, pos_y FROM moves WHERE session_id = ? ORDER BY ply`, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var color, x, y int
+		if err := rows.Scan(&color, &x, &y); err != nil {
+			return nil, err
+		}
+		s.MoveLog = append(s.MoveLog, []int{color, x, y})
+	}
+	return s, rows.Err()
+}
+
+// saveSession writes the session and the moves appended since stored moves
+func saveSession(tx *sql.Tx, s *Session, stored int) error {
+
+	moveLog := s.MoveLog
+	s.MoveLog = nil
+	data, err := json.Marshal(s)
+	s.MoveLog = moveLog
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`INSERT INTO sessions (session_id, state, updated_at, data) VALUES (?, ?, ?, ?)
+		ON CONFLICT (session_id) DO UPDATE SET state = excluded.state, updated_at = excluded.updated_at, data = excluded.data`,
+		s.SessionID, s.State, s.UpdatedAt.UTC(), string(data))
+	if err != nil {
+		return err
+	}
+
+	if len(moveLog) < stored {
+		return fmt.Errorf("session %s: move log is shorter than the stored one", s.SessionID)
+	}
+
+	if stored == len(moveLog) {
+		return nil
+	}
+
+	// every new move gets the board after it, replayed from the board of the last stored move
+	replay := newSessionAt("", User{}, s.StartPosition)
+	if stored > 0 {
+		var board string
+		err := tx.QueryRow(`SELECT board FROM moves WHERE session_id = ? AND ply = ?`, s.SessionID, stored).Scan(&board)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal([]byte(board), &replay.Board); err != nil {
+			return err
+		}
+	}
+	for i := stored; i < len(moveLog); i++ {
+		m := moveLog[i]
+		if putDisc(replay, m[0], m[1], m[2]) != 0 {
+			return fmt.Errorf("session %s: move %d is illegal", s.SessionID, i+1)
+		}
+		board, err := json.Marshal(replay.Board)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`INSERT INTO moves (session_id, ply, color, pos_x, pos_y, board) VALUES (?, ?, ?, ?, ?, ?)`,
+			s.SessionID, i+1, m[0], m[1], m[2], string(board))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get ...
+func (st *SQLiteStore) Get(sessionID string) (*Session, error) {
+	return loadSession(st.db, sessionID)
+}
+
+// All ...
+func (st *SQLiteStore) All() ([]*Session, error) {
+
+	rows, err := st.db.Query(`SELECT session_id FROM sessions`)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sessions := make([]*Session, 0, len(ids))
+	for _, id := range ids {
+		s, err := loadSession(st.db, id)
+		if err == ErrSessionNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, nil
+}
+
+// Join ...
+func (st *SQLiteStore) Join(user User, rated bool, avoid map[string]bool, maxOpen int, create func() *Session) (*Session, error) {
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	tx, err := st.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if maxOpen > 0 {
+		var open int
+		err := tx.QueryRow(`SELECT COUNT(DISTINCT s.session_id) FROM sessions s, json_each(s.data, '$.players') p
+			WHERE s.state < ? AND json_extract(p.value, '$.userID') = ?`, StateWonWhite, user.UserID).Scan(&open)
+		if err != nil {
+			return nil, err
+		}
+		if open >= maxOpen {
+			return nil, ErrTooManySessions
+		}
+	}
+
+	rows, err := tx.Query(`SELECT session_id FROM sessions WHERE state = ? ORDER BY updated_at`, StateWait)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var s *Session
+	for _, id := range ids {
+		waiting, err := loadSession(tx, id)
+		if err != nil {
+			return nil, err
+		}
+		if waiting.Players[0].UserID != user.UserID && waiting.Rated == rated && !avoid[waiting.Players[0].UserID] {
+			s = waiting
+			s.Pair(user)
+			break
+		}
+	}
+	if s == nil {
+		s = create()
+	}
+
+	if err := saveSession(tx, s, len(s.MoveLog)); err != nil {
+		return nil, err
+	}
+	return s, tx.Commit()
+}
+
+// Add ...
+func (st *SQLiteStore) Add(s *Session) error {
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	tx, err := st.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := saveSession(tx, s, 0); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Update ...
+func (st *SQLiteStore) Update(sessionID string, fn func(*Session) error) error {
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	tx, err := st.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	s, err := loadSession(tx, sessionID)
+	if err != nil {
+		return err
+	}
+
+	stored := len(s.MoveLog)
+	if err := fn(s); err != nil {
+		return err
+	}
+
+	if err := saveSession(tx, s, stored); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Delete ...
+func (st *SQLiteStore) Delete(sessionID string) error {
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	_, err := st.db.Exec(`DELETE FROM sessions WHERE session_id = ?`, sessionID)
+	return err
+}
+
+// SQLiteUserStore is the UserStore view of a SQLiteStore
+type SQLiteUserStore struct {
+	st *SQLiteStore
+}
+
+// Users returns the user store backed by the same database
+func (st *SQLiteStore) Users() *SQLiteUserStore {
+	return &SQLiteUserStore{st: st}
+}
+
+// Get ...
+func (us *SQLiteUserStore) Get(userID string) (User, error) {
+
+	var user User
+	var data string
+	err := us.st.db.QueryRow(`SELECT data FROM users WHERE user_id = ?`, userID).Scan(&data)
+	if err == sql.ErrNoRows {
+		return user, ErrUserNotFound
+	}
+	if err != nil {
+		return user, err
+	}
+	err = json.Unmarshal([]byte(data), &user)
+	return user, err
+}
+
+// All ...
+func (us *SQLiteUserStore) All() ([]User, error) {
+
+	rows, err := us.st.db.Query(`SELECT data FROM users`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := make([]User, 0)
+	for rows.Next() {
+		var user User
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(data), &user); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+// Put ...
+func (us *SQLiteUserStore) Put(user User) error {
+
+	data, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+
+	us.st.mu.Lock()
+	defer us.st.mu.Unlock()
+
+	_, err = us.st.db.Exec(`INSERT INTO users (user_id, name, data) VALUES (?, ?, ?)
+		ON CONFLICT (user_id) DO UPDATE SET name = excluded.name, data = excluded.data`,
+		user.UserID, user.Name, string(data))
+	return err
+}
+
+// Update ...
+func (us *SQLiteUserStore) Update(userID string, fn func(*User) error) error {
+
+	us.st.mu.Lock()
+	defer us.st.mu.Unlock()
+
+	tx, err := us.st.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var user User
+	var data string
+	err = tx.QueryRow(`SELECT data FROM users WHERE user_id = ?`, userID).Scan(&data)
+	if err == sql.ErrNoRows {
+		return ErrUserNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal([]byte(data), &user); err != nil {
+		return err
+	}
+	if err := fn(&user); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE users SET name = ?, data = ? WHERE user_id = ?`, user.Name, string(b), userID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Delete ...
+func (us *SQLiteUserStore) Delete(userID string) error {
+
+	us.st.mu.Lock()
+	defer us.st.mu.Unlock()
+
+	_, err := us.st.db.Exec(`DELETE FROM users WHERE user_id = ?`, userID)
+	return err
+}
+
+// SQLiteTokenStore is the TokenStore view of a SQLiteStore
+type SQLiteTokenStore struct {
+	st *SQLiteStore
+}
+
+// Tokens returns the token store backed by the same database
+func (st *SQLiteStore) Tokens() *SQLiteTokenStore {
+	return &SQLiteTokenStore{st: st}
+}
+
+// Put ...
+func (ts *SQLiteTokenStore) Put(hash string, userID string, expires time.Time) error {
+
+	ts.st.mu.Lock()
+	defer ts.st.mu.Unlock()
+
+	_, err := ts.st.db.Exec(`INSERT INTO tokens (token_hash, user_id, expires_at) VALUES (?, ?, ?)
+		ON CONFLICT (token_hash) DO UPDATE SET user_id = excluded.user_id, expires_at = excluded.expires_at`,
+		hash, userID, expires.Unix())
+	return err
+}
+
+// Take ...
+func (ts *SQLiteTokenStore) Take(hash string, now time.Time) (string, error) {
+
+	ts.st.mu.Lock()
+	defer ts.st.mu.Unlock()
+
+	tx, err := ts.st.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var userID string
+	var expires int64
+	err = tx.QueryRow(`SELECT user_id, expires_at FROM tokens WHERE token_hash = ?`, hash).Scan(&userID, &expires)
+	if err == sql.ErrNoRows {
+		return "", ErrUnauthorized
+	}
+	if err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec(`DELETE FROM tokens WHERE token_hash = ?`, hash); err != nil {
+		return "", err
+	}
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	if now.Unix() >= expires {
+		return "", ErrUnauthorized
+	}
+	return userID, nil
+}
+
+// Delete ...
+func (ts *SQLiteTokenStore) Delete(hash string) error {
+
+	ts.st.mu.Lock()
+	defer ts.st.mu.Unlock()
+
+	_, err := ts.st.db.Exec(`DELETE FROM tokens WHERE token_hash = ?`, hash)
+	return err
+}
+
+// DeleteUser ...
+func (ts *SQLiteTokenStore) DeleteUser(userID string) error {
+
+	ts.st.mu.Lock()
+	defer ts.st.mu.Unlock()
+
+	_, err := ts.st.db.Exec(`DELETE FROM tokens WHERE user_id = ?`, userID)
+	return err
+}
+
+// Purge ...
+func (ts *SQLiteTokenStore) Purge(now time.Time) error {
+
+	ts.st.mu.Lock()
+	defer ts.st.mu.Unlock()
+
+	_, err := ts.st.db.Exec(`DELETE FROM tokens WHERE expires_at <= ?`, now.Unix())
+	return err
+}
+
+// SQLiteAccountStore is the AccountStore view of a SQLiteStore
+type SQLiteAccountStore struct {
+	st *SQLiteStore
+}
+
+// Accounts returns the account store backed by the same database
+func (st *SQLiteStore) Accounts() *SQLiteAccountStore {
+	return &SQLiteAccountStore{st: st}
+}
+
+// Get ...
+func (as *SQLiteAccountStore) Get(username string) (Account, error) {
+
+	var account Account
+	var data string
+	err := as.st.db.QueryRow(`SELECT data FROM accounts WHERE username = ?`, accountKey(username)).Scan(&data)
+	if err == sql.ErrNoRows {
+		return account, ErrAccountNotFound
+	}
+	if err != nil {
+		return account, err
+	}
+	err = json.Unmarshal([]byte(data), &account)
+	return account, err
+}
+
+// Create ...
+func (as *SQLiteAccountStore) Create(account Account) error {
+
+	data, err := json.Marshal(account)
+	if err != nil {
+		return err
+	}
+
+	as.st.mu.Lock()
+	defer as.st.mu.Unlock()
+
+	res, err := as.st.db.Exec(`INSERT INTO accounts (username, user_id, password_hash, created_at, data) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (username) DO NOTHING`,
+		accountKey(account.Username), account.UserID, account.PasswordHash, account.CreatedAt, string(data))
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrUsernameTaken
+	}
+	return nil
+}
+
+// Delete ...
+func (as *SQLiteAccountStore) Delete(username string) error {
+
+	as.st.mu.Lock()
+	defer as.st.mu.Unlock()
+
+	_, err := as.st.db.Exec(`DELETE FROM accounts WHERE username = ?`, accountKey(username))
+	return err
+}
+
+// SQLiteIdentityStore is the IdentityStore view of a SQLiteStore
+type SQLiteIdentityStore struct {
+	st *SQLiteStore
+}
+
+// Identities returns the identity store backed by the same database
+func (st *SQLiteStore) Identities() *SQLiteIdentityStore {
+	return &SQLiteIdentityStore{st: st}
+}
+
+// Get ...
+func (is *SQLiteIdentityStore) Get(issuer, subject string) (Identity, error) {
+
+	var identity Identity
+	var data string
+	err := is.st.db.QueryRow(`SELECT data FROM identities WHERE issuer = ? AND subject = ?`, issuer, subject).Scan(&data)
+	if err == sql.ErrNoRows {
+		return identity, ErrIdentityNotFound
+	}
+	if err != nil {
+		return identity, err
+	}
+	err = json.Unmarshal([]byte(data), &identity)
+	return identity, err
+}
+
+// Link ...
+func (is *SQLiteIdentityStore) Link(identity Identity) error {
+
+	data, err := json.Marshal(identity)
+	if err != nil {
+		return err
+	}
+
+	is.st.mu.Lock()
+	defer is.st.mu.Unlock()
+
+	res, err := is.st.db.Exec(`INSERT INTO identities (issuer, subject, user_id, data) VALUES (?, ?, ?, ?)
+		ON CONFLICT (issuer, subject) DO NOTHING`,
+		identity.Issuer, identity.Subject, identity.UserID, string(data))
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrIdentityLinked
+	}
+	return nil
+}
+
+// DeleteUser ...
+func (is *SQLiteIdentityStore) DeleteUser(userID string) error {
+
+	is.st.mu.Lock()
+	defer is.st.mu.Unlock()
+
+	_, err := is.st.db.Exec(`DELETE FROM identities WHERE user_id = ?`, userID)
+	return err
+}
+
+// SQLiteRelationStore is the RelationStore view of a SQLiteStore. Every relation is a row
+// of the kind of the list of Relations it is in
+type SQLiteRelationStore struct {
+	st *SQLiteStore
+}
+
+// Relations returns the relation store backed by the same database
+func (st *SQLiteStore) Relations() *SQLiteRelationStore {
+	return &SQLiteRelationStore{st: st}
+}
+
+// relationLists returns the lists of the relations by their kinds
+func relationLists(rel *Relations) map[string]*[]string {
+	return map[string]*[]string{
+		"friend":     &rel.Friends,
+		"incoming":   &rel.Incoming,
+		"outgoing":   &rel.Outgoing,
+		"blocked":    &rel.Blocked,
+		"blocked_by": &rel.BlockedBy,
+	}
+}
+
+// Get ...
+func (rs *SQLiteRelationStore) Get(userID string) (*Relations, error) {
+	return loadRelations(rs.st.db, userID)
+}
+
+func loadRelations(q sqlQueryer, userID string) (*Relations, error) {
+
+	rows, err := q.Query(`SELECT other_id, kind FROM relations WHERE user_id = ? ORDER BY rowid`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rel := &Relations{UserID: userID}
+	lists := relationLists(rel)
+	for rows.Next() {
+		var otherID, kind string
+		if err := rows.Scan(&otherID, &kind); err != nil {
+			return nil, err
+		}
+		if ids, ok := lists[kind]; ok {
+			*ids = append(*ids, otherID)
+		}
+	}
+	return rel, rows.Err()
+}
+
+// Update ...
+func (rs *SQLiteRelationStore) Update(userID, otherID string, fn func(user, other *Relations) error) error {
+
+	rs.st.mu.Lock()
+	defer rs.st.mu.Unlock()
+
+	tx, err := rs.st.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	user, err := loadRelations(tx, userID)
+	if err != nil {
+		return err
+	}
+	other, err := loadRelations(tx, otherID)
+	if err != nil {
+		return err
+	}
+	if err := fn(user, other); err != nil {
+		return err
+	}
+
+	for _, rel := range []*Relations{user, other} {
+		if _, err := tx.Exec(`DELETE FROM relations WHERE user_id = ?`, rel.UserID); err != nil {
+			return err
+		}
+		for _, kind := range []string{"friend", "incoming", "outgoing", "blocked", "blocked_by"} {
+			for _, id := range *relationLists(rel)[kind] {
+				if _, err := tx.Exec(`INSERT INTO relations (user_id, other_id, kind) VALUES (?, ?, ?)`, rel.UserID, id, kind); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// Delete ...
+func (rs *SQLiteRelationStore) Delete(userID string) error {
+
+	rs.st.mu.Lock()
+	defer rs.st.mu.Unlock()
+
+	_, err := rs.st.db.Exec(`DELETE FROM relations WHERE user_id = ? OR other_id = ?`, userID, userID)
+	return err
+}
+
+// SQLiteProfileStore is the ProfileStore view of a SQLiteStore
+type SQLiteProfileStore struct {
+	st *SQLiteStore
+}
+
+// Profiles returns the profile store backed by the same database
+func (st *SQLiteStore) Profiles() *SQLiteProfileStore {
+	return &SQLiteProfileStore{st: st}
+}
+
+// Get ...
+func (ps *SQLiteProfileStore) Get(userID string) (*Profile, error) {
+	return loadProfile(ps.st.db, userID)
+}
+
+func loadProfile(q sqlQueryer, userID string) (*Profile, error) {
+
+	var data string
+	err := q.QueryRow(`SELECT data FROM profiles WHERE user_id = ?`, userID).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, ErrProfileNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	p := new(Profile)
+	err = json.Unmarshal([]byte(data), p)
+	return p, err
+}
+
+// Update ...
+func (ps *SQLiteProfileStore) Update(userID string, fn func(*Profile) error) error {
+
+	ps.st.mu.Lock()
+	defer ps.st.mu.Unlock()
+
+	tx, err := ps.st.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	p, err := loadProfile(tx, userID)
+	if err == ErrProfileNotFound {
+		p, err = &Profile{UserID: userID}, nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := fn(p); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO profiles (user_id, data) VALUES (?, ?)
+		ON CONFLICT (user_id) DO UPDATE SET data = excluded.data`, userID, string(data))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Delete ...
+func (ps *SQLiteProfileStore) Delete(userID string) error {
+
+	ps.st.mu.Lock()
+	defer ps.st.mu.Unlock()
+
+	_, err := ps.st.db.Exec(`DELETE FROM profiles WHERE user_id = ?`, userID)
+	return err
+}
+
+// SQLiteRatingStore is the RatingStore view of a SQLiteStore. The history is kept a row per game
+type SQLiteRatingStore struct {
+	st *SQLiteStore
+}
+
+// Ratings returns the rating store backed by the same database
+func (st *SQLiteStore) Ratings() *SQLiteRatingStore {
+	return &SQLiteRatingStore{st: st}
+}
+
+// Get ...
+func (rs *SQLiteRatingStore) Get(userID string) (*UserRating, error) {
+	return loadRating(rs.st.db, userID)
+}
+
+func loadRating(q sqlQueryer, userID string) (*UserRating, error) {
+
+	ur := &UserRating{UserID: userID, History: []RatingChange{}}
+	err := q.QueryRow(`SELECT rating, deviation, volatility, games, updated_at FROM ratings WHERE user_id = ?`, userID).
+		Scan(&ur.Rating.Rating, &ur.Deviation, &ur.Volatility, &ur.Games, &ur.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrRatingNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := q.Query(`SELECT data FROM rating_history WHERE user_id = ? ORDER BY time DESC, rowid DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var c RatingChange
+		if err := json.Unmarshal([]byte(data), &c); err != nil {
+			return nil, err
+		}
+		ur.History = append(ur.History, c)
+	}
+	return ur, rows.Err()
+}
+
+// Update ...
+func (rs *SQLiteRatingStore) Update(whiteID, blackID string, fn func(white, black *UserRating) error) error {
+
+	rs.st.mu.Lock()
+	defer rs.st.mu.Unlock()
+
+	tx, err := rs.st.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	players := make([]*UserRating, 0, 2)
+	stored := make([]int, 0, 2)
+	for _, userID := range []string{whiteID, blackID} {
+		ur, err := loadRating(tx, userID)
+		if err == ErrRatingNotFound {
+			ur, err = &UserRating{UserID: userID, Rating: NewRating()}, nil
+		}
+		if err != nil {
+			return err
+		}
+		players = append(players, ur)
+		stored = append(stored, len(ur.History))
+	}
+	if err := fn(players[0], players[1]); err != nil {
+		return err
+	}
+
+	for i, ur := range players {
+		_, err := tx.Exec(`INSERT INTO ratings (user_id, rating, deviation, volatility, games, updated_at) VALUES (?, ?, ?, ?, ?, ?)
+			ON CONFLICT (user_id) DO UPDATE SET rating = excluded.rating, deviation = excluded.deviation,
+			volatility = excluded.volatility, games = excluded.games, updated_at = excluded.updated_at`,
+			ur.UserID, ur.Rating.Rating, ur.Deviation, ur.Volatility, ur.Games, ur.UpdatedAt.UTC())
+		if err != nil {
+			return err
+		}
+
+		// the changes made by fn are in front of the stored ones
+		for _, c := range ur.History[:len(ur.History)-stored[i]] {
+			data, err := json.Marshal(c)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(`INSERT INTO rating_history (user_id, game_id, time, data) VALUES (?, ?, ?, ?)`,
+				ur.UserID, c.GameID, c.Time.UTC(), string(data))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// Delete ...
+func (rs *SQLiteRatingStore) Delete(userID string) error {
+
+	rs.st.mu.Lock()
+	defer rs.st.mu.Unlock()
+
+	tx, err := rs.st.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM ratings WHERE user_id = ?`, userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM rating_history WHERE user_id = ?`, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SQLiteLeaderboardStore is the LeaderboardStore view of a SQLiteStore, which ranks players by SQL
+type SQLiteLeaderboardStore struct {
+	st *SQLiteStore
+}
+
+// Leaderboards returns the leaderboard store backed by the same database
+func (st *SQLiteStore) Leaderboards() *SQLiteLeaderboardStore {
+	return &SQLiteLeaderboardStore{st: st}
+}
+
+// leaderboardColumns are the columns of an entry in the order scanLeaderboardEntry reads them
+const leaderboardColumns = `user_id, name, games, wins, losses, draws, rated_games, rating, last_game_id`
+
+func scanLeaderboardEntry(row interface{ Scan(...interface{}) error }) (LeaderboardEntry, error) {
+	var e LeaderboardEntry
+	err := row.Scan(&e.UserID, &e.Name, &e.Games, &e.Wins, &e.Losses, &e.Draws, &e.RatedGames, &e.Rating, &e.LastGameID)
+	return e, err
+}
+
+// Update ...
+func (ls *SQLiteLeaderboardStore) Update(key LeaderboardKey, userID string, fn func(*LeaderboardEntry) error) error {
+
+	ls.st.mu.Lock()
+	defer ls.st.mu.Unlock()
+
+	tx, err := ls.st.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	e, err := scanLeaderboardEntry(tx.QueryRow(`SELECT `+leaderboardColumns+` FROM leaderboards
+		WHERE variant = ? AND time_window = ? AND period = ? AND user_id = ?`, key.Variant, key.Window, key.Period, userID))
+	if err == sql.ErrNoRows {
+		e, err = LeaderboardEntry{UserID: userID}, nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := fn(&e); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`INSERT INTO leaderboards (variant, time_window, period, `+leaderboardColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (variant, time_window, period, user_id) DO UPDATE SET name = excluded.name,
+		games = excluded.games, wins = excluded.wins, losses = excluded.losses, draws = excluded.draws,
+		rated_games = excluded.rated_games, rating = excluded.rating, last_game_id = excluded.last_game_id`,
+		key.Variant, key.Window, key.Period, e.UserID, e.Name, e.Games, e.Wins, e.Losses, e.Draws, e.RatedGames, e.Rating, e.LastGameID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Top ...
+func (ls *SQLiteLeaderboardStore) Top(q *LeaderboardQuery) ([]LeaderboardEntry, error) {
+
+	// the same order as rankEntries
+	cond, order := `games > 0 AND games >= ?`, ``
+	switch q.By {
+	case RankByRating:
+		cond, order = `rated_games > 0 AND rated_games >= ?`, `rating DESC, `
+	case RankByWins:
+		order = `wins DESC, games ASC, `
+	case RankByWinRate:
+		order = `CAST(wins AS REAL) / games DESC, games DESC, `
+	}
+
+	rows, err := ls.st.db.Query(`SELECT `+leaderboardColumns+` FROM leaderboards
+		WHERE variant = ? AND time_window = ? AND period = ? AND `+cond+`
+		ORDER BY `+order+`user_id LIMIT ?`, q.Variant, q.Window, q.Period, q.MinGames, q.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]LeaderboardEntry, 0)
+	for rows.Next() {
+		e, err := scanLeaderboardEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// Purge ...
+func (ls *SQLiteLeaderboardStore) Purge(now time.Time) error {
+
+	ls.st.mu.Lock()
+	defer ls.st.mu.Unlock()
+
+	for _, window := range []string{LeaderboardDaily, LeaderboardWeekly} {
+		_, err := ls.st.db.Exec(`DELETE FROM leaderboards WHERE time_window = ? AND period < ?`,
+			window, leaderboardKey("", window, now).Period)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteUser ...
+func (ls *SQLiteLeaderboardStore) DeleteUser(userID string) error {
+
+	ls.st.mu.Lock()
+	defer ls.st.mu.Unlock()
+
+	_, err := ls.st.db.Exec(`DELETE FROM leaderboards WHERE user_id = ?`, userID)
+	return err
+}
+
+// SQLiteArchive is the GameArchive view of a SQLiteStore
+type SQLiteArchive struct {
+	st *SQLiteStore
+}
+
+// Games returns the archive backed by the same database
+func (st *SQLiteStore) Games() *SQLiteArchive {
+	return &SQLiteArchive{st: st}
+}
+
+// Put ...
+func (a *SQLiteArchive) Put(game *GameRecord) error {
+
+	data, err := json.Marshal(game)
+	if err != nil {
+		return err
+	}
+
+	a.st.mu.Lock()
+	defer a.st.mu.Unlock()
+
+	_, err = a.st.db.Exec(`INSERT INTO games (game_id, white_id, white_name, black_id, black_name, result, length, moves, finished_at, data)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (game_id) DO UPDATE SET white_id = excluded.white_id, white_name = excluded.white_name,
+			black_id = excluded.black_id, black_name = excluded.black_name, result = excluded.result,
+			length = excluded.length, moves = excluded.moves, finished_at = excluded.finished_at, data = excluded.data`,
+		game.GameID, game.White.UserID, game.White.Name, game.Black.UserID, game.Black.Name,
+		game.Result, game.Length, game.Moves, game.FinishedAt.UTC(), string(data))
+	return err
+}
+
+// Get ...
+func (a *SQLiteArchive) Get(gameID string) (*GameRecord, error) {
+
+	var data string
+	err := a.st.db.QueryRow(`SELECT data FROM games WHERE game_id = ?`, gameID).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, ErrGameNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	game := new(GameRecord)
+	err = json.Unmarshal([]byte(data), game)
+	return game, err
+}
+
+// Search ...
+func (a *SQLiteArchive) Search(q *GameQuery) ([]*GameRecord, int, error) {
+
+	where := []string{"1 = 1"}
+	args := []interface{}{}
+	if q.Player != "" {
+		where = append(where, "(white_id = ? OR white_name = ? OR black_id = ? OR black_name = ?)")
+		args = append(args, q.Player, q.Player, q.Player, q.Player)
+	}
+	if !q.From.IsZero() {
+		where = append(where, "finished_at >= ?")
+		args = append(args, q.From.UTC())
+	}
+	if !q.To.IsZero() {
+		where = append(where, "finished_at < ?")
+		args = append(args, q.To.UTC())
+	}
+	if q.Result != "" {
+		where = append(where, "result = ?")
+		args = append(args, q.Result)
+	}
+	if q.Opening != "" {
+		where = append(where, "substr(moves, 1, ?) = ?")
+		args = append(args, len(q.Opening), q.Opening)
+	}
+	if q.MinLength > 0 {
+		where = append(where, "length >= ?")
+		args = append(args, q.MinLength)
+	}
+	cond := strings.Join(where, " AND ")
+
+	var total int
+	if err := a.st.db.QueryRow(`SELECT COUNT(*) FROM games WHERE `+cond, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	order := "finished_at"
+	if strings.TrimPrefix(q.Sort, "-") == "length" {
+		order = "length"
+	}
+	if strings.HasPrefix(q.Sort, "-") {
+		order += " DESC, game_id DESC"
+	} else {
+		order += ", game_id"
+	}
+
+	limit := q.Limit
+	if limit <= 0 {
+		limit = -1
+	}
+	rows, err := a.st.db.Query(`SELECT data FROM games WHERE `+cond+` ORDER BY `+order+` LIMIT ? OFFSET ?`,
+		append(args, limit, q.Offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	games := make([]*GameRecord, 0)
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, 0, err
+		}
+		game := new(GameRecord)
+		if err := json.Unmarshal([]byte(data), game); err != nil {
+			return nil, 0, err
+		}
+		games = append(games, game.summary())
+	}
+	return games, total, rows.Err()
+}
+
+// playedBatch is the number of users Played asks the database about at once
+const playedBatch = 500
+
+// Played ...
+func (a *SQLiteArchive) Played(userIDs []string) (map[string]bool, error) {
+
+	played := make(map[string]bool)
+	for len(userIDs) > 0 {
+		batch := userIDs
+		if len(batch) > playedBatch {
+			batch = batch[:playedBatch]
+		}
+		userIDs = userIDs[len(batch):]
+
+		in := strings.TrimSuffix(strings.Repeat("?, ", len(batch)), ", ")
+		args := make([]interface{}, 0, 2*len(batch))
+		for i := 0; i < 2; i++ {
+			for _, id := range batch {
+				args = append(args, id)
+			}
+		}
+		rows, err := a.st.db.Query(`SELECT white_id FROM games WHERE white_id IN (`+in+`)
+			UNION SELECT black_id FROM games WHERE black_id IN (`+in+`)`, args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			played[id] = true
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return played, nil
+}
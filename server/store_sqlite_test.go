@@ -0,0 +1,162 @@
+package server
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSQLiteStore(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "reversi.db")
+
+	st, err := OpenSQLiteStore(path)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	sv := NewServer(st, st.Users())
+	white, session, err := sv.CreateSession("white")
+	assert.Nil(t, err)
+	black, paired, err := sv.CreateSession("black")
+	assert.Nil(t, err)
+	assert.Equal(t, session.SessionID, paired.SessionID)
+
+	assert.Nil(t, sv.PlayMove(session.SessionID, white.UserID, 4, 2))
+	assert.Equal(t, ErrNotYourTurn, sv.PlayMove(session.SessionID, white.UserID, 5, 3))
+	assert.Equal(t, ErrCannotPut, sv.PlayMove(session.SessionID, black.UserID, 0, 0))
+	assert.Nil(t, sv.PlayMove(session.SessionID, black.UserID, 5, 2))
+	assert.Nil(t, st.Close())
+
+	// a restarted server sees the same state
+	st, err = OpenSQLiteStore(path)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer st.Close()
+
+	s, err := st.Get(session.SessionID)
+	assert.Nil(t, err)
+	assert.Equal(t, []User{white, black}, s.Players)
+	assert.Equal(t, [][]int{{WHITE, 4, 2}, {BLACK, 5, 2}}, s.MoveLog)
+	assert.Equal(t, WHITE, s.Turn)
+	assert.Equal(t, BLACK, s.Board[2][5])
+
+	var board string
+	assert.Nil(t, st.db.QueryRow(`SELECT board FROM moves WHERE session_id = ? AND ply = 1`, s.SessionID).Scan(&board))
+	assert.Equal(t, "[[0,0,0,0,0,0,0,0],[0,0,0,0,0,0,0,0],[0,0,0,0,1,0,0,0],[0,0,0,1,1,0,0,0],[0,0,0,2,1,0,0,0],[0,0,0,0,0,0,0,0],[0,0,0,0,0,0,0,0],[0,0,0,0,0,0,0,0]]", board)
+
+	u, err := st.Users().Get(black.UserID)
+	assert.Nil(t, err)
+	assert.Equal(t, "black", u.Name)
+
+	assert.Nil(t, st.Delete(session.SessionID))
+	_, err = st.Get(session.SessionID)
+	assert.Equal(t, ErrSessionNotFound, err)
+}
+
+func TestSQLiteStore_SeveralPlies(t *testing.T) {
+
+	st, err := OpenSQLiteStore(filepath.Join(t.TempDir(), "reversi.db"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer st.Close()
+
+	sv := NewServer(st, st.Users())
+	_, session, _ := sv.CreateSession("white")
+	sv.CreateSession("black")
+
+	// two plies saved in one update each get the board after them
+	moves := [][]int{{WHITE, 4, 2}, {BLACK, 5, 2}, {WHITE, 5, 3}}
+	assert.Nil(t, st.Update(session.SessionID, func(s *Session) error {
+		for _, m := range moves[:2] {
+			putDisc(s, m[0], m[1], m[2])
+			updateSessionState(s, m[0], m[1], m[2])
+		}
+		return nil
+	}))
+	assert.Nil(t, st.Update(session.SessionID, func(s *Session) error {
+		putDisc(s, moves[2][0], moves[2][1], moves[2][2])
+		updateSessionState(s, moves[2][0], moves[2][1], moves[2][2])
+		return nil
+	}))
+
+	for ply := 1; ply <= len(moves); ply++ {
+		var board string
+		assert.Nil(t, st.db.QueryRow(`SELECT board FROM moves WHERE session_id = ? AND ply = ?`, session.SessionID, ply).Scan(&board))
+		want, _ := json.Marshal(replayBoard("", moves[:ply]))
+		assert.Equal(t, string(want), board, "ply %d", ply)
+	}
+}
+
+func TestSQLiteStore_Recover(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "reversi.db")
+
+	st, err := OpenSQLiteStore(path)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	sv := NewServer(st, st.Users())
+	white, session, _ := sv.CreateSession("white")
+	sv.CreateSession("black")
+	assert.Nil(t, sv.PlayMove(session.SessionID, white.UserID, 4, 2))
+
+	// break the snapshot of the board as if the process died in the middle of writing it
+	assert.Nil(t, st.Update(session.SessionID, func(s *Session) error {
+		s.Board[2][4] = EMPTY
+		return nil
+	}))
+	st.Close()
+
+	st, err = OpenSQLiteStore(path)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer st.Close()
+
+	s, err := st.Get(session.SessionID)
+	assert.Nil(t, err)
+	assert.Equal(t, WHITE, s.Board[2][4])
+	assert.Equal(t, WHITE, s.Board[3][4])
+}
+
+func TestSQLiteStore_Concurrent(t *testing.T) {
+
+	st, err := OpenSQLiteStore(filepath.Join(t.TempDir(), "reversi.db"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer st.Close()
+
+	sv := NewServer(st, st.Users())
+
+	const users = 20
+
+	var wg sync.WaitGroup
+	sessionIDs := make([]string, users)
+	for i := 0; i < users; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, s, err := sv.CreateSession("test")
+			if assert.Nil(t, err) {
+				sessionIDs[i] = s.SessionID
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	count := make(map[string]int)
+	for _, id := range sessionIDs {
+		count[id]++
+	}
+	for _, n := range count {
+		assert.Equal(t, 2, n)
+	}
+}
@@ -0,0 +1,305 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemorySessionStore_ConcurrentJoin(t *testing.T) {
+
+	InitSessionStore(true)
+	InitUserStore(true)
+
+	const users = 50
+
+	var wg sync.WaitGroup
+	sessionIDs := make([]string, users)
+	for i := 0; i < users; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, sessionIDs[i] = CreateSession("test")
+		}(i)
+	}
+	wg.Wait()
+
+	// every session has exactly two players
+	count := make(map[string]int)
+	for _, id := range sessionIDs {
+		count[id]++
+	}
+	assert.Equal(t, users/2, len(count))
+	for id, n := range count {
+		assert.Equal(t, 2, n)
+		assert.Equal(t, StateEstablished, GetSessionInfo(id).State)
+	}
+}
+
+func Test_APIRoute_ConcurrentClients(t *testing.T) {
+
+	InitSessionStore(true)
+	InitUserStore(true)
+
+	ts := httptest.NewServer(http.HandlerFunc(APIRoute))
+	defer ts.Close()
+
+	const users = 20
+
+	var wg sync.WaitGroup
+	infos := make([]GetSessionInfoResponse, users)
+	for i := 0; i < users; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res, err := http.Post(ts.URL+"/user", "application/json", bytes.NewReader([]byte(`{"name": "test"}`)))
+			if !assert.Nil(t, err) {
+				return
+			}
+			defer res.Body.Close()
+			assert.Nil(t, json.NewDecoder(res.Body).Decode(&infos[i]))
+		}(i)
+	}
+	wg.Wait()
+
+	// both players of every session try the same move at once while others watch the board
+	for i := 0; i < users; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			body, _ := json.Marshal(&PostBoardRequest{PosX: 4, PosY: 2})
+			res, err := postWithToken(ts.URL+"/session/"+infos[i].SessionID, infos[i].Token, body)
+			if assert.Nil(t, err) {
+				res.Body.Close()
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			res, err := http.Get(ts.URL + "/session/" + infos[i].SessionID + "/board")
+			if assert.Nil(t, err) {
+				res.Body.Close()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// only the white player could move, exactly once
+	for _, info := range infos {
+		s := GetSessionInfo(info.SessionID)
+		assert.Equal(t, 2, s.ElapsedTurn)
+		assert.Equal(t, [][]int{{WHITE, 4, 2}}, s.MoveLog)
+	}
+}
+
+func TestFileSessionStore(t *testing.T) {
+
+	dir := t.TempDir()
+
+	sessions, err := NewFileSessionStore(dir)
+	if !assert.Nil(t, err) {
+		return
+	}
+	users, err := NewFileUserStore(dir)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	sv := NewServer(sessions, users)
+	white, session, err := sv.CreateSession("white")
+	assert.Nil(t, err)
+	black, _, err := sv.CreateSession("black")
+	assert.Nil(t, err)
+	assert.Nil(t, sv.PlayMove(session.SessionID, white.UserID, 4, 2))
+	assert.Equal(t, ErrCannotPut, sv.PlayMove(session.SessionID, black.UserID, 0, 0))
+
+	// a restarted server sees the same state
+	sessions, err = NewFileSessionStore(dir)
+	if !assert.Nil(t, err) {
+		return
+	}
+	users, err = NewFileUserStore(dir)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	s, err := sessions.Get(session.SessionID)
+	assert.Nil(t, err)
+	assert.Equal(t, []User{white, black}, s.Players)
+	assert.Equal(t, [][]int{{WHITE, 4, 2}}, s.MoveLog)
+	assert.Equal(t, WHITE, s.Board[2][4])
+
+	u, err := users.Get(black.UserID)
+	assert.Nil(t, err)
+	assert.Equal(t, "black", u.Name)
+
+	assert.Nil(t, sessions.Delete(session.SessionID))
+	sessions, _ = NewFileSessionStore(dir)
+	_, err = sessions.Get(session.SessionID)
+	assert.Equal(t, ErrSessionNotFound, err)
+}
+
+func TestFileSessionStore_DeleteDuringUpdate(t *testing.T) {
+
+	dir := t.TempDir()
+	sessions, err := NewFileSessionStore(dir)
+	if !assert.Nil(t, err) {
+		return
+	}
+	s := NewSession("s", User{UserID: "u"})
+	assert.Nil(t, sessions.Add(s))
+
+	// Delete waits for an update in progress
+	updating, release := make(chan struct{}), make(chan struct{})
+	updated := make(chan error)
+	go func() {
+		updated <- sessions.Update(s.SessionID, func(s *Session) error {
+			close(updating)
+			<-release
+			s.Touch()
+			return nil
+		})
+	}()
+	<-updating
+	deleted := make(chan error)
+	go func() { deleted <- sessions.Delete(s.SessionID) }()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	assert.Nil(t, <-updated)
+	assert.Nil(t, <-deleted)
+
+	// an update which got the session before Delete does not write it back
+	var wg sync.WaitGroup
+	ids := make([]string, 0)
+	for i := 0; i < 50; i++ {
+		s := NewSession(fmt.Sprintf("s%d", i), User{UserID: "u"})
+		assert.Nil(t, sessions.Add(s))
+		ids = append(ids, s.SessionID)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			err := sessions.Update(s.SessionID, func(s *Session) error {
+				s.Touch()
+				return nil
+			})
+			assert.True(t, err == nil || err == ErrSessionNotFound)
+		}()
+		go func() {
+			defer wg.Done()
+			assert.Nil(t, sessions.Delete(s.SessionID))
+		}()
+	}
+	wg.Wait()
+
+	sessions, err = NewFileSessionStore(dir)
+	if !assert.Nil(t, err) {
+		return
+	}
+	for _, id := range append(ids, s.SessionID) {
+		_, err = sessions.Get(id)
+		assert.Equal(t, ErrSessionNotFound, err)
+	}
+}
+
+// brokenSessionStore fails to access anything
+type brokenSessionStore struct{}
+
+var errBrokenStore = errors.New("broken store")
+
+func (brokenSessionStore) Get(string) (*Session, error) { return nil, errBrokenStore }
+func (brokenSessionStore) All() ([]*Session, error)     { return nil, errBrokenStore }
+func (brokenSessionStore) Join(User, bool, map[string]bool, int, func() *Session) (*Session, error) {
+	return nil, errBrokenStore
+}
+func (brokenSessionStore) Add(*Session) error                        { return errBrokenStore }
+func (brokenSessionStore) Update(string, func(*Session) error) error { return errBrokenStore }
+func (brokenSessionStore) Delete(string) error                       { return errBrokenStore }
+
+func Test_APIRoute_StoreFailure(t *testing.T) {
+
+	ts := httptest.NewServer(NewServer(brokenSessionStore{}, NewMemoryUserStore()))
+	defer ts.Close()
+
+	res, err := http.Post(ts.URL+"/user", "application/json", bytes.NewReader([]byte(`{"name": "test"}`)))
+	if assert.Nil(t, err) {
+		assert.Equal(t, http.StatusInternalServerError, res.StatusCode)
+		res.Body.Close()
+	}
+
+	res, err = http.Get(ts.URL + "/session/abc/board")
+	if assert.Nil(t, err) {
+		msg := new(GeneralMessageResponse)
+		json.NewDecoder(res.Body).Decode(msg)
+		res.Body.Close()
+		assert.Equal(t, http.StatusInternalServerError, res.StatusCode)
+		assert.Equal(t, "Cannot access the session", msg.Description)
+	}
+
+	ts = httptest.NewServer(NewServer(NewMemorySessionStore(), NewMemoryUserStore()))
+	defer ts.Close()
+
+	res, err = http.Get(ts.URL + "/session/abc/board")
+	if assert.Nil(t, err) {
+		assert.Equal(t, http.StatusNotFound, res.StatusCode)
+		res.Body.Close()
+	}
+}
+
+func TestUserStore_Update(t *testing.T) {
+
+	files, err := NewFileUserStore(t.TempDir())
+	if !assert.Nil(t, err) {
+		return
+	}
+	db, err := OpenSQLiteStore(filepath.Join(t.TempDir(), "reversi.db"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer db.Close()
+
+	for name, users := range map[string]UserStore{"memory": NewMemoryUserStore(), "file": files, "sqlite": db.Users()} {
+		user := newUser("alice")
+		assert.Nil(t, users.Put(user), name)
+
+		// concurrent updates of different fields are all kept
+		const updates = 20
+		var wg sync.WaitGroup
+		for i := 0; i < updates; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				assert.Nil(t, users.Update(user.UserID, func(u *User) error {
+					u.Rating++
+					if i == 0 {
+						u.Banned = true
+					}
+					return nil
+				}), name)
+			}(i)
+		}
+		wg.Wait()
+
+		got, err := users.Get(user.UserID)
+		assert.Nil(t, err, name)
+		assert.Equal(t, updates, got.Rating, name)
+		assert.True(t, got.Banned, name)
+
+		// a failed update changes nothing
+		assert.Equal(t, ErrInvalidRole, users.Update(user.UserID, func(u *User) error {
+			u.Role = RoleAdmin
+			return ErrInvalidRole
+		}), name)
+		got, _ = users.Get(user.UserID)
+		assert.Equal(t, "", got.Role, name)
+
+		assert.Equal(t, ErrUserNotFound, users.Update("nobody", func(*User) error { return nil }), name)
+	}
+}
@@ -0,0 +1,346 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrUnauthorized is returned when a request has no valid access token, or a refresh token is not known
+var ErrUnauthorized = errors.New("Unauthorized")
+
+// tokenBytes is the length of a refresh token before it is hex encoded
+const tokenBytes = 32
+
+// tokenIDBytes is the length of the ID of an access token before it is hex encoded
+const tokenIDBytes = 16
+
+const (
+	// DefaultAccessTTL is the default lifetime of an access token. Access tokens are validated
+	// by their signature alone, so it bounds how long one outlives a logout or a ban
+	DefaultAccessTTL = 5 * time.Minute
+
+	// DefaultRefreshTTL is the default lifetime of a refresh token
+	DefaultRefreshTTL = 30 * 24 * time.Hour
+)
+
+// TokenStore keeps the refresh tokens of users. Only the hashes of the tokens are kept,
+// so that reading the store does not let anyone act as the users.
+// Implementations must be safe for concurrent use
+type TokenStore interface {
+	// Put adds the token hash of the user, which is valid until expires
+	Put(hash string, userID string, expires time.Time) error
+
+	// Take removes the token hash and returns the ID of its user. It returns
+	// ErrUnauthorized when the hash is not known or has expired
+	Take(hash string, now time.Time) (string, error)
+
+	// Delete removes the token hash
+	Delete(hash string) error
+
+	// DeleteUser removes all token hashes of the user
+	DeleteUser(userID string) error
+
+	// Purge removes the token hashes expired at now
+	Purge(now time.Time) error
+}
+
+// tokenRecord is a token hash, its user and when it expires
+type tokenRecord struct {
+	Hash      string    `json:"hash"`
+	UserID    string    `json:"userID"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// TokenPair is a short-lived access token, which is sent as "Authorization: Bearer <token>"
+// and validated by its signature alone, and a refresh token which is exchanged for a new pair
+type TokenPair struct {
+	AccessToken  string
+	RefreshToken string
+	ExpiresIn    int
+}
+
+// randomToken returns n random bytes hex encoded
+func randomToken(n int) (string, error) {
+
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// hashToken returns the hash under which the token is kept
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// IssueTokens returns a new access token and refresh token of the user. The refresh
+// token is not kept by the server, so it is handed to the user once
+func (sv *Server) IssueTokens(user User) (*TokenPair, error) {
+
+	id, err := randomToken(tokenIDBytes)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	access, err := sv.Keyring.Sign(&Claims{
+		ID:        id,
+		Subject:   user.UserID,
+		Name:      user.Name,
+		Roles:     userRoles(user),
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(sv.AccessTTL).Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	refresh, err := randomToken(tokenBytes)
+	if err != nil {
+		return nil, err
+	}
+	if err := sv.Tokens.Put(hashToken(refresh), user.UserID, now.Add(sv.RefreshTTL)); err != nil {
+		return nil, err
+	}
+
+	return &TokenPair{AccessToken: access, RefreshToken: refresh, ExpiresIn: int(sv.AccessTTL / time.Second)}, nil
+}
+
+// Refresh exchanges the refresh token for a new pair of tokens of its user. The refresh token is used up
+func (sv *Server) Refresh(refreshToken string) (User, *TokenPair, error) {
+
+	userID, err := sv.Tokens.Take(hashToken(refreshToken), time.Now())
+	if err != nil {
+		return User{}, nil, err
+	}
+	user, err := sv.Users.Get(userID)
+	if err == ErrUserNotFound {
+		return User{}, nil, ErrUnauthorized
+	}
+	if err != nil {
+		return User{}, nil, err
+	}
+	if user.Banned {
+		return User{}, nil, ErrBanned
+	}
+	tokens, err := sv.IssueTokens(user)
+	return user, tokens, err
+}
+
+// Authenticate returns the claims of the access token. It does not look up the user,
+// so any server which shares the keyring authenticates the token
+func (sv *Server) Authenticate(token string) (*Claims, error) {
+
+	if token == "" {
+		return nil, ErrUnauthorized
+	}
+	return sv.Keyring.Verify(token, time.Now())
+}
+
+// authenticate returns the user of the bearer token in the Authorization header of the request
+func (sv *Server) authenticate(r *http.Request) (User, error) {
+
+	claims, err := sv.Authenticate(bearerToken(r))
+	if err != nil {
+		return User{}, err
+	}
+	return claims.User(), nil
+}
+
+// bearerToken returns the bearer token in the Authorization header of the request, or ""
+func bearerToken(r *http.Request) string {
+
+	scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// redactor is a response with an access token, which is logged by its redacted copy
+type redactor interface {
+	redacted() interface{}
+}
+
+func (res GetSessionInfoResponse) redacted() interface{} {
+	if res.Token != "" {
+		res.Token, res.RefreshToken = "[redacted]", "[redacted]"
+	}
+	return res
+}
+
+func (res LoginResponse) redacted() interface{} {
+	res.Token, res.RefreshToken = "[redacted]", "[redacted]"
+	return res
+}
+
+// returnAuthError replies an error of authenticate
+func returnAuthError(w http.ResponseWriter, err error) {
+
+	if err == ErrUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="rest_reversi"`)
+		returnJSONMessage(w, http.StatusUnauthorized, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: err.Error(),
+		})
+		return
+	}
+	if err == ErrForbidden || err == ErrBanned {
+		returnJSONMessage(w, http.StatusForbidden, &GeneralMessageResponse{
+			Status:      "fail",
+			Description: err.Error(),
+		})
+		return
+	}
+
+	fmt.Println("returnAuthError: " + err.Error())
+	returnJSONMessage(w, http.StatusInternalServerError, &GeneralMessageResponse{
+		Status:      "fail",
+		Description: "Cannot authenticate",
+	})
+}
+
+// MemoryTokenStore keeps token hashes in memory
+type MemoryTokenStore struct {
+	mu     sync.Mutex
+	tokens map[string]tokenRecord
+
+	// save and remove let a durable store write a change through before it is committed
+	save   func(rec tokenRecord) error
+	remove func(hash string) error
+}
+
+// NewMemoryTokenStore returns an empty MemoryTokenStore
+func NewMemoryTokenStore() *MemoryTokenStore {
+	return &MemoryTokenStore{tokens: make(map[string]tokenRecord)}
+}
+
+// Put ...
+func (st *MemoryTokenStore) Put(hash string, userID string, expires time.Time) error {
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	rec := tokenRecord{Hash: hash, UserID: userID, ExpiresAt: expires}
+	if st.save != nil {
+		if err := st.save(rec); err != nil {
+			return err
+		}
+	}
+	st.tokens[hash] = rec
+	return nil
+}
+
+// Take ...
+func (st *MemoryTokenStore) Take(hash string, now time.Time) (string, error) {
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	rec, ok := st.tokens[hash]
+	if !ok {
+		return "", ErrUnauthorized
+	}
+	if err := st.delete(hash); err != nil {
+		return "", err
+	}
+	if !now.Before(rec.ExpiresAt) {
+		return "", ErrUnauthorized
+	}
+	return rec.UserID, nil
+}
+
+// Delete ...
+func (st *MemoryTokenStore) Delete(hash string) error {
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	return st.delete(hash)
+}
+
+// DeleteUser ...
+func (st *MemoryTokenStore) DeleteUser(userID string) error {
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	for hash, rec := range st.tokens {
+		if rec.UserID != userID {
+			continue
+		}
+		if err := st.delete(hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Purge ...
+func (st *MemoryTokenStore) Purge(now time.Time) error {
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	for hash, rec := range st.tokens {
+		if now.Before(rec.ExpiresAt) {
+			continue
+		}
+		if err := st.delete(hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (st *MemoryTokenStore) delete(hash string) error {
+
+	if st.remove != nil {
+		if err := st.remove(hash); err != nil {
+			return err
+		}
+	}
+	delete(st.tokens, hash)
+	return nil
+}
+
+// NewFileTokenStore returns a token store which keeps every token hash as a JSON file under dir/tokens
+func NewFileTokenStore(dir string) (*MemoryTokenStore, error) {
+
+	dir = filepath.Join(dir, "tokens")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	st := NewMemoryTokenStore()
+	err := readJSONFiles(dir, func(data []byte) error {
+		var rec tokenRecord
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return err
+		}
+		st.tokens[rec.Hash] = rec
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	st.save = func(rec tokenRecord) error {
+		return writeJSONFile(filepath.Join(dir, rec.Hash+".json"), &rec)
+	}
+	st.remove = func(hash string) error {
+		return removeFile(filepath.Join(dir, hash+".json"))
+	}
+	return st, nil
+}
@@ -0,0 +1,292 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// postWithToken posts the JSON body with the access token
+func postWithToken(url, token string, body []byte) (*http.Response, error) {
+
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	return http.DefaultClient.Do(req)
+}
+
+func TestAuthenticate(t *testing.T) {
+
+	sv := NewServer(NewMemorySessionStore(), NewMemoryUserStore())
+
+	user, _ := sv.CreateUser("alice")
+	tokens, err := sv.IssueTokens(user)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, int(DefaultAccessTTL/time.Second), tokens.ExpiresIn)
+
+	claims, err := sv.Authenticate(tokens.AccessToken)
+	assert.Nil(t, err)
+	assert.Equal(t, user, claims.User())
+	assert.Equal(t, []string{RoleGuest}, claims.Roles)
+
+	// only the hash of the refresh token is kept
+	_, err = sv.Tokens.Take(tokens.RefreshToken, time.Now())
+	assert.Equal(t, ErrUnauthorized, err)
+
+	parts := strings.Split(tokens.AccessToken, ".")
+	forged, _ := json.Marshal(&Claims{Subject: "someone", ExpiresAt: time.Now().Add(time.Hour).Unix()})
+	for _, bad := range []string{
+		"",
+		user.UserID,
+		tokens.RefreshToken,
+		tokens.AccessToken + "x",
+		parts[0] + "." + base64.RawURLEncoding.EncodeToString(forged) + "." + parts[2],
+	} {
+		_, err = sv.Authenticate(bad)
+		assert.Equal(t, ErrUnauthorized, err, bad)
+	}
+
+	// another server sharing the keyring accepts the token without the user store
+	other := NewServer(NewMemorySessionStore(), NewMemoryUserStore())
+	_, err = other.Authenticate(tokens.AccessToken)
+	assert.Equal(t, ErrUnauthorized, err)
+	other.Keyring = sv.Keyring
+	claims, err = other.Authenticate(tokens.AccessToken)
+	assert.Nil(t, err)
+	assert.Equal(t, user.UserID, claims.Subject)
+
+	sv.AccessTTL = -time.Second
+	expired, _ := sv.IssueTokens(user)
+	_, err = sv.Authenticate(expired.AccessToken)
+	assert.Equal(t, ErrUnauthorized, err)
+
+	// the refresh token is used once
+	refreshed, refreshedTokens, err := sv.Refresh(tokens.RefreshToken)
+	assert.Nil(t, err)
+	assert.Equal(t, user, refreshed)
+	assert.NotEqual(t, tokens.RefreshToken, refreshedTokens.RefreshToken)
+	_, _, err = sv.Refresh(tokens.RefreshToken)
+	assert.Equal(t, ErrUnauthorized, err)
+
+	// a refresh token dies with its user
+	sv.Users.Delete(user.UserID)
+	_, _, err = sv.Refresh(refreshedTokens.RefreshToken)
+	assert.Equal(t, ErrUnauthorized, err)
+}
+
+func TestKeyring(t *testing.T) {
+
+	dir := t.TempDir()
+	old, current := bytes.Repeat([]byte{1}, minKeyBytes), bytes.Repeat([]byte{2}, minKeyBytes)
+	write := func(kr *Keyring) string {
+		path := filepath.Join(dir, "keyring.json")
+		data, _ := json.Marshal(kr)
+		os.WriteFile(path, data, 0600)
+		return path
+	}
+
+	kr, err := LoadKeyring(write(&Keyring{Current: "k1", Keys: map[string][]byte{"k1": old}}))
+	if !assert.Nil(t, err) {
+		return
+	}
+	claims := &Claims{Subject: "u1", ExpiresAt: time.Now().Add(time.Hour).Unix()}
+	signedByOld, _ := kr.Sign(claims)
+
+	// after the rotation, tokens are signed by the new key and the old ones are still accepted
+	kr, err = LoadKeyring(write(&Keyring{Current: "k2", Keys: map[string][]byte{"k1": old, "k2": current}}))
+	if !assert.Nil(t, err) {
+		return
+	}
+	signedByNew, _ := kr.Sign(claims)
+	for _, token := range []string{signedByOld, signedByNew} {
+		got, err := kr.Verify(token, time.Now())
+		assert.Nil(t, err)
+		assert.Equal(t, "u1", got.Subject)
+	}
+
+	// and rejected once the old key is removed
+	kr, _ = LoadKeyring(write(&Keyring{Current: "k2", Keys: map[string][]byte{"k2": current}}))
+	_, err = kr.Verify(signedByOld, time.Now())
+	assert.Equal(t, ErrUnauthorized, err)
+	_, err = kr.Verify(signedByNew, time.Unix(claims.ExpiresAt, 0))
+	assert.Equal(t, ErrUnauthorized, err)
+
+	for _, bad := range []*Keyring{
+		{Current: "k3", Keys: map[string][]byte{"k2": current}},
+		{Current: "k1", Keys: map[string][]byte{"k1": []byte("short")}},
+	} {
+		_, err = LoadKeyring(write(bad))
+		assert.ErrorIs(t, err, ErrInvalidKeyring)
+	}
+}
+
+func TestAPIPostBoard_Token(t *testing.T) {
+
+	sv := NewServer(NewMemorySessionStore(), NewMemoryUserStore())
+	ts := httptest.NewServer(sv)
+	defer ts.Close()
+
+	var infos [2]GetSessionInfoResponse
+	for i := range infos {
+		res, err := http.Post(ts.URL+APIUser, "application/json", bytes.NewReader([]byte(`{"name": "test"}`)))
+		if !assert.Nil(t, err) {
+			return
+		}
+		assert.Nil(t, json.NewDecoder(res.Body).Decode(&infos[i]))
+		res.Body.Close()
+		assert.NotEmpty(t, infos[i].Token)
+	}
+	white, black := infos[0], infos[1]
+	url := ts.URL + APISession + "/" + white.SessionID
+	body := []byte(`{"userID": "` + white.UserID + `", "posX": 4, "posY": 2}`)
+
+	// the user ID alone does not let anyone move
+	res, err := http.Post(url, "application/json", bytes.NewReader(body))
+	if !assert.Nil(t, err) {
+		return
+	}
+	res.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	assert.Contains(t, res.Header.Get("WWW-Authenticate"), "Bearer")
+
+	// the user ID in the body is ignored, so black cannot move for white
+	res, err = postWithToken(url, black.Token, body)
+	if !assert.Nil(t, err) {
+		return
+	}
+	msg := new(GeneralMessageResponse)
+	json.NewDecoder(res.Body).Decode(msg)
+	res.Body.Close()
+	assert.Equal(t, "Not your turn", msg.Description)
+
+	res, err = postWithToken(url, white.Token, body)
+	if !assert.Nil(t, err) {
+		return
+	}
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	s, _ := sv.GetSessionInfo(white.SessionID)
+	assert.Equal(t, [][]int{{WHITE, 4, 2}}, s.MoveLog)
+
+	res, err = postWithToken(url+APISessionResign, "nothing", nil)
+	if !assert.Nil(t, err) {
+		return
+	}
+	res.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+	res, err = postWithToken(url+APISessionResign, black.Token, nil)
+	if !assert.Nil(t, err) {
+		return
+	}
+	res.Body.Close()
+	s, _ = sv.GetSessionInfo(white.SessionID)
+	assert.Equal(t, StateWonWhite, s.State)
+}
+
+func TestTokenStores(t *testing.T) {
+
+	dir := t.TempDir()
+	sqlite, err := OpenSQLiteStore(filepath.Join(dir, "reversi.db"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer sqlite.Close()
+
+	files, err := NewFileTokenStore(dir)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	now := time.Now()
+	for _, st := range []TokenStore{NewMemoryTokenStore(), files, sqlite.Tokens()} {
+		assert.Nil(t, st.Put("a", "alice", now.Add(time.Hour)))
+		assert.Nil(t, st.Put("b", "alice", now.Add(time.Hour)))
+		assert.Nil(t, st.Put("c", "bob", now.Add(time.Hour)))
+		assert.Nil(t, st.Put("d", "bob", now.Add(-time.Second)))
+		assert.Nil(t, st.Put("e", "bob", now.Add(-time.Second)))
+
+		userID, err := st.Take("a", now)
+		assert.Nil(t, err)
+		assert.Equal(t, "alice", userID)
+		_, err = st.Take("a", now)
+		assert.Equal(t, ErrUnauthorized, err)
+		_, err = st.Take("d", now)
+		assert.Equal(t, ErrUnauthorized, err)
+
+		assert.Nil(t, st.DeleteUser("alice"))
+		_, err = st.Take("b", now)
+		assert.Equal(t, ErrUnauthorized, err)
+
+		assert.Nil(t, st.Purge(now))
+		assert.Nil(t, st.Put("e", "bob", now.Add(time.Hour)))
+		assert.Nil(t, st.Delete("e"))
+		_, err = st.Take("e", now)
+		assert.Equal(t, ErrUnauthorized, err)
+	}
+
+	// the file store reloads the tokens
+	files, err = NewFileTokenStore(dir)
+	if !assert.Nil(t, err) {
+		return
+	}
+	userID, err := files.Take("c", now)
+	assert.Nil(t, err)
+	assert.Equal(t, "bob", userID)
+	_, err = files.Take("b", now)
+	assert.Equal(t, ErrUnauthorized, err)
+}
+
+func TestRevokeTokens(t *testing.T) {
+
+	sv := NewServer(NewMemorySessionStore(), NewMemoryUserStore())
+	user, err := sv.Register("alice", "correct horse")
+	if !assert.Nil(t, err) {
+		return
+	}
+	authenticate := func(token string) error {
+		r := httptest.NewRequest("GET", APISession, nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		_, err := sv.authenticate(r)
+		return err
+	}
+
+	// tokens issued within the same second are still different
+	phone, _ := sv.IssueTokens(user)
+	laptop, _ := sv.IssueTokens(user)
+	assert.NotEqual(t, phone.AccessToken, laptop.AccessToken)
+	assert.NotEqual(t, phone.RefreshToken, laptop.RefreshToken)
+
+	// logging out revokes the refresh token only. The access token is validated
+	// without the stores, so it lasts until it expires
+	assert.Nil(t, sv.Logout(phone.RefreshToken))
+	_, _, err = sv.Refresh(phone.RefreshToken)
+	assert.Equal(t, ErrUnauthorized, err)
+	assert.Nil(t, authenticate(phone.AccessToken))
+	_, refreshed, err := sv.Refresh(laptop.RefreshToken)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	// a ban revokes every refresh token, and the access tokens can neither join nor move
+	assert.Nil(t, sv.Ban(user.UserID, true))
+	_, _, err = sv.Refresh(refreshed.RefreshToken)
+	assert.Equal(t, ErrUnauthorized, err)
+	_, err = sv.JoinSession(user, false)
+	assert.Equal(t, ErrBanned, err)
+	assert.Equal(t, ErrBanned, sv.PlayMove("any", user.UserID, 4, 2))
+}
@@ -10,35 +10,80 @@ import (
 type User struct {
 	Name   string `json:"name"`
 	UserID string `json:"userID"`
+
+	// Registered is true for the user of an account, and false for a guest
+	Registered bool `json:"registered,omitempty"`
+
+	// Rating is the rating of a player as a rated session started
+	Rating int `json:"rating,omitempty"`
+
+	// Role is the role of a registered user, RolePlayer when it is empty
+	Role string `json:"role,omitempty"`
+
+	// Banned is true for a user who may neither log in nor join sessions
+	Banned bool `json:"banned,omitempty"`
 }
 
-var userStore map[string]User
+// player returns the user as a player of a session. The role and the ban are left out, since they
+// belong to the account and would go stale in sessions, the journal and archived games
+func (u User) player() User {
+	u.Role = ""
+	u.Banned = false
+	return u
+}
 
 func InitUserStore(force bool) {
-	if userStore == nil || force {
-		userStore = make(map[string]User)
+	if defaultServer.Users == nil || force {
+		defaultServer.Users = NewMemoryUserStore()
+		defaultServer.Tokens = NewMemoryTokenStore()
+		defaultServer.Accounts = NewMemoryAccountStore()
+		defaultServer.Profiles = NewMemoryProfileStore()
+		defaultServer.Ratings = NewMemoryRatingStore()
+		defaultServer.Leaderboards = NewMemoryLeaderboardStore()
+		defaultServer.Identities = NewMemoryIdentityStore()
+		defaultServer.Relations = NewMemoryRelationStore()
 	}
 }
 
 func CreateUser(name string) User {
 
-	InitUserStore(false)
+	user, err := defaultServer.CreateUser(name)
+	if err != nil {
+		fmt.Println("CreateUser: " + err.Error())
+	}
+	return user
+}
+
+// CreateUser registers a guest user named name
+func (sv *Server) CreateUser(name string) (User, error) {
+
+	user := newUser(name)
+	if err := sv.Users.Put(user); err != nil {
+		return user, err
+	}
+	return user, sv.createProfile(user)
+}
 
-	user := User{
+// newUser returns a user named name with a new ID
+func newUser(name string) User {
+	return User{
 		Name:   name,
 		UserID: fmt.Sprintf("%x", sha256.Sum224([]byte((name + strconv.FormatInt(time.Now().UnixNano(), 10))))),
 	}
-
-	userStore[user.UserID] = user
-
-	return user
 }
 
 func RemoveUser(userID string) {
 
-	delete(userStore, userID)
+	defaultServer.Users.Delete(userID)
+	defaultServer.Tokens.DeleteUser(userID)
+	defaultServer.Profiles.Delete(userID)
+	defaultServer.Ratings.Delete(userID)
+	defaultServer.Leaderboards.DeleteUser(userID)
+	defaultServer.Identities.DeleteUser(userID)
+	defaultServer.Relations.Delete(userID)
 }
 
 func GetUser(userID string) User {
-	return userStore[userID]
+	user, _ := defaultServer.Users.Get(userID)
+	return user
 }